@@ -0,0 +1,139 @@
+package asset
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/nkcr/hodor/config"
+)
+
+// Asset is a downloadable file of a release, as listed by GitHub
+type Asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// archAliases contains the other names commonly used in asset names for an
+// architecture.
+var archAliases = map[string][]string{
+	"amd64": {"x86_64", "x64"},
+	"386":   {"i386", "x86"},
+	"arm64": {"aarch64"},
+	"arm":   {"armv7", "armhf"},
+}
+
+// osAliases contains the other names commonly used in asset names for an OS.
+var osAliases = map[string][]string{
+	"darwin":  {"macos"},
+	"windows": {"win"},
+}
+
+// Select returns the asset that matches the rules. Only assets whose name
+// match one of the patterns are considered, or all assets if there is no
+// pattern. Among them, the first one with the most preferred extension is
+// selected, or the first one if there is no preferred extension.
+func Select(assets []Asset, rules config.AssetRules) (Asset, error) {
+	if len(assets) == 0 {
+		return Asset{}, errors.New("no asset")
+	}
+
+	goos := rules.OS
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+
+	goarch := rules.Arch
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+
+	var patterns []string
+	for _, pattern := range rules.Patterns {
+		patterns = append(patterns, expand(pattern, goos, goarch)...)
+	}
+
+	candidates := assets
+
+	if len(patterns) != 0 {
+		candidates = nil
+
+		for _, asset := range assets {
+			ok, err := matchAny(asset.Name, patterns)
+			if err != nil {
+				return Asset{}, err
+			}
+
+			if ok {
+				candidates = append(candidates, asset)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return Asset{}, fmt.Errorf("no asset matches the patterns %v", rules.Patterns)
+	}
+
+	if len(rules.Extensions) == 0 {
+		return candidates[0], nil
+	}
+
+	for _, ext := range rules.Extensions {
+		for _, asset := range candidates {
+			if strings.HasSuffix(asset.Name, ext) {
+				return asset, nil
+			}
+		}
+	}
+
+	return Asset{}, fmt.Errorf("no asset has one of the extensions %v", rules.Extensions)
+}
+
+// expand returns the pattern with "{os}" and "{arch}" replaced by the OS and
+// architecture, and by their aliases.
+func expand(pattern, goos, goarch string) []string {
+	var res []string
+
+	for _, o := range append([]string{goos}, osAliases[goos]...) {
+		withOS := strings.ReplaceAll(pattern, "{os}", o)
+
+		for _, a := range append([]string{goarch}, archAliases[goarch]...) {
+			expanded := strings.ReplaceAll(withOS, "{arch}", a)
+
+			if !contains(res, expanded) {
+				res = append(res, expanded)
+			}
+		}
+	}
+
+	return res
+}
+
+// contains returns true if the element is in the slice
+func contains(slice []string, element string) bool {
+	for _, e := range slice {
+		if e == element {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAny returns true if the name matches one of the glob patterns
+func matchAny(name string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("wrong pattern %q: %v", pattern, err)
+		}
+
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
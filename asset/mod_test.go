@@ -0,0 +1,105 @@
+package asset
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/stretchr/testify/require"
+)
+
+var assets = []Asset{
+	{Name: "app-darwin-amd64.zip"},
+	{Name: "app-linux-amd64.zip"},
+	{Name: "app-linux-amd64.tar.gz"},
+	{Name: "checksums.txt"},
+}
+
+func TestSelect_No_Rules(t *testing.T) {
+	asset, err := Select(assets, config.AssetRules{})
+	require.NoError(t, err)
+	require.Equal(t, "app-darwin-amd64.zip", asset.Name)
+}
+
+func TestSelect_Patterns(t *testing.T) {
+	asset, err := Select(assets, config.AssetRules{
+		Patterns: []string{"*-linux-*"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "app-linux-amd64.zip", asset.Name)
+}
+
+func TestSelect_Patterns_And_Extensions(t *testing.T) {
+	asset, err := Select(assets, config.AssetRules{
+		Patterns:   []string{"*-linux-*"},
+		Extensions: []string{".tar.gz", ".zip"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "app-linux-amd64.tar.gz", asset.Name)
+}
+
+func TestSelect_OS_Arch(t *testing.T) {
+	assets := []Asset{
+		{Name: "app-linux-x86_64.tar.gz"},
+		{Name: "app-linux-aarch64.tar.gz"},
+		{Name: "app-macos-arm64.tar.gz"},
+	}
+
+	rules := config.AssetRules{
+		Patterns: []string{"app-{os}-{arch}.tar.gz"},
+		OS:       "linux",
+		Arch:     "arm64",
+	}
+
+	asset, err := Select(assets, rules)
+	require.NoError(t, err)
+	require.Equal(t, "app-linux-aarch64.tar.gz", asset.Name)
+
+	rules.OS = "darwin"
+
+	asset, err = Select(assets, rules)
+	require.NoError(t, err)
+	require.Equal(t, "app-macos-arm64.tar.gz", asset.Name)
+}
+
+func TestSelect_Current_OS_Arch(t *testing.T) {
+	name := "app-" + runtime.GOOS + "-" + runtime.GOARCH
+
+	asset, err := Select([]Asset{{Name: "app-other"}, {Name: name}}, config.AssetRules{
+		Patterns: []string{"app-{os}-{arch}"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, name, asset.Name)
+}
+
+func TestExpand(t *testing.T) {
+	patterns := expand("{os}-{arch}", "linux", "amd64")
+	require.Equal(t, []string{"linux-amd64", "linux-x86_64", "linux-x64"}, patterns)
+
+	patterns = expand("*", "linux", "amd64")
+	require.Equal(t, []string{"*"}, patterns)
+}
+
+func TestSelect_No_Asset(t *testing.T) {
+	_, err := Select(nil, config.AssetRules{})
+	require.EqualError(t, err, "no asset")
+}
+
+func TestSelect_No_Match(t *testing.T) {
+	_, err := Select(assets, config.AssetRules{
+		Patterns: []string{"*-windows-*"},
+	})
+	require.EqualError(t, err, "no asset matches the patterns [*-windows-*]")
+
+	_, err = Select(assets, config.AssetRules{
+		Extensions: []string{".deb"},
+	})
+	require.EqualError(t, err, "no asset has one of the extensions [.deb]")
+}
+
+func TestSelect_Wrong_Pattern(t *testing.T) {
+	_, err := Select(assets, config.AssetRules{
+		Patterns: []string{"["},
+	})
+	require.EqualError(t, err, "wrong pattern \"[\": syntax error in pattern")
+}
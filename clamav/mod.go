@@ -0,0 +1,147 @@
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+)
+
+// defaultTimeout is the maximum duration of a scan if not configured
+const defaultTimeout = time.Minute
+
+// chunkSize is the maximum size of a chunk of the content sent to clamd
+const chunkSize = 32 * 1024
+
+// Scanner defines the primitive needed to scan an archive for malware
+type Scanner interface {
+	// Scan streams the content to the scanner and returns the name of the
+	// signature it matches, or an empty string if it is clean
+	Scan(content io.Reader) (string, error)
+}
+
+// NewClamd returns a new initialized scanner that streams the content to the
+// clamd daemon at the address of the configuration
+func NewClamd(conf config.ClamAV) Scanner {
+	return Clamd{
+		conf: conf,
+	}
+}
+
+// Clamd implements a scanner with the INSTREAM command of clamd.
+//
+// - implements clamav.Scanner
+type Clamd struct {
+	conf config.ClamAV
+}
+
+// Scan implements clamav.Scanner
+func (c Clamd) Scan(content io.Reader) (string, error) {
+	timeout := time.Duration(c.conf.Timeout)
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	network := "tcp"
+	if filepath.IsAbs(c.conf.Address) {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, c.conf.Address, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect: %v", err)
+	}
+
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", fmt.Errorf("failed to set deadline: %v", err)
+	}
+
+	err = stream(conn, content)
+	if err != nil {
+		// clamd closes the connection once the stream exceeds its limit, and
+		// its reply explains why
+		reply, replyErr := readReply(conn)
+		if replyErr == nil && reply != "" {
+			return "", fmt.Errorf("failed to stream: %s", reply)
+		}
+
+		return "", fmt.Errorf("failed to stream: %v", err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read reply: %v", err)
+	}
+
+	return ParseReply(reply)
+}
+
+// stream sends the INSTREAM command followed by the content, in chunks
+// prefixed by their size, and a zero-size chunk
+func stream(w io.Writer, content io.Reader) error {
+	_, err := w.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+chunkSize)
+
+	for {
+		n, err := content.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+
+			_, werr := w.Write(buf[:4+n])
+			if werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read content: %v", err)
+		}
+	}
+
+	_, err = w.Write([]byte{0, 0, 0, 0})
+
+	return err
+}
+
+// readReply reads the reply of clamd, terminated by a null byte
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// ParseReply returns the signature of a reply of clamd, such as
+// "stream: Eicar-Signature FOUND", an empty string if it is "stream: OK", or
+// an error if clamd failed.
+func ParseReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,158 @@
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClamd_Scan(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	received := make(chan string, 2)
+	go fakeClamd(t, listener, received, "stream: OK\x00", "stream: Eicar-Signature FOUND\x00")
+
+	scanner := NewClamd(config.ClamAV{Address: listener.Addr().String()})
+
+	// the content is sent in several chunks
+	content := strings.Repeat("a", chunkSize+10)
+
+	signature, err := scanner.Scan(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, "", signature)
+	require.Equal(t, content, <-received)
+
+	signature, err = scanner.Scan(strings.NewReader("eicar"))
+	require.NoError(t, err)
+	require.Equal(t, "Eicar-Signature", signature)
+	require.Equal(t, "eicar", <-received)
+
+	listener.Close()
+}
+
+func TestClamd_Scan_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamd.ctl")
+
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go fakeClamd(t, listener, received, "stream: OK\x00")
+
+	signature, err := NewClamd(config.ClamAV{Address: path}).Scan(strings.NewReader("aa"))
+	require.NoError(t, err)
+	require.Equal(t, "", signature)
+	require.Equal(t, "aa", <-received)
+}
+
+func TestClamd_Scan_Wrong(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	received := make(chan string, 1)
+	go fakeClamd(t, listener, received, "INSTREAM size limit exceeded. ERROR\x00")
+
+	scanner := NewClamd(config.ClamAV{Address: listener.Addr().String()})
+
+	_, err = scanner.Scan(strings.NewReader("aa"))
+	require.EqualError(t, err, "unexpected reply \"INSTREAM size limit exceeded. ERROR\"")
+
+	listener.Close()
+
+	_, err = scanner.Scan(strings.NewReader("aa"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to connect: ")
+}
+
+func TestClamd_Scan_Timeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	// clamd accepts the connection but never replies
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		io.Copy(io.Discard, conn)
+	}()
+
+	scanner := NewClamd(config.ClamAV{
+		Address: listener.Addr().String(),
+		Timeout: config.Duration(50 * time.Millisecond),
+	})
+
+	_, err = scanner.Scan(strings.NewReader("aa"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read reply: ")
+}
+
+func TestParseReply(t *testing.T) {
+	signature, err := ParseReply("stream: OK")
+	require.NoError(t, err)
+	require.Equal(t, "", signature)
+
+	signature, err = ParseReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+	require.NoError(t, err)
+	require.Equal(t, "Win.Test.EICAR_HDB-1", signature)
+
+	_, err = ParseReply("stream: Can't allocate memory ERROR")
+	require.EqualError(t, err, "unexpected reply \"stream: Can't allocate memory ERROR\"")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+// fakeClamd accepts a connection per reply, sends the content of its INSTREAM
+// command to received, and writes the reply
+func fakeClamd(t *testing.T, listener net.Listener, received chan string, replies ...string) {
+	for _, reply := range replies {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r := bufio.NewReader(conn)
+
+		command, err := r.ReadString(0)
+		require.NoError(t, err)
+		require.Equal(t, "zINSTREAM\x00", command)
+
+		var content strings.Builder
+
+		for {
+			var size uint32
+
+			err = binary.Read(r, binary.BigEndian, &size)
+			require.NoError(t, err)
+
+			if size == 0 {
+				break
+			}
+
+			_, err = io.CopyN(&content, r, int64(size))
+			require.NoError(t, err)
+		}
+
+		received <- content.String()
+
+		conn.Write([]byte(reply))
+		conn.Close()
+	}
+}
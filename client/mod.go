@@ -0,0 +1,638 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+)
+
+// ANSI color codes used to format the job statuses
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// DeployRequest defines the content of a deployment request
+type DeployRequest struct {
+	BrowserDownloadURL string   `json:"browser_download_url"`
+	Tag                string   `json:"tag,omitempty"`
+	FallbackURLs       []string `json:"fallback_urls,omitempty"`
+	SHA256             string   `json:"sha256,omitempty"`
+}
+
+// Client defines the primitives to interact with a running Hodor instance
+type Client interface {
+	// WatchJobs calls the handler for each job event, until the stream is
+	// closed by the server or the context is done.
+	WatchJobs(ctx context.Context, handler func(deployer.JobEvent)) error
+	// Deploy triggers the deployment of a release and returns the jobID.
+	Deploy(ctx context.Context, releaseID string, req DeployRequest) (string, error)
+	// DeployAndWait triggers the deployment of a release and waits for the
+	// job to finish. It returns the jobID and the final status of the job.
+	DeployAndWait(ctx context.Context, releaseID string, req DeployRequest) (string, deployer.JobStatus, error)
+	// GetStatus returns the status of a job
+	GetStatus(ctx context.Context, jobID string) (deployer.JobStatus, error)
+	// FollowStatus calls the handler with the status of a job, and then each
+	// time it changes, until the job is done. It returns the last status.
+	FollowStatus(ctx context.Context, jobID string, handler func(deployer.JobStatus)) (deployer.JobStatus, error)
+	// GetTag returns the tag deployed for a release
+	GetTag(ctx context.Context, releaseID string) (string, error)
+	// GetReleases returns the releases configured on the instance
+	GetReleases(ctx context.Context) ([]deployer.Release, error)
+	// ListJobs returns a page of the jobs of a release, or of all releases if
+	// releaseID is empty, from the most recent.
+	ListJobs(ctx context.Context, releaseID string, limit, offset int) ([]deployer.JobSummary, error)
+}
+
+// IsTerminal returns true if the status is final, meaning the job is done.
+func IsTerminal(status string) bool {
+	return deployer.IsTerminal(status)
+}
+
+// NewAPIClient returns a new initialized client that uses the HTTP API served
+// at baseURL, such as "http://localhost:3333".
+func NewAPIClient(baseURL string, client *http.Client) Client {
+	return &APIClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+	}
+}
+
+// APIClient implements a client that uses the HTTP API
+//
+// - implements client.Client
+type APIClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// WatchJobs implements client.Client
+func (c *APIClient) WatchJobs(ctx context.Context, handler func(deployer.JobEvent)) error {
+	return c.watchJobs(ctx, func() {}, handler)
+}
+
+// Deploy implements client.Client
+func (c *APIClient) Deploy(ctx context.Context, releaseID string, req DeployRequest) (string, error) {
+	buf, err := json.Marshal(&req)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.baseURL+"/api/hook/"+url.PathEscape(releaseID), bytes.NewBuffer(buf))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	var response struct {
+		JobID string `json:"jobID"`
+	}
+
+	err = c.do(httpReq, &response)
+	if err != nil {
+		return "", err
+	}
+
+	return response.JobID, nil
+}
+
+// DeployAndWait implements client.Client. It listens to the job events
+// before triggering the deployment, so that no event is missed.
+func (c *APIClient) DeployAndWait(ctx context.Context, releaseID string,
+	req DeployRequest) (string, deployer.JobStatus, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connected := make(chan struct{})
+	events := make(chan deployer.JobEvent, 100)
+	watchDone := make(chan error, 1)
+
+	go func() {
+		watchDone <- c.watchJobs(ctx, func() { close(connected) },
+			func(event deployer.JobEvent) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+				}
+			})
+		close(events)
+	}()
+
+	select {
+	case <-connected:
+	case err := <-watchDone:
+		return "", deployer.JobStatus{}, fmt.Errorf("failed to watch jobs: %v", err)
+	}
+
+	jobID, err := c.Deploy(ctx, releaseID, req)
+	if err != nil {
+		return "", deployer.JobStatus{}, err
+	}
+
+	for event := range events {
+		if event.JobID == jobID && IsTerminal(event.Status) {
+			return jobID, event.JobStatus, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return jobID, deployer.JobStatus{}, ctx.Err()
+	}
+
+	// the stream ended before the job finished, which can happen if the
+	// server is stopped. The status is checked a last time.
+	status, err := c.GetStatus(context.Background(), jobID)
+	if err != nil {
+		return jobID, status, err
+	}
+
+	if !IsTerminal(status.Status) {
+		return jobID, status, fmt.Errorf("stream closed before the job finished")
+	}
+
+	return jobID, status, nil
+}
+
+// GetStatus implements client.Client
+func (c *APIClient) GetStatus(ctx context.Context, jobID string) (deployer.JobStatus, error) {
+	var status deployer.JobStatus
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/status/"+url.PathEscape(jobID), nil)
+	if err != nil {
+		return status, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	err = c.do(req, &status)
+	if err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// FollowStatus implements client.Client. It reads the status stream of the
+// job, which the server closes once the job is done.
+func (c *APIClient) FollowStatus(ctx context.Context, jobID string,
+	handler func(deployer.JobStatus)) (deployer.JobStatus, error) {
+
+	var status deployer.JobStatus
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/status/"+url.PathEscape(jobID)+"/stream", nil)
+	if err != nil {
+		return status, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return status, fmt.Errorf("failed to get stream: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return status, responseError(res)
+	}
+
+	err = readEvents(res.Body, func(name string, data []byte) error {
+		if name != "status" {
+			return nil
+		}
+
+		err := json.Unmarshal(data, &status)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal status: %v", err)
+		}
+
+		handler(status)
+
+		return nil
+	})
+
+	if err != nil {
+		return status, fmt.Errorf("failed to read stream: %v", err)
+	}
+
+	if !IsTerminal(status.Status) {
+		return status, fmt.Errorf("stream closed before the job finished")
+	}
+
+	return status, nil
+}
+
+// GetTag implements client.Client
+func (c *APIClient) GetTag(ctx context.Context, releaseID string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/tags/"+url.PathEscape(releaseID), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", responseError(res)
+	}
+
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+
+	return string(buf), nil
+}
+
+// GetReleases implements client.Client
+func (c *APIClient) GetReleases(ctx context.Context) ([]deployer.Release, error) {
+	var releases []deployer.Release
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/releases", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	err = c.do(req, &releases)
+	if err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// ListJobs implements client.Client
+func (c *APIClient) ListJobs(ctx context.Context, releaseID string, limit,
+	offset int) ([]deployer.JobSummary, error) {
+
+	var page struct {
+		Jobs []deployer.JobSummary `json:"jobs"`
+	}
+
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+
+	if releaseID != "" {
+		query.Set("releaseID", releaseID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/jobs?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	err = c.do(req, &page)
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Jobs, nil
+}
+
+// do sends the request and decodes the JSON response into v
+func (c *APIClient) do(req *http.Request, v interface{}) error {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	// the hook responds with 202 Accepted
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		return responseError(res)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return nil
+}
+
+// watchJobs calls onConnect once the stream is open, and then the handler for
+// each job event.
+func (c *APIClient) watchJobs(ctx context.Context, onConnect func(),
+	handler func(deployer.JobEvent)) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+"/api/jobs/stream", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get stream: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	onConnect()
+
+	err = readEvents(res.Body, func(name string, data []byte) error {
+		if name != "status" {
+			return nil
+		}
+
+		var event deployer.JobEvent
+
+		err := json.Unmarshal(data, &event)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal event: %v", err)
+		}
+
+		handler(event)
+
+		return nil
+	})
+
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read stream: %v", err)
+	}
+
+	return nil
+}
+
+// ConfigDiff describes what a configuration would change on a running
+// instance
+type ConfigDiff struct {
+	Added   []string
+	Removed []string
+	Changed []ReleaseChange
+	// Orphaned lists the deployed targets that no release of the
+	// configuration would deploy anymore. They are left as is.
+	Orphaned []Orphan
+}
+
+// ReleaseChange describes how a release is changed
+type ReleaseChange struct {
+	ReleaseID string
+	// Changes describes each change, such as `target "/a" -> "/b"`.
+	Changes []string
+}
+
+// Orphan is a deployed target that is not used anymore
+type Orphan struct {
+	Target    string
+	ReleaseID string
+	Tag       string
+}
+
+// Diff compares a configuration against the releases of a running instance.
+func Diff(conf config.Config, releases []deployer.Release) ConfigDiff {
+	diff := ConfigDiff{}
+
+	live := make(map[string]deployer.Release, len(releases))
+	for _, release := range releases {
+		live[release.ReleaseID] = release
+	}
+
+	// the folders replaced by the releases of the configuration
+	used := make(map[string]bool)
+
+	for releaseID, entry := range conf.Entries {
+		if len(entry.Group) == 0 {
+			used[deployedPath(entry.Target, entry.Subpath)] = true
+		}
+
+		release, found := live[releaseID]
+		if !found {
+			diff.Added = append(diff.Added, releaseID)
+			continue
+		}
+
+		if release.Digest == entry.Digest() {
+			continue
+		}
+
+		var changes []string
+
+		if release.Target != entry.Target {
+			changes = append(changes, fmt.Sprintf("target %q -> %q", release.Target, entry.Target))
+		}
+
+		if release.Subpath != entry.Subpath {
+			changes = append(changes, fmt.Sprintf("subpath %q -> %q", release.Subpath, entry.Subpath))
+		}
+
+		if strings.Join(release.Group, ",") != strings.Join(entry.Group, ",") {
+			changes = append(changes, fmt.Sprintf("group %q -> %q", release.Group, entry.Group))
+		}
+
+		if len(changes) == 0 {
+			changes = append(changes, "settings")
+		}
+
+		diff.Changed = append(diff.Changed, ReleaseChange{ReleaseID: releaseID, Changes: changes})
+	}
+
+	for _, release := range releases {
+		_, found := conf.Entries[release.ReleaseID]
+		if !found {
+			diff.Removed = append(diff.Removed, release.ReleaseID)
+		}
+
+		if release.Tag == "" || len(release.Group) != 0 {
+			continue
+		}
+
+		target := deployedPath(release.Target, release.Subpath)
+		if !used[target] {
+			diff.Orphaned = append(diff.Orphaned, Orphan{
+				Target:    target,
+				ReleaseID: release.ReleaseID,
+				Tag:       release.Tag,
+			})
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].ReleaseID < diff.Changed[j].ReleaseID
+	})
+	sort.Slice(diff.Orphaned, func(i, j int) bool {
+		return diff.Orphaned[i].Target < diff.Orphaned[j].Target
+	})
+
+	return diff
+}
+
+// Empty returns true if the configuration changes nothing
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 &&
+		len(d.Orphaned) == 0
+}
+
+// String returns the diff with one line per change
+func (d ConfigDiff) String() string {
+	if d.Empty() {
+		return "no change\n"
+	}
+
+	out := new(strings.Builder)
+
+	for _, releaseID := range d.Added {
+		fmt.Fprintf(out, "+ %s\n", releaseID)
+	}
+
+	for _, releaseID := range d.Removed {
+		fmt.Fprintf(out, "- %s\n", releaseID)
+	}
+
+	for _, change := range d.Changed {
+		fmt.Fprintf(out, "~ %s: %s\n", change.ReleaseID, strings.Join(change.Changes, ", "))
+	}
+
+	for _, orphan := range d.Orphaned {
+		fmt.Fprintf(out, "! %s would be orphaned, deployed by %s at %s\n",
+			orphan.Target, orphan.ReleaseID, orphan.Tag)
+	}
+
+	return out.String()
+}
+
+// deployedPath returns the folder replaced by a release
+func deployedPath(target, subpath string) string {
+	return filepath.Clean(filepath.Join(target, subpath))
+}
+
+// FormatEvent returns a one-line description of the event. If color is true,
+// the status is colorized with ANSI codes.
+func FormatEvent(event deployer.JobEvent, color bool) string {
+	return fmt.Sprintf("%s %s %s %s %s: %s", time.Now().Format(time.RFC3339),
+		event.JobID, event.ReleaseID, event.Tag, formatStatus(event.Status, color),
+		event.Message)
+}
+
+// FormatJob returns a one-line description of the job, as FormatEvent does,
+// with the time it was last updated, in local time.
+func FormatJob(job deployer.JobSummary, color bool) string {
+	return fmt.Sprintf("%s %s %s %s %s: %s", job.UpdatedAt.Local().Format(time.RFC3339),
+		job.JobID, job.ReleaseID, job.Tag, formatStatus(job.Status, color), job.Message)
+}
+
+// FormatStatus returns a one-line description of the status of a job, as
+// FormatJob does, with the time it was last updated, in local time, if known.
+func FormatStatus(jobID string, status deployer.JobStatus, color bool) string {
+	line := fmt.Sprintf("%s %s %s %s: %s", jobID, status.ReleaseID, status.Tag,
+		formatStatus(status.Status, color), status.Message)
+
+	updatedAt := status.FinishedAt
+	if updatedAt == nil {
+		updatedAt = status.StartedAt
+	}
+
+	if updatedAt == nil {
+		updatedAt = status.CreatedAt
+	}
+
+	if updatedAt != nil {
+		line = updatedAt.Local().Format(time.RFC3339) + " " + line
+	}
+
+	return line
+}
+
+// formatStatus returns the status, colorized with ANSI codes if color is true
+func formatStatus(status string, color bool) string {
+	if !color {
+		return status
+	}
+
+	statusColor := colorYellow
+
+	switch status {
+	case "ok":
+		statusColor = colorGreen
+	case "failed":
+		statusColor = colorRed
+	}
+
+	return statusColor + status + colorReset
+}
+
+// readEvents parses the Server-Sent Events from the reader and calls the
+// handler for each event. It stops at the first handler error.
+func readEvents(r io.Reader, handler func(name string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+
+	name := ""
+	data := new(bytes.Buffer)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if data.Len() != 0 {
+				if name == "" {
+					name = "message"
+				}
+
+				err := handler(name, bytes.TrimSuffix(data.Bytes(), []byte("\n")))
+				if err != nil {
+					return err
+				}
+			}
+
+			name = ""
+			data.Reset()
+
+		case strings.HasPrefix(line, ":"):
+			// comment
+
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			data.WriteString("\n")
+		}
+	}
+
+	return scanner.Err()
+}
+
+// responseError returns an error with the status and body of the response
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return fmt.Errorf("unexpected status %q: %s", res.Status,
+		strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,398 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchJobs_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/jobs/stream", r.URL.Path)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: status\ndata: {\"jobID\":\"XX\",\"status\":\"ok\"}\n\n")
+		fmt.Fprint(w, "event: other\ndata: {}\n\n")
+		fmt.Fprint(w, "event: status\ndata: {\"jobID\":\"YY\",\"status\":\"failed\"}\n\n")
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL+"/", http.DefaultClient)
+
+	var events []deployer.JobEvent
+
+	err := client.WatchJobs(context.Background(), func(event deployer.JobEvent) {
+		events = append(events, event)
+	})
+	require.NoError(t, err)
+
+	require.Len(t, events, 2)
+	require.Equal(t, "XX", events[0].JobID)
+	require.Equal(t, "ok", events[0].Status)
+	require.Equal(t, "YY", events[1].JobID)
+	require.Equal(t, "failed", events[1].Status)
+}
+
+func TestWatchJobs_Wrong_Status(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "wrong action", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	err := client.WatchJobs(context.Background(), func(deployer.JobEvent) {})
+	require.EqualError(t, err, "unexpected status \"403 Forbidden\": wrong action")
+}
+
+func TestWatchJobs_Wrong_Event(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: status\ndata: {\n\n")
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	err := client.WatchJobs(context.Background(), func(deployer.JobEvent) {})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read stream: failed to unmarshal event")
+}
+
+func TestDeployAndWait_Pass(t *testing.T) {
+	server := newFakeServer(t, "ok")
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	jobID, status, err := client.DeployAndWait(context.Background(), "XX", DeployRequest{
+		BrowserDownloadURL: "http://xx",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "JOB", jobID)
+	require.Equal(t, "ok", status.Status)
+}
+
+func TestDeployAndWait_Failed(t *testing.T) {
+	server := newFakeServer(t, "failed")
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	_, status, err := client.DeployAndWait(context.Background(), "XX", DeployRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, "fake", status.Message)
+}
+
+func TestDeployAndWait_Deploy_Fail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/jobs/stream" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+
+		http.Error(w, "failed to deploy: fake", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	_, _, err := client.DeployAndWait(context.Background(), "XX", DeployRequest{})
+	require.EqualError(t, err, "unexpected status \"500 Internal Server Error\": failed to deploy: fake")
+}
+
+func TestGetStatus_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/status/XX", r.URL.Path)
+		fmt.Fprint(w, `{"status":"ok","message":"job done"}`)
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	status, err := client.GetStatus(context.Background(), "XX")
+	require.NoError(t, err)
+	require.Equal(t, deployer.JobStatus{Status: "ok", Message: "job done"}, status)
+}
+
+func TestFollowStatus_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/status/XX/stream", r.URL.Path)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: status\ndata: {\"status\":\"running\"}\n\n")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: status\ndata: {\"status\":\"ok\",\"message\":\"job done\"}\n\n")
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	var statuses []string
+
+	status, err := client.FollowStatus(context.Background(), "XX", func(status deployer.JobStatus) {
+		statuses = append(statuses, status.Status)
+	})
+	require.NoError(t, err)
+	require.Equal(t, deployer.JobStatus{Status: "ok", Message: "job done"}, status)
+	require.Equal(t, []string{"running", "ok"}, statuses)
+}
+
+func TestFollowStatus_Wrong(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/status/missing/stream" {
+			http.Error(w, "failed to get status: not found", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, "event: status\ndata: {\"status\":\"running\"}\n\n")
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	_, err := client.FollowStatus(context.Background(), "missing", func(deployer.JobStatus) {})
+	require.EqualError(t, err, "unexpected status \"500 Internal Server Error\": failed to get status: not found")
+
+	status, err := client.FollowStatus(context.Background(), "XX", func(deployer.JobStatus) {})
+	require.EqualError(t, err, "stream closed before the job finished")
+	require.Equal(t, "running", status.Status)
+}
+
+func TestGetTag_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tags/XX" {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, "v1.2.0")
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	tag, err := client.GetTag(context.Background(), "XX")
+	require.NoError(t, err)
+	require.Equal(t, "v1.2.0", tag)
+
+	_, err = client.GetTag(context.Background(), "YY")
+	require.EqualError(t, err, "unexpected status \"401 Unauthorized\": wrong token")
+}
+
+func TestGetReleases_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/releases", r.URL.Path)
+		fmt.Fprint(w, `[{"release_id":"XX","target":"/srv/xx","tag":"v1"}]`)
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	releases, err := client.GetReleases(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []deployer.Release{{ReleaseID: "XX", Target: "/srv/xx", Tag: "v1"}}, releases)
+}
+
+func TestListJobs_Pass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/jobs", r.URL.Path)
+		require.Equal(t, "limit=10&offset=20&releaseID=XX", r.URL.RawQuery)
+		fmt.Fprint(w, `{"jobs":[{"jobID":"AA","releaseID":"XX","tag":"v1","status":"ok"}],`+
+			`"limit":10,"offset":20}`)
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, http.DefaultClient)
+
+	jobs, err := client.ListJobs(context.Background(), "XX", 10, 20)
+	require.NoError(t, err)
+	require.Equal(t, []deployer.JobSummary{{JobID: "AA", ReleaseID: "XX", Tag: "v1", Status: "ok"}}, jobs)
+}
+
+func TestDiff(t *testing.T) {
+	same := config.Entry{Target: "/srv/same"}
+	moved := config.Entry{Target: "/srv/moved"}
+	tuned := config.Entry{Target: "/srv/tuned"}
+
+	releases := []deployer.Release{
+		{ReleaseID: "same", Target: same.Target, Digest: same.Digest(), Tag: "v1"},
+		{ReleaseID: "moved", Target: "/srv/old", Digest: "aa", Tag: "v2"},
+		{ReleaseID: "tuned", Target: tuned.Target, Digest: "bb", Tag: "v3"},
+		{ReleaseID: "removed", Target: "/srv/removed", Digest: "cc", Tag: "v4"},
+		{ReleaseID: "replaced", Target: "/srv/replaced", Subpath: "assets", Digest: "dd", Tag: "v5"},
+		{ReleaseID: "undeployed", Target: "/srv/undeployed", Digest: "ee"},
+	}
+
+	tuned.Adopt = true
+
+	diff := Diff(config.Config{Entries: map[string]config.Entry{
+		"same":  same,
+		"moved": moved,
+		"tuned": tuned,
+		"new":   {Target: "/srv/replaced/assets/"},
+	}}, releases)
+
+	require.Equal(t, ConfigDiff{
+		Added:   []string{"new"},
+		Removed: []string{"removed", "replaced", "undeployed"},
+		Changed: []ReleaseChange{
+			{ReleaseID: "moved", Changes: []string{`target "/srv/old" -> "/srv/moved"`}},
+			{ReleaseID: "tuned", Changes: []string{"settings"}},
+		},
+		Orphaned: []Orphan{
+			{Target: "/srv/old", ReleaseID: "moved", Tag: "v2"},
+			{Target: "/srv/removed", ReleaseID: "removed", Tag: "v4"},
+		},
+	}, diff)
+
+	require.Equal(t, "+ new\n"+
+		"- removed\n"+
+		"- replaced\n"+
+		"- undeployed\n"+
+		"~ moved: target \"/srv/old\" -> \"/srv/moved\"\n"+
+		"~ tuned: settings\n"+
+		"! /srv/old would be orphaned, deployed by moved at v2\n"+
+		"! /srv/removed would be orphaned, deployed by removed at v4\n", diff.String())
+
+	require.Equal(t, "no change\n", Diff(config.Config{}, nil).String())
+}
+
+func TestFormatEvent(t *testing.T) {
+	event := deployer.JobEvent{
+		JobID:     "XX",
+		ReleaseID: "YY",
+		Tag:       "ZZ",
+		JobStatus: deployer.JobStatus{Status: "ok", Message: "job done"},
+	}
+
+	line := FormatEvent(event, false)
+	require.True(t, strings.HasSuffix(line, " XX YY ZZ ok: job done"))
+
+	line = FormatEvent(event, true)
+	require.Contains(t, line, colorGreen+"ok"+colorReset)
+}
+
+func TestFormatJob(t *testing.T) {
+	setLocal(t, time.FixedZone("CET", 3600))
+
+	job := deployer.JobSummary{
+		JobID:     "XX",
+		ReleaseID: "YY",
+		Tag:       "ZZ",
+		Status:    "failed",
+		Message:   "fake",
+		UpdatedAt: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	require.Equal(t, "2022-01-02T04:04:05+01:00 XX YY ZZ failed: fake", FormatJob(job, false))
+	require.Contains(t, FormatJob(job, true), colorRed+"failed"+colorReset)
+}
+
+func TestFormatStatus(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	startedAt := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	finishedAt := startedAt.Add(time.Second)
+
+	status := deployer.JobStatus{
+		Status:    "running",
+		Message:   "downloading",
+		ReleaseID: "YY",
+		Tag:       "ZZ",
+	}
+
+	require.Equal(t, "XX YY ZZ running: downloading", FormatStatus("XX", status, false))
+
+	status.StartedAt = &startedAt
+	require.Equal(t, "2022-01-02T03:04:05Z XX YY ZZ running: downloading",
+		FormatStatus("XX", status, false))
+
+	status.Status = "ok"
+	status.Message = "job done"
+	status.FinishedAt = &finishedAt
+	require.Equal(t, "2022-01-02T03:04:06Z XX YY ZZ "+colorGreen+"ok"+colorReset+": job done",
+		FormatStatus("XX", status, true))
+}
+
+func TestReadEvents_Multiline(t *testing.T) {
+	var data []string
+
+	err := readEvents(strings.NewReader("data: a\ndata: b\n\n"), func(name string, d []byte) error {
+		require.Equal(t, "message", name)
+		data = append(data, string(d))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a\nb"}, data)
+}
+
+func TestIsTerminal(t *testing.T) {
+	require.True(t, IsTerminal("ok"))
+	require.True(t, IsTerminal("failed"))
+	require.False(t, IsTerminal("created"))
+}
+
+func TestReadEvents_Handler_Fail(t *testing.T) {
+	err := readEvents(strings.NewReader("data: a\n\n"), func(string, []byte) error {
+		return errors.New("fake")
+	})
+	require.EqualError(t, err, "fake")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+// setLocal sets the local timezone for the duration of the test
+func setLocal(t *testing.T, loc *time.Location) {
+	local := time.Local
+	time.Local = loc
+
+	t.Cleanup(func() {
+		time.Local = local
+	})
+}
+
+// newFakeServer returns a server that streams the events of job "JOB" once it
+// is deployed, ending with the provided status.
+func newFakeServer(t *testing.T, status string) *httptest.Server {
+	deployed := make(chan struct{})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/hook/XX":
+			require.Equal(t, http.MethodPost, r.Method)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"jobID":"JOB"}`)
+			close(deployed)
+
+		case "/api/jobs/stream":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			<-deployed
+
+			fmt.Fprint(w, "event: status\ndata: {\"jobID\":\"OTHER\",\"status\":\"ok\"}\n\n")
+			fmt.Fprint(w, "event: status\ndata: {\"jobID\":\"JOB\",\"status\":\"created\"}\n\n")
+			fmt.Fprintf(w, "event: status\ndata: {\"jobID\":\"JOB\",\"status\":%q,\"message\":\"fake\"}\n\n", status)
+			w.(http.Flusher).Flush()
+
+			<-r.Context().Done()
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
@@ -0,0 +1,121 @@
+package compactor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/buntdb"
+)
+
+// Shrinker defines the primitive needed to compact a database
+type Shrinker interface {
+	Shrink() error
+}
+
+// Compactor defines the primitives needed to periodically compact a database
+type Compactor interface {
+	// Start must be called only once to start the compaction loop
+	Start()
+	// Stop must be called only once and when start has been called
+	Stop()
+}
+
+// SetShrinkConfig updates the database with the shrink settings from the
+// config. Zero values keep the current database settings.
+func SetShrinkConfig(db *buntdb.DB, conf config.DBConfig) error {
+	var dbConf buntdb.Config
+
+	err := db.ReadConfig(&dbConf)
+	if err != nil {
+		return fmt.Errorf("failed to read db config: %v", err)
+	}
+
+	if conf.AutoShrinkPercentage != 0 {
+		dbConf.AutoShrinkPercentage = conf.AutoShrinkPercentage
+	}
+
+	if conf.AutoShrinkMinSize != 0 {
+		dbConf.AutoShrinkMinSize = conf.AutoShrinkMinSize
+	}
+
+	dbConf.AutoShrinkDisabled = conf.AutoShrinkDisabled
+
+	err = db.SetConfig(dbConf)
+	if err != nil {
+		return fmt.Errorf("failed to set db config: %v", err)
+	}
+
+	return nil
+}
+
+// NewPeriodicCompactor returns a new initialized compactor that shrinks the
+// database at each interval.
+func NewPeriodicCompactor(db Shrinker, interval time.Duration,
+	logger zerolog.Logger) Compactor {
+
+	logger = logger.With().Str("role", "compactor").Logger()
+
+	return &PeriodicCompactor{
+		db:       db,
+		interval: interval,
+		logger:   logger,
+		quit:     make(chan struct{}),
+	}
+}
+
+// PeriodicCompactor implements a compactor that shrinks the database at a
+// fixed interval.
+//
+// - implements compactor.Compactor
+type PeriodicCompactor struct {
+	db       Shrinker
+	interval time.Duration
+	logger   zerolog.Logger
+	quit     chan struct{}
+}
+
+// Start implements compactor.Compactor. This is a blocking function that
+// returns once Stop has been called.
+func (pc *PeriodicCompactor) Start() {
+	ticker := time.NewTicker(pc.interval)
+	defer ticker.Stop()
+
+	pc.logger.Info().Msgf("compacting the database every %s", pc.interval)
+
+	for {
+		select {
+		case <-pc.quit:
+			return
+		case <-ticker.C:
+			err := pc.compact()
+			if err != nil {
+				pc.logger.Err(err).Msg("failed to compact")
+			}
+		}
+	}
+}
+
+// Stop implements compactor.Compactor
+func (pc *PeriodicCompactor) Stop() {
+	close(pc.quit)
+}
+
+// compact shrinks the database once. A shrink already in progress, for
+// example triggered by the automatic shrinking, is not an error.
+func (pc *PeriodicCompactor) compact() error {
+	err := pc.db.Shrink()
+	if err == buntdb.ErrShrinkInProcess {
+		pc.logger.Info().Msg("shrink already in progress")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to shrink: %v", err)
+	}
+
+	pc.logger.Info().Msg("database compacted")
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package compactor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestCompactor_Scenario(t *testing.T) {
+	db := &fakeShrinker{}
+	logger := zerolog.New(io.Discard)
+
+	compactor := NewPeriodicCompactor(db, time.Millisecond*10, logger)
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		compactor.Start()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	compactor.Stop()
+	wait.Wait()
+
+	require.Greater(t, db.getCalls(), 0)
+}
+
+func TestCompact_In_Progress(t *testing.T) {
+	log := new(bytes.Buffer)
+
+	pc := PeriodicCompactor{
+		db:     &fakeShrinker{err: buntdb.ErrShrinkInProcess},
+		logger: zerolog.New(log),
+	}
+
+	err := pc.compact()
+	require.NoError(t, err)
+	require.Contains(t, log.String(), "shrink already in progress")
+}
+
+func TestCompact_Fail(t *testing.T) {
+	pc := PeriodicCompactor{
+		db: &fakeShrinker{err: errors.New("fake")},
+	}
+
+	err := pc.compact()
+	require.EqualError(t, err, "failed to shrink: fake")
+}
+
+func TestSetShrinkConfig(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	err = SetShrinkConfig(db, config.DBConfig{
+		AutoShrinkPercentage: 50,
+		AutoShrinkDisabled:   true,
+	})
+	require.NoError(t, err)
+
+	var dbConf buntdb.Config
+
+	err = db.ReadConfig(&dbConf)
+	require.NoError(t, err)
+
+	require.Equal(t, 50, dbConf.AutoShrinkPercentage)
+	require.Equal(t, 32*1024*1024, dbConf.AutoShrinkMinSize)
+	require.True(t, dbConf.AutoShrinkDisabled)
+}
+
+func TestSetShrinkConfig_Closed(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	db.Close()
+
+	err = SetShrinkConfig(db, config.DBConfig{})
+	require.EqualError(t, err, "failed to read db config: database closed")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+type fakeShrinker struct {
+	sync.Mutex
+	calls int
+	err   error
+}
+
+func (s *fakeShrinker) Shrink() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.calls++
+	return s.err
+}
+
+func (s *fakeShrinker) getCalls() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.calls
+}
@@ -1,16 +1,972 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config defines the structure of the configuration needed by Hodor.
 type Config struct {
-	// key is the release key, and value the target folder where the release
-	// should be deployed.
-	Entries map[string]string `json:"entries"`
+	// key is the release key, and value defines how the release should be
+	// deployed.
+	Entries map[string]Entry `json:"entries"`
+
+	// DB contains the database settings.
+	DB DBConfig `json:"db"`
+
+	// DirMode is the permission of the folders created by a deployment, such
+	// as "0755". Entries can override it.
+	DirMode Mode `json:"dir_mode"`
+	// FileMode is the permission of the files created by a deployment, such
+	// as "0644". Entries can override it.
+	FileMode Mode `json:"file_mode"`
+
+	// GitHub contains the settings used when fetching from GitHub.
+	GitHub GitHubConfig `json:"github"`
+
+	// PublicURL is the base URL of Hodor, such as "https://hodor.example.com",
+	// used to link the jobs in notifications.
+	PublicURL string `json:"public_url"`
+
+	// UnknownTag is the tag of the releases that were never deployed, such as
+	// in badges. Defaults to "unknown".
+	UnknownTag string `json:"unknown_tag"`
+
+	// CallbackSecret signs the job statuses posted to the callback URLs of the
+	// hooks. Callbacks are not signed if empty.
+	CallbackSecret string `json:"callback_secret"`
+
+	// WebhookSecret is the secret with which the hooks must be signed, in
+	// the X-Hub-Signature-256 header as GitHub does, unless the entry has its
+	// own. Hooks are not verified if empty.
+	WebhookSecret string `json:"webhook_secret"`
+
+	// Auth contains the settings of the API authentication.
+	Auth AuthConfig `json:"auth"`
+
+	// AllowHTTP accepts the plain HTTP download URLs of all the releases. By
+	// default, only HTTPS URLs are downloaded, except from the HTTPMirrors of
+	// an entry, so that the deployed code can't be tampered with in transit.
+	AllowHTTP bool `json:"allow_http"`
+
+	// UserAgent identifies the outbound requests, such as downloads. Defaults
+	// to "hodor/<version>".
+	UserAgent string `json:"user_agent"`
+
+	// Grafana contains the settings to annotate Grafana dashboards with the
+	// deployments.
+	Grafana GrafanaConfig `json:"grafana"`
+
+	// Discovery contains the settings to publish the deployed tags to service
+	// discovery systems.
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// Report contains the settings of the periodic deployment reports.
+	Report ReportConfig `json:"report"`
+
+	// MQTT contains the settings to trigger deployments from MQTT messages.
+	MQTT MQTTConfig `json:"mqtt"`
+
+	// Limits lowers the priority of the extractions. Entries can override
+	// it.
+	Limits Limits `json:"limits"`
+
+	// Retry retries the downloads that fail transiently. Entries can override
+	// it.
+	Retry Retry `json:"retry"`
+
+	// DurationAlert notifies the deployments that take much longer than the
+	// previous ones of their release.
+	DurationAlert DurationAlert `json:"duration_alert"`
+
+	// Workers is the number of jobs handled at the same time. The jobs of a
+	// release are always handled one after the other. Defaults to 1.
+	Workers int `json:"workers"`
+
+	// HTTP enables or disables the middlewares of the HTTP server.
+	HTTP HTTPConfig `json:"http"`
+}
+
+// HTTPConfig defines the middlewares of the HTTP server
+type HTTPConfig struct {
+	// Middlewares enables or disables the middlewares by name, among the keys
+	// of Middlewares. The missing ones keep their default.
+	Middlewares map[string]bool `json:"middlewares"`
+	// RateLimit configures the "rate_limit" middleware.
+	RateLimit RateLimit `json:"rate_limit"`
+}
+
+// Middlewares are the middlewares of the HTTP server, and whether they are
+// enabled by default
+var Middlewares = map[string]bool{
+	// "cors" lets browsers read the API from any origin
+	"cors": true,
+	// "tracing" gives each request an ID, from its X-Request-Id header if any
+	"tracing": true,
+	// "access_log" logs each request
+	"access_log": true,
+	// "compression" compresses the text responses with gzip
+	"compression": false,
+	// "rate_limit" limits the requests of each client address
+	"rate_limit": false,
+}
+
+// Enabled returns true if the middleware is enabled
+func (h HTTPConfig) Enabled(middleware string) bool {
+	enabled, ok := h.Middlewares[middleware]
+	if !ok {
+		return Middlewares[middleware]
+	}
+
+	return enabled
+}
+
+// check checks that the middlewares are known, and that the rate limit has no
+// negative values
+func (h HTTPConfig) check() error {
+	for middleware := range h.Middlewares {
+		_, ok := Middlewares[middleware]
+		if !ok {
+			return fmt.Errorf("unknown middleware %q", middleware)
+		}
+	}
+
+	if h.RateLimit.Requests < 0 || h.RateLimit.Burst < 0 {
+		return fmt.Errorf("negative rate limit")
+	}
+
+	return nil
+}
+
+// RateLimit defines the requests allowed for each client address
+type RateLimit struct {
+	// Requests is the number of requests per second. Defaults to 10.
+	Requests float64 `json:"requests"`
+	// Burst is the number of requests allowed at once, after a pause.
+	// Defaults to 20.
+	Burst int `json:"burst"`
+}
+
+// AuthConfig defines the bearer tokens required by the API, in addition to
+// the tokens of the entries
+type AuthConfig struct {
+	// Token is accepted for all the releases. Once set, the releases without
+	// a token of their own require it to be deployed.
+	Token string `json:"token"`
+	// Private requires a token for the read endpoints too, such as the status
+	// of the jobs and the tags of the releases. Requires Token.
+	Private bool `json:"private"`
+	// PublicBadges keeps the badges readable without a token when Private is
+	// set.
+	PublicBadges bool `json:"public_badges"`
+	// BadgeSecret signs the badge URLs that are readable without a token when
+	// Private is set, until they expire.
+	BadgeSecret string `json:"badge_secret"`
+}
+
+// MQTTConfig defines the MQTT broker whose messages trigger deployments
+type MQTTConfig struct {
+	// Broker is the address of the broker, such as "tcp://broker:1883" or
+	// "tls://broker:8883". MQTT is disabled if empty.
+	Broker string `json:"broker"`
+	// ClientID identifies Hodor, so that the broker keeps its messages while
+	// it is disconnected. Defaults to "hodor-<hostname>".
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Topic is the topic of each release, where "{releaseID}" is replaced by
+	// the releaseID. Defaults to "hodor/deploy/{releaseID}".
+	Topic string `json:"topic"`
+}
+
+// ReportConfig defines when the deployment reports are generated and where
+// they are sent.
+type ReportConfig struct {
+	// Period is "daily" or "weekly". Reports are disabled if empty.
+	Period string `json:"period"`
+	// Time is the time of the day, as "15:04", at which reports are sent.
+	// Defaults to "08:00".
+	Time string `json:"time"`
+	// Weekday is the day weekly reports are sent, such as "monday", which is
+	// the default.
+	Weekday string `json:"weekday"`
+	// Timezone is the IANA timezone of Time and of the report's dates, such
+	// as "Europe/Zurich". Defaults to the local timezone.
+	Timezone string `json:"timezone"`
+	// Email sends the reports by email, if its host is set
+	Email EmailConfig `json:"email"`
+	// WebhookURL receives the reports as JSON, if set
+	WebhookURL string `json:"webhook_url"`
+}
+
+// EmailConfig defines how emails are sent
+type EmailConfig struct {
+	// Host is the SMTP server, such as "smtp.example.com:587"
+	Host     string   `json:"host"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// DiscoveryConfig defines where the deployed tag of each release is published.
+// Each key is the prefix followed by the releaseID, and its value is the tag.
+type DiscoveryConfig struct {
+	Consul KVConfig `json:"consul"`
+	// Etcd uses the v3 HTTP gateway
+	Etcd KVConfig `json:"etcd"`
+}
+
+// KVConfig defines a key-value store
+type KVConfig struct {
+	// URL is the base URL of the store's HTTP API. The store is not used if
+	// empty.
+	URL string `json:"url"`
+	// Token authenticates the requests, if not empty
+	Token string `json:"token"`
+	// Prefix defaults to "hodor/releases/"
+	Prefix string `json:"prefix"`
+}
+
+// GrafanaConfig defines how deployments are posted as Grafana annotations
+type GrafanaConfig struct {
+	// URL is the base URL of Grafana. Annotations are disabled if empty.
+	URL string `json:"url"`
+	// Token is a service account token with the annotation permission
+	Token string `json:"token"`
+	// DashboardUID restricts the annotations to a dashboard. They are global
+	// to the organization if empty.
+	DashboardUID string `json:"dashboard_uid"`
+	// Tags are added to the annotations, in addition to the releaseID and the
+	// tag.
+	Tags []string `json:"tags"`
+}
+
+// GitHubConfig defines the settings used when fetching from GitHub
+type GitHubConfig struct {
+	// RateLimitMaxWait is the maximum time a download waits for the rate limit
+	// to reset before failing. Defaults to 5 minutes.
+	RateLimitMaxWait Duration `json:"rate_limit_max_wait"`
+	// Token authenticates the downloads from GitHub, to download the assets
+	// of private repositories. Defaults to the GITHUB_TOKEN environment
+	// variable.
+	Token string `json:"token"`
+	// Hosts receive the token too, in addition to github.com and
+	// api.github.com, such as a GitHub Enterprise server.
+	Hosts []string `json:"hosts"`
+}
+
+// Entry defines how a release is deployed. An entry can also be decoded from a
+// string, in which case it is the target folder.
+type Entry struct {
+	// Target is the folder where the release should be deployed.
+	Target string `json:"target"`
+	// Env contains environment variables given to the hook commands.
+	Env map[string]string `json:"env"`
+	// PreDeploy contains shell commands executed in the extracted release
+	// before it replaces the target.
+	PreDeploy []string `json:"pre_deploy"`
+	// PostDeploy contains shell commands executed in the target once the
+	// release is deployed.
+	PostDeploy []string `json:"post_deploy"`
+	// RunAs defines the account that owns the extracted files and executes
+	// the hook commands. Hodor's account is used if not set.
+	RunAs RunAs `json:"run_as"`
+	// Sandbox restricts what the hook commands can access.
+	Sandbox Sandbox `json:"sandbox"`
+	// Xattrs restores the extended attributes stored in the archive, such as
+	// SELinux labels.
+	Xattrs bool `json:"xattrs"`
+	// Restorecon restores the default SELinux contexts of the target once the
+	// release is deployed, with `restorecon -R`.
+	Restorecon bool `json:"restorecon"`
+	// Staging defines where the release is extracted before the swap.
+	// Defaults to the system's temporary folder.
+	Staging Staging `json:"staging"`
+	// MaxSize is the maximum size of the extracted release's files. The job
+	// fails during the extraction if it is exceeded. Unlimited if not set.
+	MaxSize Size `json:"max_size"`
+	// MaxArchiveSize is the maximum size of the downloaded archive. The job
+	// fails before the download if its announced size exceeds it, or during
+	// the download otherwise. Unlimited if not set.
+	MaxArchiveSize Size `json:"max_archive_size"`
+	// MinFreeSpace is the space that must remain free, on the filesystems
+	// where the release is saved and extracted, once the archive is
+	// downloaded. The job fails before the download otherwise.
+	MinFreeSpace Size `json:"min_free_space"`
+	// FlatArchive accepts archives whose entries are at the root, such as
+	// created by `tar -czf app.tar.gz -C dist .`, instead of requiring a
+	// single root folder.
+	FlatArchive bool `json:"flat_archive"`
+	// Strategy defines how the release replaces the target. Defaults to
+	// StrategyReplace.
+	Strategy Strategy `json:"strategy"`
+	// Keep is the number of previous releases kept next to the target, in
+	// "<target>.previous", or in "<target>-releases" with StrategySymlink, so
+	// that they can be rolled back. Only with the replace and symlink
+	// strategies.
+	Keep int `json:"keep"`
+	// DirMode overrides the global folder permission for this release.
+	DirMode Mode `json:"dir_mode"`
+	// FileMode overrides the global file permission for this release.
+	FileMode Mode `json:"file_mode"`
+	// FallbackURLs are tried in order if the release can't be downloaded
+	// from the URLs of the hook. "{tag}" is replaced by the release's tag.
+	FallbackURLs []string `json:"fallback_urls"`
+	// Assets defines how the release's asset is selected when the hook lists
+	// several assets instead of giving a download URL.
+	Assets AssetRules `json:"assets"`
+	// ReleaseNotes saves the release notes in the deployment history. They
+	// are taken from the hook request, or from the NOTES.md file of the
+	// release.
+	ReleaseNotes bool `json:"release_notes"`
+	// Purge defines the CDN caches purged once the release is deployed.
+	Purge Purge `json:"purge"`
+	// Scan submits the release to a vulnerability scanner before it is
+	// deployed, if its URL is set.
+	Scan Scan `json:"scan"`
+	// ClamAV scans the archive of the release with clamd before it is
+	// extracted, if its address is set.
+	ClamAV ClamAV `json:"clamav"`
+	// States are the custom statuses a running job of the release can take,
+	// such as "awaiting_approval" or "canary", set by the pipeline through
+	// the API.
+	States []string `json:"states"`
+	// After lists the releases that trigger this release once they are
+	// deployed successfully, such as an app before its documentation.
+	After []string `json:"after"`
+	// ChainURL is the download URL used when the release is triggered by a
+	// release of After. "{tag}" is replaced by the tag of that release.
+	ChainURL string `json:"chain_url"`
+	// Subpath is the folder of the target replaced by the release, such as
+	// "assets", leaving the rest of the target untouched. The hook can
+	// override it.
+	Subpath string `json:"subpath"`
+	// Group lists the releases deployed together as this release, each from
+	// its asset among the assets of the hook. If one fails, all are rolled
+	// back. A group has no target.
+	Group []string `json:"group"`
+	// Token must be given to deploy the release, as a bearer token or as the
+	// "token" parameter of /api/deploy. Anyone can deploy it if empty.
+	Token string `json:"token"`
+	// WebhookSecret overrides the global webhook secret for this release.
+	// Once the hooks are signed, the token is not required from them.
+	WebhookSecret string `json:"webhook_secret"`
+	// Repository is the image repository, such as "org/app", whose pushes to
+	// DockerHub or Harbor trigger the release.
+	Repository string `json:"repository"`
+	// RegistryURL is the download URL used when the release is triggered by a
+	// push of Repository. "{tag}" is replaced by the pushed tag.
+	RegistryURL string `json:"registry_url"`
+	// Delta enables delta updates, for large releases on constrained
+	// networks.
+	Delta Delta `json:"delta"`
+	// Recover redeploys the last release if the target is missing or doesn't
+	// match it when Hodor starts, such as after a crash during a deployment.
+	Recover bool `json:"recover"`
+	// InitialTag is the tag deployed before Hodor took over the target. It is
+	// the latest tag until the release is deployed by Hodor.
+	InitialTag string `json:"initial_tag"`
+	// Adopt allows deploying into an existing target that was not deployed by
+	// Hodor. Without it, such a target is never replaced, so that a wrong
+	// target doesn't wipe an unrelated folder.
+	Adopt bool `json:"adopt"`
+	// UnsafeTarget skips the checks of the target, such as for a target that
+	// overlaps another one on purpose.
+	UnsafeTarget bool `json:"unsafe_target"`
+	// Limits overrides the limits of the configuration for this entry.
+	Limits *Limits `json:"limits"`
+	// Retry overrides the retry policy of the configuration for this entry.
+	Retry *Retry `json:"retry"`
+	// DownloadHeaders are set on the downloads of the release, such as an
+	// Authorization header for a private artifact store. They replace the
+	// GitHub token.
+	DownloadHeaders map[string]string `json:"download_headers"`
+	// HTTPMirrors are the hosts, such as internal mirrors, from which the
+	// release can be downloaded over plain HTTP. A host matches with or
+	// without its port.
+	HTTPMirrors []string `json:"http_mirrors"`
+	// SHA256 is the hex-encoded SHA-256 of the archive, for an entry always
+	// deployed from the same archive. The archive is verified against it
+	// before its extraction, in addition to the checksum of the request.
+	SHA256 string `json:"sha256"`
+	// Forward lists the Hodor instances to which each successful deployment
+	// is forwarded as a hook, such as from staging to production.
+	Forward []Forward `json:"forward"`
+	// Promote is the release, such as the production environment of this
+	// staging release, to which the deployed archive can be promoted. The
+	// archive is then kept in the cache of the release, see Delta.Cache.
+	Promote string `json:"promote"`
+	// Debug retains the archive and the log of the failed jobs of the
+	// release, so that packaging bugs can be reproduced.
+	Debug Debug `json:"debug"`
+	// Badge customizes the badge of the release's tag.
+	Badge Badge `json:"badge"`
+}
+
+// Badge customizes the badge of a release's tag. The query parameters of a
+// badge request override it.
+type Badge struct {
+	// Label defaults to "Deployed"
+	Label string `json:"label"`
+	// Color is one of BadgeColors, or a hex color such as "#4c1". Defaults
+	// to "blue".
+	Color string `json:"color"`
+	// Style is one of BadgeStyles. Defaults to "flat".
+	Style string `json:"style"`
+}
+
+// BadgeColors are the named colors of the badges
+var BadgeColors = []string{"brightgreen", "green", "yellow", "yellowgreen", "orange",
+	"red", "blue", "grey", "gray", "lightgrey", "lightgray"}
+
+// BadgeStyles are the styles of the badges
+var BadgeStyles = []string{"flat", "flat-square"}
+
+// maxBadgeLabel is the maximum length of the label of a badge
+const maxBadgeLabel = 64
+
+// hexColor matches a hex color, with or without "#"
+var hexColor = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// CheckBadge checks that the color and the style of the badge are known, and
+// that its label is not too long
+func CheckBadge(b Badge) error {
+	if len(b.Label) > maxBadgeLabel {
+		return fmt.Errorf("label is longer than %d characters", maxBadgeLabel)
+	}
+
+	if b.Color != "" && !hexColor.MatchString(b.Color) && !contains(BadgeColors, b.Color) {
+		return fmt.Errorf("unknown color %q", b.Color)
+	}
+
+	if b.Style != "" && !contains(BadgeStyles, b.Style) {
+		return fmt.Errorf("unknown style %q", b.Style)
+	}
+
+	return nil
+}
+
+// Forward defines another Hodor instance that deploys the releases deployed by
+// this one
+type Forward struct {
+	// URL is the hook of the release on the other instance, such as
+	// "https://prod.example.com/api/hook/app"
+	URL string `json:"url"`
+	// Secret signs the hook as GitHub does. It is the webhook secret of the
+	// release on the other instance.
+	Secret string `json:"secret"`
+	// Token is sent as a bearer token, if set
+	Token string `json:"token"`
+}
+
+// Limits lowers the priority of the extraction, so that a deployment doesn't
+// slow down the services running on the same host. Limits are only applied on
+// Linux.
+type Limits struct {
+	// Nice is the niceness of the extraction, from 0, the default, to 19,
+	// the lowest priority. Unless IOIdle is set, the I/O priority follows it.
+	Nice int `json:"nice"`
+	// IOIdle only lets the extraction use the disk when no other process
+	// does, as "ionice -c 3".
+	IOIdle bool `json:"io_idle"`
+}
+
+// Retry defines how a download that fails transiently, with a network error or
+// a 408, 429, or 5xx status, is retried, before trying the next URL.
+type Retry struct {
+	// Attempts is the maximum number of attempts per URL, including the first
+	// one. 0 or 1 disables the retries.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry, doubled for each next one,
+	// with a random jitter of up to half of it. Defaults to 1 second.
+	Backoff Duration `json:"backoff"`
+	// MaxBackoff caps the wait between two attempts. Defaults to 30 seconds.
+	MaxBackoff Duration `json:"max_backoff"`
+}
+
+// check checks that the retry policy has no negative values
+func (r Retry) check() error {
+	if r.Attempts < 0 {
+		return fmt.Errorf("attempts %d is negative", r.Attempts)
+	}
+
+	if r.Backoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("negative backoff")
+	}
+
+	return nil
+}
+
+// DurationAlert defines when a deployment is reported as slow, compared to
+// the 95th percentile (p95) of the durations of the previous deployments of
+// its release.
+type DurationAlert struct {
+	// Factor enables the alerts: a deployment is slow when it takes more than
+	// Factor times the p95. Must be 0 or at least 1.
+	Factor float64 `json:"factor"`
+	// MinSamples is the number of previous deployments needed before a
+	// deployment can be reported as slow. Defaults to 5.
+	MinSamples int `json:"min_samples"`
+	// URL receives the slow deployments as JSON, in addition to the Grafana
+	// annotations. Optional.
+	URL string `json:"url"`
+	// Headers are set on the requests to URL, such as an Authorization
+	// header.
+	Headers map[string]string `json:"headers"`
+}
+
+// check returns an error if the alert is invalid
+func (a DurationAlert) check() error {
+	if a.Factor != 0 && a.Factor < 1 {
+		return fmt.Errorf("factor %g is lower than 1", a.Factor)
+	}
+
+	if a.MinSamples < 0 {
+		return fmt.Errorf("min samples %d is negative", a.MinSamples)
+	}
+
+	if a.URL != "" && a.Factor == 0 {
+		return fmt.Errorf("url requires a factor")
+	}
+
+	return nil
+}
+
+// Delta defines how a release is reconstructed from a binary diff against the
+// previous archive, which is kept in a cache.
+type Delta struct {
+	// URL is the download URL of the diff, where "{tag}" is replaced by the
+	// new tag and "{previous_tag}" by the tag of the cached archive. Delta
+	// updates are disabled if empty.
+	URL string `json:"url"`
+	// Tool is the format of the diff, "zstd" for "zstd --patch-from", which is
+	// the default, or "bsdiff". The corresponding command must be installed.
+	Tool string `json:"tool"`
+	// Cache is the folder where the last archive of the release is kept.
+	// Defaults to ".hodor-cache" next to the target.
+	Cache string `json:"cache"`
+}
+
+// Debug defines how the failed jobs of a release are retained for debugging
+type Debug struct {
+	// RetainDays is the number of days the downloaded archive and the log of
+	// a failed job are retained. Disabled if 0.
+	RetainDays int `json:"retain_days"`
+	// Dir is the folder where they are retained, in a folder per job.
+	// Defaults to ".hodor-debug" next to the target.
+	Dir string `json:"dir"`
+}
+
+// Purge defines the CDN caches purged after a deployment
+type Purge struct {
+	// Cloudflare lists the Cloudflare zones to purge
+	Cloudflare []CloudflarePurge `json:"cloudflare"`
+	// Endpoints lists arbitrary purge endpoints, such as the API of another
+	// CDN.
+	Endpoints []PurgeEndpoint `json:"endpoints"`
+}
+
+// Scan defines the vulnerability scanner a release is submitted to before it
+// is deployed
+type Scan struct {
+	// URL receives the SBOM of the release, or a tar.gz of its files if it
+	// has none, in a POST request, and responds with a Grype or Trivy JSON
+	// report.
+	URL string `json:"url"`
+	// Headers are added to the request, such as an authorization header
+	Headers map[string]string `json:"headers"`
+	// Severity is the lowest severity of the findings that block the
+	// deployment, among ScanSeverities. Defaults to "high".
+	Severity string `json:"severity"`
+	// Timeout is the maximum duration of the scan, 5 minutes by default
+	Timeout Duration `json:"timeout"`
+}
+
+// ClamAV defines the clamd daemon an archive is streamed to before it is
+// extracted
+type ClamAV struct {
+	// Address is the path of the unix socket of clamd, such as
+	// "/run/clamav/clamd.ctl", or its TCP host:port, such as "localhost:3310".
+	Address string `json:"address"`
+	// Timeout is the maximum duration of the scan, 1 minute by default
+	Timeout Duration `json:"timeout"`
+	// Quarantine is the folder where an infected archive is moved. Defaults
+	// to ".hodor-quarantine" next to the target.
+	Quarantine string `json:"quarantine"`
+}
+
+// ReservedStates are the built-in statuses of a job, which can't be custom
+// states
+var ReservedStates = []string{"created", "deferred", "running", "ok", "failed"}
+
+// checkStates checks that the custom states are lowercase names, not reserved,
+// and unique
+func checkStates(states []string) error {
+	seen := make(map[string]bool, len(states))
+
+	for _, state := range states {
+		if state == "" || strings.Trim(state, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			return fmt.Errorf("invalid state %q", state)
+		}
+
+		for _, reserved := range ReservedStates {
+			if state == reserved {
+				return fmt.Errorf("reserved state %q", state)
+			}
+		}
+
+		if seen[state] {
+			return fmt.Errorf("duplicate state %q", state)
+		}
+
+		seen[state] = true
+	}
+
+	return nil
+}
+
+// ScanSeverities are the severities of the findings of a scan, from the
+// highest
+var ScanSeverities = []string{"critical", "high", "medium", "low", "negligible", "unknown"}
+
+// CloudflarePurge defines a Cloudflare zone to purge
+type CloudflarePurge struct {
+	ZoneID string `json:"zone_id"`
+	// Token is an API token with the cache purge permission on the zone
+	Token string `json:"token"`
+	// Files are the URLs to purge. Everything is purged if empty.
+	Files []string `json:"files"`
+}
+
+// PurgeEndpoint defines an HTTP request that purges a CDN cache
+type PurgeEndpoint struct {
+	URL string `json:"url"`
+	// Method defaults to POST
+	Method string `json:"method"`
+	// Headers are added to the request, such as an authorization header
+	Headers map[string]string `json:"headers"`
+	// Body is sent as the request body, if not empty
+	Body string `json:"body"`
+}
+
+// AssetRules defines how an asset is selected among the assets of a release.
+type AssetRules struct {
+	// Patterns are glob patterns, such as "*-linux-amd64.tar.gz", that the
+	// asset name must match. Any asset is considered if empty. "{os}" and
+	// "{arch}" are replaced by the target's OS and architecture.
+	Patterns []string `json:"patterns"`
+	// Extensions are the preferred extensions, such as ".tar.gz", from most
+	// to least preferred.
+	Extensions []string `json:"extensions"`
+	// OS is the target's OS, as GOOS. Defaults to the OS running Hodor.
+	OS string `json:"os"`
+	// Arch is the target's architecture, as GOARCH. Defaults to the
+	// architecture running Hodor.
+	Arch string `json:"arch"`
+}
+
+// Strategy defines how a release replaces the target
+type Strategy string
+
+const (
+	// StrategyReplace removes the target and renames the extracted release to
+	// the target.
+	StrategyReplace Strategy = "replace"
+	// StrategyCopy copies each file of the extracted release to a temporary
+	// file in the target and renames it, then removes the files that are not
+	// part of the release. It doesn't need to rename directories, which is
+	// useful on network shares.
+	StrategyCopy Strategy = "copy"
+	// StrategyUpdate writes each file of the extracted release like
+	// StrategyCopy, but keeps the files of the target that are not part of
+	// the release. It is meant for small releases deployed in a folder that
+	// also contains runtime data.
+	StrategyUpdate Strategy = "update"
+	// StrategySymlink moves the extracted release to its own folder in
+	// "<target>-releases", and atomically replaces the target, a symlink, to
+	// point to it. The target is never missing, even while it is replaced.
+	StrategySymlink Strategy = "symlink"
+)
+
+// Staging defines where a release is extracted
+type Staging string
+
+const (
+	// StagingTmpfs extracts the release in memory, in /dev/shm
+	StagingTmpfs Staging = "tmpfs"
+	// StagingDisk extracts the release next to the target, on the same
+	// filesystem, so that it doesn't use memory and can be renamed.
+	StagingDisk Staging = "disk"
+)
+
+// Sandbox defines the restrictions applied to hook commands.
+type Sandbox struct {
+	// Enabled runs the hook commands with a minimal environment and a private
+	// home and temporary folder, removed once the command is done.
+	Enabled bool `json:"enabled"`
+	// AllowEnv lists the variables kept from Hodor's environment, in addition
+	// to PATH.
+	AllowEnv []string `json:"allow_env"`
+}
+
+// RunAs defines a user and group, by name or id.
+type RunAs struct {
+	User string `json:"user"`
+	// Group defaults to the user's primary group.
+	Group string `json:"group"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var target string
+
+	err := json.Unmarshal(data, &target)
+	if err == nil {
+		*e = Entry{Target: target}
+		return nil
+	}
+
+	// use an alias to not call UnmarshalJSON recursively
+	type entry Entry
+
+	err = json.Unmarshal(data, (*entry)(e))
+	if err != nil {
+		return fmt.Errorf("entry must be a string or an object: %v", err)
+	}
+
+	return nil
+}
+
+// Digest returns a hash of the entry's settings, so that two configurations
+// can be compared without disclosing secrets such as tokens.
+func (e Entry) Digest() string {
+	// an entry only contains types that can be marshalled
+	buf, _ := json.Marshal(e)
+	sum := sha256.Sum256(buf)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// contains returns true if the value is one of the values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check checks that the scan has an HTTP URL and a known severity
+func (s Scan) check() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", s.URL)
+	}
+
+	if s.Severity == "" {
+		return nil
+	}
+
+	for _, severity := range ScanSeverities {
+		if s.Severity == severity {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown severity %q", s.Severity)
+}
+
+// check checks that the address of clamd is a socket path or a host:port
+func (c ClamAV) check() error {
+	if filepath.IsAbs(c.Address) {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(c.Address)
+	if err != nil || port == "" {
+		return fmt.Errorf("invalid address %q", c.Address)
+	}
+
+	return nil
+}
+
+// CheckSHA256 checks that the checksum is a hex-encoded SHA-256
+func CheckSHA256(sum string) error {
+	buf, err := hex.DecodeString(sum)
+	if err != nil {
+		return fmt.Errorf("failed to decode: %v", err)
+	}
+
+	if len(buf) != sha256.Size {
+		return fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(buf))
+	}
+
+	return nil
+}
+
+// DBConfig defines the database settings. Zero values keep the database
+// defaults.
+type DBConfig struct {
+	// Backend is the engine of the database file, BackendBunt by default.
+	// The shrink and compaction settings only apply to buntdb.
+	Backend string `json:"backend"`
+	// AutoShrinkPercentage is the growth, in percent of the size after the
+	// last shrink, that triggers an automatic shrink of the database file.
+	AutoShrinkPercentage int `json:"auto_shrink_percentage"`
+	// AutoShrinkMinSize is the minimum size, in bytes, of the database file
+	// before an automatic shrink can occur.
+	AutoShrinkMinSize int `json:"auto_shrink_min_size"`
+	// AutoShrinkDisabled turns off the automatic background shrinking.
+	AutoShrinkDisabled bool `json:"auto_shrink_disabled"`
+	// CompactInterval is the interval at which the database is compacted,
+	// regardless of its size. Compaction is disabled if not set.
+	CompactInterval Duration `json:"compact_interval"`
+	// DirMode is the permission of the database folder, if it must be
+	// created.
+	DirMode Mode `json:"dir_mode"`
+}
+
+const (
+	// BackendBunt keeps the database in memory and appends the changes to
+	// its file, which must be shrunk from time to time
+	BackendBunt = "buntdb"
+	// BackendBolt keeps the database in a B+tree file mapped in memory
+	BackendBolt = "bbolt"
+)
+
+// Duration is a time.Duration that is decoded from a string such as "1h30m".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse duration: %v", err)
+	}
+
+	*d = Duration(duration)
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Size is a number of bytes that is decoded from a number, or from a string
+// such as "500MB", where units are powers of 1024.
+type Size int64
+
+// sizeUnits maps the size units to their number of bytes
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+
+	err := json.Unmarshal(data, &n)
+	if err == nil {
+		*s = Size(n)
+		return nil
+	}
+
+	var str string
+
+	err = json.Unmarshal(data, &str)
+	if err != nil {
+		return fmt.Errorf("size must be a number or a string: %v", err)
+	}
+
+	str = strings.ToUpper(strings.TrimSpace(str))
+
+	end := strings.IndexFunc(str, func(r rune) bool { return r < '0' || r > '9' })
+	if end == -1 {
+		end = len(str)
+	}
+
+	unit, found := sizeUnits[strings.TrimSpace(str[end:])]
+	if !found {
+		return fmt.Errorf("unknown unit in size %q", str)
+	}
+
+	n, err = strconv.ParseInt(str[:end], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse size: %v", err)
+	}
+
+	*s = Size(n * unit)
+
+	return nil
+}
+
+// Mode is a file permission that is decoded from an octal string such as
+// "0755".
+type Mode os.FileMode
+
+// UnmarshalJSON implements json.Unmarshaler
+func (m *Mode) UnmarshalJSON(data []byte) error {
+	var s string
+
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("mode must be a string: %v", err)
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("failed to parse mode: %v", err)
+	}
+
+	if mode > uint64(os.ModePerm) {
+		return fmt.Errorf("mode %q is not a permission", s)
+	}
+
+	*m = Mode(mode)
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (m Mode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%#o", uint32(m)))
+}
+
+// Or returns the mode, or def if the mode is not set.
+func (m Mode) Or(def os.FileMode) os.FileMode {
+	if m == 0 {
+		return def
+	}
+
+	return os.FileMode(m)
 }
 
 // LoadFromJSON updates the config from the filepath.
@@ -27,5 +983,320 @@ func (c *Config) LoadFromJSON(filepath string) error {
 		return fmt.Errorf("failed to decode file: %v", err)
 	}
 
+	err = c.checkChains()
+	if err != nil {
+		return fmt.Errorf("wrong chained releases: %v", err)
+	}
+
+	err = c.checkGroups()
+	if err != nil {
+		return fmt.Errorf("wrong group: %v", err)
+	}
+
+	err = c.CheckTargets(filepath)
+	if err != nil {
+		return fmt.Errorf("wrong target: %v", err)
+	}
+
+	if c.Auth.Private && c.Auth.Token == "" {
+		return fmt.Errorf("wrong auth: a private API requires a token")
+	}
+
+	if c.Limits.Nice < 0 || c.Limits.Nice > 19 {
+		return fmt.Errorf("wrong limits: nice %d is not between 0 and 19", c.Limits.Nice)
+	}
+
+	err = c.Retry.check()
+	if err != nil {
+		return fmt.Errorf("wrong retry: %v", err)
+	}
+
+	err = c.DurationAlert.check()
+	if err != nil {
+		return fmt.Errorf("wrong duration alert: %v", err)
+	}
+
+	if c.Workers < 0 {
+		return fmt.Errorf("wrong workers: %d is negative", c.Workers)
+	}
+
+	err = c.HTTP.check()
+	if err != nil {
+		return fmt.Errorf("wrong http: %v", err)
+	}
+
+	switch c.DB.Backend {
+	case "", BackendBunt:
+	case BackendBolt:
+		if c.DB.AutoShrinkPercentage != 0 || c.DB.AutoShrinkMinSize != 0 ||
+			c.DB.AutoShrinkDisabled || c.DB.CompactInterval != 0 {
+
+			return fmt.Errorf("wrong db: shrinking and compacting only apply to %q", BackendBunt)
+		}
+	default:
+		return fmt.Errorf("wrong db: unknown backend %q", c.DB.Backend)
+	}
+
+	for releaseID, entry := range c.Entries {
+		if entry.Repository != "" && entry.RegistryURL == "" {
+			return fmt.Errorf("wrong repository: %q has no registry_url", releaseID)
+		}
+
+		if entry.Keep < 0 {
+			return fmt.Errorf("wrong keep: %q keeps %d releases", releaseID, entry.Keep)
+		}
+
+		if entry.Keep > 0 && (entry.Strategy == StrategyCopy || entry.Strategy == StrategyUpdate) {
+			return fmt.Errorf("wrong keep: %q can't keep releases with the %q strategy",
+				releaseID, entry.Strategy)
+		}
+
+		err = CheckBadge(entry.Badge)
+		if err != nil {
+			return fmt.Errorf("wrong badge: %q: %v", releaseID, err)
+		}
+
+		if entry.Debug.RetainDays < 0 {
+			return fmt.Errorf("wrong debug: %q retains jobs for %d days", releaseID,
+				entry.Debug.RetainDays)
+		}
+
+		switch entry.Delta.Tool {
+		case "", "zstd", "bsdiff":
+		default:
+			return fmt.Errorf("wrong delta: %q has the unknown tool %q", releaseID,
+				entry.Delta.Tool)
+		}
+
+		if entry.SHA256 != "" {
+			err = CheckSHA256(entry.SHA256)
+			if err != nil {
+				return fmt.Errorf("wrong sha256: %q: %v", releaseID, err)
+			}
+		}
+
+		if entry.Limits != nil && (entry.Limits.Nice < 0 || entry.Limits.Nice > 19) {
+			return fmt.Errorf("wrong limits: %q has the nice %d, not between 0 and 19",
+				releaseID, entry.Limits.Nice)
+		}
+
+		// without another account, the hooks can read Hodor's files, such as
+		// its configuration and database
+		if entry.Sandbox.Enabled && entry.RunAs.User == "" {
+			return fmt.Errorf("wrong sandbox: %q has no run_as user", releaseID)
+		}
+
+		if entry.Retry != nil {
+			err = entry.Retry.check()
+			if err != nil {
+				return fmt.Errorf("wrong retry: %q: %v", releaseID, err)
+			}
+		}
+
+		for _, host := range entry.HTTPMirrors {
+			if host == "" || strings.ContainsAny(host, "/ ") {
+				return fmt.Errorf("wrong http mirrors: %q has the invalid host %q", releaseID, host)
+			}
+		}
+
+		for _, forward := range entry.Forward {
+			u, err := url.Parse(forward.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("wrong forward: %q has the invalid URL %q", releaseID, forward.URL)
+			}
+		}
+
+		if entry.Scan.URL != "" {
+			err = entry.Scan.check()
+			if err != nil {
+				return fmt.Errorf("wrong scan: %q: %v", releaseID, err)
+			}
+		}
+
+		if entry.ClamAV.Address != "" {
+			err = entry.ClamAV.check()
+			if err != nil {
+				return fmt.Errorf("wrong clamav: %q: %v", releaseID, err)
+			}
+		}
+
+		err = checkStates(entry.States)
+		if err != nil {
+			return fmt.Errorf("wrong states: %q: %v", releaseID, err)
+		}
+
+		if entry.Promote != "" {
+			promoted, found := c.Entries[entry.Promote]
+
+			switch {
+			case !found:
+				return fmt.Errorf("wrong promote: %q promotes to the unknown release %q",
+					releaseID, entry.Promote)
+			case entry.Promote == releaseID:
+				return fmt.Errorf("wrong promote: %q promotes to itself", releaseID)
+			case len(entry.Group) != 0 || len(promoted.Group) != 0:
+				return fmt.Errorf("wrong promote: %q can't promote a group", releaseID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckTargets checks that the targets of the entries are not dangerous
+// locations: the root, a top-level folder such as "/var", a home folder, a
+// folder that contains one of the protected files, such as the configuration
+// or the database, or a folder that overlaps the target of another entry,
+// including its subpath. Entries with UnsafeTarget are not checked.
+func (c *Config) CheckTargets(protected ...string) error {
+	releaseIDs := make([]string, 0, len(c.Entries))
+	targets := make(map[string]string, len(c.Entries))
+
+	for releaseID, entry := range c.Entries {
+		if entry.Target == "" || entry.UnsafeTarget {
+			continue
+		}
+
+		target, err := filepath.Abs(filepath.Join(entry.Target, entry.Subpath))
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of %q: %v", releaseID, err)
+		}
+
+		releaseIDs = append(releaseIDs, releaseID)
+		targets[releaseID] = target
+	}
+
+	// sorted to always report the same error
+	sort.Strings(releaseIDs)
+
+	home, _ := os.UserHomeDir()
+
+	for i, releaseID := range releaseIDs {
+		target := targets[releaseID]
+		parent := filepath.Dir(target)
+
+		switch {
+		case parent == target:
+			return fmt.Errorf("%q is the root", releaseID)
+		case filepath.Dir(parent) == parent:
+			return fmt.Errorf("%q is the top-level folder %q", releaseID, target)
+		case home != "" && target == filepath.Clean(home),
+			parent == "/home", parent == "/Users":
+			return fmt.Errorf("%q is the home folder %q", releaseID, target)
+		}
+
+		for _, path := range protected {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("failed to get absolute path of %q: %v", path, err)
+			}
+
+			if Contains(target, abs) {
+				return fmt.Errorf("%q contains %q", releaseID, path)
+			}
+		}
+
+		for _, other := range releaseIDs[i+1:] {
+			if Contains(target, targets[other]) || Contains(targets[other], target) {
+				return fmt.Errorf("%q overlaps the target of %q", releaseID, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Contains returns true if path is the folder or is inside it. Both must be
+// absolute.
+func Contains(folder, path string) bool {
+	rel, err := filepath.Rel(folder, path)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// checkGroups checks that the members of the groups exist and are not groups
+func (c *Config) checkGroups() error {
+	for releaseID, entry := range c.Entries {
+		for _, member := range entry.Group {
+			memberEntry, found := c.Entries[member]
+			if !found {
+				return fmt.Errorf("%q has the unknown member %q", releaseID, member)
+			}
+
+			if len(memberEntry.Group) != 0 {
+				return fmt.Errorf("%q has the group %q as member", releaseID, member)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkChains checks that the releases of the entries' After exist and that
+// they don't trigger each other in a cycle.
+func (c *Config) checkChains() error {
+	releaseIDs := make([]string, 0, len(c.Entries))
+
+	for releaseID, entry := range c.Entries {
+		releaseIDs = append(releaseIDs, releaseID)
+
+		for _, after := range entry.After {
+			_, found := c.Entries[after]
+			if !found {
+				return fmt.Errorf("%q is after the unknown release %q", releaseID, after)
+			}
+		}
+
+		if len(entry.After) != 0 && entry.ChainURL == "" {
+			return fmt.Errorf("%q has no chain_url", releaseID)
+		}
+	}
+
+	// sorted to always report the same cycle
+	sort.Strings(releaseIDs)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	states := make(map[string]int)
+
+	var visit func(releaseID string, path []string) error
+
+	visit = func(releaseID string, path []string) error {
+		path = append(path, releaseID)
+
+		switch states[releaseID] {
+		case visiting:
+			return fmt.Errorf("cycle %s", strings.Join(path, " → "))
+		case visited:
+			return nil
+		}
+
+		states[releaseID] = visiting
+
+		for _, after := range c.Entries[releaseID].After {
+			err := visit(after, path)
+			if err != nil {
+				return err
+			}
+		}
+
+		states[releaseID] = visited
+
+		return nil
+	}
+
+	for _, releaseID := range releaseIDs {
+		err := visit(releaseID, nil)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
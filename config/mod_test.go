@@ -0,0 +1,657 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFromJSON_Pass(t *testing.T) {
+	path := writeConfig(t, `{
+		"entries": {
+			"XX": "/var/xx",
+			"YY": {
+				"target": "/var/yy",
+				"env": {"APP_ENV": "prod"},
+				"post_deploy": ["echo ok"]
+			}
+		},
+		"db": {"compact_interval": "1h"}
+	}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+
+	require.Equal(t, Entry{Target: "/var/xx"}, conf.Entries["XX"])
+	require.Equal(t, Entry{
+		Target:     "/var/yy",
+		Env:        map[string]string{"APP_ENV": "prod"},
+		PostDeploy: []string{"echo ok"},
+	}, conf.Entries["YY"])
+	require.Equal(t, Duration(time.Hour), conf.DB.CompactInterval)
+}
+
+func TestLoadFromJSON_No_File(t *testing.T) {
+	var conf Config
+
+	err := conf.LoadFromJSON(filepath.Join(t.TempDir(), "none.json"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to open file")
+}
+
+func TestLoadFromJSON_Wrong_Entry(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": 1}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "entry must be a string or an object")
+}
+
+func TestLoadFromJSON_Wrong_Duration(t *testing.T) {
+	path := writeConfig(t, `{"db": {"compact_interval": "XX"}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse duration")
+}
+
+func TestLoadFromJSON_Modes(t *testing.T) {
+	path := writeConfig(t, `{
+		"dir_mode": "0750",
+		"entries": {"XX": {"target": "/var/xx", "file_mode": "0640"}},
+		"db": {"dir_mode": "700"}
+	}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+
+	require.Equal(t, os.FileMode(0750), conf.DirMode.Or(0755))
+	require.Equal(t, os.FileMode(0644), conf.FileMode.Or(0644))
+	require.Equal(t, os.FileMode(0640), conf.Entries["XX"].FileMode.Or(0644))
+	require.Equal(t, os.FileMode(0700), conf.DB.DirMode.Or(0744))
+}
+
+func TestLoadFromJSON_Wrong_Mode(t *testing.T) {
+	path := writeConfig(t, `{"dir_mode": "0799"}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse mode")
+
+	path = writeConfig(t, `{"dir_mode": "7777"}`)
+
+	err = conf.LoadFromJSON(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mode \"7777\" is not a permission")
+}
+
+func TestLoadFromJSON_Chains(t *testing.T) {
+	path := writeConfig(t, `{"entries": {
+		"app": "/var/app",
+		"docs": {"target": "/var/docs", "after": ["app"], "chain_url": "http://xx/{tag}"}
+	}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, conf.Entries["docs"].After)
+}
+
+func TestLoadFromJSON_Wrong_Chains(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"after": ["YY"], "chain_url": "http://xx"}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong chained releases: \"XX\" is after the unknown release \"YY\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {}, "YY": {"after": ["XX"]}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong chained releases: \"YY\" has no chain_url")
+
+	path = writeConfig(t, `{"entries": {
+		"AA": {"after": ["CC"], "chain_url": "http://xx"},
+		"BB": {"after": ["AA"], "chain_url": "http://xx"},
+		"CC": {"after": ["BB"], "chain_url": "http://xx"}
+	}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong chained releases: cycle AA → CC → BB → AA")
+}
+
+func TestLoadFromJSON_Wrong_Group(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"group": ["YY"]}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong group: \"XX\" has the unknown member \"YY\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {"group": ["YY"]}, "YY": {"group": ["ZZ"]}, "ZZ": "/var/zz"}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong group: \"XX\" has the group \"YY\" as member")
+}
+
+func TestLoadFromJSON_Wrong_Repository(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "repository": "org/xx"}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong repository: \"XX\" has no registry_url")
+}
+
+func TestLoadFromJSON_Wrong_Delta(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "delta": {"tool": "xdelta"}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong delta: \"XX\" has the unknown tool \"xdelta\"")
+}
+
+func TestLoadFromJSON_Wrong_Keep(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "keep": -1}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong keep: \"XX\" keeps -1 releases")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "keep": 2, "strategy": "copy"}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong keep: \"XX\" can't keep releases with the \"copy\" strategy")
+}
+
+func TestLoadFromJSON_Debug(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "debug": {"retain_days": 3}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, Debug{RetainDays: 3}, conf.Entries["XX"].Debug)
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "debug": {"retain_days": -1}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong debug: \"XX\" retains jobs for -1 days")
+}
+
+func TestLoadFromJSON_Badge(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", `+
+		`"badge": {"label": "prod", "color": "#4c1", "style": "flat-square"}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, Badge{Label: "prod", Color: "#4c1", Style: "flat-square"}, conf.Entries["XX"].Badge)
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/var/xx", "badge": {"color": "pink"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong badge: \"XX\": unknown color \"pink\"")
+}
+
+func TestCheckBadge(t *testing.T) {
+	require.NoError(t, CheckBadge(Badge{}))
+	require.NoError(t, CheckBadge(Badge{Color: "green"}))
+	require.NoError(t, CheckBadge(Badge{Color: "fa0"}))
+
+	err := CheckBadge(Badge{Color: "#12345"})
+	require.EqualError(t, err, "unknown color \"#12345\"")
+
+	err = CheckBadge(Badge{Style: "plastic"})
+	require.EqualError(t, err, "unknown style \"plastic\"")
+
+	err = CheckBadge(Badge{Label: strings.Repeat("a", 65)})
+	require.EqualError(t, err, "label is longer than 64 characters")
+}
+
+func TestLoadFromJSON_Wrong_Auth(t *testing.T) {
+	path := writeConfig(t, `{"auth": {"private": true}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong auth: a private API requires a token")
+}
+
+func TestLoadFromJSON_HTTP(t *testing.T) {
+	path := writeConfig(t, `{"http": {"middlewares": {"cors": false, "rate_limit": true}, `+
+		`"rate_limit": {"requests": 2}}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.False(t, conf.HTTP.Enabled("cors"))
+	require.True(t, conf.HTTP.Enabled("rate_limit"))
+	require.True(t, conf.HTTP.Enabled("tracing"))
+	require.False(t, conf.HTTP.Enabled("compression"))
+	require.Equal(t, RateLimit{Requests: 2}, conf.HTTP.RateLimit)
+
+	path = writeConfig(t, `{"http": {"middlewares": {"auth": false}}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong http: unknown middleware \"auth\"")
+
+	path = writeConfig(t, `{"http": {"rate_limit": {"burst": -1}}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong http: negative rate limit")
+}
+
+func TestLoadFromJSON_Wrong_Limits(t *testing.T) {
+	path := writeConfig(t, `{"limits": {"nice": 20}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong limits: nice 20 is not between 0 and 19")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", "limits": {"nice": -1}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong limits: \"XX\" has the nice -1, not between 0 and 19")
+
+	path = writeConfig(t, `{"limits": {"nice": 10}, "entries": {"XX": {"target": "/tmp/xx", `+
+		`"limits": {"io_idle": true}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, Limits{Nice: 10}, conf.Limits)
+	require.Equal(t, &Limits{IOIdle: true}, conf.Entries["XX"].Limits)
+}
+
+func TestLoadFromJSON_Wrong_Workers(t *testing.T) {
+	path := writeConfig(t, `{"workers": -1, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong workers: -1 is negative")
+}
+
+func TestLoadFromJSON_Wrong_Backend(t *testing.T) {
+	path := writeConfig(t, `{"db": {"backend": "sqlite"}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong db: unknown backend \"sqlite\"")
+
+	path = writeConfig(t, `{"db": {"backend": "bbolt", "compact_interval": "1h"}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong db: shrinking and compacting only apply to \"buntdb\"")
+
+	path = writeConfig(t, `{"db": {"backend": "bbolt"}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, BackendBolt, conf.DB.Backend)
+}
+
+func TestLoadFromJSON_Wrong_Scan(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"scan": {"url": "scanner:8080"}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong scan: \"XX\": invalid URL \"scanner:8080\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"scan": {"url": "http://scanner:8080/scan", "severity": "severe"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong scan: \"XX\": unknown severity \"severe\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"scan": {"url": "http://scanner:8080/scan", "severity": "medium", "timeout": "1m"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, Scan{URL: "http://scanner:8080/scan", Severity: "medium",
+		Timeout: Duration(time.Minute)}, conf.Entries["XX"].Scan)
+}
+
+func TestLoadFromJSON_Sandbox_Without_RunAs(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"sandbox": {"enabled": true}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong sandbox: \"XX\" has no run_as user")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"sandbox": {"enabled": true}, "run_as": {"user": "www"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.True(t, conf.Entries["XX"].Sandbox.Enabled)
+}
+
+func TestLoadFromJSON_Wrong_ClamAV(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"clamav": {"address": "clamd.ctl"}}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong clamav: \"XX\": invalid address \"clamd.ctl\"")
+
+	for _, address := range []string{"/run/clamav/clamd.ctl", "localhost:3310"} {
+		path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+			`"clamav": {"address": "`+address+`", "timeout": "30s"}}}}`)
+
+		conf = Config{}
+		err = conf.LoadFromJSON(path)
+		require.NoError(t, err)
+		require.Equal(t, ClamAV{Address: address, Timeout: Duration(30 * time.Second)},
+			conf.Entries["XX"].ClamAV)
+	}
+}
+
+func TestLoadFromJSON_Wrong_States(t *testing.T) {
+	tests := map[string]string{
+		`["Canary"]`:           "invalid state \"Canary\"",
+		`[""]`:                 "invalid state \"\"",
+		`["running"]`:          "reserved state \"running\"",
+		`["canary", "canary"]`: "duplicate state \"canary\"",
+	}
+
+	for states, expected := range tests {
+		path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", "states": `+states+`}}}`)
+
+		var conf Config
+
+		err := conf.LoadFromJSON(path)
+		require.EqualError(t, err, "wrong states: \"XX\": "+expected, states)
+	}
+
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"states": ["awaiting_approval", "canary"]}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"awaiting_approval", "canary"}, conf.Entries["XX"].States)
+}
+
+func TestLoadFromJSON_Wrong_Retry(t *testing.T) {
+	path := writeConfig(t, `{"retry": {"attempts": -1}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong retry: attempts -1 is negative")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"retry": {"attempts": 3, "backoff": "-1s"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong retry: \"XX\": negative backoff")
+
+	path = writeConfig(t, `{"retry": {"attempts": 2}, "entries": {"XX": {"target": "/tmp/xx", `+
+		`"retry": {"attempts": 4, "backoff": "2s", "max_backoff": "1m"}}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, Retry{Attempts: 2}, conf.Retry)
+	require.Equal(t, &Retry{Attempts: 4, Backoff: Duration(2 * time.Second),
+		MaxBackoff: Duration(time.Minute)}, conf.Entries["XX"].Retry)
+}
+
+func TestLoadFromJSON_Duration_Alert(t *testing.T) {
+	path := writeConfig(t, `{"duration_alert": {"factor": 0.5}, "entries": {}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong duration alert: factor 0.5 is lower than 1")
+
+	path = writeConfig(t, `{"duration_alert": {"url": "http://alerts"}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong duration alert: url requires a factor")
+
+	path = writeConfig(t, `{"duration_alert": {"factor": 2, "min_samples": 10, `+
+		`"url": "http://alerts"}, "entries": {}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, DurationAlert{Factor: 2, MinSamples: 10, URL: "http://alerts"},
+		conf.DurationAlert)
+}
+
+func TestLoadFromJSON_HTTP_Mirrors(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"http_mirrors": ["http://mirror.lan"]}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong http mirrors: \"XX\" has the invalid host \"http://mirror.lan\"")
+
+	path = writeConfig(t, `{"allow_http": true, "entries": {"XX": {"target": "/tmp/xx", `+
+		`"http_mirrors": ["mirror.lan", "cache.lan:8080"]}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.True(t, conf.AllowHTTP)
+	require.Equal(t, []string{"mirror.lan", "cache.lan:8080"}, conf.Entries["XX"].HTTPMirrors)
+}
+
+func TestLoadFromJSON_Wrong_Forward(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"forward": [{"url": "prod.example.com/api/hook/xx"}]}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong forward: \"XX\" has the invalid URL \"prod.example.com/api/hook/xx\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", `+
+		`"forward": [{"url": "https://prod.example.com/api/hook/xx", "secret": "s"}]}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, []Forward{{URL: "https://prod.example.com/api/hook/xx", Secret: "s"}},
+		conf.Entries["XX"].Forward)
+}
+
+func TestLoadFromJSON_Wrong_Promote(t *testing.T) {
+	table := map[string]string{
+		`{"XX": {"target": "/tmp/xx", "promote": "YY"}}`: "wrong promote: \"XX\" promotes " +
+			"to the unknown release \"YY\"",
+		`{"XX": {"target": "/tmp/xx", "promote": "XX"}}`: "wrong promote: \"XX\" promotes " +
+			"to itself",
+		`{"XX": {"target": "/tmp/xx", "promote": "YY"}, "YY": {"group": ["XX"]}}`: "wrong " +
+			"promote: \"XX\" can't promote a group",
+	}
+
+	for entries, expected := range table {
+		path := writeConfig(t, `{"entries": `+entries+`}`)
+
+		var conf Config
+
+		err := conf.LoadFromJSON(path)
+		require.EqualError(t, err, expected)
+	}
+
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", "promote": "YY"}, `+
+		`"YY": "/tmp/yy"}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.NoError(t, err)
+	require.Equal(t, "YY", conf.Entries["XX"].Promote)
+}
+
+func TestLoadFromJSON_Wrong_Target(t *testing.T) {
+	path := writeConfig(t, `{"entries": {"XX": "/var"}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong target: \"XX\" is the top-level folder \"/var\"")
+
+	path = writeConfig(t, `{"entries": {"XX": {"target": "/var", "unsafe_target": true}}}`)
+
+	conf = Config{}
+	err = conf.LoadFromJSON(path)
+	require.NoError(t, err)
+}
+
+func TestCheckSHA256(t *testing.T) {
+	require.NoError(t, CheckSHA256(strings.Repeat("aB", 32)))
+	require.EqualError(t, CheckSHA256("abcd"), "expected 32 bytes, got 2")
+	require.EqualError(t, CheckSHA256("xx"), "failed to decode: encoding/hex: "+
+		"invalid byte: U+0078 'x'")
+
+	path := writeConfig(t, `{"entries": {"XX": {"target": "/tmp/xx", "sha256": "abcd"}}}`)
+
+	var conf Config
+
+	err := conf.LoadFromJSON(path)
+	require.EqualError(t, err, "wrong sha256: \"XX\": expected 32 bytes, got 2")
+}
+
+func TestCheckTargets(t *testing.T) {
+	check := func(protected string, entries map[string]Entry) error {
+		conf := Config{Entries: entries}
+		return conf.CheckTargets(protected)
+	}
+
+	err := check("", map[string]Entry{"XX": {Target: "/"}})
+	require.EqualError(t, err, "\"XX\" is the root")
+
+	err = check("", map[string]Entry{"XX": {Target: "/home/hodor/"}})
+	require.EqualError(t, err, "\"XX\" is the home folder \"/home/hodor\"")
+
+	err = check("/srv/hodor/hodor.db", map[string]Entry{"XX": {Target: "/srv/hodor"}})
+	require.EqualError(t, err, "\"XX\" contains \"/srv/hodor/hodor.db\"")
+
+	err = check("", map[string]Entry{
+		"XX": {Target: "/var/www"},
+		"YY": {Target: "/var/www/site"},
+	})
+	require.EqualError(t, err, "\"XX\" overlaps the target of \"YY\"")
+
+	err = check("", map[string]Entry{
+		"XX": {Target: "/var/www/site", Subpath: "app"},
+		"YY": {Target: "/var/www/site", Subpath: "assets"},
+		"ZZ": {Target: "/var/www/site-docs"},
+		"WW": {Group: []string{"XX", "YY"}},
+	})
+	require.NoError(t, err)
+
+	err = check("", map[string]Entry{
+		"XX": {Target: "/var/www"},
+		"YY": {Target: "/var/www/site", UnsafeTarget: true},
+	})
+	require.NoError(t, err)
+}
+
+func TestSize_Unmarshal(t *testing.T) {
+	var sizes []Size
+
+	err := json.Unmarshal([]byte(`[1024, "12", "2KB", "3 mb", "1GB"]`), &sizes)
+	require.NoError(t, err)
+	require.Equal(t, []Size{1024, 12, 2048, 3 << 20, 1 << 30}, sizes)
+
+	var size Size
+
+	err = json.Unmarshal([]byte(`"1PB"`), &size)
+	require.EqualError(t, err, "unknown unit in size \"1PB\"")
+
+	err = json.Unmarshal([]byte(`"MB"`), &size)
+	require.EqualError(t, err, "failed to parse size: strconv.ParseInt: parsing \"\": invalid syntax")
+
+	err = json.Unmarshal([]byte(`true`), &size)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "size must be a number or a string")
+}
+
+func TestMode_Marshal(t *testing.T) {
+	buf, err := Mode(0755).MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, `"0755"`, string(buf))
+}
+
+func TestDuration_Marshal(t *testing.T) {
+	buf, err := Duration(time.Minute).MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, `"1m0s"`, string(buf))
+}
+
+func TestEntry_Digest(t *testing.T) {
+	entry := Entry{Target: "/srv/app", Env: map[string]string{"A": "1", "B": "2"}}
+
+	require.Equal(t, entry.Digest(), Entry{
+		Target: "/srv/app",
+		Env:    map[string]string{"B": "2", "A": "1"},
+	}.Digest())
+
+	entry.Token = "secret"
+	require.NotEqual(t, entry.Digest(), Entry{Target: "/srv/app"}.Digest())
+	require.NotContains(t, entry.Digest(), "secret")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	require.NoError(t, err)
+
+	return path
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package deployer
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/nkcr/hodor/config"
+	"golang.org/x/sys/unix"
+)
+
+// the constants of ioprio_set(2), which has no wrapper
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// withLimits runs fn with its priority lowered by the limits. On Linux, the
+// priorities belong to a thread: fn runs on a thread of its own, which exits
+// with it instead of going back to the other goroutines.
+func withLimits(limits config.Limits, fn func() error) error {
+	if limits.Nice == 0 && !limits.IOIdle {
+		return fn()
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		// the thread is never unlocked, so that it exits with the goroutine
+		runtime.LockOSThread()
+
+		tid := unix.Gettid()
+
+		if limits.Nice != 0 {
+			err := unix.Setpriority(unix.PRIO_PROCESS, tid, limits.Nice)
+			if err != nil {
+				errs <- fmt.Errorf("failed to set nice: %v", err)
+				return
+			}
+		}
+
+		if limits.IOIdle {
+			_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess,
+				uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+			if errno != 0 {
+				errs <- fmt.Errorf("failed to set I/O priority: %v", errno)
+				return
+			}
+		}
+
+		errs <- fn()
+	}()
+
+	return <-errs
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package deployer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestWithLimits(t *testing.T) {
+	var nice int
+	var ioprio uintptr
+
+	err := withLimits(config.Limits{Nice: 10, IOIdle: true}, func() error {
+		tid := unix.Gettid()
+
+		// the syscall returns 20 - nice
+		prio, err := unix.Getpriority(unix.PRIO_PROCESS, tid)
+		require.NoError(t, err)
+
+		nice = 20 - prio
+
+		ioprio, _, _ = unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+
+		return errors.New("fake")
+	})
+
+	require.EqualError(t, err, "fake")
+	require.Equal(t, 10, nice)
+	require.Equal(t, uintptr(ioprioClassIdle), ioprio>>ioprioClassShift)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package deployer
+
+import "github.com/nkcr/hodor/config"
+
+// withLimits is not supported on this platform: fn runs without limits
+func withLimits(limits config.Limits, fn func() error) error {
+	return fn()
+}
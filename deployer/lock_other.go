@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package deployer
+
+import "os"
+
+// flock is not supported on this platform: the lock file is only informative
+func flock(f *os.File) error {
+	return nil
+}
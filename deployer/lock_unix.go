@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package deployer
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// flock takes an exclusive advisory lock on the file without waiting. It
+// returns errLocked if the file is locked by another process.
+func flock(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return errLocked
+	}
+
+	return err
+}
@@ -2,35 +2,80 @@ package deployer
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/nkcr/hodor/asset"
+	"github.com/nkcr/hodor/clamav"
 	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/hook"
+	"github.com/nkcr/hodor/logs"
+	"github.com/nkcr/hodor/scan"
+	"github.com/nkcr/hodor/store"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
-	"github.com/tidwall/buntdb"
 )
 
 // defaultSerde is the default serialization/de-serialization mechanism used
 var defaultSerde = JSONSerde{}
 
-// jobSize is the channel size used to store jobs
-const jobSize = 50
+// QueueSize is the number of jobs that can wait to be handled. New jobs are
+// rejected once the queue is full.
+const QueueSize = 50
 
-// HTTPClient defines the function we expect from an HTTP client
+// defaultDirMode is the permission of the created folders if not configured
+const defaultDirMode os.FileMode = 0755
+
+// defaultFileMode is the permission of the created files if not configured
+const defaultFileMode os.FileMode = 0755
+
+// notesFile is the release notes file read from a release if its entry
+// captures release notes and the request doesn't provide notes
+const notesFile = "NOTES.md"
+
+// maxNotesSize is the maximum size of the saved release notes
+const maxNotesSize = 64 * 1024
+
+// defaultRateLimitMaxWait is the maximum time a download waits for a rate
+// limit to reset if not configured.
+const defaultRateLimitMaxWait = 5 * time.Minute
+
+// HTTPClient defines the function we expect from an HTTP client. Requests are
+// built by the deployer, so that they can carry authentication headers.
 type HTTPClient interface {
-	Get(url string) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
+// githubTokenEnv is the environment variable of the GitHub token if it is not
+// configured
+const githubTokenEnv = "GITHUB_TOKEN"
+
+// githubHosts are the hosts that receive the GitHub token, in addition to the
+// configured ones
+var githubHosts = []string{"github.com", "api.github.com"}
+
 // Serde ddefines the primitives to marshal/unmarshal an element
 type Serde interface {
 	Marshal(v any) ([]byte, error)
@@ -57,49 +102,600 @@ func (JSONSerde) Unmarshal(data []byte, v any) error {
 type JobStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// RequestID is the ID of the API request that created the job, if any
+	RequestID string `json:"requestID,omitempty"`
+	// Chained lists the jobs of the releases triggered once this job
+	// succeeded.
+	Chained []string `json:"chained,omitempty"`
+	// Combined is set if the job triggered other jobs. It is "failed" if the
+	// job or one of the triggered jobs, recursively, failed, "ok" if all are
+	// ok, and "running" otherwise.
+	Combined string `json:"combined,omitempty"`
+	// Group lists the jobs of the members, if the job deploys a group
+	Group     []string `json:"group,omitempty"`
+	ReleaseID string   `json:"releaseID,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	// CreatedAt is when the job was queued. It is not set on the statuses
+	// saved before it was recorded.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// StartedAt is set once the job is running
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	// FinishedAt is set once the job is ok or failed
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Duration is the time taken by the job, from its start, once it finished
+	Duration time.Duration `json:"duration,omitempty"`
+	// Hooks contains the output of the hook commands, as they run
+	Hooks []HookOutput `json:"hooks,omitempty"`
+	// Promoted is the release whose archive is deployed, if the job is a
+	// promotion
+	Promoted string `json:"promoted,omitempty"`
+	// Progress is set once the job downloads its archive, and updated at most
+	// every progressInterval
+	Progress *Progress `json:"progress,omitempty"`
+	// Scan is the result of the vulnerability scan of the release, if the
+	// entry has one
+	Scan *ScanResult `json:"scan,omitempty"`
+	// RetainedUntil is set if the archive and the log of the failed job are
+	// retained for debugging, until then. See Deployer.GetRetained.
+	RetainedUntil *time.Time `json:"retainedUntil,omitempty"`
+}
+
+// ScanResult is the result of the vulnerability scan of a release
+type ScanResult struct {
+	// Target is "sbom" if the SBOM of the release was scanned, or "archive"
+	Target string `json:"target"`
+	// Severity is the lowest severity that blocks the deployment
+	Severity string `json:"severity"`
+	// Counts is the number of findings per severity
+	Counts map[string]int `json:"counts"`
+	// Blocking lists the findings at or above Severity, truncated to
+	// maxScanFindings
+	Blocking []scan.Finding `json:"blocking,omitempty"`
+	// Passed is true if there is no blocking finding
+	Passed bool `json:"passed"`
+}
+
+// maxScanFindings is the maximum number of blocking findings saved in the
+// job's status
+const maxScanFindings = 20
+
+// Progress describes how far a job is in the download and the extraction of
+// its archive
+type Progress struct {
+	// Phase is "download" while the archive is downloaded, or "extract" once
+	// it is extracted from a file, such as a cached or verified archive. An
+	// archive that is extracted as it is downloaded stays in "download".
+	Phase string `json:"phase"`
+	// Bytes is the number of bytes of the archive read during the phase
+	Bytes int64 `json:"bytes"`
+	// Size is the size of the archive, such as from the Content-Length of
+	// the download, or 0 if it is unknown
+	Size int64 `json:"size,omitempty"`
+	// Percent is the percentage of Size read, or -1 if the size is unknown
+	Percent int `json:"percent"`
+	// Files is the number of extracted files
+	Files int `json:"files"`
+}
+
+// progressInterval is the minimum time between two saves of the progress of a
+// job
+const progressInterval = time.Second
+
+// HookOutput is the output of a hook command of a job
+type HookOutput struct {
+	// Phase is "pre_deploy" or "post_deploy"
+	Phase   string `json:"phase"`
+	Command string `json:"command"`
+	// Output is the combined stdout and stderr, truncated to its last
+	// maxHookOutput bytes
+	Output string `json:"output"`
+	// Error is set if the command failed, such as with a non-zero exit code
+	Error string `json:"error,omitempty"`
+}
+
+// maxHookOutput is the maximum size of the output of a hook command saved in
+// the job's status
+const maxHookOutput = 4096
+
+// statusTransitions are the statuses a job can take from each built-in
+// status. A job without status can take any built-in status. A running job can
+// also take a custom status of its entry, and a job with a custom status can
+// take another one, "running" again, or a terminal status.
+var statusTransitions = map[string][]string{
+	"created":  {"created", "deferred", "running", "failed"},
+	"deferred": {"deferred", "created", "running", "failed"},
+	"running":  {"running", "created", "ok", "failed"},
+	"ok":       {},
+	"failed":   {},
+}
+
+// ErrTransition is returned if a job can't take a status from its current one
+var ErrTransition = errors.New("invalid status transition")
+
+// checkTransition returns ErrTransition if a job can't go from a status to
+// another, given the custom statuses of its entry
+func checkTransition(from, to string, custom []string) error {
+	_, builtinFrom := statusTransitions[from]
+	_, builtinTo := statusTransitions[to]
+
+	allowed := false
+
+	switch {
+	case from == "":
+		allowed = builtinTo
+	case builtinFrom:
+		allowed = contains(statusTransitions[from], to) || (from == "running" && contains(custom, to))
+	default:
+		allowed = to == "running" || IsTerminal(to) || contains(custom, to)
+	}
+
+	if !allowed {
+		return fmt.Errorf("%w from %q to %q", ErrTransition, from, to)
+	}
+
+	return nil
+}
+
+// IsTerminal returns true if the status is final: the job is done and its
+// status won't change.
+func IsTerminal(status string) bool {
+	return status == "ok" || status == "failed"
+}
+
+// JobEvent is published each time the status of a job changes
+type JobEvent struct {
+	JobID     string `json:"jobID"`
+	ReleaseID string `json:"releaseID"`
+	Tag       string `json:"tag"`
+	JobStatus
+	// CallbackURL is the URL given with the job's request, if any. It is not
+	// part of the status, as it may contain a secret.
+	CallbackURL string `json:"-"`
+	// ReleaseURL is the URL of the deployed release, empty for rollbacks. It
+	// is not part of the status, as it may contain a secret.
+	ReleaseURL string `json:"-"`
+	// Subpath is the subpath of the job's request, if any
+	Subpath string `json:"-"`
+}
+
+// Request defines a release to deploy
+type Request struct {
+	ReleaseID string
+	// Tag defaults to "unknown"
+	Tag string
+	// RequestID is the ID of the API request, if any. It is saved with the job
+	// and logged to correlate it with the request.
+	RequestID  string
+	ReleaseURL *url.URL
+	// FallbackURLs are tried in order if the release can't be downloaded from
+	// ReleaseURL.
+	FallbackURLs []*url.URL
+	// Notes are the release notes, such as the body of the GitHub release.
+	// They are saved in the history if the entry captures release notes.
+	Notes string
+	// Assets are the assets of the release. The asset of each member of a
+	// group is selected among them.
+	Assets []asset.Asset
+	// Subpath is the folder of the target replaced by the release, such as
+	// "assets". It overrides the entry's subpath.
+	Subpath string
+	// CallbackURL receives the final status of the job, if set
+	CallbackURL *url.URL
+	// SHA256 is the hex-encoded SHA-256 of the archive, if set. The archive
+	// is verified against it before its extraction.
+	SHA256 string
+	// Sender identifies who sent the request, for the provenance of the
+	// deployment
+	Sender Sender
+}
+
+// HistoryEntry represents a successful deployment of a release
+type HistoryEntry struct {
+	JobID     string `json:"jobID"`
+	ReleaseID string `json:"releaseID"`
+	Tag       string `json:"tag"`
+	// PreviousTag is the tag deployed before, or the initial tag
+	PreviousTag string    `json:"previousTag"`
+	RequestID   string    `json:"requestID,omitempty"`
+	DeployedAt  time.Time `json:"deployedAt"`
+	// Duration is the time taken by the job, from its start
+	Duration time.Duration `json:"duration"`
+	// Changes counts the files changed in the target
+	Changes Changes `json:"changes"`
+	Notes   string  `json:"notes,omitempty"`
+	// Provenance records where the deployed archive comes from. It is not
+	// set for rollbacks.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// SBOM describes the SBOM found in the deployed release, if any. Its
+	// content is available with GetSBOM.
+	SBOM *SBOM `json:"sbom,omitempty"`
+}
+
+// SBOM describes the software bill of materials found at the root of a
+// release
+type SBOM struct {
+	// File is the name of the SBOM file in the release
+	File string `json:"file"`
+	// Format is "spdx" or "cyclonedx"
+	Format    string `json:"format"`
+	MediaType string `json:"mediaType"`
+	// SHA256 is the hex-encoded SHA-256 of the content
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Provenance records the origin of a deployed archive, for supply-chain audits
+type Provenance struct {
+	// SourceURL is the URL the archive was downloaded from, after the
+	// redirects. It can be a fallback URL, or the URL of the diff of a delta
+	// update.
+	SourceURL string `json:"sourceURL,omitempty"`
+	// RemoteIP is the address of the server the archive was downloaded from,
+	// if known
+	RemoteIP string `json:"remoteIP,omitempty"`
+	// SHA256 is the hex-encoded SHA-256 of the deployed archive
+	SHA256 string `json:"sha256"`
+	// Checksum is "verified" if the archive matched the checksums of the
+	// request and the entry, or "none" if there was no checksum to verify
+	Checksum string `json:"checksum"`
+	// DeltaBase is the tag of the cached archive the release was
+	// reconstructed from, if it was reconstructed from a diff
+	DeltaBase string `json:"deltaBase,omitempty"`
+	// Promoted is the release whose archive was deployed, for a promotion
+	Promoted string `json:"promoted,omitempty"`
+	// Sender identifies who requested the deployment
+	Sender Sender `json:"sender"`
+}
+
+// Sender identifies who sent the request of a deployment
+type Sender struct {
+	// Auth is how the request was authenticated: "signature" for a hook
+	// signed with the webhook secret, "token", or "none" if the release
+	// requires no token
+	Auth string `json:"auth,omitempty"`
+	// Addr is the remote address of the request
+	Addr      string `json:"addr,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	// Login is the account that triggered the hook, such as the sender of a
+	// GitHub event
+	Login string `json:"login,omitempty"`
+	// Delivery is the ID of the hook delivery, as set by GitHub
+	Delivery string `json:"delivery,omitempty"`
+}
+
+// JobSummary describes a job, as listed by ListJobs
+type JobSummary struct {
+	JobID     string    `json:"jobID"`
+	ReleaseID string    `json:"releaseID"`
+	Tag       string    `json:"tag"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"requestID,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Failure represents a failed job
+type Failure struct {
+	JobID     string    `json:"jobID"`
+	ReleaseID string    `json:"releaseID"`
+	Tag       string    `json:"tag"`
+	RequestID string    `json:"requestID,omitempty"`
+	FailedAt  time.Time `json:"failedAt"`
+	Message   string    `json:"message"`
+}
+
+// Changes counts the files changed by a deployment
+type Changes struct {
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+// Listing describes the content of a release archive
+type Listing struct {
+	Entries []ListingEntry `json:"entries"`
+	// Files is the number of regular files
+	Files int `json:"files"`
+	// TotalSize is the size of the regular files, in bytes
+	TotalSize int64 `json:"totalSize"`
+}
+
+// ListingEntry is an element of a release archive
+type ListingEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Type is "dir", "file", "symlink", or "other"
+	Type string `json:"type"`
 }
 
 // Deployer defines the primitive needed to deploy releases
 type Deployer interface {
-	// Start must be called only once to start the job processing
+	// Start must be called only once to start the job processing. Jobs
+	// deployed before are handled once it is called.
 	Start()
 	// Stop must be called only once and when start has been called
 	Stop()
 	// Deploy triggers a job to deploy a release. It returns a jobID that can be
 	// used to check the job's status.
-	Deploy(releaseID, tag string, releaseURL *url.URL) (string, error)
+	Deploy(req Request) (string, error)
 	// GetStatus returns the status of a job
 	GetStatus(jobID string) (JobStatus, error)
+	// QueueLength returns the number of jobs waiting to be handled
+	QueueLength() int
+	// Running returns true while the deployer handles jobs, that is once
+	// Start is called and until Stop is called.
+	Running() bool
 	// GetLatestTag returns the latest tag associated to the release. If not tag
 	// is found, returns 'unknown'.
 	GetLatestTag(releaseID string) (string, error)
+	// GetHistory returns the successful deployments of a release, from the
+	// most recent.
+	GetHistory(releaseID string) ([]HistoryEntry, error)
+	// GetFailures returns the failed jobs of a release, from the most recent.
+	GetFailures(releaseID string) ([]Failure, error)
+	// GetSBOM returns the SBOM of the release's last deployment and its
+	// content. It returns ErrNoSBOM if the deployed release has none.
+	GetSBOM(releaseID string) (SBOM, []byte, error)
+	// SelectAsset returns the download URL of the release's asset, selected
+	// among the assets with the release's rules. For a group, it checks that
+	// each member has an asset and returns nil.
+	SelectAsset(releaseID string, assets []asset.Asset) (*url.URL, error)
+	// CheckURL returns ErrInsecureURL if the download URL is plain HTTP and
+	// neither the configuration nor the release's HTTP mirrors allow it.
+	// releaseID can be empty.
+	CheckURL(releaseID string, u *url.URL) error
+	// List downloads a release and lists the content of its archive, without
+	// deploying it. The download is canceled with the context.
+	List(ctx context.Context, releaseURL *url.URL) (Listing, error)
+	// Subscribe returns a channel that receives the job events, and a function
+	// that must be called to unsubscribe. Events are dropped if the channel is
+	// not consumed fast enough.
+	Subscribe() (<-chan JobEvent, func())
+	// GetTargetsHealth returns the targets that didn't match their last
+	// deployment when the deployer started, by releaseID. A target is removed
+	// once it is deployed again.
+	GetTargetsHealth() map[string]TargetHealth
+	// GetReleases returns the configured releases, sorted by releaseID.
+	GetReleases() ([]Release, error)
+	// Rollback queues a job that restores the previous release kept for the
+	// releaseID, and returns the jobID. It returns ErrNoPrevious if none is
+	// kept.
+	Rollback(releaseID string) (string, error)
+	// Promote queues a job that deploys the archive of the release's last
+	// deployment to the release it promotes to, and returns the jobID. It
+	// returns ErrNoPromotion if the release doesn't promote, and ErrNoArchive
+	// if the archive is not kept.
+	Promote(releaseID string) (string, error)
+	// ListJobs returns the jobs of a release, or of all releases if releaseID
+	// is empty, from the most recent. It skips offset jobs and returns at most
+	// limit jobs, or all of them if limit is 0.
+	ListJobs(releaseID string, limit, offset int) ([]JobSummary, error)
+	// SetMaintenance puts a release in maintenance, or lifts it. The jobs of
+	// a release in maintenance are deferred until it is lifted, and then
+	// queued again. It returns the number of deferred jobs.
+	SetMaintenance(releaseID string, enabled bool) (int, error)
+	// Freeze saves a freeze of releases and returns it with its ID. The jobs
+	// of a frozen release are deferred until the freeze ends or is lifted.
+	Freeze(freeze Freeze) (Freeze, error)
+	// LiftFreeze ends a freeze early and returns it. It returns
+	// ErrFreezeNotFound if there is no such freeze.
+	LiftFreeze(freezeID, liftedBy string) (Freeze, error)
+	// GetFreezes returns the freezes, from the most recent. Freezes are kept
+	// once they end, as an audit trail.
+	GetFreezes() ([]Freeze, error)
+	// Drained returns what happened to the jobs once Stop was called. It is
+	// complete once Start returned.
+	Drained() Drain
+	// Reload replaces the configuration, for the next jobs and requests
+	Reload(conf config.Config)
+	// SetStatus sets a custom status of the job's entry, or "running" again,
+	// with a message. It returns ErrTransition if the job can't take the
+	// status, such as if it is not running.
+	SetStatus(jobID, status, message string) error
+	// GetRetained opens a file retained for a failed job, RetainedArchive or
+	// RetainedLog. It returns ErrNotRetained if the job's files are not
+	// retained, or expired.
+	GetRetained(jobID, file string) (*os.File, error)
+}
+
+// Drain summarizes what happened to the jobs of a stopped deployer
+type Drain struct {
+	// Completed counts the jobs that finished after Stop was called
+	Completed int `json:"completed"`
+	// Requeued counts the waiting jobs saved to be queued again when the
+	// deployer starts
+	Requeued int `json:"requeued"`
+	// Abandoned counts the waiting jobs that couldn't be saved, and failed
+	Abandoned int `json:"abandoned"`
+}
+
+// ErrFreezeNotFound is returned by LiftFreeze if there is no such freeze
+var ErrFreezeNotFound = errors.New("freeze not found")
+
+// Freeze defers the deployments of releases until a given time
+type Freeze struct {
+	ID          string    `json:"id"`
+	ReleaseIDs  []string  `json:"releaseIDs"`
+	Until       time.Time `json:"until"`
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requestedBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// LiftedAt is set if the freeze was lifted before it ended
+	LiftedAt *time.Time `json:"liftedAt,omitempty"`
+	LiftedBy string     `json:"liftedBy,omitempty"`
+}
+
+// Active returns true if the freeze is neither ended nor lifted at the given
+// time
+func (f Freeze) Active(now time.Time) bool {
+	return f.LiftedAt == nil && now.Before(f.Until)
+}
+
+// ErrNoPrevious is returned by Rollback if the release has no previous
+// release kept
+var ErrNoPrevious = errors.New("no previous release")
+
+// ErrInsecureURL is returned for a plain HTTP download URL that is not
+// allowed
+var ErrInsecureURL = errors.New("not https")
+
+// ErrNoPromotion is returned by Promote if the release doesn't promote to
+// another release
+var ErrNoPromotion = errors.New("no release to promote to")
+
+// ErrNoArchive is returned by Promote if the archive of the release's last
+// deployment is not kept
+var ErrNoArchive = errors.New("no archive of the deployed release")
+
+// ErrNoSBOM is returned by GetSBOM if the release's last deployment has no
+// SBOM
+var ErrNoSBOM = errors.New("no SBOM in the deployed release")
+
+// ErrNotRetained is returned by GetRetained if the files of the job are not
+// retained
+var ErrNotRetained = errors.New("no retained files for the job")
+
+// The files retained for a failed job
+const (
+	// RetainedArchive is the archive downloaded by the job, as far as it
+	// could be downloaded
+	RetainedArchive = "archive"
+	// RetainedLog contains the log of the job, up to its failure
+	RetainedLog = "log"
+)
+
+// Release describes a configured release and its deployment
+type Release struct {
+	ReleaseID string   `json:"release_id"`
+	Target    string   `json:"target"`
+	Subpath   string   `json:"subpath,omitempty"`
+	Group     []string `json:"group,omitempty"`
+	// Digest is the digest of the release's entry, see config.Entry.Digest
+	Digest string `json:"digest"`
+	// Tag is the deployed tag, empty if the release was never deployed by
+	// Hodor.
+	Tag string `json:"tag"`
+	// Maintenance is true if the jobs of the release are deferred
+	Maintenance bool `json:"maintenance,omitempty"`
+	// FrozenUntil is the end of the freeze of the release, if it is frozen
+	FrozenUntil *time.Time `json:"frozen_until,omitempty"`
+	// Promote is the release to which the release can be promoted
+	Promote string `json:"promote,omitempty"`
+}
+
+// TargetHealth describes a target that doesn't match its last deployment
+type TargetHealth struct {
+	// Status is "missing" or "modified"
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Tag is the tag of the last deployment
+	Tag string `json:"tag"`
+}
+
+// eventsSize is the channel size used for each events subscriber
+const eventsSize = 100
+
+// broker dispatches job events to subscribers. The zero value is ready to
+// use.
+type broker struct {
+	sync.Mutex
+	subscribers map[chan JobEvent]struct{}
+}
+
+// subscribe returns a new channel that receives the published events, and a
+// function that removes it.
+func (b *broker) subscribe() (<-chan JobEvent, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan JobEvent]struct{})
+	}
+
+	events := make(chan JobEvent, eventsSize)
+	b.subscribers[events] = struct{}{}
+
+	unsubscribe := func() {
+		b.Lock()
+		defer b.Unlock()
+
+		delete(b.subscribers, events)
+	}
+
+	return events, unsubscribe
+}
+
+// publish sends the event to all subscribers without blocking. The event is
+// dropped for subscribers whose channel is full.
+func (b *broker) publish(event JobEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
 }
 
 // newJob returns a new initialized job
-func newJob(releaseID, tag string, releaseURL *url.URL) job {
+func newJob(req Request) job {
+	tag := req.Tag
 	if tag == "" {
 		tag = "unknown"
 	}
 
 	return job{
-		id:         xid.New().String(),
-		releaseID:  releaseID,
-		tag:        tag,
-		releaseURL: releaseURL,
+		id:           xid.New().String(),
+		releaseID:    req.ReleaseID,
+		tag:          tag,
+		requestID:    req.RequestID,
+		releaseURL:   req.ReleaseURL,
+		fallbackURLs: req.FallbackURLs,
+		notes:        req.Notes,
+		subpath:      req.Subpath,
+		callbackURL:  req.CallbackURL,
+		sha256:       req.SHA256,
+		sender:       req.Sender,
 	}
 }
 
 // job is created each time a release is triggered. It contains information to
 // download and deploy a release.
 type job struct {
-	id         string
-	releaseID  string
-	tag        string
-	releaseURL *url.URL
+	id           string
+	releaseID    string
+	tag          string
+	requestID    string
+	releaseURL   *url.URL
+	fallbackURLs []*url.URL
+	notes        string
+	subpath      string
+	callbackURL  *url.URL
+	// chain lists the releases that triggered the job, from the first one
+	chain []string
+	// chained lists the jobs triggered once the job succeeded
+	chained []string
+	// members are the jobs of a group, deployed all or nothing
+	members []job
+	// rollback restores the previous release instead of deploying one
+	rollback bool
+	sha256   string
+	// promoted is the release whose kept archive is deployed, instead of
+	// downloading it
+	promoted string
+	sender   Sender
+	// progress tracks the progress of the job while it is handled
+	progress *progressTracker
+	// capture records the archive and the log of the job while it is
+	// handled, if its entry retains them
+	capture *capture
 }
 
 // NewFileDeployer returns a new initialized file deployer
-func NewFileDeployer(db *buntdb.DB, conf config.Config, client HTTPClient,
+func NewFileDeployer(db store.Store, conf config.Config, client HTTPClient,
 	logger zerolog.Logger) Deployer {
 
 	logger = logger.With().Str("role", "deployer").Logger()
@@ -107,8 +703,12 @@ func NewFileDeployer(db *buntdb.DB, conf config.Config, client HTTPClient,
 	return &FileDeployer{
 		db:     db,
 		config: conf,
+		// created here, so that jobs deployed before Start are queued and
+		// handled once it is called.
+		jobs:   make(chan job, QueueSize),
 		client: client,
 		serde:  defaultSerde,
+		hooks:  hook.NewShellExecutor(),
 		logger: logger,
 	}
 }
@@ -118,290 +718,5949 @@ func NewFileDeployer(db *buntdb.DB, conf config.Config, client HTTPClient,
 // - implements deployer.Deployer
 type FileDeployer struct {
 	sync.Mutex
-	db     *buntdb.DB
+	events broker
+	db     store.Store
 	config config.Config
 	jobs   chan job
 	stop   bool
 	client HTTPClient
 	logger zerolog.Logger
 	serde  Serde
+	hooks  hook.Executor
+	// health contains the targets flagged at startup, by releaseID
+	health map[string]TargetHealth
+	// running is true while processJobs loops
+	running bool
+	// maintenance contains the releases in maintenance
+	maintenance map[string]bool
+	// deferred contains the jobs deferred by a maintenance or a freeze, by
+	// releaseID
+	deferred map[string][]job
+	// pending contains the jobs taken from the chan, waiting for their turn
+	pending fairQueue
+	// drain is filled once Stop is called
+	drain Drain
+	// configLock protects config, which is replaced by Reload
+	configLock sync.RWMutex
 }
 
 // Start implements deployer.Deployer. This is a blocking function that handles
-// jobs. It must be called only once.
+// jobs, starting with the ones deployed before it is called. It must be called
+// only once.
 func (fd *FileDeployer) Start() {
 	fd.Lock()
-	fd.jobs = make(chan job, jobSize)
-	fd.stop = false
+	if fd.jobs == nil {
+		fd.jobs = make(chan job, QueueSize)
+	}
 	fd.Unlock()
 
-	fd.processJobs()
-}
-
-// processJobs loops over jobs and processes it
-func (fd *FileDeployer) processJobs() {
-	// This loop exits if the job chan is closed or the stop flag is true.
-	for job := range fd.jobs {
-		if fd.getStop() {
-			return
-		}
-
-		err := fd.handleJob(job)
-		if err != nil {
-			err2 := fd.saveJobStatus(job.id, "failed", err.Error())
-			if err2 != nil {
-				fd.logger.Err(err2).Msgf("job failed: failed to save status. Error was: %v", err)
-			}
-			continue
-		}
+	fd.recoverSwaps()
+	fd.checkTargets()
+	fd.purgeRetained(time.Now())
+	fd.restoreQueued()
 
-		err = fd.saveJobStatus(job.id, "ok", "job done")
-		if err != nil {
-			fd.logger.Err(err).Msg("job ok: failed to save status")
-		}
+	fd.processJobs()
 
-		fd.db.Update(func(tx *buntdb.Tx) error {
-			_, _, err := tx.Set(job.releaseID, job.tag, nil)
-			if err != nil {
-				fd.logger.Err(err).Msg("failed to save tag")
-			}
-			return nil
-		})
-	}
+	fd.saveLeftJobs()
 }
 
-// saveJobStatus save the status of job onto the database
-func (fd *FileDeployer) saveJobStatus(jobID, status, message string) error {
-	jobStatus := JobStatus{
-		Status:  status,
-		Message: message,
-	}
-
-	buf, err := fd.serde.Marshal(&jobStatus)
-	if err != nil {
-		return fmt.Errorf("failed to marshal status: %v", err)
-	}
+// Reload implements deployer.Deployer. The jobs already running keep the
+// configuration they started with.
+func (fd *FileDeployer) Reload(conf config.Config) {
+	fd.configLock.Lock()
+	defer fd.configLock.Unlock()
 
-	err = fd.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(jobID, string(buf), nil)
-		return err
-	})
+	fd.config = conf
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to save status: %v", err)
-	}
+// getConfig returns the current configuration
+func (fd *FileDeployer) getConfig() config.Config {
+	fd.configLock.RLock()
+	defer fd.configLock.RUnlock()
 
-	return nil
+	return fd.config
 }
 
-// Stop implements deployer.Deployer. Must be called only once and if already
-// started.
-func (fd *FileDeployer) Stop() {
-	close(fd.jobs)
-	fd.Lock()
-	fd.stop = true
-	fd.Unlock()
+// dirMode returns the permission of the folders created for the release, from
+// its entry or else from the global configuration.
+func (fd *FileDeployer) dirMode(releaseID string) os.FileMode {
+	conf := fd.getConfig()
+	return conf.Entries[releaseID].DirMode.Or(conf.DirMode.Or(defaultDirMode))
 }
 
-// getStop safely returns the stop status of the deployer. If true it means that
-// the Stop() function has been called and therefore the deployer must be
-// stopped.
-func (fd *FileDeployer) getStop() bool {
+// Drained implements deployer.Deployer
+func (fd *FileDeployer) Drained() Drain {
 	fd.Lock()
 	defer fd.Unlock()
-	return fd.stop
+	return fd.drain
 }
 
-// Deploy implements deployer.Deployer. It adds a new job to the queue.
-func (fd *FileDeployer) Deploy(releaseID, tag string, releaseURL *url.URL) (string, error) {
-	fd.logger.Info().Msgf("deploying release %q from %q", releaseID, releaseURL)
+// manifest records the files of the last deployment of a release, to check
+// its target when the deployer starts
+type manifest struct {
+	Tag        string `json:"tag"`
+	ReleaseURL string `json:"releaseURL"`
+	// Target is the target of the entry, without the subpath. It is empty in
+	// the manifests saved before it was recorded.
+	Target  string `json:"target,omitempty"`
+	Subpath string `json:"subpath,omitempty"`
+	// Files are the sizes of the deployed files, relative to the subpath
+	Files map[string]int64 `json:"files"`
+}
 
-	if fd.getStop() {
-		return "", errors.New("deployer is stopped")
+// manifestKey returns the database key of the release's manifest
+func manifestKey(releaseID string) string {
+	return "manifest:" + releaseID
+}
+
+// saveManifest saves the manifest of the release's last deployment
+func (fd *FileDeployer) saveManifest(releaseID string, m manifest) error {
+	buf, err := fd.serde.Marshal(&m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
 	}
 
-	job := newJob(releaseID, tag, releaseURL)
+	err = fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(manifestKey(releaseID), string(buf))
+	})
 
-	err := fd.saveJobStatus(job.id, "created", "job has been created")
 	if err != nil {
-		return "", fmt.Errorf("failed to set job status: %v", err)
+		return fmt.Errorf("failed to save manifest: %v", err)
 	}
 
-	select {
-	case fd.jobs <- job:
-		return job.id, nil
-	default:
-		return "", errors.New("buffer is full, re-try later")
-	}
+	return nil
 }
 
-// GetStatus implements deployer.Deployer
-func (fd *FileDeployer) GetStatus(key string) (JobStatus, error) {
-	var jobStatus JobStatus
-	var statusBuf string
-	var err error
+// getManifest returns the manifest of the release, or nil if the release has
+// none
+func (fd *FileDeployer) getManifest(releaseID string) (*manifest, error) {
+	var value string
 
-	err = fd.db.View(func(tx *buntdb.Tx) error {
-		statusBuf, err = tx.Get(key, false)
+	err := fd.db.View(func(tx store.Tx) error {
+		var err error
+
+		value, err = tx.Get(manifestKey(releaseID))
 		return err
 	})
 
-	if err == buntdb.ErrNotFound {
-		return jobStatus, fmt.Errorf("key %q not found", key)
+	if err == store.ErrNotFound {
+		return nil, nil
 	}
 
 	if err != nil {
-		return jobStatus, fmt.Errorf("failed to get status: %v", err)
+		return nil, fmt.Errorf("failed to get manifest: %v", err)
 	}
 
-	err = fd.serde.Unmarshal([]byte(statusBuf), &jobStatus)
+	var m manifest
+
+	err = fd.serde.Unmarshal([]byte(value), &m)
 	if err != nil {
-		return jobStatus, fmt.Errorf("failed to unmarshal job status: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal manifest: %v", err)
 	}
 
-	return jobStatus, nil
+	return &m, nil
 }
 
-// GetLatestTag implements deployer.Deployer
-func (fd *FileDeployer) GetLatestTag(releaseID string) (string, error) {
-	var tag string
+// Orphan is the target of a release deployed by Hodor that is no longer in the
+// configuration
+type Orphan struct {
+	ReleaseID string `json:"release_id"`
+	// Target is the folder replaced by the release, including its subpath
+	Target string `json:"target"`
+	Tag    string `json:"tag"`
+}
+
+// FindOrphans returns the targets of the deployed releases that are not in the
+// configuration anymore, sorted by releaseID. A target that overlaps the target
+// of a configured release is not an orphan. Releases deployed before their
+// target was recorded can't be found.
+func FindOrphans(db store.Store, conf config.Config) ([]Orphan, error) {
+	orphans := []Orphan{}
+
 	var err error
 
-	err = fd.db.View(func(tx *buntdb.Tx) error {
-		tag, err = tx.Get(releaseID)
-		return err
+	dbErr := db.View(func(tx store.Tx) error {
+		return tx.Iterate(manifestKey(""), false, func(key, value string) bool {
+			releaseID := strings.TrimPrefix(key, manifestKey(""))
+
+			_, found := conf.Entries[releaseID]
+			if found {
+				return true
+			}
+
+			var m manifest
+
+			err = defaultSerde.Unmarshal([]byte(value), &m)
+			if err != nil {
+				err = fmt.Errorf("failed to unmarshal manifest of %q: %v", releaseID, err)
+				return false
+			}
+
+			if m.Target == "" {
+				return true
+			}
+
+			target := filepath.Join(m.Target, m.Subpath)
+
+			for _, entry := range conf.Entries {
+				if entry.Target == "" {
+					continue
+				}
+
+				if config.Contains(entry.Target, target) || config.Contains(target, entry.Target) {
+					return true
+				}
+			}
+
+			orphans = append(orphans, Orphan{ReleaseID: releaseID, Target: target, Tag: m.Tag})
+
+			return true
+		})
 	})
 
-	if err == buntdb.ErrNotFound {
-		return "unknown", nil
+	if dbErr != nil {
+		return nil, fmt.Errorf("failed to read manifests: %v", dbErr)
 	}
 
 	if err != nil {
-		return "", fmt.Errorf("failed to get tag: %v", err)
+		return nil, err
 	}
 
-	return tag, nil
+	return orphans, nil
 }
 
-// handleJob is called by the queue processor and processes a job. It downloads,
-// extracts, and deploys a release.
-func (fd *FileDeployer) handleJob(job job) error {
-	fd.logger.Info().Msgf("starting job %q (release %q)", job.id, job.releaseID)
+// RemoveOrphan removes the target of the orphan and its previous releases, and
+// forgets its release's tag and manifest. If archiveDir is not empty, the target is first saved there as
+// "<releaseID>-<tag>.tar.gz", which can be deployed again, and its path is
+// returned. The archive dir is created with the global folder permission.
+func RemoveOrphan(db store.Store, conf config.Config, orphan Orphan,
+	archiveDir string) (string, error) {
 
-	targetFolder, found := fd.config.Entries[job.releaseID]
-	if !found {
-		return fmt.Errorf("releaseID %q not found from the config", job.releaseID)
-	}
+	var archivePath string
 
-	res, err := fd.client.Get(job.releaseURL.String())
-	if err != nil {
-		return fmt.Errorf("failed to get file: %v", err)
+	_, err := os.Stat(orphan.Target)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to stat target: %v", err)
 	}
 
-	tmpDest, err := ioutil.TempDir("", "hodor")
-	if err != nil {
-		return fmt.Errorf("failed to create tmp dir: %v", err)
+	// the release of a symlink is archived
+	folder, evalErr := filepath.EvalSymlinks(orphan.Target)
+	if evalErr != nil {
+		folder = orphan.Target
 	}
 
-	fd.logger.Info().Msgf("job %q using temp folder %q (release %q)", job.id,
-		tmpDest, job.releaseID)
+	if err == nil && archiveDir != "" {
+		err = os.MkdirAll(archiveDir, conf.DirMode.Or(defaultDirMode))
+		if err != nil {
+			return "", fmt.Errorf("failed to create archive dir: %v", err)
+		}
 
-	defer os.RemoveAll(tmpDest)
+		name := fmt.Sprintf("%s-%s.tar.gz", orphan.ReleaseID, orphan.Tag)
+		archivePath = filepath.Join(archiveDir, strings.ReplaceAll(name, "/", "_"))
 
-	tarRootFolder, err := saveTar(res.Body, tmpDest)
-	if err != nil {
-		return fmt.Errorf("failed to save tar file: %v", err)
+		err = archiveFolder(folder, archivePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to archive target: %v", err)
+		}
 	}
 
-	// remove the actual target and move the extracted contents to the actual
-	// target.
-
-	os.RemoveAll(targetFolder)
-
-	err = os.Rename(filepath.Join(tmpDest, tarRootFolder), targetFolder)
+	err = os.RemoveAll(orphan.Target)
 	if err != nil {
-		return fmt.Errorf("failed to rename folder: %v", err)
+		return archivePath, fmt.Errorf("failed to remove target: %v", err)
 	}
 
-	fd.logger.Info().Msgf("job %q done (release %q)", job.id, job.releaseID)
-
-	return nil
-}
+	for _, dir := range []string{previousDir(orphan.Target), releasesDir(orphan.Target)} {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return archivePath, fmt.Errorf("failed to remove previous releases: %v", err)
+		}
+	}
 
-// saveTar extract a .tar.gz to the provided destination. It expects the tar.gz
-// to be a folder.
-func saveTar(r io.Reader, dest string) (string, error) {
-	gzr, err := gzip.NewReader(r)
-	if err != nil {
-		return "", fmt.Errorf("failed to create reader: %v", err)
+	// Hodor is not running, so the lock file of lockTarget can be removed
+	err = os.Remove(filepath.Clean(orphan.Target) + ".lock")
+	if err != nil && !os.IsNotExist(err) {
+		return archivePath, fmt.Errorf("failed to remove lock file: %v", err)
 	}
 
-	defer gzr.Close()
+	err = db.Update(func(tx store.Tx) error {
+		keys := []string{orphan.ReleaseID, manifestKey(orphan.ReleaseID), previousKey(orphan.ReleaseID)}
 
-	tr := tar.NewReader(gzr)
+		for _, key := range keys {
+			err := tx.Delete(key)
+			if err != nil && err != store.ErrNotFound {
+				return err
+			}
+		}
 
-	header, err := tr.Next()
-	if err != nil {
-		return "", fmt.Errorf("failed to read the first header: %v", err)
-	}
+		return nil
+	})
 
-	if header.Typeflag != tar.TypeDir {
-		return "", errors.New("tar must be a folder")
+	if err != nil {
+		return archivePath, fmt.Errorf("failed to forget release: %v", err)
 	}
 
-	tarRootFolder := header.Name
-	tmpRootTarget := filepath.Join(dest, tarRootFolder)
+	return archivePath, nil
+}
 
-	err = os.MkdirAll(tmpRootTarget, 0755)
+// archiveFolder saves the folder as a tar.gz whose single root folder has the
+// folder's name, as expected from a release.
+func archiveFolder(folder, archivePath string) error {
+	file, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return "", fmt.Errorf("failed to create root dir %s: %v", tmpRootTarget, err)
+		return fmt.Errorf("failed to create archive: %v", err)
 	}
 
-	err = untar(dest, tr)
-	if err != nil {
-		return "", fmt.Errorf("failed to extract: %v", err)
-	}
+	defer file.Close()
 
-	return tarRootFolder, nil
-}
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
 
-// untar walks through the tar's content and extracts the elements
-func untar(dest string, tr *tar.Reader) error {
-	for {
-		header, err := tr.Next()
+	root := filepath.Base(folder)
 
-		if err == io.EOF {
-			break
+	err = filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
 
+		rel, err := filepath.Rel(folder, path)
 		if err != nil {
-			return fmt.Errorf("failed to get next: %v", err)
+			return err
 		}
 
-		target := filepath.Join(dest, header.Name)
+		var link string
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			_, err := os.Stat(target)
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
 			if err != nil {
-				err := os.MkdirAll(target, 0755)
-				if err != nil {
-					return fmt.Errorf("failed to create dir %s: %v", target, err)
-				}
+				return err
 			}
+		}
 
-		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %v", target, err)
-			}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
 
-			_, err = io.Copy(f, tr)
-			if err != nil {
-				return fmt.Errorf("failed to copy file %s: %v", target, err)
-			}
+		header.Name = filepath.ToSlash(filepath.Join(root, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
 
-			f.Close()
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close tar: %v", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close gzip: %v", err)
+	}
+
+	return file.Close()
+}
+
+// listFiles returns the size of the regular files of the folder, by path
+// relative to it
+func listFiles(folder string) (map[string]int64, error) {
+	files := make(map[string]int64)
+
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = info.Size()
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// checkTargets compares the target of each release with its last deployment,
+// such as after a crash during a deployment. Targets that don't match are
+// flagged, and redeployed from their last release if the entry sets recover.
+// Files that are not part of the last deployment are ignored.
+func (fd *FileDeployer) checkTargets() {
+	health := make(map[string]TargetHealth)
+
+	for releaseID, entry := range fd.getConfig().Entries {
+		if len(entry.Group) != 0 {
+			continue
+		}
+
+		m, err := fd.getManifest(releaseID)
+		if err != nil {
+			fd.logger.Err(err).Str(logs.ReleaseIDKey, releaseID).
+				Msg("failed to check target")
+			continue
+		}
+
+		if m == nil {
+			continue
+		}
+
+		targetHealth, ok := checkTarget(entry.Target, *m)
+		if ok {
+			continue
+		}
+
+		health[releaseID] = targetHealth
+
+		logger := fd.logger.With().Str(logs.ReleaseIDKey, releaseID).Logger()
+		logger.Warn().Msgf("target is %s: %s", targetHealth.Status, targetHealth.Message)
+
+		if !entry.Recover {
+			continue
+		}
+
+		releaseURL, err := url.ParseRequestURI(m.ReleaseURL)
+		if err != nil {
+			logger.Err(err).Msg("failed to recover: wrong release url")
+			continue
+		}
+
+		jobID, err := fd.Deploy(Request{
+			ReleaseID:  releaseID,
+			Tag:        m.Tag,
+			ReleaseURL: releaseURL,
+			Subpath:    m.Subpath,
+		})
+		if err != nil {
+			logger.Err(err).Msg("failed to recover")
+			continue
+		}
+
+		logger.Info().Msgf("recovering %q with job %s", m.Tag, jobID)
+	}
+
+	fd.Lock()
+	fd.health = health
+	fd.Unlock()
+}
+
+// checkTarget returns the health of the target and false if it doesn't match
+// the manifest
+func checkTarget(target string, m manifest) (TargetHealth, bool) {
+	health := TargetHealth{Tag: m.Tag}
+
+	_, err := os.Stat(target)
+	if err != nil {
+		health.Status = "missing"
+		health.Message = err.Error()
+		return health, false
+	}
+
+	folder, err := subpathTarget(target, m.Subpath)
+	if err != nil {
+		health.Status = "modified"
+		health.Message = err.Error()
+		return health, false
+	}
+
+	var wrong []string
+
+	for path, size := range m.Files {
+		info, err := os.Stat(filepath.Join(folder, filepath.FromSlash(path)))
+		if err != nil || info.Size() != size {
+			wrong = append(wrong, path)
+		}
+	}
+
+	if len(wrong) == 0 {
+		return health, true
+	}
+
+	sort.Strings(wrong)
+
+	health.Status = "modified"
+	health.Message = fmt.Sprintf("%d of %d files are missing or changed, such as %q",
+		len(wrong), len(m.Files), wrong[0])
+
+	return health, false
+}
+
+// GetTargetsHealth implements deployer.Deployer
+func (fd *FileDeployer) GetTargetsHealth() map[string]TargetHealth {
+	fd.Lock()
+	defer fd.Unlock()
+
+	health := make(map[string]TargetHealth, len(fd.health))
+	for releaseID, targetHealth := range fd.health {
+		health[releaseID] = targetHealth
+	}
+
+	return health
+}
+
+// GetReleases implements deployer.Deployer
+func (fd *FileDeployer) GetReleases() ([]Release, error) {
+	releases := make([]Release, 0, len(fd.getConfig().Entries))
+
+	freezes, err := fd.activeFreezes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fd.db.View(func(tx store.Tx) error {
+		for releaseID, entry := range fd.getConfig().Entries {
+			tag, err := tx.Get(releaseID)
+			if err != nil && err != store.ErrNotFound {
+				return fmt.Errorf("failed to get tag of %q: %v", releaseID, err)
+			}
+
+			release := Release{
+				ReleaseID: releaseID,
+				Target:    entry.Target,
+				Subpath:   entry.Subpath,
+				Group:     entry.Group,
+				Digest:    entry.Digest(),
+				Tag:       tag,
+
+				Maintenance: fd.inMaintenance(releaseID),
+				Promote:     entry.Promote,
+			}
+
+			freeze, found := freezes[releaseID]
+			if found {
+				release.FrozenUntil = &freeze.Until
+			}
+
+			releases = append(releases, release)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].ReleaseID < releases[j].ReleaseID
+	})
+
+	return releases, nil
+}
+
+// processJobs loops over jobs and handles up to the configured number of jobs
+// at the same time. The jobs that write to the same release are handled one
+// after the other.
+func (fd *FileDeployer) processJobs() {
+	fd.setRunning(true)
+	defer fd.setRunning(false)
+
+	workers := fd.getConfig().Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	fd.Lock()
+	jobs := fd.jobs
+	fd.Unlock()
+
+	// busy contains the releases written by the running jobs
+	busy := make(map[string]bool)
+	done := make(chan job)
+	running := 0
+
+	// This loop exits once the job chan is closed or the stop flag is true,
+	// and the running jobs are done.
+	for {
+		stopped := fd.getStop()
+
+		if !stopped && running < workers {
+			next, found := fd.nextFree(busy)
+			if found {
+				if fd.deferJob(next) {
+					continue
+				}
+
+				for _, releaseID := range jobReleases(next) {
+					busy[releaseID] = true
+				}
+
+				running++
+
+				fd.start(next)
+
+				go func(next job) {
+					fd.run(next)
+					done <- next
+				}(next)
+
+				continue
+			}
+		}
+
+		if (stopped || jobs == nil) && running == 0 {
+			return
+		}
+
+		select {
+		case next, ok := <-jobs:
+			if !ok {
+				jobs = nil
+				continue
+			}
+
+			fd.Lock()
+			fd.pending.push(next)
+			fd.Unlock()
+		case finished := <-done:
+			for _, releaseID := range jobReleases(finished) {
+				delete(busy, releaseID)
+			}
+
+			running--
+
+			fd.Lock()
+			if fd.stop {
+				fd.drain.Completed++
+			}
+			fd.Unlock()
+		}
+	}
+}
+
+// jobReleases returns the releases a job writes to: its release, and the
+// members of a group
+func jobReleases(j job) []string {
+	releaseIDs := []string{j.releaseID}
+
+	for _, member := range j.members {
+		releaseIDs = append(releaseIDs, member.releaseID)
+	}
+
+	return releaseIDs
+}
+
+// run handles a started job and saves its outcome
+func (fd *FileDeployer) run(job job) {
+	if len(job.members) != 0 {
+		fd.processGroup(job)
+		return
+	}
+
+	handle := fd.handleJob
+	if job.rollback {
+		handle = fd.handleRollback
+	} else {
+		job.capture = fd.newCapture(job)
+	}
+
+	deployment, err := handle(job)
+
+	fd.finishCapture(job, err)
+
+	if err != nil {
+		fd.fail(job, err.Error())
+		return
+	}
+
+	fd.succeed(job, deployment)
+}
+
+// nextFree returns the next job to handle that doesn't write to a busy
+// release, taking the releases in turn. It returns false if there is none.
+func (fd *FileDeployer) nextFree(busy map[string]bool) (job, bool) {
+	fd.Lock()
+	defer fd.Unlock()
+
+	// the jobs waiting in the chan are moved to the pending ones, so that the
+	// releases are taken in turn across all the queued jobs.
+	for !fd.stop {
+		select {
+		case next, ok := <-fd.jobs:
+			if ok {
+				fd.pending.push(next)
+				continue
+			}
+		default:
+		}
+
+		break
+	}
+
+	return fd.pending.popFree(busy)
+}
+
+// fairQueue holds jobs in a FIFO per release, and pops them by taking the
+// releases in turn, so that a release with many jobs doesn't delay the others.
+// It is not thread-safe.
+type fairQueue struct {
+	// releases lists the releases with jobs, from the next one to take
+	releases []string
+	jobs     map[string][]job
+	size     int
+}
+
+// push adds a job after the other jobs of its release
+func (q *fairQueue) push(next job) {
+	if q.jobs == nil {
+		q.jobs = make(map[string][]job)
+	}
+
+	if len(q.jobs[next.releaseID]) == 0 {
+		q.releases = append(q.releases, next.releaseID)
+	}
+
+	q.jobs[next.releaseID] = append(q.jobs[next.releaseID], next)
+	q.size++
+}
+
+// pop removes and returns the first job of the next release. The queue must
+// not be empty.
+func (q *fairQueue) pop() job {
+	next, _ := q.popFree(nil)
+	return next
+}
+
+// popFree removes and returns the first job of the next release whose first
+// job doesn't write to a busy release. It returns false if there is none.
+func (q *fairQueue) popFree(busy map[string]bool) (job, bool) {
+	for i, releaseID := range q.releases {
+		jobs := q.jobs[releaseID]
+		next := jobs[0]
+
+		if isBusy(next, busy) {
+			continue
+		}
+
+		q.releases = append(q.releases[:i:i], q.releases[i+1:]...)
+
+		if len(jobs) == 1 {
+			delete(q.jobs, releaseID)
+		} else {
+			q.jobs[releaseID] = jobs[1:]
+			q.releases = append(q.releases, releaseID)
+		}
+
+		q.size--
+
+		return next, true
+	}
+
+	return job{}, false
+}
+
+// isBusy returns true if the job writes to a busy release
+func isBusy(j job, busy map[string]bool) bool {
+	for _, releaseID := range jobReleases(j) {
+		if busy[releaseID] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// len returns the number of jobs in the queue
+func (q *fairQueue) len() int {
+	return q.size
+}
+
+// queuedJob is a job saved when the deployer stops before handling it
+type queuedJob struct {
+	ID           string      `json:"id"`
+	ReleaseID    string      `json:"releaseID"`
+	Tag          string      `json:"tag"`
+	RequestID    string      `json:"requestID,omitempty"`
+	ReleaseURL   string      `json:"releaseURL,omitempty"`
+	FallbackURLs []string    `json:"fallbackURLs,omitempty"`
+	Notes        string      `json:"notes,omitempty"`
+	Subpath      string      `json:"subpath,omitempty"`
+	CallbackURL  string      `json:"callbackURL,omitempty"`
+	Chain        []string    `json:"chain,omitempty"`
+	Members      []queuedJob `json:"members,omitempty"`
+	Rollback     bool        `json:"rollback,omitempty"`
+	SHA256       string      `json:"sha256,omitempty"`
+	Promoted     string      `json:"promoted,omitempty"`
+	Sender       Sender      `json:"sender"`
+}
+
+// newQueuedJob returns the job as it is saved
+func newQueuedJob(j job) queuedJob {
+	queued := queuedJob{
+		ID:          j.id,
+		ReleaseID:   j.releaseID,
+		Tag:         j.tag,
+		RequestID:   j.requestID,
+		Notes:       j.notes,
+		Subpath:     j.subpath,
+		Chain:       j.chain,
+		Rollback:    j.rollback,
+		SHA256:      j.sha256,
+		Promoted:    j.promoted,
+		Sender:      j.sender,
+		ReleaseURL:  urlString(j.releaseURL),
+		CallbackURL: urlString(j.callbackURL),
+	}
+
+	for _, fallback := range j.fallbackURLs {
+		queued.FallbackURLs = append(queued.FallbackURLs, fallback.String())
+	}
+
+	for _, member := range j.members {
+		queued.Members = append(queued.Members, newQueuedJob(member))
+	}
+
+	return queued
+}
+
+// job returns the saved job
+func (q queuedJob) job() (job, error) {
+	var err error
+
+	j := job{
+		id:        q.ID,
+		releaseID: q.ReleaseID,
+		tag:       q.Tag,
+		requestID: q.RequestID,
+		notes:     q.Notes,
+		subpath:   q.Subpath,
+		chain:     q.Chain,
+		rollback:  q.Rollback,
+		sha256:    q.SHA256,
+		promoted:  q.Promoted,
+		sender:    q.Sender,
+	}
+
+	j.releaseURL, err = parseURL(q.ReleaseURL)
+	if err != nil {
+		return j, fmt.Errorf("wrong release url: %v", err)
+	}
+
+	j.callbackURL, err = parseURL(q.CallbackURL)
+	if err != nil {
+		return j, fmt.Errorf("wrong callback url: %v", err)
+	}
+
+	for _, fallback := range q.FallbackURLs {
+		u, err := url.Parse(fallback)
+		if err != nil {
+			return j, fmt.Errorf("wrong fallback url: %v", err)
+		}
+
+		j.fallbackURLs = append(j.fallbackURLs, u)
+	}
+
+	for _, member := range q.Members {
+		m, err := member.job()
+		if err != nil {
+			return j, fmt.Errorf("wrong member %q: %v", member.ReleaseID, err)
+		}
+
+		j.members = append(j.members, m)
+	}
+
+	return j, nil
+}
+
+// urlString returns the URL as a string, or an empty string if it is nil
+func urlString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+// parseURL parses the URL, or returns nil if it is empty
+func parseURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	return url.Parse(rawURL)
+}
+
+// queuedKey returns the database key of a job saved to be queued again
+func queuedKey(jobID string) string {
+	return "queued:" + jobID
+}
+
+// saveLeftJobs saves the jobs waiting once the deployer is stopped, including
+// the deferred ones, so that they are queued again when it starts. The jobs
+// that can't be saved fail.
+func (fd *FileDeployer) saveLeftJobs() {
+	fd.Lock()
+
+	var left []job
+
+	for fd.pending.len() != 0 {
+		left = append(left, fd.pending.pop())
+	}
+
+	// the chan is closed by Stop
+	for next := range fd.jobs {
+		left = append(left, next)
+	}
+
+	for _, jobs := range fd.deferred {
+		left = append(left, jobs...)
+	}
+
+	fd.deferred = nil
+
+	fd.Unlock()
+
+	for _, job := range left {
+		err := fd.saveQueued(job)
+		if err != nil {
+			fd.fail(job, fmt.Sprintf("job abandoned at shutdown: %v", err))
+
+			fd.Lock()
+			fd.drain.Abandoned++
+			fd.Unlock()
+
+			continue
+		}
+
+		err = fd.saveJobStatus(job, "created", "job is queued again once Hodor restarts")
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseQueue).Err(err).Msg("failed to save status")
+		}
+
+		fd.Lock()
+		fd.drain.Requeued++
+		fd.Unlock()
+	}
+}
+
+// saveQueued saves a job to be queued again when the deployer starts
+func (fd *FileDeployer) saveQueued(job job) error {
+	buf, err := fd.serde.Marshal(newQueuedJob(job))
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+
+	return fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(queuedKey(job.id), string(buf))
+	})
+}
+
+// restoreQueued queues the jobs saved when the deployer last stopped, in the
+// order they were created, and removes them from the database.
+func (fd *FileDeployer) restoreQueued() {
+	var restored []job
+
+	err := fd.db.Update(func(tx store.Tx) error {
+		var keys []string
+
+		err := tx.Iterate(queuedKey(""), false, func(key, value string) bool {
+			keys = append(keys, key)
+
+			var queued queuedJob
+
+			err := fd.serde.Unmarshal([]byte(value), &queued)
+			if err != nil {
+				fd.logger.Err(err).Msgf("failed to unmarshal %q", key)
+				return true
+			}
+
+			job, err := queued.job()
+			if err != nil {
+				fd.logger.Err(err).Msgf("failed to restore %q", key)
+				return true
+			}
+
+			restored = append(restored, job)
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = tx.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fd.logger.Err(err).Msg("failed to restore the queued jobs")
+		return
+	}
+
+	if len(restored) == 0 {
+		return
+	}
+
+	fd.logger.Info().Msgf("queuing %d jobs saved at the last shutdown", len(restored))
+
+	for _, job := range restored {
+		err = fd.saveJobStatus(job, "created", "job is queued again after a restart")
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseQueue).Err(err).Msg("failed to save status")
+		}
+
+		fd.Lock()
+		fd.pending.push(job)
+		fd.Unlock()
+	}
+}
+
+// start saves the running status of a job
+func (fd *FileDeployer) start(job job) {
+	err := fd.saveJobStatus(job, "running", "job is running")
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseQueue).Err(err).Msg("failed to save running status")
+	}
+}
+
+// fail saves the failure and the failed status of a job
+func (fd *FileDeployer) fail(job job, message string) {
+	err := fd.saveFailure(job, message)
+	if err != nil {
+		fd.jobLogger(job, "").Err(err).Msg("job failed: failed to save failure")
+	}
+
+	err = fd.saveJobStatus(job, "failed", message)
+	if err != nil {
+		fd.jobLogger(job, "").Err(err).Msgf("job failed: failed to save status. Error was: %s", message)
+	}
+}
+
+// succeed saves the deployment of a job, triggers the chained releases, and
+// saves the ok status.
+func (fd *FileDeployer) succeed(job job, deployment deployment) {
+	// the history and the tag are saved first, so that they are up to date
+	// once the status is ok.
+	err := fd.saveHistory(job, deployment)
+	if err != nil {
+		fd.jobLogger(job, "").Err(err).Msg("failed to save history")
+	}
+
+	fd.db.Update(func(tx store.Tx) error {
+		err := tx.Set(job.releaseID, job.tag)
+		if err != nil {
+			fd.jobLogger(job, "").Err(err).Msg("failed to save tag")
+		}
+		return nil
+	})
+
+	if deployment.manifest != nil {
+		err = fd.saveManifest(job.releaseID, *deployment.manifest)
+		if err != nil {
+			fd.jobLogger(job, "").Err(err).Msg("failed to save manifest")
+		}
+
+		fd.Lock()
+		delete(fd.health, job.releaseID)
+		fd.Unlock()
+	}
+
+	job.chained = fd.triggerChained(job)
+
+	err = fd.saveJobStatus(job, "ok", "job done")
+	if err != nil {
+		fd.jobLogger(job, "").Err(err).Msg("job ok: failed to save status")
+	}
+}
+
+// processGroup deploys the members of a group one after the other. The target
+// of each member is backed up first, so that if a member fails, the members
+// already deployed are restored. The group succeeds if all members succeed.
+func (fd *FileDeployer) processGroup(group job) {
+	fd.jobLogger(group, "").Info().Msgf("starting group of %d members", len(group.members))
+
+	// the same configuration is used to back up and restore the members
+	conf := fd.getConfig()
+
+	deployments := make([]deployment, 0, len(group.members))
+	backups := make([]string, 0, len(group.members))
+
+	defer func() {
+		for _, backup := range backups {
+			os.RemoveAll(backup)
+		}
+	}()
+
+	var err error
+
+	for i, member := range group.members {
+		entry := conf.Entries[member.releaseID]
+
+		var backup string
+
+		backup, err = backupTarget(entry.Target, entry.DirMode.Or(conf.DirMode.Or(defaultDirMode)))
+		if err != nil {
+			err = fmt.Errorf("failed to back up %q: %v", member.releaseID, err)
+			break
+		}
+
+		backups = append(backups, backup)
+
+		fd.start(member)
+
+		// the capture is kept in the group, for the status of the member
+		member.capture = fd.newCapture(member)
+		group.members[i].capture = member.capture
+
+		var d deployment
+
+		d, err = fd.handleJob(member)
+
+		fd.finishCapture(member, err)
+
+		if err != nil {
+			err = fmt.Errorf("failed to deploy %q: %v", member.releaseID, err)
+			break
+		}
+
+		deployments = append(deployments, d)
+	}
+
+	if err == nil {
+		total := deployment{}
+
+		for i, member := range group.members {
+			fd.succeed(member, deployments[i])
+
+			total.duration += deployments[i].duration
+			total.changes.Added += deployments[i].changes.Added
+			total.changes.Changed += deployments[i].changes.Changed
+			total.changes.Removed += deployments[i].changes.Removed
+		}
+
+		fd.succeed(group, total)
+
+		return
+	}
+
+	// the failed member is also restored, as it may be partially deployed
+	for i := len(backups) - 1; i >= 0; i-- {
+		member := group.members[i]
+		entry := conf.Entries[member.releaseID]
+		dirMode := entry.DirMode.Or(conf.DirMode.Or(defaultDirMode))
+
+		err2 := restoreTarget(backups[i], entry.Target, dirMode)
+		if err2 != nil {
+			fd.jobLogger(member, "").Err(err2).Msg("failed to roll back")
+			err = fmt.Errorf("%v; failed to roll back %q: %v", err, member.releaseID, err2)
+		}
+	}
+
+	message := fmt.Sprintf("group rolled back: %v", err)
+
+	for _, member := range group.members {
+		fd.fail(member, message)
+	}
+
+	fd.fail(group, message)
+}
+
+// backupTarget copies the target to a new temporary folder and returns it,
+// or returns an empty string if the target doesn't exist. Its folders are
+// created with dirMode.
+func backupTarget(target string, dirMode os.FileMode) (string, error) {
+	_, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	backup, err := os.MkdirTemp("", "hodor-backup")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup dir: %v", err)
+	}
+
+	err = copyTree(target, backup, false, dirMode)
+	if err != nil {
+		os.RemoveAll(backup)
+		return "", fmt.Errorf("failed to copy: %v", err)
+	}
+
+	return backup, nil
+}
+
+// restoreTarget replaces the content of the target with the backup, or
+// removes the target if there is no backup.
+func restoreTarget(backup, target string, dirMode os.FileMode) error {
+	if backup == "" {
+		return os.RemoveAll(target)
+	}
+
+	return copyTree(backup, target, true, dirMode)
+}
+
+// previousRelease is a release kept in the previous folder of its target, so
+// that it can be rolled back
+type previousRelease struct {
+	Tag        string `json:"tag"`
+	ReleaseURL string `json:"releaseURL"`
+	Subpath    string `json:"subpath,omitempty"`
+	// Folder is the name of the release's folder in the previous folder
+	Folder string `json:"folder"`
+}
+
+// previousKey returns the database key of the release's previous releases,
+// from the most recent
+func previousKey(releaseID string) string {
+	return "previous:" + releaseID
+}
+
+// previousDir returns the folder where the previous releases of a target are
+// kept, next to it so that they can be renamed.
+func previousDir(target string) string {
+	return filepath.Clean(target) + ".previous"
+}
+
+// releasesDir returns the folder of the releases of a target deployed with
+// config.StrategySymlink
+func releasesDir(target string) string {
+	return filepath.Clean(target) + "-releases"
+}
+
+// keptDir returns the folder where the previous releases of a target are kept,
+// according to the strategy
+func keptDir(strategy config.Strategy, target string) string {
+	if strategy == config.StrategySymlink {
+		return releasesDir(target)
+	}
+
+	return previousDir(target)
+}
+
+// hookSettings returns the account and the sandbox of the entry's hooks, which
+// are nil if not set.
+func hookSettings(entry config.Entry) (*hook.Credential, *hook.Sandbox, error) {
+	var cred *hook.Credential
+	var sandbox *hook.Sandbox
+
+	if entry.RunAs.User != "" {
+		var err error
+
+		cred, err = hook.LookupCredential(entry.RunAs.User, entry.RunAs.Group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get run_as credential: %v", err)
+		}
+	}
+
+	if entry.Sandbox.Enabled {
+		sandbox = &hook.Sandbox{AllowEnv: entry.Sandbox.AllowEnv}
+	}
+
+	return cred, sandbox, nil
+}
+
+// getPrevious returns the previous releases kept for the release, from the
+// most recent
+func (fd *FileDeployer) getPrevious(releaseID string) ([]previousRelease, error) {
+	var value string
+
+	err := fd.db.View(func(tx store.Tx) error {
+		var err error
+
+		value, err = tx.Get(previousKey(releaseID))
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get previous releases: %v", err)
+	}
+
+	var previous []previousRelease
+
+	err = fd.serde.Unmarshal([]byte(value), &previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal previous releases: %v", err)
+	}
+
+	return previous, nil
+}
+
+// savePrevious saves the previous releases kept for the release
+func (fd *FileDeployer) savePrevious(releaseID string, previous []previousRelease) error {
+	buf, err := fd.serde.Marshal(&previous)
+	if err != nil {
+		return fmt.Errorf("failed to marshal previous releases: %v", err)
+	}
+
+	err = fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(previousKey(releaseID), string(buf))
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save previous releases: %v", err)
+	}
+
+	return nil
+}
+
+// swapJournal records a swap while it replaces a target, so that a swap
+// interrupted by a crash is recovered when the deployer starts
+type swapJournal struct {
+	JobID     string `json:"jobID"`
+	ReleaseID string `json:"releaseID"`
+	Tag       string `json:"tag"`
+	Target    string `json:"target"`
+	// Release is the extracted release, moved to the target
+	Release string `json:"release"`
+	// Staging is the temporary folder of the release
+	Staging string `json:"staging"`
+	// Aside is where the target is moved before the release replaces it. It
+	// is empty if there was no target.
+	Aside string `json:"aside,omitempty"`
+}
+
+// journalKey returns the database key of the swap journal of a release
+func journalKey(releaseID string) string {
+	return "swap:" + releaseID
+}
+
+// swapReplace replaces the target with the release in two phases: the target
+// is moved aside, and the release is moved in its place. A journal is saved
+// before and cleared after, see recoverSwaps. If keep is true, the target is
+// moved aside to its previous folder and returned as a previous release, or
+// else it is removed.
+func (fd *FileDeployer) swapReplace(job job, staging, releaseFolder, target, subpath string,
+	keep bool) (*previousRelease, error) {
+
+	journal := swapJournal{
+		JobID:     job.id,
+		ReleaseID: job.releaseID,
+		Tag:       job.tag,
+		Target:    target,
+		Release:   releaseFolder,
+		Staging:   staging,
+	}
+
+	var previous *previousRelease
+
+	_, err := os.Lstat(target)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to stat target: %v", err)
+	case keep:
+		previous, err = fd.newPrevious(job.releaseID, subpath, xid.New().String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to keep previous release: %v", err)
+		}
+
+		err = os.MkdirAll(previousDir(target), fd.dirMode(job.releaseID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to keep previous release: failed to create folder: %v", err)
+		}
+
+		journal.Aside = filepath.Join(previousDir(target), previous.Folder)
+	default:
+		journal.Aside = filepath.Clean(target) + ".hodor-old-" + job.id
+	}
+
+	err = fd.saveJournal(journal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save journal: %v", err)
+	}
+
+	if journal.Aside != "" {
+		err = os.Rename(target, journal.Aside)
+		if err != nil {
+			fd.clearJournal(journal)
+			return nil, fmt.Errorf("failed to move target: %v", err)
+		}
+	}
+
+	err = os.Rename(releaseFolder, target)
+	if err != nil {
+		if journal.Aside != "" {
+			os.Rename(journal.Aside, target)
+		}
+
+		fd.clearJournal(journal)
+
+		return nil, fmt.Errorf("failed to rename folder: %v", err)
+	}
+
+	fd.clearJournal(journal)
+
+	if !keep && journal.Aside != "" {
+		err = os.RemoveAll(journal.Aside)
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to remove previous target: %v", err)
+		}
+	}
+
+	return previous, nil
+}
+
+// saveJournal saves the journal of a swap. It is always encoded in JSON, so
+// that it can be read back whatever the serde of the deployer.
+func (fd *FileDeployer) saveJournal(journal swapJournal) error {
+	buf, err := json.Marshal(&journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %v", err)
+	}
+
+	return fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(journalKey(journal.ReleaseID), string(buf))
+	})
+}
+
+// clearJournal removes the journal of a swap. A journal that can't be removed
+// is only logged: the swap is recovered as completed when the deployer starts.
+func (fd *FileDeployer) clearJournal(journal swapJournal) {
+	err := fd.db.Update(func(tx store.Tx) error {
+		return tx.Delete(journalKey(journal.ReleaseID))
+	})
+
+	if err != nil {
+		fd.logger.Err(err).Str(logs.ReleaseIDKey, journal.ReleaseID).Msg("failed to clear journal")
+	}
+}
+
+// recoverSwaps recovers the swaps interrupted by a crash, as recorded by their
+// journal, so that no target is left missing. The job of each swap fails.
+func (fd *FileDeployer) recoverSwaps() {
+	var journals []swapJournal
+
+	err := fd.db.View(func(tx store.Tx) error {
+		return tx.Iterate(journalKey(""), false, func(key, value string) bool {
+			var journal swapJournal
+
+			err := json.Unmarshal([]byte(value), &journal)
+			if err != nil {
+				fd.logger.Err(err).Msgf("failed to unmarshal %q", key)
+				return true
+			}
+
+			journals = append(journals, journal)
+
+			return true
+		})
+	})
+
+	if err != nil {
+		fd.logger.Err(err).Msg("failed to read the swap journals")
+		return
+	}
+
+	for _, journal := range journals {
+		logger := fd.logger.With().Str(logs.ReleaseIDKey, journal.ReleaseID).Logger()
+
+		outcome, err := recoverSwap(journal)
+		if err != nil {
+			logger.Err(err).Msgf("failed to recover the swap of %q", journal.Target)
+			continue
+		}
+
+		logger.Warn().Msgf("recovered the interrupted swap of %q: %s", journal.Target, outcome)
+
+		fd.clearJournal(journal)
+
+		err = os.RemoveAll(journal.Staging)
+		if err != nil {
+			logger.Warn().Msgf("failed to remove staging folder: %v", err)
+		}
+
+		j := job{id: journal.JobID, releaseID: journal.ReleaseID, tag: journal.Tag}
+
+		err = fd.saveJobStatus(j, "failed", "interrupted during the swap, which was "+outcome)
+		if err != nil {
+			logger.Err(err).Msg("failed to save status")
+		}
+	}
+}
+
+// recoverSwap brings the target of an interrupted swap back to a consistent
+// state, and returns what was done. The target that was moved aside is
+// restored, since it is the one the database knows of. Otherwise, the release
+// is moved in place if the target is missing.
+func recoverSwap(journal swapJournal) (string, error) {
+	targetExists := exists(journal.Target)
+
+	if journal.Aside != "" && exists(journal.Aside) {
+		if targetExists {
+			err := os.RemoveAll(journal.Target)
+			if err != nil {
+				return "", fmt.Errorf("failed to remove release: %v", err)
+			}
+		}
+
+		err := os.Rename(journal.Aside, journal.Target)
+		if err != nil {
+			return "", fmt.Errorf("failed to restore target: %v", err)
+		}
+
+		return "rolled back", nil
+	}
+
+	if targetExists {
+		if journal.Aside != "" {
+			return "not started", nil
+		}
+
+		return "completed", nil
+	}
+
+	if !exists(journal.Release) {
+		return "", errors.New("target, release, and previous target are missing")
+	}
+
+	err := os.Rename(journal.Release, journal.Target)
+	if err != nil {
+		return "", fmt.Errorf("failed to move release: %v", err)
+	}
+
+	return "completed", nil
+}
+
+// exists returns true if the file exists, without following symlinks
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// newPrevious returns the release currently deployed as a previous release
+// kept in folder
+func (fd *FileDeployer) newPrevious(releaseID, subpath, folder string) (*previousRelease, error) {
+	tag, err := fd.GetLatestTag(releaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := previousRelease{
+		Tag:     tag,
+		Subpath: subpath,
+		Folder:  folder,
+	}
+
+	m, err := fd.getManifest(releaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	if m != nil {
+		previous.ReleaseURL = m.ReleaseURL
+	}
+
+	return &previous, nil
+}
+
+// swapSymlink moves the release to the releases folder of the target, and
+// atomically replaces the target with a symlink to it. It returns the release
+// the target pointed to, or nil if there was none. A target that is a folder,
+// such as deployed with another strategy, is first moved to the releases
+// folder.
+func (fd *FileDeployer) swapSymlink(job job, releaseFolder, target, subpath string,
+	dirMode os.FileMode) (*previousRelease, error) {
+
+	dir := releasesDir(target)
+
+	err := os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create releases folder: %v", err)
+	}
+
+	name := strings.ReplaceAll(job.tag, "/", "_") + "-" + job.id
+	folder := filepath.Join(dir, name)
+
+	err = os.Rename(releaseFolder, folder)
+	if err != nil {
+		// the staging folder may be on another filesystem
+		err = copyTree(releaseFolder, folder, false, dirMode)
+		if err != nil {
+			os.RemoveAll(folder)
+			return nil, fmt.Errorf("failed to move release: %v", err)
+		}
+	}
+
+	var previous *previousRelease
+	var movedTarget string
+
+	info, err := os.Lstat(target)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+
+	case err != nil:
+		return nil, fmt.Errorf("failed to stat target: %v", err)
+
+	case info.Mode()&os.ModeSymlink != 0:
+		current, ok := linkedRelease(target)
+		if ok {
+			previous, err = fd.newPrevious(job.releaseID, subpath, current)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		previous, err = fd.newPrevious(job.releaseID, subpath, xid.New().String())
+		if err != nil {
+			return nil, err
+		}
+
+		movedTarget = filepath.Join(dir, previous.Folder)
+
+		err = os.Rename(target, movedTarget)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move target: %v", err)
+		}
+	}
+
+	err = replaceSymlink(folder, target)
+	if err != nil {
+		if movedTarget != "" {
+			os.Rename(movedTarget, target)
+		}
+
+		return nil, err
+	}
+
+	return previous, nil
+}
+
+// replaceSymlink atomically replaces the target with a relative symlink to the
+// folder, by renaming a new symlink over it.
+func replaceSymlink(folder, target string) error {
+	link, err := filepath.Rel(filepath.Dir(target), folder)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	tmp := target + tmpSuffix
+
+	os.Remove(tmp)
+
+	err = os.Symlink(link, tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create symlink: %v", err)
+	}
+
+	err = os.Rename(tmp, target)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace symlink: %v", err)
+	}
+
+	return nil
+}
+
+// linkedRelease returns the name of the folder the target links to, and false
+// if the target doesn't link to a folder of its releases folder.
+func linkedRelease(target string) (string, bool) {
+	link, err := os.Readlink(target)
+	if err != nil {
+		return "", false
+	}
+
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(target), link)
+	}
+
+	if filepath.Dir(link) != releasesDir(target) {
+		return "", false
+	}
+
+	return filepath.Base(link), true
+}
+
+// pushPrevious saves the previous release as the most recent one, and removes
+// the oldest ones to keep at most keep.
+func (fd *FileDeployer) pushPrevious(releaseID string, previous previousRelease,
+	entry config.Entry) error {
+
+	kept, err := fd.getPrevious(releaseID)
+	if err != nil {
+		return err
+	}
+
+	kept = append([]previousRelease{previous}, kept...)
+
+	for len(kept) > entry.Keep {
+		oldest := kept[len(kept)-1]
+		kept = kept[:len(kept)-1]
+
+		folder, err := previousFolder(entry, oldest)
+		if err != nil {
+			return err
+		}
+
+		err = os.RemoveAll(folder)
+		if err != nil {
+			return fmt.Errorf("failed to remove %q: %v", oldest.Tag, err)
+		}
+	}
+
+	return fd.savePrevious(releaseID, kept)
+}
+
+// previousFolder returns the folder of a previous release of the entry
+func previousFolder(entry config.Entry, previous previousRelease) (string, error) {
+	target, err := subpathTarget(entry.Target, previous.Subpath)
+	if err != nil {
+		return "", fmt.Errorf("wrong subpath: %v", err)
+	}
+
+	return filepath.Join(keptDir(entry.Strategy, target), previous.Folder), nil
+}
+
+// saveJobStatus save the status of job onto the database and publishes it to
+// the subscribers. The job is running with the "running" status, and finished
+// with a terminal one.
+func (fd *FileDeployer) saveJobStatus(job job, status, message string) error {
+	now := time.Now().UTC()
+
+	jobStatus := JobStatus{
+		Status:    status,
+		Message:   message,
+		RequestID: job.requestID,
+		Chained:   job.chained,
+		ReleaseID: job.releaseID,
+		Tag:       job.tag,
+		CreatedAt: &now,
+		Promoted:  job.promoted,
+	}
+
+	for _, member := range job.members {
+		jobStatus.Group = append(jobStatus.Group, member.id)
+	}
+
+	if job.capture != nil && !job.capture.until.IsZero() {
+		until := job.capture.until
+		jobStatus.RetainedUntil = &until
+	}
+
+	custom := fd.getConfig().Entries[job.releaseID].States
+
+	var marshalErr error
+	var transitionErr error
+
+	err := fd.db.Update(func(tx store.Tx) error {
+		value, err := tx.Get(job.id)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+
+		var previous JobStatus
+
+		if err == nil {
+			err = fd.serde.Unmarshal([]byte(value), &previous)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal status: %v", err)
+			}
+
+			jobStatus.CreatedAt = previous.CreatedAt
+			jobStatus.StartedAt = previous.StartedAt
+			jobStatus.Hooks = previous.Hooks
+			jobStatus.Progress = previous.Progress
+			jobStatus.Scan = previous.Scan
+		}
+
+		transitionErr = checkTransition(previous.Status, status, custom)
+		if transitionErr != nil {
+			return transitionErr
+		}
+
+		switch {
+		// a job running again, such as after a custom status, keeps its start
+		case status == "running" && jobStatus.StartedAt == nil:
+			jobStatus.StartedAt = &now
+		case IsTerminal(status):
+			jobStatus.FinishedAt = &now
+
+			if jobStatus.StartedAt != nil {
+				jobStatus.Duration = now.Sub(*jobStatus.StartedAt)
+			}
+		}
+
+		buf, err := fd.serde.Marshal(&jobStatus)
+		if err != nil {
+			marshalErr = fmt.Errorf("failed to marshal status: %v", err)
+			return marshalErr
+		}
+
+		err = tx.Set(job.id, string(buf))
+		if err != nil {
+			return err
+		}
+
+		return fd.saveJobSummary(tx, job, jobStatus)
+	})
+
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	if transitionErr != nil {
+		return transitionErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to save status: %v", err)
+	}
+
+	event := JobEvent{
+		JobID:     job.id,
+		ReleaseID: job.releaseID,
+		Tag:       job.tag,
+		JobStatus: jobStatus,
+	}
+
+	if job.callbackURL != nil {
+		event.CallbackURL = job.callbackURL.String()
+	}
+
+	if job.releaseURL != nil && !job.rollback {
+		event.ReleaseURL = job.releaseURL.String()
+	}
+
+	event.Subpath = job.subpath
+
+	fd.events.publish(event)
+
+	return nil
+}
+
+// jobKey returns the database key of the job's summary. The keys are in the
+// creation order of the jobs, since job IDs are sortable by time.
+func jobKey(jobID string) string {
+	return "job:" + jobID
+}
+
+// saveJobSummary saves the summary of the job with its new status
+func (fd *FileDeployer) saveJobSummary(tx store.Tx, job job, status JobStatus) error {
+	now := time.Now().UTC()
+
+	summary := JobSummary{
+		JobID:     job.id,
+		ReleaseID: job.releaseID,
+		Tag:       job.tag,
+		Status:    status.Status,
+		Message:   status.Message,
+		RequestID: job.requestID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if status.CreatedAt != nil {
+		summary.CreatedAt = *status.CreatedAt
+	}
+
+	buf, err := fd.serde.Marshal(&summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %v", err)
+	}
+
+	return tx.Set(jobKey(job.id), string(buf))
+}
+
+// ListJobs implements deployer.Deployer
+func (fd *FileDeployer) ListJobs(releaseID string, limit, offset int) ([]JobSummary, error) {
+	jobs := []JobSummary{}
+
+	var decodeErr error
+
+	// the stores have no index, so the jobs of a release are filtered from
+	// all the jobs
+	err := fd.db.View(func(tx store.Tx) error {
+		return tx.Iterate(jobKey(""), true, func(key, value string) bool {
+			var summary JobSummary
+
+			decodeErr = fd.serde.Unmarshal([]byte(value), &summary)
+			if decodeErr != nil {
+				decodeErr = fmt.Errorf("failed to unmarshal job %q: %v", key, decodeErr)
+				return false
+			}
+
+			if releaseID != "" && summary.ReleaseID != releaseID {
+				return true
+			}
+
+			if offset > 0 {
+				offset--
+				return true
+			}
+
+			jobs = append(jobs, summary)
+
+			return limit <= 0 || len(jobs) < limit
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return jobs, nil
+}
+
+// Subscribe implements deployer.Deployer
+func (fd *FileDeployer) Subscribe() (<-chan JobEvent, func()) {
+	return fd.events.subscribe()
+}
+
+// Stop implements deployer.Deployer. Must be called only once and if already
+// started.
+func (fd *FileDeployer) Stop() {
+	fd.Lock()
+	defer fd.Unlock()
+
+	// the jobs chan is closed with the lock so that enqueue never sends on a
+	// closed chan.
+	close(fd.jobs)
+	fd.stop = true
+}
+
+// setRunning safely sets the running status of the deployer
+func (fd *FileDeployer) setRunning(running bool) {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.running = running
+}
+
+// Running implements deployer.Deployer
+func (fd *FileDeployer) Running() bool {
+	fd.Lock()
+	defer fd.Unlock()
+	return fd.running && !fd.stop
+}
+
+// getStop safely returns the stop status of the deployer. If true it means that
+// the Stop() function has been called and therefore the deployer must be
+// stopped.
+func (fd *FileDeployer) getStop() bool {
+	fd.Lock()
+	defer fd.Unlock()
+	return fd.stop
+}
+
+// Deploy implements deployer.Deployer. It adds a new job to the queue.
+func (fd *FileDeployer) Deploy(req Request) (string, error) {
+	logger := logs.WithRequest(fd.logger, req.RequestID)
+	logger.Info().Str(logs.ReleaseIDKey, req.ReleaseID).
+		Msgf("deploying release from %q", req.ReleaseURL)
+
+	if fd.getStop() {
+		return "", errors.New("deployer is stopped")
+	}
+
+	job := newJob(req)
+
+	entry := fd.getConfig().Entries[req.ReleaseID]
+
+	if len(entry.Group) != 0 {
+		members, err := fd.newMembers(req, entry)
+		if err != nil {
+			return "", err
+		}
+
+		job.members = members
+	}
+
+	err := fd.enqueue(job)
+	if err != nil {
+		return "", err
+	}
+
+	return job.id, nil
+}
+
+// SetMaintenance implements deployer.Deployer
+func (fd *FileDeployer) SetMaintenance(releaseID string, enabled bool) (int, error) {
+	_, found := fd.getConfig().Entries[releaseID]
+	if !found {
+		return 0, fmt.Errorf("releaseID %q not found from the config", releaseID)
+	}
+
+	fd.Lock()
+
+	if enabled {
+		if fd.maintenance == nil {
+			fd.maintenance = make(map[string]bool)
+		}
+
+		fd.maintenance[releaseID] = true
+	} else {
+		delete(fd.maintenance, releaseID)
+	}
+
+	deferred := len(fd.deferred[releaseID])
+
+	fd.Unlock()
+
+	if enabled {
+		fd.logger.Info().Str(logs.ReleaseIDKey, releaseID).Msg("maintenance started")
+		return deferred, nil
+	}
+
+	fd.logger.Info().Str(logs.ReleaseIDKey, releaseID).
+		Msgf("maintenance lifted, resuming %d job(s)", deferred)
+
+	fd.resumeDeferred()
+
+	return deferred, nil
+}
+
+// inMaintenance safely returns true if the release is in maintenance
+func (fd *FileDeployer) inMaintenance(releaseID string) bool {
+	fd.Lock()
+	defer fd.Unlock()
+
+	return fd.maintenance[releaseID]
+}
+
+// holdReason returns why the job can't be handled now, or an empty string if
+// it can. It also returns the end of the freeze that holds the job, if any.
+func (fd *FileDeployer) holdReason(job job) (string, time.Time, error) {
+	releaseIDs := []string{job.releaseID}
+	for _, member := range job.members {
+		releaseIDs = append(releaseIDs, member.releaseID)
+	}
+
+	for _, releaseID := range releaseIDs {
+		if fd.inMaintenance(releaseID) {
+			return fmt.Sprintf("%q is in maintenance", releaseID), time.Time{}, nil
+		}
+	}
+
+	freezes, err := fd.activeFreezes()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	for _, releaseID := range releaseIDs {
+		freeze, found := freezes[releaseID]
+		if found {
+			return fmt.Sprintf("%q is frozen until %s: %s", releaseID,
+				freeze.Until.Format(time.RFC3339), freeze.Reason), freeze.Until, nil
+		}
+	}
+
+	return "", time.Time{}, nil
+}
+
+// deferJob keeps the job until its release, or one of its members, is no
+// longer in maintenance or frozen, and returns true if it is.
+func (fd *FileDeployer) deferJob(job job) bool {
+	reason, until, err := fd.holdReason(job)
+	if err != nil {
+		// a freeze that can't be read doesn't block the deployments
+		fd.jobLogger(job, logs.PhaseQueue).Err(err).Msg("failed to check freezes")
+		return false
+	}
+
+	if reason == "" {
+		return false
+	}
+
+	fd.addDeferred(job.releaseID, job)
+
+	if !until.IsZero() {
+		time.AfterFunc(time.Until(until), fd.resumeDeferred)
+	}
+
+	err = fd.saveJobStatus(job, "deferred", reason)
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseQueue).Err(err).Msg("failed to save deferred status")
+	}
+
+	return true
+}
+
+// resumeDeferred queues again the deferred jobs that are no longer held, in
+// order.
+func (fd *FileDeployer) resumeDeferred() {
+	fd.Lock()
+	deferred := fd.deferred
+	fd.deferred = nil
+	fd.Unlock()
+
+	for releaseID, jobs := range deferred {
+		var held []job
+
+		for _, job := range jobs {
+			reason, _, err := fd.holdReason(job)
+			if err == nil && reason != "" {
+				held = append(held, job)
+				continue
+			}
+
+			err = fd.enqueue(job)
+			if err != nil {
+				fd.fail(job, fmt.Sprintf("failed to resume job: %v", err))
+			}
+		}
+
+		if len(held) == 0 {
+			continue
+		}
+
+		fd.Lock()
+
+		if fd.deferred == nil {
+			fd.deferred = make(map[string][]job)
+		}
+
+		// the jobs deferred meanwhile are more recent
+		fd.deferred[releaseID] = append(held, fd.deferred[releaseID]...)
+
+		fd.Unlock()
+	}
+}
+
+// addDeferred safely adds a deferred job of a release, after the ones already
+// deferred
+func (fd *FileDeployer) addDeferred(releaseID string, deferred job) {
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.deferred == nil {
+		fd.deferred = make(map[string][]job)
+	}
+
+	fd.deferred[releaseID] = append(fd.deferred[releaseID], deferred)
+}
+
+// freezeKey returns the database key of a freeze
+func freezeKey(freezeID string) string {
+	return "freeze:" + freezeID
+}
+
+// Freeze implements deployer.Deployer
+func (fd *FileDeployer) Freeze(freeze Freeze) (Freeze, error) {
+	if len(freeze.ReleaseIDs) == 0 {
+		return freeze, errors.New("no release to freeze")
+	}
+
+	for _, releaseID := range freeze.ReleaseIDs {
+		_, found := fd.getConfig().Entries[releaseID]
+		if !found {
+			return freeze, fmt.Errorf("releaseID %q not found from the config", releaseID)
+		}
+	}
+
+	if !freeze.Until.After(time.Now()) {
+		return freeze, errors.New("the freeze must end in the future")
+	}
+
+	if freeze.Reason == "" {
+		return freeze, errors.New("reason is missing")
+	}
+
+	if freeze.RequestedBy == "" {
+		return freeze, errors.New("requestedBy is missing")
+	}
+
+	freeze.ID = xid.New().String()
+	freeze.Until = freeze.Until.UTC()
+	freeze.CreatedAt = time.Now().UTC()
+	freeze.LiftedAt = nil
+	freeze.LiftedBy = ""
+
+	err := fd.saveFreeze(freeze)
+	if err != nil {
+		return freeze, err
+	}
+
+	fd.logger.Info().Str("freezeID", freeze.ID).Strs("releaseIDs", freeze.ReleaseIDs).
+		Str("requestedBy", freeze.RequestedBy).Time("until", freeze.Until).
+		Msgf("freeze declared: %s", freeze.Reason)
+
+	return freeze, nil
+}
+
+// LiftFreeze implements deployer.Deployer
+func (fd *FileDeployer) LiftFreeze(freezeID, liftedBy string) (Freeze, error) {
+	var freeze Freeze
+
+	if liftedBy == "" {
+		return freeze, errors.New("liftedBy is missing")
+	}
+
+	err := fd.db.View(func(tx store.Tx) error {
+		value, err := tx.Get(freezeKey(freezeID))
+		if err != nil {
+			return err
+		}
+
+		return fd.serde.Unmarshal([]byte(value), &freeze)
+	})
+
+	if err == store.ErrNotFound {
+		return freeze, ErrFreezeNotFound
+	}
+
+	if err != nil {
+		return freeze, fmt.Errorf("failed to get freeze: %v", err)
+	}
+
+	now := time.Now().UTC()
+
+	if !freeze.Active(now) {
+		return freeze, fmt.Errorf("freeze %q already ended", freezeID)
+	}
+
+	freeze.LiftedAt = &now
+	freeze.LiftedBy = liftedBy
+
+	err = fd.saveFreeze(freeze)
+	if err != nil {
+		return freeze, err
+	}
+
+	fd.logger.Info().Str("freezeID", freeze.ID).Strs("releaseIDs", freeze.ReleaseIDs).
+		Str("liftedBy", liftedBy).Msg("freeze lifted")
+
+	fd.resumeDeferred()
+
+	return freeze, nil
+}
+
+// saveFreeze saves the freeze
+func (fd *FileDeployer) saveFreeze(freeze Freeze) error {
+	buf, err := fd.serde.Marshal(&freeze)
+	if err != nil {
+		return fmt.Errorf("failed to marshal freeze: %v", err)
+	}
+
+	err = fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(freezeKey(freeze.ID), string(buf))
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save freeze: %v", err)
+	}
+
+	return nil
+}
+
+// GetFreezes implements deployer.Deployer
+func (fd *FileDeployer) GetFreezes() ([]Freeze, error) {
+	freezes := []Freeze{}
+
+	var decodeErr error
+
+	// freeze IDs are sortable by time
+	err := fd.db.View(func(tx store.Tx) error {
+		return tx.Iterate(freezeKey(""), true, func(key, value string) bool {
+			var freeze Freeze
+
+			decodeErr = fd.serde.Unmarshal([]byte(value), &freeze)
+			if decodeErr != nil {
+				decodeErr = fmt.Errorf("failed to unmarshal freeze %q: %v", key, decodeErr)
+				return false
+			}
+
+			freezes = append(freezes, freeze)
+
+			return true
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get freezes: %v", err)
+	}
+
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return freezes, nil
+}
+
+// activeFreezes returns the active freezes by releaseID. If several freezes
+// affect a release, it returns the one that ends last.
+func (fd *FileDeployer) activeFreezes() (map[string]Freeze, error) {
+	freezes, err := fd.GetFreezes()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := make(map[string]Freeze)
+
+	for _, freeze := range freezes {
+		if !freeze.Active(now) {
+			continue
+		}
+
+		for _, releaseID := range freeze.ReleaseIDs {
+			current, found := active[releaseID]
+			if !found || freeze.Until.After(current.Until) {
+				active[releaseID] = freeze
+			}
+		}
+	}
+
+	return active, nil
+}
+
+// Rollback implements deployer.Deployer
+func (fd *FileDeployer) Rollback(releaseID string) (string, error) {
+	fd.logger.Info().Str(logs.ReleaseIDKey, releaseID).Msg("rolling back release")
+
+	if fd.getStop() {
+		return "", errors.New("deployer is stopped")
+	}
+
+	_, found := fd.getConfig().Entries[releaseID]
+	if !found {
+		return "", fmt.Errorf("releaseID %q not found from the config", releaseID)
+	}
+
+	previous, err := fd.getPrevious(releaseID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(previous) == 0 {
+		return "", ErrNoPrevious
+	}
+
+	job := newJob(Request{
+		ReleaseID: releaseID,
+		Tag:       previous[0].Tag,
+		Subpath:   previous[0].Subpath,
+	})
+
+	job.rollback = true
+
+	err = fd.enqueue(job)
+	if err != nil {
+		return "", err
+	}
+
+	return job.id, nil
+}
+
+// Promote implements deployer.Deployer. The job is given the checksum of the
+// archive, so that it fails if the archive changes before it is deployed.
+func (fd *FileDeployer) Promote(releaseID string) (string, error) {
+	fd.logger.Info().Str(logs.ReleaseIDKey, releaseID).Msg("promoting release")
+
+	if fd.getStop() {
+		return "", errors.New("deployer is stopped")
+	}
+
+	entry, found := fd.getConfig().Entries[releaseID]
+	if !found {
+		return "", fmt.Errorf("releaseID %q not found from the config", releaseID)
+	}
+
+	if entry.Promote == "" {
+		return "", ErrNoPromotion
+	}
+
+	var tag string
+
+	err := fd.db.View(func(tx store.Tx) error {
+		var err error
+
+		tag, err = tx.Get(releaseID)
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return "", ErrNoArchive
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get tag: %v", err)
+	}
+
+	cache := newArchiveCache(releaseID, entry.Delta.Cache, entry.Target)
+
+	// the cached archive is replaced before the swap, it may be the one of a
+	// job that failed afterwards
+	cachedTag, err := cache.baseTag()
+	if err != nil {
+		return "", fmt.Errorf("failed to read cached tag: %v", err)
+	}
+
+	if cachedTag != tag {
+		return "", ErrNoArchive
+	}
+
+	sum, err := fileSHA256(cache.archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash archive: %v", err)
+	}
+
+	job := newJob(Request{
+		ReleaseID: entry.Promote,
+		Tag:       tag,
+		SHA256:    sum,
+	})
+
+	job.promoted = releaseID
+
+	err = fd.enqueue(job)
+	if err != nil {
+		return "", err
+	}
+
+	return job.id, nil
+}
+
+// newMembers returns the jobs of a group's members, each with its asset
+// selected among the request's assets. Their created status is saved.
+func (fd *FileDeployer) newMembers(req Request, entry config.Entry) ([]job, error) {
+	members := make([]job, len(entry.Group))
+
+	for i, releaseID := range entry.Group {
+		releaseURL, err := fd.SelectAsset(releaseID, req.Assets)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select asset of %q: %v", releaseID, err)
+		}
+
+		members[i] = newJob(Request{
+			ReleaseID:  releaseID,
+			Tag:        req.Tag,
+			RequestID:  req.RequestID,
+			ReleaseURL: releaseURL,
+			Notes:      req.Notes,
+			Sender:     req.Sender,
+		})
+
+		err = fd.saveJobStatus(members[i], "created", "job has been created")
+		if err != nil {
+			return nil, fmt.Errorf("failed to set job status: %v", err)
+		}
+	}
+
+	return members, nil
+}
+
+// enqueue saves the created status of the job and adds it to the queue
+func (fd *FileDeployer) enqueue(job job) error {
+	err := fd.saveJobStatus(job, "created", "job has been created")
+	if err != nil {
+		return fmt.Errorf("failed to set job status: %v", err)
+	}
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.stop {
+		return errors.New("deployer is stopped")
+	}
+
+	if len(fd.jobs)+fd.pending.len() >= QueueSize {
+		return errors.New("buffer is full, re-try later")
+	}
+
+	select {
+	case fd.jobs <- job:
+		return nil
+	default:
+		return errors.New("buffer is full, re-try later")
+	}
+}
+
+// triggerChained deploys the releases that are after the job's release, from
+// their chain URL and with the job's tag. It returns the IDs of the created
+// jobs. A release already in the job's chain is skipped, so that chained jobs
+// never loop.
+func (fd *FileDeployer) triggerChained(parent job) []string {
+	chain := append(append([]string{}, parent.chain...), parent.releaseID)
+
+	releaseIDs := make([]string, 0)
+
+	for releaseID, entry := range fd.getConfig().Entries {
+		for _, after := range entry.After {
+			if after == parent.releaseID {
+				releaseIDs = append(releaseIDs, releaseID)
+				break
+			}
+		}
+	}
+
+	sort.Strings(releaseIDs)
+
+	var jobIDs []string
+
+	for _, releaseID := range releaseIDs {
+		logger := fd.jobLogger(parent, "").With().Str("chained", releaseID).Logger()
+
+		if contains(chain, releaseID) {
+			logger.Warn().Msgf("skipping chained release already in %v", chain)
+			continue
+		}
+
+		rawURL := strings.ReplaceAll(fd.getConfig().Entries[releaseID].ChainURL, "{tag}", parent.tag)
+
+		releaseURL, err := url.ParseRequestURI(rawURL)
+		if err != nil {
+			logger.Err(err).Msgf("wrong chain url %q", rawURL)
+			continue
+		}
+
+		job := newJob(Request{
+			ReleaseID:  releaseID,
+			Tag:        parent.tag,
+			RequestID:  parent.requestID,
+			ReleaseURL: releaseURL,
+		})
+
+		job.chain = chain
+
+		err = fd.enqueue(job)
+		if err != nil {
+			logger.Err(err).Msg("failed to trigger chained release")
+			continue
+		}
+
+		logger.Info().Msgf("triggered chained job %s", job.id)
+
+		jobIDs = append(jobIDs, job.id)
+	}
+
+	return jobIDs
+}
+
+// contains returns true if the element is in the list
+func contains(list []string, element string) bool {
+	for _, e := range list {
+		if e == element {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueueLength implements deployer.Deployer
+func (fd *FileDeployer) QueueLength() int {
+	fd.Lock()
+	defer fd.Unlock()
+
+	return len(fd.jobs) + fd.pending.len()
+}
+
+// GetStatus implements deployer.Deployer
+func (fd *FileDeployer) GetStatus(key string) (JobStatus, error) {
+	jobStatus, err := fd.getJobStatus(key)
+	if err != nil {
+		return jobStatus, err
+	}
+
+	if len(jobStatus.Chained) != 0 {
+		jobStatus.Combined, err = fd.combinedStatus(jobStatus)
+		if err != nil {
+			return jobStatus, fmt.Errorf("failed to get combined status: %v", err)
+		}
+	}
+
+	return jobStatus, nil
+}
+
+// SetStatus implements deployer.Deployer. The built-in statuses other than
+// "running" are only set by the deployer.
+func (fd *FileDeployer) SetStatus(jobID, status, message string) error {
+	if status != "running" {
+		_, builtin := statusTransitions[status]
+		if builtin {
+			return fmt.Errorf("%w: %q is set by the deployer", ErrTransition, status)
+		}
+	}
+
+	saved, err := fd.getJobStatus(jobID)
+	if err != nil {
+		return err
+	}
+
+	// the job is rebuilt from its status, so that the saved fields are kept
+	j := job{
+		id:        jobID,
+		releaseID: saved.ReleaseID,
+		tag:       saved.Tag,
+		requestID: saved.RequestID,
+		chained:   saved.Chained,
+		promoted:  saved.Promoted,
+	}
+
+	for _, memberID := range saved.Group {
+		j.members = append(j.members, job{id: memberID})
+	}
+
+	err = fd.saveJobStatus(j, status, message)
+	if err != nil {
+		return err
+	}
+
+	fd.jobLogger(j, "").Info().Msgf("status set to %q: %s", status, message)
+
+	return nil
+}
+
+// combinedStatus returns the status of a job and of its chained jobs,
+// recursively.
+func (fd *FileDeployer) combinedStatus(status JobStatus) (string, error) {
+	switch status.Status {
+	case "failed":
+		return "failed", nil
+	case "ok":
+	default:
+		return "running", nil
+	}
+
+	combined := "ok"
+
+	for _, jobID := range status.Chained {
+		chained, err := fd.getJobStatus(jobID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get chained job %q: %v", jobID, err)
+		}
+
+		chainedStatus, err := fd.combinedStatus(chained)
+		if err != nil {
+			return "", err
+		}
+
+		switch chainedStatus {
+		case "failed":
+			return "failed", nil
+		case "running":
+			combined = "running"
+		}
+	}
+
+	return combined, nil
+}
+
+// getJobStatus returns the saved status of a job
+func (fd *FileDeployer) getJobStatus(key string) (JobStatus, error) {
+	var jobStatus JobStatus
+	var statusBuf string
+	var err error
+
+	err = fd.db.View(func(tx store.Tx) error {
+		statusBuf, err = tx.Get(key)
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return jobStatus, fmt.Errorf("key %q not found", key)
+	}
+
+	if err != nil {
+		return jobStatus, fmt.Errorf("failed to get status: %v", err)
+	}
+
+	err = fd.serde.Unmarshal([]byte(statusBuf), &jobStatus)
+	if err != nil {
+		return jobStatus, fmt.Errorf("failed to unmarshal job status: %v", err)
+	}
+
+	return jobStatus, nil
+}
+
+// initialTag returns the tag of a release that Hodor never deployed: the
+// entry's initial tag, or the configured placeholder.
+func (fd *FileDeployer) initialTag(releaseID string) string {
+	conf := fd.getConfig()
+
+	tag := conf.Entries[releaseID].InitialTag
+	if tag != "" {
+		return tag
+	}
+
+	if conf.UnknownTag != "" {
+		return conf.UnknownTag
+	}
+
+	return "unknown"
+}
+
+// GetLatestTag implements deployer.Deployer
+func (fd *FileDeployer) GetLatestTag(releaseID string) (string, error) {
+	var tag string
+	var err error
+
+	err = fd.db.View(func(tx store.Tx) error {
+		tag, err = tx.Get(releaseID)
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return fd.initialTag(releaseID), nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get tag: %v", err)
+	}
+
+	return tag, nil
+}
+
+// GetHistory implements deployer.Deployer
+func (fd *FileDeployer) GetHistory(releaseID string) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+
+	err := fd.descend(historyPrefix(releaseID), func(key, value string) error {
+		var entry HistoryEntry
+
+		err := fd.serde.Unmarshal([]byte(value), &entry)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal history entry %q: %v", key, err)
+		}
+
+		history = append(history, entry)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// GetFailures implements deployer.Deployer
+func (fd *FileDeployer) GetFailures(releaseID string) ([]Failure, error) {
+	failures := []Failure{}
+
+	err := fd.descend(failuresPrefix(releaseID), func(key, value string) error {
+		var failure Failure
+
+		err := fd.serde.Unmarshal([]byte(value), &failure)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal failure %q: %v", key, err)
+		}
+
+		failures = append(failures, failure)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+// descend calls fn on the keys of a "<kind>:<releaseID>:" prefix, from the
+// last one. It stops at the first error.
+func (fd *FileDeployer) descend(prefix string, fn func(key, value string) error) error {
+	var err error
+
+	dbErr := fd.db.View(func(tx store.Tx) error {
+		return tx.Iterate(prefix, true, func(key, value string) bool {
+			// the prefix also matches the releaseIDs that start with
+			// "<releaseID>:"
+			if strings.Contains(strings.TrimPrefix(key, prefix), ":") {
+				return true
+			}
+
+			err = fn(key, value)
+
+			return err == nil
+		})
+	})
+
+	if dbErr != nil {
+		return fmt.Errorf("failed to read %q: %v", prefix, dbErr)
+	}
+
+	return err
+}
+
+// saveFailure saves a failed job
+func (fd *FileDeployer) saveFailure(job job, message string) error {
+	failure := Failure{
+		JobID:     job.id,
+		ReleaseID: job.releaseID,
+		Tag:       job.tag,
+		RequestID: job.requestID,
+		FailedAt:  time.Now().UTC(),
+		Message:   message,
+	}
+
+	buf, err := fd.serde.Marshal(&failure)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failure: %v", err)
+	}
+
+	err = fd.db.Update(func(tx store.Tx) error {
+		return tx.Set(failuresPrefix(job.releaseID)+job.id, string(buf))
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save failure: %v", err)
+	}
+
+	return nil
+}
+
+// failuresPrefix returns the prefix of the database keys that store the
+// failed jobs of a release
+func failuresPrefix(releaseID string) string {
+	return "failure:" + releaseID + ":"
+}
+
+// saveHistory saves a successful deployment of the job. It must be called
+// before the job's tag is saved.
+func (fd *FileDeployer) saveHistory(job job, deployment deployment) error {
+	previousTag, err := fd.GetLatestTag(job.releaseID)
+	if err != nil {
+		return fmt.Errorf("failed to get previous tag: %v", err)
+	}
+
+	entry := HistoryEntry{
+		JobID:       job.id,
+		ReleaseID:   job.releaseID,
+		Tag:         job.tag,
+		PreviousTag: previousTag,
+		RequestID:   job.requestID,
+		DeployedAt:  time.Now().UTC(),
+		Duration:    deployment.duration,
+		Changes:     deployment.changes,
+		Notes:       deployment.notes,
+		Provenance:  deployment.provenance,
+		SBOM:        deployment.sbom,
+	}
+
+	buf, err := fd.serde.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %v", err)
+	}
+
+	// jobIDs are sorted by creation time, so are the keys
+	key := historyPrefix(job.releaseID) + job.id
+
+	err = fd.db.Update(func(tx store.Tx) error {
+		// an entry is never replaced, so that its provenance can be trusted
+		_, err := tx.Get(key)
+		if err == nil {
+			return fmt.Errorf("%q already exists", key)
+		}
+
+		if err != store.ErrNotFound {
+			return err
+		}
+
+		err = tx.Set(key, string(buf))
+		if err != nil {
+			return err
+		}
+
+		if deployment.sbom != nil {
+			err = tx.Set(sbomKey(job.releaseID, job.id), string(deployment.sbomContent))
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save history entry: %v", err)
+	}
+
+	return nil
+}
+
+// historyPrefix returns the prefix of the database keys that store the
+// history of a release
+func historyPrefix(releaseID string) string {
+	return "history:" + releaseID + ":"
+}
+
+// sbomKey returns the database key of the content of the SBOM deployed by a
+// job
+func sbomKey(releaseID, jobID string) string {
+	return "sbom:" + releaseID + ":" + jobID
+}
+
+// GetSBOM implements deployer.Deployer
+func (fd *FileDeployer) GetSBOM(releaseID string) (SBOM, []byte, error) {
+	history, err := fd.GetHistory(releaseID)
+	if err != nil {
+		return SBOM{}, nil, err
+	}
+
+	if len(history) == 0 || history[0].SBOM == nil {
+		return SBOM{}, nil, ErrNoSBOM
+	}
+
+	var content string
+
+	err = fd.db.View(func(tx store.Tx) error {
+		content, err = tx.Get(sbomKey(releaseID, history[0].JobID))
+		return err
+	})
+
+	if err != nil {
+		return SBOM{}, nil, fmt.Errorf("failed to get SBOM: %v", err)
+	}
+
+	return *history[0].SBOM, []byte(content), nil
+}
+
+// sbomFormats are the SBOM files looked for at the root of a release, by
+// pattern of their lowercase name, in order
+var sbomFormats = []struct {
+	pattern   string
+	format    string
+	mediaType string
+}{
+	{"*.spdx.json", "spdx", "application/spdx+json"},
+	{"*.spdx", "spdx", "text/spdx"},
+	{"*.cdx.json", "cyclonedx", "application/vnd.cyclonedx+json"},
+	{"*.cdx.xml", "cyclonedx", "application/vnd.cyclonedx+xml"},
+	{"bom.json", "cyclonedx", "application/vnd.cyclonedx+json"},
+	{"bom.xml", "cyclonedx", "application/vnd.cyclonedx+xml"},
+}
+
+// maxSBOMSize is the maximum size of a saved SBOM
+const maxSBOMSize = 8 * 1024 * 1024
+
+// readSBOM returns the SBOM file at the root of the release folder and its
+// content, or nil if there is none. If several files match, the first in the
+// order of sbomFormats, then by name, is taken.
+func readSBOM(releaseFolder string) (*SBOM, []byte, error) {
+	entries, err := os.ReadDir(releaseFolder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read release: %v", err)
+	}
+
+	for _, f := range sbomFormats {
+		for _, entry := range entries {
+			name := entry.Name()
+
+			match, _ := path.Match(f.pattern, strings.ToLower(name))
+			if !match || !entry.Type().IsRegular() {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to stat %q: %v", name, err)
+			}
+
+			if info.Size() > maxSBOMSize {
+				return nil, nil, fmt.Errorf("%q is larger than %d bytes", name, maxSBOMSize)
+			}
+
+			buf, err := os.ReadFile(filepath.Join(releaseFolder, name))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read %q: %v", name, err)
+			}
+
+			hash := sha256.Sum256(buf)
+
+			sbom := &SBOM{
+				File:      name,
+				Format:    f.format,
+				MediaType: f.mediaType,
+				SHA256:    hex.EncodeToString(hash[:]),
+				Size:      int64(len(buf)),
+			}
+
+			return sbom, buf, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// findSBOM returns the SBOM of the release folder. The SBOM is only
+// informative, so a failure to read it is logged and doesn't fail the job.
+func (fd *FileDeployer) findSBOM(job job, releaseFolder string) (*SBOM, []byte) {
+	sbom, content, err := readSBOM(releaseFolder)
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to get SBOM: %v", err)
+		return nil, nil
+	}
+
+	if sbom != nil {
+		fd.jobLogger(job, logs.PhaseSwap).Info().Msgf("found %s SBOM %q", sbom.Format, sbom.File)
+	}
+
+	return sbom, content
+}
+
+// readNotes returns the content of the release notes file in the release
+// folder, or an empty string if there is none. The content is truncated to
+// maxNotesSize.
+func readNotes(releaseFolder string) (string, error) {
+	file, err := os.Open(filepath.Join(releaseFolder, notesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to open notes: %v", err)
+	}
+
+	defer file.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(file, maxNotesSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read notes: %v", err)
+	}
+
+	return string(buf), nil
+}
+
+// SelectAsset implements deployer.Deployer
+func (fd *FileDeployer) SelectAsset(releaseID string, assets []asset.Asset) (*url.URL, error) {
+	entry, found := fd.getConfig().Entries[releaseID]
+	if !found {
+		return nil, fmt.Errorf("releaseID %q not found from the config", releaseID)
+	}
+
+	if len(entry.Group) != 0 {
+		for _, member := range entry.Group {
+			_, err := asset.Select(assets, fd.getConfig().Entries[member].Assets)
+			if err != nil {
+				return nil, fmt.Errorf("failed to select asset of %q: %v", member, err)
+			}
+		}
+
+		return nil, nil
+	}
+
+	selected, err := asset.Select(assets, entry.Assets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select asset: %v", err)
+	}
+
+	fd.logger.Info().Str(logs.ReleaseIDKey, releaseID).
+		Msgf("selected asset %q", selected.Name)
+
+	releaseURL, err := url.ParseRequestURI(selected.BrowserDownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("wrong url for asset %q: %v", selected.Name, err)
+	}
+
+	return releaseURL, nil
+}
+
+// CheckURL implements deployer.Deployer
+func (fd *FileDeployer) CheckURL(releaseID string, u *url.URL) error {
+	if u.Scheme != "http" {
+		return nil
+	}
+
+	conf := fd.getConfig()
+
+	if conf.AllowHTTP {
+		return nil
+	}
+
+	for _, host := range conf.Entries[releaseID].HTTPMirrors {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrInsecureURL, u.Redacted())
+}
+
+// maxRedirects is the number of redirects followed by do, as by default in
+// net/http
+const maxRedirects = 10
+
+// do sends the request. If the client is an *http.Client, each redirect is
+// checked with CheckURL before it is followed, so that the request and its
+// headers are never sent to a plain HTTP URL that is not allowed. releaseID can
+// be empty.
+func (fd *FileDeployer) do(releaseID string, req *http.Request) (*http.Response, error) {
+	client, ok := fd.client.(*http.Client)
+	if !ok {
+		return fd.client.Do(req)
+	}
+
+	checked := *client
+	checked.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		err := fd.CheckURL(releaseID, next.URL)
+		if err != nil {
+			return fmt.Errorf("redirected: %w", err)
+		}
+
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(next, via)
+		}
+
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		return nil
+	}
+
+	return checked.Do(req)
+}
+
+// checkRedirect returns ErrInsecureURL if the request of the response was
+// redirected to a plain HTTP URL that is not allowed. It covers the clients
+// whose redirects are not checked by do.
+func (fd *FileDeployer) checkRedirect(releaseID string, res *http.Response) error {
+	if res.Request == nil || res.Request.URL == nil {
+		return nil
+	}
+
+	err := fd.CheckURL(releaseID, res.Request.URL)
+	if err != nil {
+		return fmt.Errorf("redirected: %w", err)
+	}
+
+	return nil
+}
+
+// maxListEntries is the maximum number of entries of a listed archive, and
+// maxListSize the maximum size of the archive, compressed or not, so that
+// listing any URL has a bounded cost
+const (
+	maxListEntries = 10000
+	maxListSize    = 1 << 30
+)
+
+// List implements deployer.Deployer
+func (fd *FileDeployer) List(ctx context.Context, releaseURL *url.URL) (Listing, error) {
+	listing := Listing{Entries: []ListingEntry{}}
+
+	req, err := fd.newRequest(ctx, "", releaseURL)
+	if err != nil {
+		return listing, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	res, err := fd.do("", req)
+	if err != nil {
+		return listing, fmt.Errorf("failed to get file: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	err = fd.checkRedirect("", res)
+	if err != nil {
+		return listing, fmt.Errorf("failed to get file: %v", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return listing, fmt.Errorf("failed to get file: unexpected status %q", res.Status)
+	}
+
+	gzr, err := gzip.NewReader(&limitedBody{ReadCloser: res.Body, max: maxListSize})
+	if err != nil {
+		return listing, fmt.Errorf("failed to create reader: %v", err)
+	}
+
+	defer gzr.Close()
+
+	tr := tar.NewReader(&limitedBody{ReadCloser: gzr, max: maxListSize})
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return listing, fmt.Errorf("failed to get next: %v", err)
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		if len(listing.Entries) >= maxListEntries {
+			return listing, fmt.Errorf("archive has more than %d entries", maxListEntries)
+		}
+
+		entry := ListingEntry{
+			Name: header.Name,
+			Size: header.Size,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.Type = "dir"
+		case tar.TypeReg, tar.TypeGNUSparse:
+			entry.Type = "file"
+			listing.Files++
+			listing.TotalSize += header.Size
+		case tar.TypeSymlink:
+			entry.Type = "symlink"
+		default:
+			entry.Type = "other"
+		}
+
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	return listing, nil
+}
+
+// jobLogger returns the logger used for the lines about a job, with the job's
+// fields and the phase, if not empty.
+func (fd *FileDeployer) jobLogger(job job, phase string) *zerolog.Logger {
+	logger := logs.WithJob(fd.logger, job.id, job.releaseID, job.tag, job.requestID)
+
+	if phase != "" {
+		logger = logs.WithPhase(logger, phase)
+	}
+
+	if job.capture != nil {
+		logger = logger.Hook(captureHook{w: job.capture.log, phase: phase})
+	}
+
+	return &logger
+}
+
+// deployment contains the information about a successful job
+type deployment struct {
+	// notes are the release notes, if the entry captures them
+	notes    string
+	duration time.Duration
+	changes  Changes
+	// manifest is the record of the deployed files, if any
+	manifest *manifest
+	// provenance is the origin of the deployed archive, if any
+	provenance *Provenance
+	// sbom is the SBOM found in the release and its content, if any
+	sbom        *SBOM
+	sbomContent []byte
+}
+
+// handleJob is called by the queue processor and processes a job. It downloads,
+// extracts, and deploys a release.
+func (fd *FileDeployer) handleJob(job job) (deployment, error) {
+	fd.jobLogger(job, "").Info().Msg("starting job")
+
+	start := time.Now()
+
+	conf := fd.getConfig()
+
+	entry, found := conf.Entries[job.releaseID]
+	if !found {
+		return deployment{}, fmt.Errorf("releaseID %q not found from the config", job.releaseID)
+	}
+
+	subpath := job.subpath
+	if subpath == "" {
+		subpath = entry.Subpath
+	}
+
+	targetFolder, err := subpathTarget(entry.Target, subpath)
+	if err != nil {
+		return deployment{}, fmt.Errorf("wrong subpath: %v", err)
+	}
+
+	unlock, err := fd.lockTarget(job, entry.Target)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to lock target: %v", err)
+	}
+
+	defer unlock()
+
+	err = fd.checkOwnership(job.releaseID, entry)
+	if err != nil {
+		return deployment{}, fmt.Errorf("wrong target: %v", err)
+	}
+
+	provenance := &Provenance{
+		Checksum: "none",
+		Promoted: job.promoted,
+		Sender:   job.sender,
+	}
+
+	job.progress = fd.newProgressTracker(job)
+
+	archive, keepArchive, err := fd.openArchive(job, entry, provenance)
+	if errors.Is(err, ErrInsufficientSpace) {
+		return deployment{}, err
+	}
+
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to get file: %v", err)
+	}
+
+	defer archive.Close()
+
+	tmpDest, err := stagingDir(job, entry.Staging, targetFolder,
+		entry.DirMode.Or(conf.DirMode.Or(defaultDirMode)))
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to create tmp dir: %v", err)
+	}
+
+	fd.jobLogger(job, logs.PhaseExtract).Info().Msgf("using temp folder %q", tmpDest)
+
+	defer os.RemoveAll(tmpDest)
+
+	var checksums []string
+
+	for _, checksum := range []string{job.sha256, entry.SHA256} {
+		if checksum != "" {
+			checksums = append(checksums, checksum)
+		}
+	}
+
+	var reader io.Reader = archive
+
+	// a cached archive is extracted from its file, once downloaded
+	f, ok := archive.(*os.File)
+	if ok && len(checksums) == 0 {
+		reader = job.progress.extract(f)
+	}
+
+	// the captured archive is read to its end, even if the job fails before
+	if job.capture != nil {
+		reader = io.TeeReader(reader, job.capture.archive)
+		defer io.Copy(io.Discard, reader)
+	}
+
+	// the archive is hashed as it is read, for its provenance
+	hash := sha256.New()
+	source := io.TeeReader(reader, hash)
+
+	// the archive is saved before it is extracted if it must be checked as a
+	// whole
+	if len(checksums) != 0 || entry.ClamAV.Address != "" {
+		verified, err := saveVerified(source, filepath.Dir(tmpDest), job.id, checksums)
+		if err != nil {
+			return deployment{}, fmt.Errorf("failed to verify archive: %v", err)
+		}
+
+		defer os.Remove(verified.Name())
+		defer verified.Close()
+
+		if len(checksums) != 0 {
+			fd.jobLogger(job, logs.PhaseDownload).Info().Msg("archive matches its checksum")
+			provenance.Checksum = "verified"
+		}
+
+		if entry.ClamAV.Address != "" {
+			err = fd.clamScan(job, entry, verified)
+			if err != nil {
+				return deployment{}, err
+			}
+		}
+
+		source = job.progress.extract(verified)
+	}
+
+	opts := extractOptions{
+		xattrs:   entry.Xattrs,
+		dirMode:  entry.DirMode.Or(conf.DirMode.Or(defaultDirMode)),
+		fileMode: entry.FileMode.Or(conf.FileMode.Or(defaultFileMode)),
+		flat:     entry.FlatArchive,
+		maxSize:  int64(entry.MaxSize),
+		onFile:   job.progress.file,
+	}
+
+	limits := conf.Limits
+	if entry.Limits != nil {
+		limits = *entry.Limits
+	}
+
+	var tarRootFolder string
+
+	err = withLimits(limits, func() error {
+		tarRootFolder, err = saveTar(source, tmpDest, opts)
+		return err
+	})
+
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to save tar file: %v", err)
+	}
+
+	// the end of the archive, such as the padding after the tar, may not be
+	// read by the extraction
+	_, err = io.Copy(io.Discard, source)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to read archive: %v", err)
+	}
+
+	provenance.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	job.progress.save()
+
+	// the archive is only kept once it is known to be valid
+	err = keepArchive()
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseDownload).Warn().Msgf("failed to cache archive: %v", err)
+	}
+
+	releaseFolder := filepath.Join(tmpDest, tarRootFolder)
+	env := hookEnv(job, entry)
+
+	cred, sandbox, err := hookSettings(entry)
+	if err != nil {
+		return deployment{}, err
+	}
+
+	if cred != nil {
+		// the private staging folder is also given, so that the account
+		// can enter the release
+		err = hook.Chown(tmpDest, cred)
+		if err != nil {
+			return deployment{}, fmt.Errorf("failed to change owner: %v", err)
+		}
+	}
+
+	var notes string
+
+	if entry.ReleaseNotes {
+		notes = job.notes
+
+		if notes == "" {
+			notes, err = readNotes(releaseFolder)
+			if err != nil {
+				return deployment{}, fmt.Errorf("failed to get release notes: %v", err)
+			}
+		}
+	}
+
+	sbom, sbomContent := fd.findSBOM(job, releaseFolder)
+
+	if entry.Scan.URL != "" {
+		err = fd.scanRelease(job, entry.Scan, tmpDest, releaseFolder, sbom, sbomContent)
+		if err != nil {
+			return deployment{}, err
+		}
+	}
+
+	err = fd.runHooks(job, logs.PhasePreDeploy, entry.PreDeploy, releaseFolder, env, cred, sandbox)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to run pre-deploy hooks: %v", err)
+	}
+
+	fd.jobLogger(job, logs.PhaseSwap).Info().Msgf("deploying to %q", targetFolder)
+
+	// the changes are only informative, a failure doesn't fail the job
+	diffTarget := targetFolder
+	if resolved, err := filepath.EvalSymlinks(targetFolder); err == nil {
+		diffTarget = resolved
+	}
+
+	changes, err := diffTrees(releaseFolder, diffTarget, entry.Strategy != config.StrategyUpdate)
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to count changes: %v", err)
+	}
+
+	files, err := listFiles(releaseFolder)
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to list files: %v", err)
+	}
+
+	if targetFolder != entry.Target {
+		err = os.MkdirAll(filepath.Dir(targetFolder), opts.dirMode)
+		if err != nil {
+			return deployment{}, fmt.Errorf("failed to create subpath parent: %v", err)
+		}
+	}
+
+	var previous *previousRelease
+
+	if entry.Strategy == config.StrategySymlink {
+		previous, err = fd.swapSymlink(job, releaseFolder, targetFolder, subpath, opts.dirMode)
+		if err != nil {
+			return deployment{}, err
+		}
+	} else if entry.Strategy == "" || entry.Strategy == config.StrategyReplace {
+		previous, err = fd.swapReplace(job, tmpDest, releaseFolder, targetFolder, subpath,
+			entry.Keep > 0)
+		if err != nil {
+			return deployment{}, err
+		}
+	} else {
+		err = swap(entry.Strategy, releaseFolder, targetFolder, opts.dirMode)
+		if err != nil {
+			return deployment{}, err
+		}
+	}
+
+	// without keep, the previous release of a symlink is removed right away
+	if previous != nil {
+		err = fd.pushPrevious(job.releaseID, *previous, entry)
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to save previous release: %v", err)
+		}
+	}
+
+	if entry.Restorecon {
+		out, err := fd.hooks.Execute(hook.Command{
+			Line: "restorecon -R .",
+			Dir:  targetFolder,
+		})
+		if err != nil {
+			return deployment{}, fmt.Errorf("failed to restore SELinux contexts: %v: %s", err, out)
+		}
+	}
+
+	err = fd.runHooks(job, logs.PhasePostDeploy, entry.PostDeploy, entry.Target, env, cred, sandbox)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to run post-deploy hooks: %v", err)
+	}
+
+	fd.jobLogger(job, "").Info().Msg("job done")
+
+	d := deployment{
+		notes:       notes,
+		duration:    time.Since(start),
+		changes:     changes,
+		provenance:  provenance,
+		sbom:        sbom,
+		sbomContent: sbomContent,
+	}
+
+	if files != nil {
+		d.manifest = &manifest{
+			Tag:     job.tag,
+			Target:  entry.Target,
+			Subpath: subpath,
+			Files:   files,
+		}
+
+		if job.releaseURL != nil {
+			d.manifest.ReleaseURL = job.releaseURL.String()
+		}
+	}
+
+	return d, nil
+}
+
+// handleRollback restores the most recent previous release of the job's
+// release in place of its target, which is removed, and runs the post-deploy
+// hooks.
+func (fd *FileDeployer) handleRollback(job job) (deployment, error) {
+	fd.jobLogger(job, "").Info().Msg("starting rollback")
+
+	start := time.Now()
+
+	entry, found := fd.getConfig().Entries[job.releaseID]
+	if !found {
+		return deployment{}, fmt.Errorf("releaseID %q not found from the config", job.releaseID)
+	}
+
+	unlock, err := fd.lockTarget(job, entry.Target)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to lock target: %v", err)
+	}
+
+	defer unlock()
+
+	// another job may have changed the previous releases since it was queued
+	kept, err := fd.getPrevious(job.releaseID)
+	if err != nil {
+		return deployment{}, err
+	}
+
+	if len(kept) == 0 {
+		return deployment{}, ErrNoPrevious
+	}
+
+	previous := kept[0]
+
+	targetFolder, err := subpathTarget(entry.Target, previous.Subpath)
+	if err != nil {
+		return deployment{}, fmt.Errorf("wrong subpath: %v", err)
+	}
+
+	folder, err := previousFolder(entry, previous)
+	if err != nil {
+		return deployment{}, err
+	}
+
+	files, err := listFiles(folder)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to list previous release: %v", err)
+	}
+
+	// the restored release keeps its SBOM
+	sbom, sbomContent := fd.findSBOM(job, folder)
+
+	fd.jobLogger(job, logs.PhaseSwap).Info().Msgf("restoring %q to %q", previous.Tag, targetFolder)
+
+	var current string
+
+	if entry.Strategy == config.StrategySymlink {
+		name, ok := linkedRelease(targetFolder)
+		if ok {
+			current = filepath.Join(releasesDir(targetFolder), name)
+		}
+
+		err = replaceSymlink(folder, targetFolder)
+		if err != nil {
+			return deployment{}, fmt.Errorf("failed to restore previous release: %v", err)
+		}
+	} else {
+		// the target is renamed first, so that it can be restored if the
+		// previous release can't be renamed
+		current = filepath.Join(previousDir(targetFolder), job.id)
+
+		err = os.Rename(targetFolder, current)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return deployment{}, fmt.Errorf("failed to move target: %v", err)
+		}
+
+		err = os.Rename(folder, targetFolder)
+		if err != nil {
+			os.Rename(current, targetFolder)
+			return deployment{}, fmt.Errorf("failed to restore previous release: %v", err)
+		}
+	}
+
+	if current != "" {
+		err = os.RemoveAll(current)
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to remove rolled back target: %v", err)
+		}
+	}
+
+	err = fd.savePrevious(job.releaseID, kept[1:])
+	if err != nil {
+		fd.jobLogger(job, logs.PhaseSwap).Warn().Msgf("failed to save previous releases: %v", err)
+	}
+
+	cred, sandbox, err := hookSettings(entry)
+	if err != nil {
+		return deployment{}, err
+	}
+
+	err = fd.runHooks(job, logs.PhasePostDeploy, entry.PostDeploy, entry.Target,
+		hookEnv(job, entry), cred, sandbox)
+	if err != nil {
+		return deployment{}, fmt.Errorf("failed to run post-deploy hooks: %v", err)
+	}
+
+	fd.jobLogger(job, "").Info().Msg("job done")
+
+	return deployment{
+		duration: time.Since(start),
+		manifest: &manifest{
+			Tag:        previous.Tag,
+			ReleaseURL: previous.ReleaseURL,
+			Target:     entry.Target,
+			Subpath:    previous.Subpath,
+			Files:      files,
+		},
+		sbom:        sbom,
+		sbomContent: sbomContent,
+	}, nil
+}
+
+// tmpfsDir is the tmpfs folder used to extract the releases in memory
+var tmpfsDir = "/dev/shm"
+
+// stagingDir creates the private folder where the job's release is extracted,
+// according to the staging. The missing parents of the target are created
+// with dirMode.
+func stagingDir(job job, staging config.Staging, target string,
+	dirMode os.FileMode) (string, error) {
+
+	var parent string
+
+	switch staging {
+	case "":
+	case config.StagingTmpfs:
+		info, err := os.Stat(tmpfsDir)
+		if err != nil || !info.IsDir() {
+			return "", fmt.Errorf("tmpfs %q is not available", tmpfsDir)
+		}
+
+		parent = tmpfsDir
+	case config.StagingDisk:
+		parent = filepath.Dir(target)
+
+		err := os.MkdirAll(parent, dirMode)
+		if err != nil {
+			return "", fmt.Errorf("failed to create %q: %v", parent, err)
+		}
+	default:
+		return "", fmt.Errorf("unknown staging %q", staging)
+	}
+
+	dir, err := os.MkdirTemp(parent, ".hodor-"+job.id+"-")
+	if err != nil {
+		return "", err
+	}
+
+	// only Hodor can read the release until it is deployed, regardless of
+	// how the temporary folders are created.
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to chmod: %v", err)
+	}
+
+	return dir, nil
+}
+
+// CleanSubpath returns the subpath as a clean relative path. It fails if the
+// subpath is absolute or goes out of the target.
+func CleanSubpath(subpath string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(subpath, "\\", "/"))
+
+	if path.IsAbs(clean) || filepath.IsAbs(subpath) {
+		return "", fmt.Errorf("%q is absolute", subpath)
+	}
+
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%q is out of the target", subpath)
+	}
+
+	return filepath.FromSlash(clean), nil
+}
+
+// subpathTarget returns the folder of the target replaced by a release, which
+// is the target itself if the subpath is empty.
+func subpathTarget(target, subpath string) (string, error) {
+	if subpath == "" {
+		return target, nil
+	}
+
+	clean, err := CleanSubpath(subpath)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(target, clean), nil
+}
+
+// download gets the release from the job's URL. If it fails, it tries the
+// job's fallback URLs and then the entry's fallback URLs, in order. It returns
+// the error of the last URL if all fail.
+func (fd *FileDeployer) download(job job, entry config.Entry,
+	provenance *Provenance) (*http.Response, error) {
+
+	urls := append([]*url.URL{job.releaseURL}, job.fallbackURLs...)
+
+	for _, fallback := range entry.FallbackURLs {
+		fallback = strings.ReplaceAll(fallback, "{tag}", job.tag)
+
+		u, err := url.ParseRequestURI(fallback)
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseDownload).Warn().
+				Msgf("ignoring wrong fallback url %q: %v", fallback, err)
+			continue
+		}
+
+		urls = append(urls, u)
+	}
+
+	var err error
+
+	retry := fd.getConfig().Retry
+	if entry.Retry != nil {
+		retry = *entry.Retry
+	}
+
+	for i, u := range urls {
+		var res *http.Response
+
+		res, err = fd.getWithRetry(job, u, retry, provenance)
+		if err == nil {
+			// the space is checked once the size of the archive is known,
+			// before its content is read.
+			err = fd.checkSpace(job, entry, res.ContentLength)
+			if err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+
+			if entry.MaxArchiveSize > 0 && res.ContentLength <= 0 {
+				res.Body = &limitedBody{ReadCloser: res.Body, max: int64(entry.MaxArchiveSize)}
+			}
+
+			res.Body = job.progress.download(res.Body, res.ContentLength)
+			return res, nil
+		}
+
+		if i < len(urls)-1 {
+			fd.jobLogger(job, logs.PhaseDownload).Warn().
+				Msgf("failed to get %q, trying next url: %v", u, err)
+		}
+	}
+
+	return nil, err
+}
+
+// ErrInsufficientSpace is returned when a filesystem used by a job doesn't
+// have the space needed by its release
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// errNoFreeSpace is returned by diskFree on the platforms where the free space
+// of a filesystem is not known. The space is then not checked.
+var errNoFreeSpace = errors.New("free space is not supported on this platform")
+
+// freeSpace returns the number of bytes available to Hodor on the filesystem
+// of the folder. It is a variable so that tests can replace it.
+var freeSpace = diskFree
+
+// checkSpace fails if the archive, of the given size or -1 if unknown, exceeds
+// the maximum archive size of the entry, or if a filesystem where the release
+// is saved or extracted has less free space than the archive and the minimum
+// free space of the entry.
+func (fd *FileDeployer) checkSpace(job job, entry config.Entry, size int64) error {
+	if entry.MaxArchiveSize > 0 && size > int64(entry.MaxArchiveSize) {
+		return fmt.Errorf("archive of %d bytes exceeds the maximum size of %d bytes",
+			size, entry.MaxArchiveSize)
+	}
+
+	needed := int64(entry.MinFreeSpace)
+	if size > 0 {
+		needed += size
+	}
+
+	if needed == 0 {
+		return nil
+	}
+
+	for _, dir := range spaceDirs(entry) {
+		free, err := freeSpace(dir)
+		if err == errNoFreeSpace {
+			return nil
+		}
+
+		if err != nil {
+			fd.jobLogger(job, logs.PhaseDownload).Warn().
+				Msgf("failed to get the free space of %q: %v", dir, err)
+			continue
+		}
+
+		if free < needed {
+			return fmt.Errorf("%w: %q has %d bytes free, the release needs %d",
+				ErrInsufficientSpace, dir, free, needed)
+		}
+	}
+
+	return nil
+}
+
+// spaceDirs returns the existing folders, or their closest existing parent,
+// where the release of the entry is saved and extracted
+func spaceDirs(entry config.Entry) []string {
+	dirs := []string{filepath.Dir(entry.Target)}
+
+	switch entry.Staging {
+	case "":
+		dirs = append(dirs, os.TempDir())
+	case config.StagingTmpfs:
+		dirs = append(dirs, tmpfsDir)
+	}
+
+	if entry.Delta.URL != "" || entry.Promote != "" {
+		dirs = append(dirs, newArchiveCache("", entry.Delta.Cache, entry.Target).dir)
+	}
+
+	existing := make([]string, 0, len(dirs))
+
+	for _, dir := range dirs {
+		for {
+			_, err := os.Stat(dir)
+			if err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+
+			dir = filepath.Dir(dir)
+		}
+
+		existing = append(existing, dir)
+	}
+
+	return existing
+}
+
+// limitedBody fails the download of an archive of unknown size once it
+// exceeds the maximum archive size
+type limitedBody struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+// Read implements io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.read += int64(n)
+	if b.read > b.max {
+		return n, fmt.Errorf("archive exceeds the maximum size of %d bytes", b.max)
+	}
+
+	return n, err
+}
+
+// defaultRetryBackoff is the wait before the first retry of a download, and
+// defaultRetryMaxBackoff the maximum wait, if not configured
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// getWithRetry fetches the URL and expects a 2xx status. A transient failure,
+// a network error or a 408, 429, or 5xx status, is retried up to the attempts
+// of the retry policy, after an exponential backoff with jitter. Each retry is
+// recorded in the message of the job's status.
+func (fd *FileDeployer) getWithRetry(job job, u *url.URL, retry config.Retry,
+	provenance *Provenance) (*http.Response, error) {
+
+	attempts := retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := fd.get(job, u, provenance)
+
+		// a redirect to an insecure URL is refused again if retried
+		var urlErr *url.Error
+		transient := errors.As(err, &urlErr) && !errors.Is(err, ErrInsecureURL)
+
+		if err == nil && (res.StatusCode < 200 || res.StatusCode > 299) {
+			res.Body.Close()
+			err = fmt.Errorf("unexpected status %q", res.Status)
+			transient = transientStatus(res.StatusCode)
+		}
+
+		if err == nil {
+			return res, nil
+		}
+
+		if !transient || attempt >= attempts {
+			if attempt > 1 {
+				err = fmt.Errorf("%v, after %d attempts", err, attempt)
+			}
+
+			return nil, err
+		}
+
+		wait := retryWait(retry, attempt)
+
+		message := fmt.Sprintf("download attempt %d/%d failed, retrying in %s: %v",
+			attempt, attempts, wait.Round(time.Millisecond), err)
+
+		fd.jobLogger(job, logs.PhaseDownload).Warn().Msg(message)
+
+		if fd.db != nil {
+			err = fd.saveJobStatus(job, "running", message)
+			if err != nil {
+				fd.jobLogger(job, logs.PhaseDownload).Warn().Msgf("failed to save attempt: %v", err)
+			}
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+// transientStatus returns true if a request that got the status may succeed
+// if retried
+func transientStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryWait returns the wait after the failed attempt, starting at 1: the
+// backoff doubled for each previous retry, capped at the maximum backoff, and
+// reduced by a random jitter of up to half of it, so that the clients that
+// failed together don't retry together.
+func retryWait(retry config.Retry, attempt int) time.Duration {
+	backoff := time.Duration(retry.Backoff)
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	maxBackoff := time.Duration(retry.MaxBackoff)
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	wait := backoff
+
+	for i := 1; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+
+	return wait - time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// errLocked is returned by flock if the file is locked by another process
+var errLocked = errors.New("locked by another process")
+
+// lockWait is the maximum time a job waits for the lock of its target, and
+// lockRetry the interval at which it tries to take it.
+var (
+	lockWait  = time.Minute
+	lockRetry = time.Second
+)
+
+// lockTarget takes the advisory lock of the target, in "<target>.lock", so
+// that other Hodor processes and external tools don't modify the target at
+// the same time. It waits up to lockWait if the target is locked. The lock is
+// released by the returned function, or by the system if Hodor dies. The file
+// is kept, as removing it would let two processes lock different files.
+func (fd *FileDeployer) lockTarget(job job, target string) (func(), error) {
+	path := filepath.Clean(target) + ".lock"
+
+	err := os.MkdirAll(filepath.Dir(path), fd.dirMode(job.releaseID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	deadline := time.Now().Add(lockWait)
+
+	for {
+		err = flock(f)
+		if err != errLocked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%q is %v after %s", path, err, lockWait)
+		}
+
+		fd.jobLogger(job, "").Info().Msgf("waiting for the lock of %q", path)
+
+		time.Sleep(lockRetry)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", path, err)
+	}
+
+	// informative, for the operators
+	f.Truncate(0)
+	fmt.Fprintf(f, "pid %d, job %s\n", os.Getpid(), job.id)
+
+	return func() { f.Close() }, nil
+}
+
+// checkOwnership returns an error if the target exists, is not empty, and was
+// never deployed by Hodor, unless the entry adopts it.
+func (fd *FileDeployer) checkOwnership(releaseID string, entry config.Entry) error {
+	if entry.Adopt {
+		return nil
+	}
+
+	files, err := os.ReadDir(entry.Target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read target: %v", err)
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	err = fd.db.View(func(tx store.Tx) error {
+		_, err := tx.Get(releaseID)
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return fmt.Errorf("%q was not deployed by Hodor, set \"adopt\" to "+
+			"deploy into it", entry.Target)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get tag: %v", err)
+	}
+
+	return nil
+}
+
+// openArchive returns the release archive of the job. With delta updates, the
+// archive is reconstructed from the cached archive and the diff if possible,
+// and downloaded otherwise. The returned function then keeps it in the cache,
+// as the base of the next delta update, or to be promoted. The origin of the
+// archive is saved in provenance.
+func (fd *FileDeployer) openArchive(job job, entry config.Entry,
+	provenance *Provenance) (io.ReadCloser, func() error, error) {
+
+	if job.promoted != "" {
+		return fd.openPromoted(job, entry)
+	}
+
+	if entry.Delta.URL == "" && entry.Promote == "" {
+		res, err := fd.download(job, entry, provenance)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return res.Body, func() error { return nil }, nil
+	}
+
+	cache := newArchiveCache(job.releaseID, entry.Delta.Cache, entry.Target)
+
+	err := os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+
+	logger := fd.jobLogger(job, logs.PhaseDownload)
+
+	var baseTag string
+
+	if entry.Delta.URL != "" {
+		baseTag, err = cache.baseTag()
+		if err != nil {
+			logger.Warn().Msgf("failed to read cached tag: %v", err)
+		}
+	}
+
+	patched := false
+
+	if baseTag != "" {
+		err = fd.patchArchive(job, entry.Delta, cache, baseTag, provenance)
+		if err != nil {
+			logger.Warn().Msgf("failed to apply delta from %q, downloading "+
+				"the full release: %v", baseTag, err)
+		} else {
+			logger.Info().Msgf("reconstructed release from %q", baseTag)
+			provenance.DeltaBase = baseTag
+			patched = true
+		}
+	}
+
+	if !patched {
+		err = fd.downloadArchive(job, entry, cache.next, provenance)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.Open(cache.next)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+
+	keep := func() error {
+		return cache.keep(job.tag)
+	}
+
+	return f, keep, nil
+}
+
+// openPromoted returns the archive kept by the release that the job promotes.
+// If the job's release also keeps its archive, the archive is copied in its
+// cache.
+func (fd *FileDeployer) openPromoted(job job,
+	entry config.Entry) (io.ReadCloser, func() error, error) {
+
+	source, found := fd.getConfig().Entries[job.promoted]
+	if !found {
+		return nil, nil, fmt.Errorf("releaseID %q not found from the config", job.promoted)
+	}
+
+	fd.jobLogger(job, logs.PhaseDownload).Info().Msgf("using the archive of %q", job.promoted)
+
+	f, err := os.Open(newArchiveCache(job.promoted, source.Delta.Cache, source.Target).archive)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open promoted archive: %v", err)
+	}
+
+	if entry.Delta.URL == "" && entry.Promote == "" {
+		return f, func() error { return nil }, nil
+	}
+
+	defer f.Close()
+
+	cache := newArchiveCache(job.releaseID, entry.Delta.Cache, entry.Target)
+
+	err = os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+
+	err = saveFile(f, cache.next)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to copy archive: %v", err)
+	}
+
+	next, err := os.Open(cache.next)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+
+	keep := func() error {
+		return cache.keep(job.tag)
+	}
+
+	return next, keep, nil
+}
+
+// patchArchive downloads the diff from the cached archive to the job's
+// release, and reconstructs the release archive in cache.next.
+func (fd *FileDeployer) patchArchive(job job, delta config.Delta, cache archiveCache,
+	baseTag string, provenance *Provenance) error {
+
+	rawURL := strings.ReplaceAll(delta.URL, "{tag}", job.tag)
+	rawURL = strings.ReplaceAll(rawURL, "{previous_tag}", baseTag)
+
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return fmt.Errorf("wrong delta url: %v", err)
+	}
+
+	res, err := fd.get(job, u, provenance)
+	if err != nil {
+		return fmt.Errorf("failed to get diff: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+
+	patch := cache.next + ".patch"
+	defer os.Remove(patch)
+
+	err = saveFile(res.Body, patch)
+	if err != nil {
+		return fmt.Errorf("failed to save diff: %v", err)
+	}
+
+	out, err := patchCommand(delta.Tool, cache.archive, patch, cache.next).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to patch: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// downloadArchive downloads the full release archive to path
+func (fd *FileDeployer) downloadArchive(job job, entry config.Entry, path string,
+	provenance *Provenance) error {
+
+	res, err := fd.download(job, entry, provenance)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	err = saveFile(res.Body, path)
+	if err != nil {
+		return fmt.Errorf("failed to save archive: %v", err)
+	}
+
+	return nil
+}
+
+// saveVerified writes the content of r to a new private file in dir, and
+// returns it, opened at its start, if its SHA-256 matches the checksums. The
+// caller must remove the file.
+func saveVerified(r io.Reader, dir, jobID string, checksums []string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, ".hodor-"+jobID+"-archive-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+
+	hash := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to save archive: %v", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	for _, checksum := range checksums {
+		if !strings.EqualFold(sum, checksum) {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, fmt.Errorf("checksum mismatch: expected %s, got %s",
+				strings.ToLower(checksum), sum)
+		}
+	}
+
+	return f, nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of the file's content
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// saveFile writes the content of r to a new private file
+func saveFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// patchCommand returns the command that reconstructs next from the base
+// archive and the diff. It is a variable so that tests don't need the tools.
+var patchCommand = func(tool, base, patch, next string) *exec.Cmd {
+	if tool == "bsdiff" {
+		return exec.Command("bspatch", base, next, patch)
+	}
+
+	// the long window must match the one used to create the diff of large
+	// archives
+	return exec.Command("zstd", "-d", "-f", "-q", "--long=31", "--patch-from="+base,
+		patch, "-o", next)
+}
+
+// archiveCache holds the last archive of a release, with its tag
+type archiveCache struct {
+	dir string
+	// archive is the cached archive, used as the base of delta updates
+	archive string
+	// tag is the file containing the tag of archive
+	tag string
+	// next is the archive of the current job
+	next string
+}
+
+// newArchiveCache returns the cache of the release. The folder defaults to
+// ".hodor-cache" next to the target.
+func newArchiveCache(releaseID, dir, target string) archiveCache {
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(target), ".hodor-cache")
+	}
+
+	base := filepath.Join(dir, releaseID)
+
+	return archiveCache{
+		dir:     dir,
+		archive: base + ".archive",
+		tag:     base + ".tag",
+		next:    base + ".next",
+	}
+}
+
+// baseTag returns the tag of the cached archive, or an empty string if there
+// is none.
+func (c archiveCache) baseTag() (string, error) {
+	tag, err := os.ReadFile(c.tag)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Stat(c.archive)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(tag), nil
+}
+
+// keep replaces the cached archive with the archive of the current job. The
+// tag is removed first, so that a crash never leaves an archive with the
+// wrong tag.
+func (c archiveCache) keep(tag string) error {
+	err := os.Remove(c.tag)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove tag: %v", err)
+	}
+
+	err = os.Rename(c.next, c.archive)
+	if err != nil {
+		return fmt.Errorf("failed to rename archive: %v", err)
+	}
+
+	err = os.WriteFile(c.tag, []byte(tag), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write tag: %v", err)
+	}
+
+	return nil
+}
+
+// capture records the archive and the log of a job, to retain them if the job
+// fails
+type capture struct {
+	dir     string
+	archive *os.File
+	log     *os.File
+	days    int
+	// until is set once the capture is retained
+	until time.Time
+}
+
+// retained is the record of the retained files of a failed job
+type retained struct {
+	ReleaseID string    `json:"releaseID"`
+	Dir       string    `json:"dir"`
+	Until     time.Time `json:"until"`
+}
+
+// retainedKey returns the database key of the retained files of a job
+func retainedKey(jobID string) string {
+	return "retained:" + jobID
+}
+
+// retainedDir returns the folder where the failed jobs of the entry are
+// retained. It defaults to ".hodor-debug" next to the target.
+func retainedDir(entry config.Entry) string {
+	if entry.Debug.Dir != "" {
+		return entry.Debug.Dir
+	}
+
+	return filepath.Join(filepath.Dir(entry.Target), ".hodor-debug")
+}
+
+// newCapture returns the capture of the job, in a private folder, or nil if
+// its entry doesn't retain the failed jobs. A capture that can't be created is
+// logged and skipped, so that it doesn't fail the job.
+func (fd *FileDeployer) newCapture(job job) *capture {
+	entry := fd.getConfig().Entries[job.releaseID]
+	if entry.Debug.RetainDays <= 0 {
+		return nil
+	}
+
+	c := &capture{
+		dir:  filepath.Join(retainedDir(entry), job.id),
+		days: entry.Debug.RetainDays,
+	}
+
+	err := os.MkdirAll(c.dir, 0700)
+	if err == nil {
+		c.archive, err = os.OpenFile(filepath.Join(c.dir, RetainedArchive),
+			os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
+
+	if err == nil {
+		c.log, err = os.OpenFile(filepath.Join(c.dir, RetainedLog),
+			os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
+
+	if err != nil {
+		fd.jobLogger(job, "").Warn().Msgf("failed to capture job: %v", err)
+
+		if c.archive != nil {
+			c.archive.Close()
+		}
+
+		os.RemoveAll(c.dir)
+
+		return nil
+	}
+
+	return c
+}
+
+// finishCapture closes the capture of the job, if any. It is retained if the
+// job failed, with the failure at the end of its log, or else removed. The
+// expired captures are then removed.
+func (fd *FileDeployer) finishCapture(job job, jobErr error) {
+	c := job.capture
+	if c == nil {
+		return
+	}
+
+	// the next messages are not captured
+	job.capture = nil
+
+	if jobErr != nil {
+		captureHook{w: c.log}.Run(nil, zerolog.ErrorLevel, "job failed: "+jobErr.Error())
+	}
+
+	c.archive.Close()
+	c.log.Close()
+
+	if jobErr == nil {
+		err := os.RemoveAll(c.dir)
+		if err != nil {
+			fd.jobLogger(job, "").Warn().Msgf("failed to remove capture: %v", err)
+		}
+
+		return
+	}
+
+	until := time.Now().UTC().Add(time.Duration(c.days) * 24 * time.Hour).Truncate(time.Second)
+
+	buf, err := fd.serde.Marshal(&retained{
+		ReleaseID: job.releaseID,
+		Dir:       c.dir,
+		Until:     until,
+	})
+	if err == nil {
+		err = fd.db.Update(func(tx store.Tx) error {
+			return tx.Set(retainedKey(job.id), string(buf))
+		})
+	}
+
+	if err != nil {
+		fd.jobLogger(job, "").Err(err).Msg("failed to retain job")
+		os.RemoveAll(c.dir)
+
+		return
+	}
+
+	c.until = until
+
+	fd.jobLogger(job, "").Info().Msgf("archive and log retained in %q until %s",
+		c.dir, until.Format(time.RFC3339))
+
+	fd.purgeRetained(time.Now())
+}
+
+// purgeRetained removes the retained files that expired at now
+func (fd *FileDeployer) purgeRetained(now time.Time) {
+	expired := make(map[string]retained)
+
+	err := fd.db.View(func(tx store.Tx) error {
+		return tx.Iterate(retainedKey(""), false, func(key, value string) bool {
+			var r retained
+
+			err := fd.serde.Unmarshal([]byte(value), &r)
+			if err != nil || now.After(r.Until) {
+				expired[key] = r
+			}
+
+			return true
+		})
+	})
+
+	if err != nil {
+		fd.logger.Warn().Msgf("failed to read retained jobs: %v", err)
+		return
+	}
+
+	for key, r := range expired {
+		if r.Dir != "" {
+			err = os.RemoveAll(r.Dir)
+			if err != nil {
+				fd.logger.Warn().Msgf("failed to remove retained job: %v", err)
+				continue
+			}
+		}
+
+		err = fd.db.Update(func(tx store.Tx) error {
+			return tx.Delete(key)
+		})
+
+		if err != nil {
+			fd.logger.Warn().Msgf("failed to delete %q: %v", key, err)
+		}
+	}
+}
+
+// GetRetained implements deployer.Deployer
+func (fd *FileDeployer) GetRetained(jobID, file string) (*os.File, error) {
+	if file != RetainedArchive && file != RetainedLog {
+		return nil, fmt.Errorf("unknown file %q", file)
+	}
+
+	var value string
+
+	err := fd.db.View(func(tx store.Tx) error {
+		var err error
+		value, err = tx.Get(retainedKey(jobID))
+		return err
+	})
+
+	if err == store.ErrNotFound {
+		return nil, ErrNotRetained
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retained job: %v", err)
+	}
+
+	var r retained
+
+	err = fd.serde.Unmarshal([]byte(value), &r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal retained job: %v", err)
+	}
+
+	if time.Now().After(r.Until) {
+		return nil, ErrNotRetained
+	}
+
+	f, err := os.Open(filepath.Join(r.Dir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotRetained
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retained file: %v", err)
+	}
+
+	return f, nil
+}
+
+// captureHook writes the messages of a job's logger to its captured log
+//
+// - implements zerolog.Hook
+type captureHook struct {
+	w     io.Writer
+	phase string
+}
+
+// Run implements zerolog.Hook
+func (h captureHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	phase := ""
+	if h.phase != "" {
+		phase = " [" + h.phase + "]"
+	}
+
+	fmt.Fprintf(h.w, "%s %s%s %s\n", time.Now().UTC().Format(time.RFC3339),
+		level, phase, msg)
+}
+
+// get fetches the URL. If the host rate-limits the request, as indicated by
+// the GitHub rate-limit headers, it waits for the limit to reset and retries
+// once. The URL and the server of the response are saved in provenance.
+func (fd *FileDeployer) get(job job, u *url.URL, provenance *Provenance) (*http.Response, error) {
+	res, err := fd.fetch(job, u, provenance)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := res.Header.Get("X-RateLimit-Remaining")
+	if remaining != "" {
+		fd.jobLogger(job, logs.PhaseDownload).Debug().
+			Msgf("rate limit of %q: %s/%s remaining", u.Host, remaining, res.Header.Get("X-RateLimit-Limit"))
+	}
+
+	wait, limited := rateLimitWait(res, time.Now())
+	if !limited {
+		return res, nil
+	}
+
+	res.Body.Close()
+
+	maxWait := time.Duration(fd.getConfig().GitHub.RateLimitMaxWait)
+	if maxWait == 0 {
+		maxWait = defaultRateLimitMaxWait
+	}
+
+	if wait > maxWait {
+		return nil, fmt.Errorf("rate limited by %q for %s, more than the "+
+			"maximum wait of %s", u.Host, wait, maxWait)
+	}
+
+	fd.jobLogger(job, logs.PhaseDownload).Warn().
+		Msgf("rate limited by %q, waiting %s", u.Host, wait)
+
+	time.Sleep(wait)
+
+	return fd.fetch(job, u, provenance)
+}
+
+// fetch sends a GET request to the URL, with the authentication headers of
+// the job's release. It saves in provenance the URL of the response, after the
+// redirects, and the address of the server.
+func (fd *FileDeployer) fetch(job job, u *url.URL, provenance *Provenance) (*http.Response, error) {
+	var remoteIP string
+
+	// called for each request, the last one is the server of the response
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteIP = info.Conn.RemoteAddr().String()
+
+			host, _, err := net.SplitHostPort(remoteIP)
+			if err == nil {
+				remoteIP = host
+			}
+		},
+	}
+
+	req, err := fd.newRequest(httptrace.WithClientTrace(context.Background(), trace),
+		job.releaseID, u)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := fd.do(job.releaseID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fd.checkRedirect(job.releaseID, res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	provenance.SourceURL = responseURL(res, u)
+	provenance.RemoteIP = remoteIP
+
+	return res, nil
+}
+
+// newRequest returns a GET request to the URL, if the URL is allowed. It
+// carries the download headers of the release's entry, if any, and otherwise
+// the GitHub token if the URL is an HTTPS URL of GitHub. The token isn't
+// forwarded if GitHub redirects to another domain, such as its storage.
+// releaseID can be empty.
+func (fd *FileDeployer) newRequest(ctx context.Context, releaseID string,
+	u *url.URL) (*http.Request, error) {
+
+	err := fd.CheckURL(releaseID, u)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := fd.getConfig()
+
+	for key, value := range conf.Entries[releaseID].DownloadHeaders {
+		req.Header.Set(key, value)
+	}
+
+	if req.Header.Get("Authorization") == "" && u.Scheme == "https" &&
+		isGitHub(u.Hostname(), conf.GitHub.Hosts) {
+
+		token := conf.GitHub.Token
+		if token == "" {
+			token = os.Getenv(githubTokenEnv)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	// the API returns the content of an asset, instead of its description,
+	// which is how the assets of private repositories are downloaded
+	if req.Header.Get("Accept") == "" && u.Hostname() == "api.github.com" &&
+		strings.Contains(u.Path, "/releases/assets/") {
+
+		req.Header.Set("Accept", "application/octet-stream")
+	}
+
+	return req, nil
+}
+
+// isGitHub returns true if the host is one of GitHub or of the configured
+// hosts
+func isGitHub(host string, hosts []string) bool {
+	for _, h := range append(githubHosts, hosts...) {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseURL returns the URL of the request that got the response, which
+// differs from u if the request was redirected
+func responseURL(res *http.Response, u *url.URL) string {
+	if res.Request != nil && res.Request.URL != nil {
+		return res.Request.URL.String()
+	}
+
+	return u.String()
+}
+
+// rateLimitWait returns how long to wait before retrying a rate-limited
+// request, based on the Retry-After and GitHub's X-RateLimit-* headers. It
+// returns false if the response is not rate-limited.
+func rateLimitWait(res *http.Response, now time.Time) (time.Duration, bool) {
+	if res.StatusCode != http.StatusForbidden &&
+		res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err == nil {
+		return time.Duration(retryAfter) * time.Second, true
+	}
+
+	if res.Header.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	wait := time.Unix(reset, 0).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, true
+}
+
+// swap replaces the target with the extracted release, using the strategy.
+// Folders created in the target use dirMode.
+func swap(strategy config.Strategy, releaseFolder, targetFolder string,
+	dirMode os.FileMode) error {
+
+	switch strategy {
+	case "", config.StrategyReplace:
+		// remove the actual target and move the extracted contents to the
+		// actual target.
+
+		os.RemoveAll(targetFolder)
+
+		err := os.Rename(releaseFolder, targetFolder)
+		if err != nil {
+			return fmt.Errorf("failed to rename folder: %v", err)
+		}
+
+	case config.StrategyCopy:
+		err := copyTree(releaseFolder, targetFolder, true, dirMode)
+		if err != nil {
+			return fmt.Errorf("failed to copy folder: %v", err)
+		}
+
+	case config.StrategyUpdate:
+		err := copyTree(releaseFolder, targetFolder, false, dirMode)
+		if err != nil {
+			return fmt.Errorf("failed to update folder: %v", err)
+		}
+
+	default:
+		return fmt.Errorf("unknown strategy %q", strategy)
+	}
+
+	return nil
+}
+
+// tmpSuffix is added to the files being copied to the target
+const tmpSuffix = ".hodor-tmp"
+
+// diffTrees counts the files of release that are added to or changed in
+// target, and the files of target that are removed, if prune is true. Only
+// regular files are counted.
+func diffTrees(release, target string, prune bool) (Changes, error) {
+	var changes Changes
+
+	seen := map[string]bool{}
+
+	err := filepath.Walk(release, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(release, path)
+		if err != nil {
+			return err
+		}
+
+		seen[rel] = true
+
+		same, err := sameFile(path, filepath.Join(target, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			changes.Added++
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !same {
+			changes.Changed++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return changes, fmt.Errorf("failed to walk release: %v", err)
+	}
+
+	if !prune {
+		return changes, nil
+	}
+
+	err = filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path == target {
+			return filepath.SkipDir
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(target, path)
+		if err != nil {
+			return err
+		}
+
+		if !seen[rel] {
+			changes.Removed++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return changes, fmt.Errorf("failed to walk target: %v", err)
+	}
+
+	return changes, nil
+}
+
+// sameFile returns true if the two files have the same content. The error
+// wraps os.ErrNotExist if b doesn't exist.
+func sameFile(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	if !infoB.Mode().IsRegular() || infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufA, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+
+	bufB, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(bufA, bufB), nil
+}
+
+// copyTree copies the regular files and folders of src to dst. Each file is
+// first written with a temporary suffix and then renamed, so that a file in
+// dst is never partially written. If prune is true, the elements of dst that
+// are not in src are removed. Folders are created with dirMode and files keep
+// their permission.
+func copyTree(src, dst string, prune bool, dirMode os.FileMode) error {
+	copied := map[string]bool{".": true}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(target, dirMode)
+			if err != nil {
+				return fmt.Errorf("failed to create dir %s: %v", target, err)
+			}
+
+		case info.Mode().IsRegular():
+			err = copyFile(path, target, info.Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("failed to copy file %s: %v", rel, err)
+			}
+
+		default:
+			return nil
+		}
+
+		copied[rel] = true
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !prune {
+		return nil
+	}
+
+	return filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+
+		if copied[rel] {
+			return nil
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// copyFile writes the content of src to dst+tmpSuffix and then renames it to
+// dst.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open: %v", err)
+	}
+
+	defer in.Close()
+
+	tmp := dst + tmpSuffix
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create: %v", err)
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write: %v", err)
+	}
+
+	err = out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close: %v", err)
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename: %v", err)
+	}
+
+	return nil
+}
+
+// runHooks executes the hook commands of a job's phase in order, in the
+// provided folder. It stops at the first failing command. A nil credential runs the
+// commands with the current account, and a nil sandbox doesn't restrict them.
+func (fd *FileDeployer) runHooks(job job, phase string, commands []string, dir string,
+	env map[string]string, cred *hook.Credential, sandbox *hook.Sandbox) error {
+
+	for _, line := range commands {
+		out, err := fd.hooks.Execute(hook.Command{
+			Line:       line,
+			Dir:        dir,
+			Env:        env,
+			Credential: cred,
+			Sandbox:    sandbox,
+		})
+
+		fd.jobLogger(job, phase).Info().Msgf("hook %q output: %s", line, out)
+
+		output := HookOutput{
+			Phase:   phase,
+			Command: line,
+			Output:  truncateOutput(out),
+		}
+
+		if err != nil {
+			output.Error = err.Error()
+		}
+
+		err2 := fd.saveHookOutput(job, output)
+		if err2 != nil {
+			fd.jobLogger(job, phase).Warn().Msgf("failed to save hook output: %v", err2)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newProgressTracker returns the tracker of the progress of the job, or nil if
+// the deployer has no database to save it
+func (fd *FileDeployer) newProgressTracker(job job) *progressTracker {
+	if fd.db == nil {
+		return nil
+	}
+
+	return &progressTracker{
+		store: func(progress Progress) {
+			err := fd.saveProgress(job, progress)
+			if err != nil {
+				fd.jobLogger(job, "").Warn().Msgf("failed to save progress: %v", err)
+			}
+		},
+		now: time.Now,
+	}
+}
+
+// progressTracker counts the bytes read and the files extracted by a job, and
+// saves its progress at most every progressInterval. A nil tracker tracks
+// nothing.
+type progressTracker struct {
+	sync.Mutex
+	progress Progress
+	saved    time.Time
+	store    func(Progress)
+	now      func() time.Time
+}
+
+// download starts the download phase and returns the body, which tracks the
+// bytes read
+func (t *progressTracker) download(body io.ReadCloser, size int64) io.ReadCloser {
+	if t == nil {
+		return body
+	}
+
+	t.start("download", size)
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{progressReader{Reader: body, tracker: t}, body}
+}
+
+// extract starts the extraction phase from the file and returns a reader that
+// tracks the bytes read
+func (t *progressTracker) extract(f *os.File) io.Reader {
+	if t == nil {
+		return f
+	}
+
+	var size int64
+
+	info, err := f.Stat()
+	if err == nil {
+		size = info.Size()
+	}
+
+	t.start("extract", size)
+
+	return progressReader{Reader: f, tracker: t}
+}
+
+// file counts an extracted file
+func (t *progressTracker) file() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.progress.Files++
+	t.update(false)
+}
+
+// save saves the progress, whatever the time of the last save
+func (t *progressTracker) save() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.update(true)
+}
+
+// start starts a new phase, which is always saved
+func (t *progressTracker) start(phase string, size int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+
+	t.progress = Progress{
+		Phase: phase,
+		Size:  size,
+	}
+
+	t.update(true)
+}
+
+// read counts bytes read
+func (t *progressTracker) read(n int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.progress.Bytes += int64(n)
+	t.update(false)
+}
+
+// update computes the percentage and saves the progress if forced or if the
+// last save is older than progressInterval. It must be called with the lock.
+func (t *progressTracker) update(force bool) {
+	t.progress.Percent = -1
+
+	if t.progress.Size > 0 {
+		t.progress.Percent = int(t.progress.Bytes * 100 / t.progress.Size)
+		if t.progress.Percent > 100 {
+			t.progress.Percent = 100
+		}
+	}
+
+	now := t.now()
+
+	if !force && now.Sub(t.saved) < progressInterval {
+		return
+	}
+
+	t.saved = now
+	t.store(t.progress)
+}
+
+// progressReader counts the bytes read from its reader
+type progressReader struct {
+	io.Reader
+	tracker *progressTracker
+}
+
+// Read implements io.Reader
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.read(n)
+
+	return n, err
+}
+
+// saveProgress sets the progress of the job in its status
+func (fd *FileDeployer) saveProgress(job job, progress Progress) error {
+	return fd.db.Update(func(tx store.Tx) error {
+		value, err := tx.Get(job.id)
+		if err != nil {
+			return fmt.Errorf("failed to get status: %v", err)
+		}
+
+		var status JobStatus
+
+		err = fd.serde.Unmarshal([]byte(value), &status)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal status: %v", err)
+		}
+
+		status.Progress = &progress
+
+		buf, err := fd.serde.Marshal(&status)
+		if err != nil {
+			return fmt.Errorf("failed to marshal status: %v", err)
+		}
+
+		err = tx.Set(job.id, string(buf))
+
+		return err
+	})
+}
+
+// saveHookOutput adds the output of a hook command to the job's status
+func (fd *FileDeployer) saveHookOutput(job job, output HookOutput) error {
+	return fd.db.Update(func(tx store.Tx) error {
+		value, err := tx.Get(job.id)
+		if err != nil {
+			return fmt.Errorf("failed to get status: %v", err)
+		}
+
+		var status JobStatus
+
+		err = fd.serde.Unmarshal([]byte(value), &status)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal status: %v", err)
+		}
+
+		status.Hooks = append(status.Hooks, output)
+
+		buf, err := fd.serde.Marshal(&status)
+		if err != nil {
+			return fmt.Errorf("failed to marshal status: %v", err)
+		}
+
+		err = tx.Set(job.id, string(buf))
+
+		return err
+	})
+}
+
+// scanRelease submits the SBOM of the release, or else an archive of the
+// release folder, to the scanner of the entry. It saves the result in the
+// job's status, and returns an error if the scan failed or if a finding is at
+// or above the configured severity.
+func (fd *FileDeployer) scanRelease(job job, conf config.Scan, tmpDest, releaseFolder string,
+	sbom *SBOM, sbomContent []byte) error {
+
+	scanner := scan.NewHTTPScanner(conf, fd.client)
+	logger := fd.jobLogger(job, logs.PhasePreDeploy)
+
+	result := ScanResult{
+		Severity: scan.Severity(conf),
+		Counts:   map[string]int{},
+	}
+
+	var findings []scan.Finding
+	var err error
+
+	if sbom != nil {
+		result.Target = "sbom"
+
+		logger.Info().Msgf("scanning SBOM %q", sbom.File)
+		findings, err = scanner.Scan(bytes.NewReader(sbomContent), sbom.MediaType)
+	} else {
+		result.Target = "archive"
+
+		logger.Info().Msg("scanning release archive")
+		findings, err = fd.scanArchive(scanner, job, tmpDest, releaseFolder)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to scan release: %v", err)
+	}
+
+	for _, finding := range findings {
+		result.Counts[finding.Severity]++
+	}
+
+	blocking := scan.Blocking(findings, result.Severity)
+
+	result.Passed = len(blocking) == 0
+	result.Blocking = blocking
+
+	if len(result.Blocking) > maxScanFindings {
+		result.Blocking = result.Blocking[:maxScanFindings]
+	}
+
+	err = fd.saveScan(job, result)
+	if err != nil {
+		logger.Warn().Msgf("failed to save scan: %v", err)
+	}
+
+	if !result.Passed {
+		return fmt.Errorf("scan found %d vulnerabilities at or above %q severity",
+			len(blocking), result.Severity)
+	}
+
+	logger.Info().Msgf("scan passed with %d findings", len(findings))
+
+	return nil
+}
+
+// scanArchive archives the release folder next to the staging folder and
+// submits it to the scanner. The archive is removed once scanned.
+func (fd *FileDeployer) scanArchive(scanner scan.Scanner, job job, tmpDest,
+	releaseFolder string) ([]scan.Finding, error) {
+
+	archivePath := filepath.Join(filepath.Dir(tmpDest), job.id+".scan.tar.gz")
+
+	err := archiveFolder(releaseFolder, archivePath)
+	if err != nil {
+		os.Remove(archivePath)
+		return nil, err
+	}
+
+	defer os.Remove(archivePath)
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+
+	defer file.Close()
+
+	return scanner.Scan(file, "application/gzip")
+}
+
+// clamScan streams the saved archive to clamd. An infected archive is moved to
+// the quarantine folder of the entry and fails the job. The archive is
+// rewound once scanned.
+func (fd *FileDeployer) clamScan(job job, entry config.Entry, archive *os.File) error {
+	logger := fd.jobLogger(job, logs.PhaseDownload)
+
+	signature, err := clamav.NewClamd(entry.ClamAV).Scan(archive)
+	if err != nil {
+		return fmt.Errorf("failed to scan archive with clamd: %v", err)
+	}
+
+	if signature == "" {
+		logger.Info().Msg("archive is clean according to clamd")
+
+		_, err = archive.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to rewind archive: %v", err)
+		}
+
+		return nil
+	}
+
+	dir := entry.ClamAV.Quarantine
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(entry.Target), ".hodor-quarantine")
+	}
+
+	path, err := quarantine(archive, dir, job)
+	if err != nil {
+		logger.Error().Msgf("failed to quarantine infected archive: %v", err)
+		return fmt.Errorf("archive is infected with %q", signature)
+	}
+
+	logger.Warn().Msgf("archive infected with %q, quarantined to %q", signature, path)
+
+	return fmt.Errorf("archive is infected with %q, quarantined to %q", signature, path)
+}
+
+// quarantine moves the archive to the folder, readable only by Hodor, under
+// the name of the job's release and ID
+func quarantine(archive *os.File, dir string, job job) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder: %v", err)
+	}
+
+	path := filepath.Join(dir, job.releaseID+"-"+job.id+".archive")
+
+	err = os.Rename(archive.Name(), path)
+	if err == nil {
+		return path, nil
+	}
+
+	// the archive may be on another file system, such as a tmpfs
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewind archive: %v", err)
+	}
+
+	err = saveFile(archive, path)
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to copy archive: %v", err)
+	}
+
+	return path, nil
+}
+
+// saveScan sets the result of the scan in the job's status
+func (fd *FileDeployer) saveScan(job job, result ScanResult) error {
+	if fd.db == nil {
+		return nil
+	}
+
+	return fd.db.Update(func(tx store.Tx) error {
+		value, err := tx.Get(job.id)
+		if err != nil {
+			return fmt.Errorf("failed to get status: %v", err)
+		}
+
+		var status JobStatus
+
+		err = fd.serde.Unmarshal([]byte(value), &status)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal status: %v", err)
+		}
+
+		status.Scan = &result
+
+		buf, err := fd.serde.Marshal(&status)
+		if err != nil {
+			return fmt.Errorf("failed to marshal status: %v", err)
+		}
+
+		err = tx.Set(job.id, string(buf))
+
+		return err
+	})
+}
+
+// truncateOutput returns the last maxHookOutput bytes of the output, where
+// the errors usually are
+func truncateOutput(out []byte) string {
+	if len(out) <= maxHookOutput {
+		return string(out)
+	}
+
+	return strings.ToValidUTF8(string(out[len(out)-maxHookOutput:]), "")
+}
+
+// hookEnv returns the environment variables given to the hook commands of a
+// job. It contains the variables from the release entry and variables
+// describing the job, prefixed by HODOR_.
+func hookEnv(job job, entry config.Entry) map[string]string {
+	env := make(map[string]string, len(entry.Env)+4)
+
+	for k, v := range entry.Env {
+		env[k] = v
+	}
+
+	env["HODOR_JOB_ID"] = job.id
+	env["HODOR_RELEASE_ID"] = job.releaseID
+	env["HODOR_TAG"] = job.tag
+	env["HODOR_TARGET"] = entry.Target
+
+	return env
+}
+
+// extractOptions defines how the content of a tar is extracted
+type extractOptions struct {
+	// xattrs restores the extended attributes stored in the PAX records
+	xattrs bool
+	// dirMode is the permission of the extracted folders
+	dirMode os.FileMode
+	// fileMode is the permission of the extracted files
+	fileMode os.FileMode
+	// flat extracts all the entries of the tar into flatRoot, instead of
+	// expecting them in a root folder
+	flat bool
+	// maxSize is the maximum size of the extracted files, if not 0
+	maxSize int64
+	// onFile is called once each file is extracted, if set
+	onFile func()
+}
+
+// flatRoot is the folder where the entries of a flat tar are extracted
+const flatRoot = "release"
+
+// saveTar extract a .tar.gz to the provided destination and returns the
+// folder of the release, relative to dest. Unless opts.flat is set, it expects
+// the tar.gz to be a folder.
+func saveTar(r io.Reader, dest string, opts extractOptions) (string, error) {
+	if opts.dirMode == 0 {
+		opts.dirMode = defaultDirMode
+	}
+
+	if opts.fileMode == 0 {
+		opts.fileMode = defaultFileMode
+	}
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to create reader: %v", err)
+	}
+
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+
+	if opts.flat {
+		root := filepath.Join(dest, flatRoot)
+
+		err = os.MkdirAll(root, opts.dirMode)
+		if err != nil {
+			return "", fmt.Errorf("failed to create root dir %s: %v", root, err)
+		}
+
+		err = os.Chmod(root, opts.dirMode)
+		if err != nil {
+			return "", fmt.Errorf("failed to chmod root dir %s: %v", root, err)
+		}
+
+		files, err := untar(root, "", tr, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to extract: %v", err)
+		}
+
+		err = verifyFiles(files)
+		if err != nil {
+			return "", fmt.Errorf("failed to verify extraction: %v", err)
+		}
+
+		return flatRoot, nil
+	}
+
+	header, err := tr.Next()
+
+	// archives created by git start with a global PAX header, which is not an
+	// entry.
+	for err == nil && header.Typeflag == tar.TypeXGlobalHeader {
+		header, err = tr.Next()
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read the first header: %v", err)
+	}
+
+	if header.Typeflag != tar.TypeDir {
+		return "", errors.New("tar must be a folder")
+	}
+
+	tarRootFolder, err := normalizeName(header.Name, runtime.GOOS)
+	if err != nil {
+		return "", fmt.Errorf("wrong root folder: %v", err)
+	}
+
+	// the destination itself would be the release
+	if tarRootFolder == "." {
+		return "", fmt.Errorf("wrong root folder: %q is not a folder of the release", header.Name)
+	}
+
+	tmpRootTarget := filepath.Join(dest, tarRootFolder)
+
+	err = os.MkdirAll(tmpRootTarget, opts.dirMode)
+	if err != nil {
+		return "", fmt.Errorf("failed to create root dir %s: %v", tmpRootTarget, err)
+	}
+
+	// set the mode explicitly, which is otherwise restricted by the umask
+	err = os.Chmod(tmpRootTarget, opts.dirMode)
+	if err != nil {
+		return "", fmt.Errorf("failed to chmod root dir %s: %v", tmpRootTarget, err)
+	}
+
+	if opts.xattrs {
+		err = setXattrs(tmpRootTarget, header)
+		if err != nil {
+			return "", fmt.Errorf("failed to set xattrs of %s: %v", tmpRootTarget, err)
+		}
+	}
+
+	files, err := untar(dest, tarRootFolder, tr, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract: %v", err)
+	}
+
+	err = verifyFiles(files)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify extraction: %v", err)
+	}
+
+	return tarRootFolder, nil
+}
+
+// untar walks through the tar's content and extracts the elements. If root is
+// not empty, the elements must be the root folder or in it, as the others
+// would be extracted next to the release and left out of it. It returns the
+// size of each extracted file, as read from the tar.
+func untar(dest, root string, tr *tar.Reader,
+	opts extractOptions) (map[string]int64, error) {
+
+	files := make(map[string]int64)
+
+	var total int64
+
+	// on case-insensitive filesystems, entries that only differ by case would
+	// overwrite each other.
+	caseInsensitive := runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	names := make(map[string]string)
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next: %v", err)
+		}
+
+		name, err := normalizeName(header.Name, runtime.GOOS)
+		if err != nil {
+			return nil, fmt.Errorf("wrong entry: %v", err)
+		}
+
+		if root != "" && name != root && !strings.HasPrefix(name, root+string(filepath.Separator)) {
+			return nil, fmt.Errorf("wrong entry: %q is out of the root folder %q",
+				header.Name, filepath.ToSlash(root))
+		}
+
+		if caseInsensitive {
+			key := strings.ToLower(name)
+
+			other, found := names[key]
+			if found && other != name {
+				return nil, fmt.Errorf("case conflict between %q and %q", other, name)
+			}
+
+			names[key] = name
+		}
+
+		target := filepath.Join(dest, name)
+
+		var mode os.FileMode
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			mode = opts.dirMode
+
+			_, err := os.Stat(target)
+			if err != nil {
+				err := os.MkdirAll(target, mode)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create dir %s: %v", target, err)
+				}
+			}
+
+		case tar.TypeReg, tar.TypeGNUSparse:
+			// the reader expands sparse files
+			mode = opts.fileMode
+
+			// checked before writing, so that a runaway release never fills
+			// the disk
+			total += header.Size
+			if opts.maxSize != 0 && total > opts.maxSize {
+				return nil, fmt.Errorf("release exceeds the maximum size of %d bytes",
+					opts.maxSize)
+			}
+
+			// an archive can contain the same file several times, the last
+			// one wins
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open file %s: %v", target, err)
+			}
+
+			n, err := io.Copy(f, tr)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to copy file %s: %v", target, err)
+			}
+
+			if n != header.Size {
+				f.Close()
+				return nil, fmt.Errorf("short write of %s: %d bytes instead of %d",
+					target, n, header.Size)
+			}
+
+			// a full disk can be reported when the file is closed
+			err = f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to close file %s: %v", target, err)
+			}
+
+			files[target] = header.Size
+
+			if opts.onFile != nil {
+				opts.onFile()
+			}
+
+		case tar.TypeXGlobalHeader:
+			continue
+
+		// links are never extracted, as following one could write outside
+		// of the release
+		case tar.TypeSymlink, tar.TypeLink:
+			return nil, fmt.Errorf("%q is a link to %q, links are not supported",
+				header.Name, header.Linkname)
+
+		default:
+			return nil, fmt.Errorf("%q has the unsupported type %q", header.Name,
+				header.Typeflag)
+		}
+
+		// set the mode explicitly, which is otherwise restricted by the umask
+		err = os.Chmod(target, mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to chmod %s: %v", target, err)
+		}
+
+		if opts.xattrs {
+			err = setXattrs(target, header)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set xattrs of %s: %v", target, err)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// verifyFiles checks that the extracted files are on disk with the size read
+// from the tar, so that a truncated tree is never deployed.
+func verifyFiles(files map[string]int64) error {
+	var count int
+	var total, expected int64
+
+	for path, size := range files {
+		expected += size
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if info.Mode().IsRegular() && info.Size() == size {
+			count++
+			total += size
+		}
+	}
+
+	if count != len(files) || total != expected {
+		return fmt.Errorf("found %d files of %d bytes instead of %d files of %d bytes",
+			count, total, len(files), expected)
+	}
+
+	return nil
+}
+
+// windowsReserved contains the names that can't be used as a file name on
+// Windows, with or without extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// normalizeName returns the tar entry name as a clean path for the given OS.
+// Backslashes, used by some Windows archivers, are considered as separators.
+// It rejects absolute names and names out of the release, and on Windows, the
+// names that can't be created on the filesystem.
+func normalizeName(name, goos string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+
+	if path.IsAbs(clean) {
+		return "", fmt.Errorf("%q is absolute", name)
+	}
+
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%q is out of the release", name)
+	}
+
+	if goos == "windows" {
+		for _, element := range strings.Split(clean, "/") {
+			if element == "" || element == "." || element == ".." {
+				continue
+			}
+
+			base := strings.ToUpper(strings.SplitN(element, ".", 2)[0])
+			if windowsReserved[base] {
+				return "", fmt.Errorf("%q uses the reserved name %q", name, element)
+			}
+
+			if strings.ContainsAny(element, "<>:\"|?*") {
+				return "", fmt.Errorf("%q contains an invalid character", name)
+			}
+
+			if strings.HasSuffix(element, ".") || strings.HasSuffix(element, " ") {
+				return "", fmt.Errorf("%q has an element ending with a dot or space", name)
+			}
+		}
+	}
+
+	return filepath.FromSlash(clean), nil
+}
+
+// xattrPrefix is the PAX record prefix of extended attributes
+const xattrPrefix = "SCHILY.xattr."
+
+// setXattrs sets the extended attributes stored in the header's PAX records
+// on the path.
+func setXattrs(path string, header *tar.Header) error {
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, xattrPrefix)
+
+		err := lsetxattr(path, name, []byte(value))
+		if err != nil {
+			return fmt.Errorf("failed to set %q: %v", name, err)
 		}
 	}
 
@@ -2,28 +2,43 @@ package deployer
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nkcr/hodor/asset"
 	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/hook"
+	"github.com/nkcr/hodor/scan"
+	"github.com/nkcr/hodor/store"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
-	"github.com/tidwall/buntdb"
 )
 
 func TestDeployer_Scenario_Pass(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+	db, err := store.OpenBunt(":memory:")
 	require.NoError(t, err)
 
 	releaseID := "XX"
@@ -40,8 +55,8 @@ func TestDeployer_Scenario_Pass(t *testing.T) {
 	target := filepath.Join(tmpDir, "target")
 
 	conf := config.Config{
-		Entries: map[string]string{
-			releaseID: target,
+		Entries: map[string]config.Entry{
+			releaseID: {Target: target},
 		},
 	}
 	client := fakeClient{
@@ -67,7 +82,7 @@ func TestDeployer_Scenario_Pass(t *testing.T) {
 
 	time.Sleep(time.Second)
 
-	jobID, err := deployer.Deploy(releaseID, tag, &url.URL{})
+	jobID, err := deployer.Deploy(Request{ReleaseID: releaseID, Tag: tag, ReleaseURL: &url.URL{}})
 	require.NoError(t, err)
 
 	time.Sleep(time.Second)
@@ -90,309 +105,4431 @@ func TestDeployer_Scenario_Pass(t *testing.T) {
 	buf, err := os.ReadFile(filepath.Join(target, "el.txt"))
 	require.NoError(t, err)
 	require.Equal(t, releaseContent, string(buf))
+
+	history, err := deployer.GetHistory(releaseID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	require.Equal(t, jobID, history[0].JobID)
+	require.Equal(t, tag, history[0].Tag)
+	require.Equal(t, "unknown", history[0].PreviousTag)
+	require.Equal(t, Changes{Added: 1}, history[0].Changes)
+	require.Greater(t, history[0].Duration, time.Duration(0))
+}
+
+func TestDeployer_Chained(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	appGz, _ := createTar(t, t.TempDir())
+	docsGz, _ := createTar(t, t.TempDir())
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{
+			"app": {Target: filepath.Join(tmpDir, "app")},
+			"docs": {
+				Target:   filepath.Join(tmpDir, "docs"),
+				After:    []string{"app"},
+				ChainURL: "https://docs/{tag}.tar.gz",
+			},
+			// not found by the client
+			"site": {
+				Target:   filepath.Join(tmpDir, "site"),
+				After:    []string{"docs"},
+				ChainURL: "https://site/{tag}.tar.gz",
+			},
+		},
+	}
+
+	client := &urlClient{
+		responses: map[string]fakeClient{
+			"https://app/v1.tar.gz":  {body: appGz},
+			"https://docs/v1.tar.gz": {body: docsGz},
+		},
+	}
+
+	deployer := NewFileDeployer(db, conf, client, zerolog.New(io.Discard))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		deployer.Start()
+	}()
+
+	defer func() {
+		deployer.Stop()
+		wait.Wait()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	appURL, err := url.Parse("https://app/v1.tar.gz")
+	require.NoError(t, err)
+
+	jobID, err := deployer.Deploy(Request{ReleaseID: "app", Tag: "v1", ReleaseURL: appURL})
+	require.NoError(t, err)
+
+	time.Sleep(time.Second)
+
+	status, err := deployer.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "ok", status.Status)
+	require.Equal(t, "failed", status.Combined)
+	require.Len(t, status.Chained, 1)
+
+	docsStatus, err := deployer.GetStatus(status.Chained[0])
+	require.NoError(t, err)
+	require.Equal(t, "ok", docsStatus.Status)
+	require.Len(t, docsStatus.Chained, 1)
+
+	siteStatus, err := deployer.GetStatus(docsStatus.Chained[0])
+	require.NoError(t, err)
+	require.Equal(t, "failed", siteStatus.Status)
+	require.Empty(t, siteStatus.Combined)
+
+	tag, err := deployer.GetLatestTag("docs")
+	require.NoError(t, err)
+	require.Equal(t, "v1", tag)
+}
+
+func TestTriggerChained_Cycle(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+		jobs:  make(chan job, 1),
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {After: []string{"YY"}, ChainURL: "https://xx"},
+				"YY": {After: []string{"XX"}, ChainURL: "https://yy"},
+			},
+		},
+		logger: zerolog.New(io.Discard),
+	}
+
+	jobIDs := fd.triggerChained(job{releaseID: "XX", chain: []string{"YY"}})
+	require.Empty(t, jobIDs)
+
+	jobIDs = fd.triggerChained(job{releaseID: "XX", tag: "v1"})
+	require.Len(t, jobIDs, 1)
+
+	chained := <-fd.jobs
+	require.Equal(t, "YY", chained.releaseID)
+	require.Equal(t, "v1", chained.tag)
+	require.Equal(t, []string{"XX"}, chained.chain)
+}
+
+func TestCombinedStatus_Running(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+	}
+
+	err = fd.saveJobStatus(job{id: "BB"}, "created", "")
+	require.NoError(t, err)
+
+	err = fd.saveJobStatus(job{id: "AA", chained: []string{"BB"}}, "ok", "")
+	require.NoError(t, err)
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "running", status.Combined)
+
+	err = fd.saveJobStatus(job{id: "DD", chained: []string{"CC"}}, "ok", "")
+	require.NoError(t, err)
+
+	_, err = fd.GetStatus("DD")
+	require.EqualError(t, err, "failed to get combined status: failed to get "+
+		"chained job \"CC\": key \"CC\" not found")
+}
+
+func TestCheckTransition(t *testing.T) {
+	custom := []string{"canary", "awaiting_approval"}
+
+	allowed := [][2]string{
+		{"", "created"},
+		{"", "running"},
+		{"created", "running"},
+		{"created", "deferred"},
+		{"deferred", "created"},
+		{"running", "ok"},
+		{"running", "canary"},
+		{"canary", "awaiting_approval"},
+		{"canary", "running"},
+		{"canary", "failed"},
+		// a custom status removed from the configuration can still end
+		{"removed", "ok"},
+	}
+
+	for _, transition := range allowed {
+		require.NoError(t, checkTransition(transition[0], transition[1], custom), transition)
+	}
+
+	denied := [][2]string{
+		{"", "canary"},
+		{"created", "ok"},
+		{"created", "canary"},
+		{"deferred", "ok"},
+		{"running", "other"},
+		{"canary", "created"},
+		{"canary", "other"},
+		{"ok", "running"},
+		{"ok", "ok"},
+		{"failed", "canary"},
+	}
+
+	for _, transition := range denied {
+		err := checkTransition(transition[0], transition[1], custom)
+		require.True(t, errors.Is(err, ErrTransition), transition)
+	}
+
+	err := checkTransition("ok", "running", nil)
+	require.EqualError(t, err, "invalid status transition from \"ok\" to \"running\"")
+}
+
+func TestSetStatus(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{Entries: map[string]config.Entry{
+			"XX": {States: []string{"canary"}},
+		}},
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	events, unsubscribe := fd.Subscribe()
+	defer unsubscribe()
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", requestID: "RR"}
+
+	err = fd.saveJobStatus(job, "created", "")
+	require.NoError(t, err)
+
+	// a job must be running to take a custom status
+	err = fd.SetStatus("AA", "canary", "10% of the traffic")
+	require.True(t, errors.Is(err, ErrTransition))
+
+	fd.start(job)
+
+	running, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+
+	err = fd.SetStatus("AA", "canary", "10% of the traffic")
+	require.NoError(t, err)
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "canary", status.Status)
+	require.Equal(t, "10% of the traffic", status.Message)
+	require.Equal(t, "XX", status.ReleaseID)
+	require.Equal(t, "RR", status.RequestID)
+
+	// the custom status is published
+	for event := range events {
+		if event.Status == "canary" {
+			require.Equal(t, "AA", event.JobID)
+			break
+		}
+	}
+
+	// the job keeps its start once it runs again
+	err = fd.SetStatus("AA", "running", "canary passed")
+	require.NoError(t, err)
+
+	status, err = fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "running", status.Status)
+	require.Equal(t, running.StartedAt.UnixNano(), status.StartedAt.UnixNano())
+
+	// unknown and deployer statuses are rejected
+	err = fd.SetStatus("AA", "other", "")
+	require.True(t, errors.Is(err, ErrTransition))
+
+	err = fd.SetStatus("AA", "ok", "")
+	require.EqualError(t, err, "invalid status transition: \"ok\" is set by the deployer")
+
+	err = fd.SetStatus("BB", "canary", "")
+	require.EqualError(t, err, "key \"BB\" not found")
+
+	// a finished job can't take a custom status
+	err = fd.saveJobStatus(job, "ok", "job done")
+	require.NoError(t, err)
+
+	err = fd.SetStatus("AA", "canary", "")
+	require.True(t, errors.Is(err, ErrTransition))
+}
+
+func TestDeployer_Group_Pass(t *testing.T) {
+	fd, tmpDir := newGroupDeployer(t)
+
+	frontGz, _ := createTar(t, t.TempDir())
+	backGz, _ := createTar(t, t.TempDir())
+
+	fd.client = &urlClient{
+		responses: map[string]fakeClient{
+			"https://front": {body: frontGz},
+			"https://back":  {body: backGz},
+		},
+	}
+
+	jobID, err := fd.Deploy(Request{ReleaseID: "bundle", Tag: "v1", Assets: groupAssets})
+	require.NoError(t, err)
+
+	group := <-fd.jobs
+
+	fd.start(group)
+	fd.processGroup(group)
+
+	status, err := fd.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "ok", status.Status)
+	require.Len(t, status.Group, 2)
+
+	for _, memberID := range status.Group {
+		memberStatus, err := fd.GetStatus(memberID)
+		require.NoError(t, err)
+		require.Equal(t, "ok", memberStatus.Status)
+	}
+
+	for _, releaseID := range []string{"bundle", "front", "back"} {
+		tag, err := fd.GetLatestTag(releaseID)
+		require.NoError(t, err)
+		require.Equal(t, "v1", tag)
+	}
+
+	history, err := fd.GetHistory("bundle")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, Changes{Added: 2, Removed: 2}, history[0].Changes)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "front", "el.txt"))
+	require.NoError(t, err)
+}
+
+func TestDeployer_Group_Rollback(t *testing.T) {
+	fd, tmpDir := newGroupDeployer(t)
+
+	frontGz, _ := createTar(t, t.TempDir())
+
+	// the back asset is not found
+	fd.client = &urlClient{
+		responses: map[string]fakeClient{
+			"https://front": {body: frontGz},
+		},
+	}
+
+	jobID, err := fd.Deploy(Request{ReleaseID: "bundle", Tag: "v1", Assets: groupAssets})
+	require.NoError(t, err)
+
+	group := <-fd.jobs
+
+	fd.start(group)
+	fd.processGroup(group)
+
+	status, err := fd.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, "group rolled back: failed to deploy \"back\": failed to get file: "+
+		"unexpected status \"404 Not Found\"", status.Message)
+
+	for _, memberID := range status.Group {
+		memberStatus, err := fd.GetStatus(memberID)
+		require.NoError(t, err)
+		require.Equal(t, "failed", memberStatus.Status)
+	}
+
+	tag, err := fd.GetLatestTag("front")
+	require.NoError(t, err)
+	require.Equal(t, "unknown", tag)
+
+	for _, target := range []string{"front", "back"} {
+		buf, err := os.ReadFile(filepath.Join(tmpDir, target, "old.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "old", string(buf))
+
+		_, err = os.Stat(filepath.Join(tmpDir, target, "el.txt"))
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestDeploy_Group_Missing_Asset(t *testing.T) {
+	fd, _ := newGroupDeployer(t)
+
+	_, err := fd.Deploy(Request{ReleaseID: "bundle", Assets: groupAssets[:1]})
+	require.EqualError(t, err, "failed to select asset of \"back\": failed to select "+
+		"asset: no asset matches the patterns [back-*]")
+
+	_, err = fd.SelectAsset("bundle", groupAssets[:1])
+	require.EqualError(t, err, "failed to select asset of \"back\": no asset matches "+
+		"the patterns [back-*]")
+
+	releaseURL, err := fd.SelectAsset("bundle", groupAssets)
+	require.NoError(t, err)
+	require.Nil(t, releaseURL)
+}
+
+func TestDeploy_Before_Start(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	deployer := NewFileDeployer(db, config.Config{}, fakeClient{}, zerolog.New(io.Discard))
+
+	jobID, err := deployer.Deploy(Request{ReleaseID: "XX", ReleaseURL: &url.URL{}})
+	require.NoError(t, err)
+	require.Equal(t, 1, deployer.QueueLength())
+	require.False(t, deployer.Running())
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		deployer.Start()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	require.True(t, deployer.Running())
+
+	deployer.Stop()
+	wait.Wait()
+
+	require.False(t, deployer.Running())
+
+	// the job is handled, and fails since the release is not configured
+	status, err := deployer.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+}
+
+func TestSubscribe(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+	}
+
+	events, unsubscribe := fd.Subscribe()
+
+	releaseURL, err := url.Parse("https://xx/release.tar.gz")
+	require.NoError(t, err)
+
+	err = fd.saveJobStatus(job{id: "XX", releaseID: "YY", tag: "ZZ", releaseURL: releaseURL},
+		"ok", "done")
+	require.NoError(t, err)
+
+	event := <-events
+	require.Equal(t, "XX", event.JobID)
+	require.Equal(t, "YY", event.ReleaseID)
+	require.Equal(t, "ZZ", event.Tag)
+	require.Equal(t, "ok", event.Status)
+	require.Equal(t, "done", event.Message)
+	require.Equal(t, "https://xx/release.tar.gz", event.ReleaseURL)
+
+	unsubscribe()
+
+	err = fd.saveJobStatus(job{id: "YY"}, "ok", "done")
+	require.NoError(t, err)
+
+	require.Len(t, events, 0)
+}
+
+func TestBroker_Full(t *testing.T) {
+	var b broker
+
+	events, _ := b.subscribe()
+
+	for i := 0; i < eventsSize+1; i++ {
+		b.publish(JobEvent{})
+	}
+
+	require.Len(t, events, eventsSize)
+}
+
+func TestProcessJobs_Stop(t *testing.T) {
+	jobs := make(chan job, 2)
+	jobs <- job{}
+	jobs <- job{}
+
+	fd := FileDeployer{
+		stop: true,
+		jobs: jobs,
+	}
+
+	fd.processJobs()
+
+	// no job is taken once stopped
+	require.Len(t, jobs, 2)
+}
+
+func TestFairQueue(t *testing.T) {
+	var q fairQueue
+
+	for _, id := range []string{"A1", "A2", "A3", "B1", "C1", "B2"} {
+		q.push(job{id: id, releaseID: id[:1]})
+	}
+
+	require.Equal(t, 6, q.len())
+
+	var order []string
+
+	for q.len() != 0 {
+		order = append(order, q.pop().id)
+	}
+
+	require.Equal(t, []string{"A1", "B1", "C1", "A2", "B2", "A3"}, order)
+
+	// a release that is emptied takes its turn again with its next job
+	q.push(job{id: "A4", releaseID: "A"})
+	q.push(job{id: "B3", releaseID: "B"})
+	require.Equal(t, "A4", q.pop().id)
+	require.Equal(t, "B3", q.pop().id)
+}
+
+func TestFairQueue_PopFree(t *testing.T) {
+	var q fairQueue
+
+	q.push(job{id: "A1", releaseID: "A"})
+	q.push(job{id: "G1", releaseID: "G", members: []job{{releaseID: "B"}, {releaseID: "C"}}})
+	q.push(job{id: "B1", releaseID: "B"})
+	q.push(job{id: "D1", releaseID: "D"})
+
+	// the group writes to B
+	next, ok := q.popFree(map[string]bool{"A": true, "B": true})
+	require.True(t, ok)
+	require.Equal(t, "D1", next.id)
+
+	_, ok = q.popFree(map[string]bool{"A": true, "B": true})
+	require.False(t, ok)
+
+	next, ok = q.popFree(map[string]bool{"A": true})
+	require.True(t, ok)
+	require.Equal(t, "G1", next.id)
+
+	require.Equal(t, "A1", q.pop().id)
+	require.Equal(t, "B1", q.pop().id)
+	require.Equal(t, 0, q.len())
+}
+
+func TestReload(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{"XX": {Target: "/var/xx"}},
+	}
+
+	deployer := NewFileDeployer(db, conf, fakeClient{}, zerolog.New(io.Discard))
+
+	tag, err := deployer.GetLatestTag("YY")
+	require.NoError(t, err)
+	require.Equal(t, "unknown", tag)
+
+	deployer.Reload(config.Config{
+		Entries: map[string]config.Entry{
+			"XX": {Target: "/var/xx"},
+			"YY": {Target: "/var/yy", InitialTag: "v0"},
+		},
+	})
+
+	tag, err = deployer.GetLatestTag("YY")
+	require.NoError(t, err)
+	require.Equal(t, "v0", tag)
+
+	releases, err := deployer.GetReleases()
+	require.NoError(t, err)
+	require.Len(t, releases, 2)
+}
+
+func TestDrain_Requeue(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	deployer := NewFileDeployer(db, config.Config{}, fakeClient{}, zerolog.New(io.Discard))
+
+	releaseURL, err := url.Parse("https://xx/release.tar.gz")
+	require.NoError(t, err)
+
+	jobIDs := make([]string, 2)
+
+	for i, releaseID := range []string{"XX", "YY"} {
+		jobIDs[i], err = deployer.Deploy(Request{ReleaseID: releaseID, Tag: "v1",
+			ReleaseURL: releaseURL, SHA256: "AA"})
+		require.NoError(t, err)
+	}
+
+	// stopped before any job is handled
+	deployer.Stop()
+	deployer.Start()
+
+	require.Equal(t, Drain{Requeued: 2}, deployer.Drained())
+
+	for _, jobID := range jobIDs {
+		status, err := deployer.GetStatus(jobID)
+		require.NoError(t, err)
+		require.Equal(t, "created", status.Status)
+		require.Equal(t, "job is queued again once Hodor restarts", status.Message)
+	}
+
+	fd := NewFileDeployer(db, config.Config{}, fakeClient{}, zerolog.New(io.Discard)).(*FileDeployer)
+	fd.restoreQueued()
+
+	require.Equal(t, 2, fd.QueueLength())
+
+	first := fd.pending.pop()
+	require.Equal(t, job{id: jobIDs[0], releaseID: "XX", tag: "v1", releaseURL: releaseURL,
+		sha256: "AA"}, first)
+
+	// the saved jobs are removed once restored
+	err = db.View(func(tx store.Tx) error {
+		return tx.Iterate(queuedKey(""), false, func(key, value string) bool {
+			t.Errorf("unexpected key %q", key)
+			return true
+		})
+	})
+	require.NoError(t, err)
+}
+
+func TestNextFree(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		jobs:  make(chan job, QueueSize),
+		serde: defaultSerde,
+	}
+
+	for _, releaseID := range []string{"XX", "XX", "XX", "YY"} {
+		require.NoError(t, fd.enqueue(newJob(Request{ReleaseID: releaseID})))
+	}
+
+	next, ok := fd.nextFree(nil)
+	require.True(t, ok)
+	require.Equal(t, "XX", next.releaseID)
+	require.Equal(t, 3, fd.QueueLength())
+
+	// the pending jobs count in the queue size
+	for i := 0; i < QueueSize-3; i++ {
+		require.NoError(t, fd.enqueue(newJob(Request{ReleaseID: "ZZ"})))
+	}
+
+	err = fd.enqueue(newJob(Request{ReleaseID: "ZZ"}))
+	require.EqualError(t, err, "buffer is full, re-try later")
+
+	var order []string
+
+	for i := 0; i < 4; i++ {
+		next, ok = fd.nextFree(nil)
+		require.True(t, ok)
+		order = append(order, next.releaseID)
+	}
+
+	require.Equal(t, []string{"YY", "XX", "ZZ", "XX"}, order)
+
+	// the jobs of a busy release are skipped
+	next, ok = fd.nextFree(map[string]bool{"ZZ": true})
+	require.False(t, ok)
+
+	for fd.QueueLength() != 0 {
+		_, ok = fd.nextFree(nil)
+		require.True(t, ok)
+	}
+
+	_, ok = fd.nextFree(nil)
+	require.False(t, ok)
+}
+
+func TestProcessJobs_Workers(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	hooks := &blockingExecutor{started: make(chan string, 10), release: make(chan struct{})}
+
+	tmpDir := t.TempDir()
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	entries := make(map[string]config.Entry)
+	for _, releaseID := range []string{"XX", "YY"} {
+		entries[releaseID] = config.Entry{
+			Target:    filepath.Join(tmpDir, releaseID),
+			PreDeploy: []string{releaseID},
+		}
+	}
+
+	fd := NewFileDeployer(db, config.Config{Entries: entries, Workers: 2},
+		bytesClient{body: releaseGz.Bytes()}, zerolog.New(io.Discard)).(*FileDeployer)
+	fd.hooks = hooks
+
+	releaseURL, err := url.Parse("https://xx/release.tar.gz")
+	require.NoError(t, err)
+
+	var jobIDs []string
+
+	for _, releaseID := range []string{"XX", "XX", "YY"} {
+		jobID, err := fd.Deploy(Request{ReleaseID: releaseID, Tag: "v1", ReleaseURL: releaseURL})
+		require.NoError(t, err)
+
+		jobIDs = append(jobIDs, jobID)
+	}
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		fd.Start()
+	}()
+
+	// the jobs of different releases run at the same time, while the second
+	// job of XX waits for the first one
+	started := []string{<-hooks.started, <-hooks.started}
+	require.ElementsMatch(t, []string{"XX", "YY"}, started)
+
+	status, err := fd.GetStatus(jobIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, "created", status.Status)
+
+	close(hooks.release)
+
+	require.Equal(t, "XX", <-hooks.started)
+
+	require.Eventually(t, func() bool {
+		status, err := fd.GetStatus(jobIDs[1])
+		return err == nil && status.Status == "ok"
+	}, time.Second*5, time.Millisecond*10)
+
+	fd.Stop()
+	wait.Wait()
+
+	for _, jobID := range jobIDs {
+		status, err := fd.GetStatus(jobID)
+		require.NoError(t, err)
+		require.Equal(t, "ok", status.Status)
+	}
+}
+
+func TestProcessJobs_Handle_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	jobs := make(chan job, 1)
+	jobID := "XX"
+	releaseID := "YY"
+	jobs <- job{
+		id:        jobID,
+		releaseID: releaseID,
+	}
+	close(jobs)
+
+	fd := FileDeployer{
+		stop:  false,
+		jobs:  jobs,
+		db:    db,
+		serde: defaultSerde,
+	}
+
+	fd.processJobs()
+
+	status, err := fd.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, fmt.Sprintf("releaseID %q not found from the config", releaseID), status.Message)
+}
+
+func TestProcessJobs_Handle_Fail_Status_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	jobs := make(chan job, 1)
+	jobID := "XX"
+	releaseID := "YY"
+	jobs <- job{
+		id:        jobID,
+		releaseID: releaseID,
+	}
+	close(jobs)
+
+	log := new(bytes.Buffer)
+	logger := zerolog.New(log)
+
+	fd := FileDeployer{
+		stop:   false,
+		jobs:   jobs,
+		db:     db,
+		serde:  fakeSerde{errors.New("fakes")},
+		logger: logger,
+	}
+
+	fd.processJobs()
+
+	_, err = fd.GetStatus(jobID)
+	require.EqualError(t, err, fmt.Sprintf("key %q not found", "XX"))
+
+	require.Contains(t, log.String(), "job failed: failed to save status")
+}
+
+func TestProcessJobs_Handle_Pass_Status_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	jobs := make(chan job, 1)
+	jobID := "XX"
+	releaseID := "YY"
+	jobs <- job{
+		id:         jobID,
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	}
+	close(jobs)
+
+	log := new(bytes.Buffer)
+	logger := zerolog.New(log)
+
+	fd := FileDeployer{
+		stop:   false,
+		jobs:   jobs,
+		db:     db,
+		serde:  fakeSerde{errors.New("fakes")},
+		logger: logger,
+		client: fakeClient{body: releaseGz},
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {Target: filepath.Join(tmpDir, "YY")},
+			},
+		},
+	}
+
+	fd.processJobs()
+
+	require.Contains(t, log.String(), "job ok: failed to save status")
+}
+
+func TestDeploy_Not_Started(t *testing.T) {
+	fd := FileDeployer{
+		stop: true,
+	}
+
+	_, err := fd.Deploy(Request{})
+	require.EqualError(t, err, "deployer is stopped")
+}
+
+func TestDeploy_Update_Status_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		serde: fakeSerde{err: errors.New("fake")},
+		db:    db,
+	}
+
+	_, err = fd.Deploy(Request{})
+	require.EqualError(t, err, "failed to set job status: failed to marshal status: fake")
+}
+
+func TestDeploy_Update_Buffer_Full(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		serde: fakeSerde{},
+		db:    db,
+		jobs:  make(chan job),
+	}
+
+	_, err = fd.Deploy(Request{})
+	require.EqualError(t, err, "buffer is full, re-try later")
+}
+
+func TestDeploy_Request_ID(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	log := new(bytes.Buffer)
+
+	fd := FileDeployer{
+		serde:  defaultSerde,
+		db:     db,
+		jobs:   make(chan job, 1),
+		logger: zerolog.New(log),
+	}
+
+	jobID, err := fd.Deploy(Request{ReleaseID: "XX", RequestID: "YY", ReleaseURL: &url.URL{}})
+	require.NoError(t, err)
+
+	status, err := fd.GetStatus(jobID)
+	require.NoError(t, err)
+	require.Equal(t, "YY", status.RequestID)
+
+	job := <-fd.jobs
+	fd.handleJob(job)
+
+	require.Contains(t, log.String(), `"requestID":"YY"`)
+	require.Contains(t, log.String(), `"jobID":"`+jobID+`"`)
+}
+
+func TestList_Pass(t *testing.T) {
+	releaseGz, _ := createTar(t, t.TempDir())
+
+	fd := FileDeployer{
+		client: fakeClient{body: releaseGz},
+	}
+
+	listing, err := fd.List(context.Background(), &url.URL{})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, listing.Files)
+	require.Equal(t, int64(2), listing.TotalSize)
+	require.Contains(t, listing.Entries, ListingEntry{Name: "release/el.txt", Size: 2, Type: "file"})
+}
+
+// A small archive of empty entries must not use unbounded memory
+func TestList_Too_Many_Entries(t *testing.T) {
+	releaseGz := new(bytes.Buffer)
+
+	gzw := gzip.NewWriter(releaseGz)
+	tw := tar.NewWriter(gzw)
+
+	for i := 0; i <= maxListEntries; i++ {
+		err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("release/%d", i),
+			Typeflag: tar.TypeReg, Mode: 0644})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+
+	fd := FileDeployer{
+		client: fakeClient{body: releaseGz},
+	}
+
+	_, err := fd.List(context.Background(), &url.URL{})
+	require.EqualError(t, err, fmt.Sprintf("archive has more than %d entries", maxListEntries))
+}
+
+func TestList_Status_Fail(t *testing.T) {
+	fd := FileDeployer{
+		client: &urlClient{},
+	}
+
+	_, err := fd.List(context.Background(), &url.URL{})
+	require.EqualError(t, err, "failed to get file: unexpected status \"404 Not Found\"")
+}
+
+func TestGetStatus_Key_Not_Found(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+	}
+
+	key := "XX"
+
+	_, err = fd.GetStatus(key)
+	require.EqualError(t, err, fmt.Sprintf("key %q not found", key))
+}
+
+func TestGetStatus_Unmarshal_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	key := "XX"
+
+	err = db.Update(func(tx store.Tx) error {
+		err = tx.Set(key, "")
+		require.NoError(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: fakeSerde{err: errors.New("fake")},
+	}
+
+	_, err = fd.GetStatus(key)
+	require.EqualError(t, err, "failed to unmarshal job status: fake")
+}
+
+func TestGetLatestTag_Not_Found(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+	}
+
+	tag, err := fd.GetLatestTag("XX")
+
+	require.NoError(t, err)
+	require.Equal(t, "unknown", tag)
+}
+
+func TestGetLatestTag_Initial(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			UnknownTag: "none",
+			Entries: map[string]config.Entry{
+				"XX": {InitialTag: "v0"},
+			},
+		},
+	}
+
+	tag, err := fd.GetLatestTag("XX")
+	require.NoError(t, err)
+	require.Equal(t, "v0", tag)
+
+	tag, err = fd.GetLatestTag("YY")
+	require.NoError(t, err)
+	require.Equal(t, "none", tag)
+
+	err = db.Update(func(tx store.Tx) error {
+		return tx.Set("XX", "v1")
+	})
+	require.NoError(t, err)
+
+	tag, err = fd.GetLatestTag("XX")
+	require.NoError(t, err)
+	require.Equal(t, "v1", tag)
+}
+
+func TestGetReleases(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	entries := map[string]config.Entry{
+		"YY": {Target: "/srv/yy", Subpath: "assets"},
+		"XX": {Target: "/srv/xx"},
+	}
+
+	fd := FileDeployer{
+		db:     db,
+		config: config.Config{Entries: entries},
+	}
+
+	err = db.Update(func(tx store.Tx) error {
+		return tx.Set("XX", "v1")
+	})
+	require.NoError(t, err)
+
+	releases, err := fd.GetReleases()
+	require.NoError(t, err)
+	require.Equal(t, []Release{
+		{ReleaseID: "XX", Target: "/srv/xx", Digest: entries["XX"].Digest(), Tag: "v1"},
+		{ReleaseID: "YY", Target: "/srv/yy", Subpath: "assets", Digest: entries["YY"].Digest()},
+	}, releases)
+}
+
+func TestSelectAsset_Pass(t *testing.T) {
+	fd := FileDeployer{
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {
+					Assets: config.AssetRules{Patterns: []string{"*.tar.gz"}},
+				},
+			},
+		},
+		logger: zerolog.New(io.Discard),
+	}
+
+	releaseURL, err := fd.SelectAsset("XX", []asset.Asset{
+		{Name: "app.zip", BrowserDownloadURL: "https://xx/app.zip"},
+		{Name: "app.tar.gz", BrowserDownloadURL: "https://xx/app.tar.gz"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "https://xx/app.tar.gz", releaseURL.String())
+}
+
+func TestSelectAsset_Not_Found(t *testing.T) {
+	fd := FileDeployer{}
+
+	_, err := fd.SelectAsset("XX", nil)
+	require.EqualError(t, err, "releaseID \"XX\" not found from the config")
+}
+
+func TestSelectAsset_No_Match(t *testing.T) {
+	fd := FileDeployer{
+		config: config.Config{
+			Entries: map[string]config.Entry{"XX": {}},
+		},
+	}
+
+	_, err := fd.SelectAsset("XX", nil)
+	require.EqualError(t, err, "failed to select asset: no asset")
+}
+
+func TestCheckURL(t *testing.T) {
+	fd := FileDeployer{
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {HTTPMirrors: []string{"mirror.lan", "cache.lan:8080"}},
+			},
+		},
+	}
+
+	check := func(releaseID, rawURL string) error {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+
+		return fd.CheckURL(releaseID, u)
+	}
+
+	require.NoError(t, check("XX", "https://xx/app.tar.gz"))
+	require.NoError(t, check("XX", "http://mirror.lan/app.tar.gz"))
+	require.NoError(t, check("XX", "http://MIRROR.lan:8080/app.tar.gz"))
+	require.NoError(t, check("XX", "http://cache.lan:8080/app.tar.gz"))
+
+	err := check("XX", "http://cache.lan/app.tar.gz")
+	require.EqualError(t, err, "not https: \"http://cache.lan/app.tar.gz\"")
+
+	// the mirrors of a release don't apply to the others
+	err = check("YY", "http://mirror.lan/app.tar.gz")
+	require.ErrorIs(t, err, ErrInsecureURL)
+
+	// a redirect must not downgrade to plain HTTP
+	req := httptest.NewRequest(http.MethodGet, "http://xx/app.tar.gz", nil)
+
+	err = fd.checkRedirect("XX", &http.Response{Request: req})
+	require.EqualError(t, err, "redirected: not https: \"http://xx/app.tar.gz\"")
+
+	fd.config.AllowHTTP = true
+
+	require.NoError(t, check("YY", "http://xx/app.tar.gz"))
+	require.NoError(t, fd.checkRedirect("XX", &http.Response{Request: req}))
+}
+
+// A redirect through plain HTTP must be refused before it is followed, even if
+// the chain ends on HTTPS.
+func TestFetch_Insecure_Redirect(t *testing.T) {
+	var insecureHits int32
+
+	var secure *httptest.Server
+
+	insecure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&insecureHits, 1)
+		http.Redirect(w, r, secure.URL+"/app.tar.gz", http.StatusFound)
+	}))
+	defer insecure.Close()
+
+	secure = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			http.Redirect(w, r, insecure.URL+"/app.tar.gz", http.StatusFound)
+			return
+		}
+
+		w.Write([]byte("archive"))
+	}))
+	defer secure.Close()
+
+	fd := FileDeployer{
+		config: config.Config{Entries: map[string]config.Entry{
+			"XX": {DownloadHeaders: map[string]string{"Authorization": "Bearer secret"}},
+		}},
+		client: secure.Client(),
+		logger: zerolog.New(io.Discard),
+	}
+
+	u, err := url.Parse(secure.URL + "/latest")
+	require.NoError(t, err)
+
+	_, err = fd.fetch(job{releaseID: "XX"}, u, &Provenance{})
+	require.ErrorIs(t, err, ErrInsecureURL)
+	require.Equal(t, int32(0), atomic.LoadInt32(&insecureHits))
+
+	// the secure URL is still fetched
+	u, err = url.Parse(secure.URL + "/app.tar.gz")
+	require.NoError(t, err)
+
+	res, err := fd.fetch(job{releaseID: "XX"}, u, &Provenance{})
+	require.NoError(t, err)
+	res.Body.Close()
+
+	// an allowed plain HTTP hop is followed
+	fd.config.AllowHTTP = true
+
+	res, err = fd.fetch(job{releaseID: "XX"}, u, &Provenance{})
+	require.NoError(t, err)
+	res.Body.Close()
+
+	u, err = url.Parse(secure.URL + "/latest")
+	require.NoError(t, err)
+
+	res, err = fd.fetch(job{releaseID: "XX"}, u, &Provenance{})
+	require.NoError(t, err)
+	res.Body.Close()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&insecureHits))
+}
+
+func TestHandleJob_Release_Not_Found(t *testing.T) {
+	releaseID := "XX"
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{},
+	}
+
+	fd := FileDeployer{
+		config: conf,
+	}
+
+	job := job{
+		id:         "",
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	}
+
+	_, err := fd.handleJob(job)
+	require.EqualError(t, err, fmt.Sprintf("releaseID %q not found from the config", releaseID))
+}
+
+func TestHandleJob_Release_GET_Failed(t *testing.T) {
+	releaseID := "XX"
+
+	client := fakeClient{
+		err: errors.New("fake"),
+	}
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{
+			releaseID: {Target: filepath.Join(t.TempDir(), "YY")},
+		},
+	}
+
+	fd := FileDeployer{
+		config: conf,
+		client: client,
+	}
+
+	job := job{
+		id:         "",
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	}
+
+	_, err := fd.handleJob(job)
+	require.EqualError(t, err, "failed to get file: fake")
+}
+
+func TestHandleJob_Fallback_URLs(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+
+	client := &urlClient{
+		responses: map[string]fakeClient{
+			"https://primary":           {err: errors.New("fake")},
+			"https://mirror/release-v1": {body: releaseGz},
+		},
+	}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:       filepath.Join(tmpDir, "target"),
+					FallbackURLs: []string{"https://mirror/release-{tag}"},
+				},
+			},
+		},
+		client: client,
+		logger: zerolog.New(io.Discard),
+	}
+
+	primary, _ := url.Parse("https://primary")
+	fallback, _ := url.Parse("https://fallback")
+
+	_, err = fd.handleJob(job{
+		releaseID:    releaseID,
+		tag:          "v1",
+		releaseURL:   primary,
+		fallbackURLs: []*url.URL{fallback},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"https://primary", "https://fallback",
+		"https://mirror/release-v1"}, client.calls)
+}
+
+func TestHandleJob_All_URLs_Failed(t *testing.T) {
+	releaseID := "XX"
+
+	fd := FileDeployer{
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {Target: filepath.Join(t.TempDir(), "YY")},
+			},
+		},
+		client: &urlClient{},
+		logger: zerolog.New(io.Discard),
+	}
+
+	primary, _ := url.Parse("https://primary")
+
+	_, err := fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: primary,
+	})
+	require.EqualError(t, err, "failed to get file: unexpected status \"404 Not Found\"")
+}
+
+func TestHandleJob_Retry(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	releaseGz, _ := createTar(t, t.TempDir())
+
+	// the first two requests fail with a bad gateway, and /missing always
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if requests <= 2 {
+			http.Error(w, "upstream", http.StatusBadGateway)
+			return
+		}
+
+		w.Write(releaseGz.Bytes())
+	}))
+	defer server.Close()
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			AllowHTTP: true,
+			Retry:     config.Retry{Attempts: 3, Backoff: config.Duration(time.Millisecond)},
+			Entries: map[string]config.Entry{
+				"XX": {Target: filepath.Join(tmpDir, "target")},
+			},
+		},
+		client: server.Client(),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	events, unsubscribe := fd.Subscribe()
+	defer unsubscribe()
+
+	releaseURL, err := url.Parse(server.URL + "/release")
+	require.NoError(t, err)
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: releaseURL}
+
+	fd.start(job)
+
+	d, err := fd.handleJob(job)
+	require.NoError(t, err)
+	require.Equal(t, 3, requests)
+
+	// each retry is recorded in the status message
+	var messages []string
+
+	for len(events) > 0 {
+		messages = append(messages, (<-events).Message)
+	}
+
+	require.Len(t, messages, 3)
+	require.Regexp(t, `^download attempt 1/3 failed, retrying in .+: unexpected status "502 Bad Gateway"$`,
+		messages[1])
+	require.Regexp(t, `^download attempt 2/3 failed`, messages[2])
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "running", status.Status)
+
+	fd.succeed(job, d)
+
+	// a missing archive is not retried
+	requests = 0
+	job.id = "BB"
+	job.releaseURL, _ = url.Parse(server.URL + "/missing")
+
+	_, err = fd.handleJob(job)
+	require.EqualError(t, err, "failed to get file: unexpected status \"404 Not Found\"")
+	require.Equal(t, 1, requests)
+
+	// the attempts are bounded, and the entry overrides the policy
+	entry := fd.config.Entries["XX"]
+	entry.Retry = &config.Retry{Attempts: 2, Backoff: config.Duration(time.Millisecond)}
+	fd.config.Entries["XX"] = entry
+
+	requests = 0
+	job.id = "CC"
+	job.releaseURL = releaseURL
+
+	_, err = fd.handleJob(job)
+	require.EqualError(t, err, "failed to get file: unexpected status \"502 Bad Gateway\", after 2 attempts")
+	require.Equal(t, 2, requests)
+}
+
+func TestRetryWait(t *testing.T) {
+	retry := config.Retry{
+		Backoff:    config.Duration(time.Second),
+		MaxBackoff: config.Duration(5 * time.Second),
+	}
+
+	for attempt, max := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		wait := retryWait(retry, attempt)
+		require.LessOrEqual(t, wait, max, attempt)
+		require.GreaterOrEqual(t, wait, max/2, attempt)
+	}
+
+	wait := retryWait(config.Retry{}, 1)
+	require.LessOrEqual(t, wait, defaultRetryBackoff)
+	require.GreaterOrEqual(t, wait, defaultRetryBackoff/2)
+}
+
+func TestGet_Rate_Limited(t *testing.T) {
+	client := &rateLimitedClient{
+		header: http.Header{"Retry-After": []string{"0"}},
+	}
+
+	fd := FileDeployer{
+		client: client,
+		logger: zerolog.New(io.Discard),
+	}
+
+	res, err := fd.get(job{}, &url.URL{Host: "api.github.com"}, &Provenance{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, 2, client.calls)
+}
+
+func TestGet_Rate_Limited_Too_Long(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+
+	client := &rateLimitedClient{
+		header: http.Header{
+			"X-Ratelimit-Remaining": []string{"0"},
+			"X-Ratelimit-Reset":     []string{fmt.Sprint(reset)},
+		},
+	}
+
+	fd := FileDeployer{
+		client: client,
+		logger: zerolog.New(io.Discard),
+		config: config.Config{
+			GitHub: config.GitHubConfig{
+				RateLimitMaxWait: config.Duration(time.Minute),
+			},
+		},
+	}
+
+	_, err := fd.get(job{}, &url.URL{Host: "api.github.com"}, &Provenance{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rate limited by \"api.github.com\"")
+	require.Contains(t, err.Error(), "more than the maximum wait of 1m0s")
+	require.Equal(t, 1, client.calls)
+}
+
+func TestNewRequest(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "")
+
+	fd := FileDeployer{
+		config: config.Config{
+			GitHub: config.GitHubConfig{Token: "TOKEN", Hosts: []string{"git.example.com"}},
+			Entries: map[string]config.Entry{
+				"XX": {DownloadHeaders: map[string]string{"Authorization": "Basic xx"}},
+			},
+		},
+	}
+
+	header := func(releaseID, rawURL, key string) string {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+
+		req, err := fd.newRequest(context.Background(), releaseID, u)
+		require.NoError(t, err)
+
+		return req.Header.Get(key)
+	}
+
+	require.Equal(t, "Bearer TOKEN", header("YY", "https://github.com/a/b/releases/download/v1/b.tar.gz",
+		"Authorization"))
+	require.Equal(t, "Bearer TOKEN", header("", "https://git.example.com/a/b.tar.gz", "Authorization"))
+	require.Equal(t, "Basic xx", header("XX", "https://github.com/a/b.tar.gz", "Authorization"))
+
+	// the token is only sent to GitHub, over HTTPS
+	require.Equal(t, "", header("YY", "https://example.com/b.tar.gz", "Authorization"))
+
+	// the plain HTTP URLs are only allowed by the configuration
+	_, err := fd.newRequest(context.Background(), "YY", &url.URL{Scheme: "http", Host: "github.com"})
+	require.ErrorIs(t, err, ErrInsecureURL)
+
+	fd.config.AllowHTTP = true
+	require.Equal(t, "", header("YY", "http://github.com/a/b.tar.gz", "Authorization"))
+	fd.config.AllowHTTP = false
+
+	require.Equal(t, "application/octet-stream",
+		header("YY", "https://api.github.com/repos/a/b/releases/assets/1", "Accept"))
+	require.Equal(t, "", header("YY", "https://github.com/a/b.tar.gz", "Accept"))
+
+	// the token defaults to the environment variable
+	fd.config.GitHub.Token = ""
+	require.Equal(t, "", header("YY", "https://github.com/a/b.tar.gz", "Authorization"))
+
+	t.Setenv("GITHUB_TOKEN", "ENV")
+	require.Equal(t, "Bearer ENV", header("YY", "https://github.com/a/b.tar.gz", "Authorization"))
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Now()
+
+	res := &http.Response{StatusCode: http.StatusOK}
+	_, limited := rateLimitWait(res, now)
+	require.False(t, limited)
+
+	res = &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"X-Ratelimit-Remaining": []string{"10"}},
+	}
+	_, limited = rateLimitWait(res, now)
+	require.False(t, limited)
+
+	res = &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header: http.Header{
+			"X-Ratelimit-Remaining": []string{"0"},
+			"X-Ratelimit-Reset":     []string{fmt.Sprint(now.Add(time.Minute).Unix())},
+		},
+	}
+	wait, limited := rateLimitWait(res, now)
+	require.True(t, limited)
+	require.InDelta(t, time.Minute, wait, float64(time.Second))
+
+	res = &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"30"}},
+	}
+	wait, limited = rateLimitWait(res, now)
+	require.True(t, limited)
+	require.Equal(t, 30*time.Second, wait)
+}
+
+func TestHandleJob_Untar_Failed(t *testing.T) {
+	releaseID := "XX"
+
+	client := fakeClient{
+		body: &bytes.Buffer{},
+	}
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{
+			releaseID: {Target: filepath.Join(t.TempDir(), "YY")},
+		},
+	}
+
+	fd := FileDeployer{
+		config: conf,
+		client: client,
+	}
+
+	job := job{
+		id:         "",
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	}
+
+	_, err := fd.handleJob(job)
+	require.EqualError(t, err, "failed to save tar file: failed to create reader: EOF")
+}
+
+func TestHandleJob_Subpath(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "release", "app.css"), "new")
+	writeFile(t, filepath.Join(tmpDir, "target", "index.html"), "index")
+	writeFile(t, filepath.Join(tmpDir, "target", "assets", "old.css"), "old")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: filepath.Join(tmpDir, "target"), Subpath: "other", Adopt: true},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		logger: zerolog.New(io.Discard),
+	}
+
+	deployment, err := fd.handleJob(job{releaseID: "XX", releaseURL: &url.URL{}, subpath: "assets"})
+	require.NoError(t, err)
+	require.Equal(t, Changes{Added: 1, Removed: 1}, deployment.changes)
+
+	buf, err := os.ReadFile(filepath.Join(tmpDir, "target", "assets", "app.css"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(buf))
+
+	_, err = os.Stat(filepath.Join(tmpDir, "target", "assets", "old.css"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(tmpDir, "target", "other"))
+	require.True(t, os.IsNotExist(err))
+
+	buf, err = os.ReadFile(filepath.Join(tmpDir, "target", "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, "index", string(buf))
+}
+
+func TestHandleJob_Checksum(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "release", "index.html"), "new")
+	writeFile(t, filepath.Join(tmpDir, "target", "index.html"), "old")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	hash := sha256.Sum256(releaseGz.Bytes())
+	sum := hex.EncodeToString(hash[:])
+	wrong := strings.Repeat("0", 64)
+
+	entry := config.Entry{
+		Target:  filepath.Join(tmpDir, "target"),
+		Staging: config.StagingDisk,
+		Adopt:   true,
+	}
+
+	fd := FileDeployer{
+		db:     db,
+		config: config.Config{Entries: map[string]config.Entry{"XX": entry}},
+		client: fakeClient{body: bytes.NewReader(releaseGz.Bytes())},
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{id: "AA", releaseID: "XX", releaseURL: &url.URL{}, sha256: wrong})
+	require.EqualError(t, err, fmt.Sprintf("failed to verify archive: checksum mismatch: "+
+		"expected %s, got %s", wrong, sum))
+
+	buf, err := os.ReadFile(filepath.Join(tmpDir, "target", "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(buf))
+
+	// the checksum of the request and of the entry must both match
+	entry.SHA256 = sum
+	fd.config.Entries["XX"] = entry
+	fd.client = fakeClient{body: bytes.NewReader(releaseGz.Bytes())}
+
+	_, err = fd.handleJob(job{id: "BB", releaseID: "XX", releaseURL: &url.URL{},
+		sha256: strings.ToUpper(sum)})
+	require.NoError(t, err)
+
+	buf, err = os.ReadFile(filepath.Join(tmpDir, "target", "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(buf))
+
+	// the saved archives are removed
+	files, err := filepath.Glob(filepath.Join(tmpDir, ".hodor-*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestHandleJob_Provenance(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "release", "index.html"), "new")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	hash := sha256.Sum256(releaseGz.Bytes())
+	sum := hex.EncodeToString(hash[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			http.Redirect(w, r, "/v1.tar.gz", http.StatusFound)
+			return
+		}
+
+		w.Write(releaseGz.Bytes())
+	}))
+	defer server.Close()
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{AllowHTTP: true, Entries: map[string]config.Entry{
+			"XX": {Target: filepath.Join(tmpDir, "target")},
+		}},
+		client: server.Client(),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	releaseURL, err := url.Parse(server.URL + "/latest")
+	require.NoError(t, err)
+
+	sender := Sender{Auth: "signature", Addr: "1.2.3.4:5678", Login: "alice"}
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: releaseURL, sender: sender}
+
+	d, err := fd.handleJob(job)
+	require.NoError(t, err)
+
+	fd.succeed(job, d)
+
+	history, err := fd.GetHistory("XX")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	require.Equal(t, &Provenance{
+		SourceURL: server.URL + "/v1.tar.gz",
+		RemoteIP:  "127.0.0.1",
+		SHA256:    sum,
+		Checksum:  "none",
+		Sender:    sender,
+	}, history[0].Provenance)
+
+	// the archive is also hashed when it is verified
+	job.id = "BB"
+	job.sha256 = sum
+
+	d, err = fd.handleJob(job)
+	require.NoError(t, err)
+	require.Equal(t, sum, d.provenance.SHA256)
+	require.Equal(t, "verified", d.provenance.Checksum)
+}
+
+func TestHandleJob_Progress(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "release", "index.html"), "new")
+	writeFile(t, filepath.Join(tmpDir, "release", "app.js"), "app")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	hash := sha256.Sum256(releaseGz.Bytes())
+	size := int64(releaseGz.Len())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(releaseGz.Bytes())
+	}))
+	defer server.Close()
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{AllowHTTP: true, Entries: map[string]config.Entry{
+			"XX": {Target: filepath.Join(tmpDir, "target")},
+		}},
+		client: server.Client(),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	releaseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: releaseURL}
+
+	err = fd.saveJobStatus(job, "running", "")
+	require.NoError(t, err)
+
+	d, err := fd.handleJob(job)
+	require.NoError(t, err)
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, &Progress{Phase: "download", Bytes: size, Size: size,
+		Percent: 100, Files: 2}, status.Progress)
+
+	// the progress is kept with the status
+	fd.succeed(job, d)
+
+	status, err = fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, 2, status.Progress.Files)
+
+	// a verified archive is extracted from its file
+	job.id = "BB"
+	job.sha256 = hex.EncodeToString(hash[:])
+
+	err = fd.saveJobStatus(job, "running", "")
+	require.NoError(t, err)
+
+	_, err = fd.handleJob(job)
+	require.NoError(t, err)
+
+	status, err = fd.GetStatus("BB")
+	require.NoError(t, err)
+	require.Equal(t, &Progress{Phase: "extract", Bytes: size, Size: size,
+		Percent: 100, Files: 2}, status.Progress)
+}
+
+func TestProgressTracker(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	saved := []Progress{}
+
+	tracker := &progressTracker{
+		store: func(progress Progress) { saved = append(saved, progress) },
+		now:   func() time.Time { return now },
+	}
+
+	// the size of the download is unknown
+	body := tracker.download(io.NopCloser(strings.NewReader("aaaa")), -1)
+	require.Equal(t, []Progress{{Phase: "download", Percent: -1}}, saved)
+
+	buf := make([]byte, 2)
+
+	_, err := body.Read(buf)
+	require.NoError(t, err)
+
+	// not saved again within the interval
+	require.Len(t, saved, 1)
+
+	now = now.Add(progressInterval)
+	tracker.file()
+
+	require.Equal(t, Progress{Phase: "download", Bytes: 2, Percent: -1, Files: 1}, saved[1])
+
+	// a new phase is always saved
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString("aaaa")
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	reader := tracker.extract(f)
+	require.Equal(t, Progress{Phase: "extract", Size: 4}, saved[2])
+
+	_, err = reader.Read(buf)
+	require.NoError(t, err)
+
+	tracker.save()
+	require.Equal(t, Progress{Phase: "extract", Bytes: 2, Size: 4, Percent: 50}, saved[3])
+
+	// a nil tracker tracks nothing
+	var nilTracker *progressTracker
+
+	require.Equal(t, f, nilTracker.extract(f))
+	nilTracker.file()
+	nilTracker.save()
+}
+
+func TestHandleJob_Scan(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	release := func(name, content string) []byte {
+		folder := filepath.Join(t.TempDir(), "release")
+		writeFile(t, filepath.Join(folder, "index.html"), content)
+
+		if name != "" {
+			writeFile(t, filepath.Join(folder, name), content)
+		}
+
+		buf := new(bytes.Buffer)
+		err := compress(folder, buf)
+		require.NoError(t, err)
+
+		return buf.Bytes()
+	}
+
+	var archive []byte
+	var mediaType string
+	var submitted []byte
+
+	report := `{"matches": [
+		{"vulnerability": {"id": "CVE-1", "severity": "High"}, "artifact": {"name": "openssl", "version": "1.1"}},
+		{"vulnerability": {"id": "CVE-2", "severity": "Low"}, "artifact": {"name": "zlib", "version": "1.2"}}
+	]}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write(archive)
+			return
+		}
+
+		mediaType = r.Header.Get("Content-Type")
+
+		submitted, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Write([]byte(report))
+	}))
+	defer server.Close()
+
+	entry := config.Entry{
+		Target: filepath.Join(tmpDir, "target"),
+		Scan:   config.Scan{URL: server.URL + "/scan"},
+	}
+
+	fd := FileDeployer{
+		db:     db,
+		config: config.Config{AllowHTTP: true, Entries: map[string]config.Entry{"XX": entry}},
+		client: server.Client(),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	releaseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	// without SBOM, the release is archived and blocked by the high finding
+	archive = release("", "v1")
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: releaseURL}
+
+	err = fd.saveJobStatus(job, "running", "")
+	require.NoError(t, err)
+
+	_, err = fd.handleJob(job)
+	require.EqualError(t, err, "scan found 1 vulnerabilities at or above \"high\" severity")
+	require.NoDirExists(t, entry.Target)
+
+	require.Equal(t, "application/gzip", mediaType)
+
+	gz, err := gzip.NewReader(bytes.NewReader(submitted))
+	require.NoError(t, err)
+
+	header, err := tar.NewReader(gz).Next()
+	require.NoError(t, err)
+	require.Equal(t, "release/", header.Name)
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, &ScanResult{
+		Target:   "archive",
+		Severity: "high",
+		Counts:   map[string]int{"high": 1, "low": 1},
+		Blocking: []scan.Finding{{ID: "CVE-1", Severity: "high", Package: "openssl", Version: "1.1"}},
+	}, status.Scan)
+
+	// the result is kept with the final status
+	fd.saveJobStatus(job, "failed", "blocked")
+
+	status, err = fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.False(t, status.Scan.Passed)
+
+	// the SBOM is scanned instead, and passes with a critical threshold
+	entry.Scan.Severity = "critical"
+	fd.config.Entries["XX"] = entry
+
+	archive = release("bom.json", `{"bomFormat": "CycloneDX"}`)
+
+	job.id = "BB"
+
+	err = fd.saveJobStatus(job, "running", "")
+	require.NoError(t, err)
+
+	d, err := fd.handleJob(job)
+	require.NoError(t, err)
+
+	fd.succeed(job, d)
+
+	require.Equal(t, "application/vnd.cyclonedx+json", mediaType)
+	require.Equal(t, `{"bomFormat": "CycloneDX"}`, string(submitted))
+
+	status, err = fd.GetStatus("BB")
+	require.NoError(t, err)
+	require.Equal(t, &ScanResult{
+		Target:   "sbom",
+		Severity: "critical",
+		Counts:   map[string]int{"high": 1, "low": 1},
+		Passed:   true,
+	}, status.Scan)
+
+	// a failing scanner blocks the deployment
+	entry.Scan.URL = "http://127.0.0.1:0"
+	fd.config.Entries["XX"] = entry
+
+	job.id = "CC"
+
+	_, err = fd.handleJob(job)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to scan release: ")
+}
+
+func TestHandleJob_ClamAV(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "release", "index.html"), "new")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	received := make(chan []byte, 2)
+	go fakeClamd(t, listener, received, "stream: Eicar-Signature FOUND\x00", "stream: OK\x00")
+
+	entry := config.Entry{
+		Target: filepath.Join(tmpDir, "target"),
+		ClamAV: config.ClamAV{Address: listener.Addr().String()},
+	}
+
+	fd := FileDeployer{
+		db:     db,
+		config: config.Config{Entries: map[string]config.Entry{"XX": entry}},
+		client: bytesClient{body: releaseGz.Bytes()},
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: &url.URL{}}
+
+	// an infected archive is quarantined next to the target
+	quarantined := filepath.Join(tmpDir, ".hodor-quarantine", "XX-AA.archive")
+
+	_, err = fd.handleJob(job)
+	require.EqualError(t, err, fmt.Sprintf("archive is infected with \"Eicar-Signature\", "+
+		"quarantined to %q", quarantined))
+	require.Equal(t, releaseGz.Bytes(), <-received)
+	require.NoDirExists(t, entry.Target)
+
+	content, err := os.ReadFile(quarantined)
+	require.NoError(t, err)
+	require.Equal(t, releaseGz.Bytes(), content)
+
+	// a clean archive is deployed
+	job.id = "BB"
+
+	_, err = fd.handleJob(job)
+	require.NoError(t, err)
+	require.Equal(t, releaseGz.Bytes(), <-received)
+	require.FileExists(t, filepath.Join(entry.Target, "index.html"))
+
+	// the job fails if clamd can't be reached
+	listener.Close()
+
+	job.id = "CC"
+	entry.Target = filepath.Join(tmpDir, "other")
+	fd.config.Entries["XX"] = entry
+
+	_, err = fd.handleJob(job)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to scan archive with clamd: failed to connect: ")
+	require.NoDirExists(t, entry.Target)
+}
+
+func TestGetSBOM(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	release := func(name, content string) []byte {
+		folder := filepath.Join(t.TempDir(), "release")
+		writeFile(t, filepath.Join(folder, "index.html"), content)
+
+		if name != "" {
+			writeFile(t, filepath.Join(folder, name), content)
+		}
+
+		buf := new(bytes.Buffer)
+		err := compress(folder, buf)
+		require.NoError(t, err)
+
+		return buf.Bytes()
+	}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{Entries: map[string]config.Entry{
+			"XX": {Target: filepath.Join(tmpDir, "target")},
+		}},
+		client: bytesClient{body: release("bom.json", `{"bomFormat": "CycloneDX"}`)},
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, _, err = fd.GetSBOM("XX")
+	require.Equal(t, ErrNoSBOM, err)
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1", releaseURL: &url.URL{}}
+
+	d, err := fd.handleJob(job)
+	require.NoError(t, err)
+
+	fd.succeed(job, d)
+
+	hash := sha256.Sum256([]byte(`{"bomFormat": "CycloneDX"}`))
+
+	sbom, content, err := fd.GetSBOM("XX")
+	require.NoError(t, err)
+	require.Equal(t, SBOM{
+		File:      "bom.json",
+		Format:    "cyclonedx",
+		MediaType: "application/vnd.cyclonedx+json",
+		SHA256:    hex.EncodeToString(hash[:]),
+		Size:      26,
+	}, sbom)
+	require.Equal(t, `{"bomFormat": "CycloneDX"}`, string(content))
+
+	history, err := fd.GetHistory("XX")
+	require.NoError(t, err)
+	require.Equal(t, &sbom, history[0].SBOM)
+
+	// a release without SBOM replaces the deployed one
+	fd.client = bytesClient{body: release("", "v2")}
+
+	job.id = "BB"
+	job.tag = "v2"
+
+	d, err = fd.handleJob(job)
+	require.NoError(t, err)
+
+	fd.succeed(job, d)
+
+	_, _, err = fd.GetSBOM("XX")
+	require.Equal(t, ErrNoSBOM, err)
+}
+
+func TestReadSBOM(t *testing.T) {
+	tests := []struct {
+		files  []string
+		file   string
+		format string
+	}{
+		{[]string{"index.html"}, "", ""},
+		{[]string{"app.spdx"}, "app.spdx", "spdx"},
+		{[]string{"bom.xml", "app.cdx.json"}, "app.cdx.json", "cyclonedx"},
+		{[]string{"bom.json", "APP.SPDX.JSON"}, "APP.SPDX.JSON", "spdx"},
+		{[]string{"sbom.json", "notes.cdx.txt"}, "", ""},
+	}
+
+	for _, test := range tests {
+		folder := t.TempDir()
+
+		for _, file := range test.files {
+			writeFile(t, filepath.Join(folder, file), "sbom")
+		}
+
+		sbom, content, err := readSBOM(folder)
+		require.NoError(t, err)
+
+		if test.file == "" {
+			require.Nil(t, sbom, test.files)
+			continue
+		}
+
+		require.Equal(t, test.file, sbom.File)
+		require.Equal(t, test.format, sbom.Format)
+		require.Equal(t, "sbom", string(content))
+	}
+
+	// a folder named as an SBOM is ignored
+	folder := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(folder, "bom.json"), 0755)
+	require.NoError(t, err)
+
+	sbom, _, err := readSBOM(folder)
+	require.NoError(t, err)
+	require.Nil(t, sbom)
+}
+
+func TestSaveHistory_Exists(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:     db,
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	job := job{id: "AA", releaseID: "XX", tag: "v1"}
+
+	err = fd.saveHistory(job, deployment{provenance: &Provenance{SHA256: "aa"}})
+	require.NoError(t, err)
+
+	// an entry is never replaced
+	err = fd.saveHistory(job, deployment{provenance: &Provenance{SHA256: "bb"}})
+	require.EqualError(t, err, "failed to save history entry: \"history:XX:AA\" already exists")
+
+	history, err := fd.GetHistory("XX")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "aa", history[0].Provenance.SHA256)
+}
+
+func TestHandleJob_Delta(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	release := func(content string) *bytes.Buffer {
+		writeFile(t, filepath.Join(tmpDir, "release", "app.js"), content)
+
+		releaseGz := new(bytes.Buffer)
+		err := compress(filepath.Join(tmpDir, "release"), releaseGz)
+		require.NoError(t, err)
+
+		return releaseGz
+	}
+
+	// the diff is the new archive, applied by copying it
+	defer func(previous func(tool, base, patch, next string) *exec.Cmd) {
+		patchCommand = previous
+	}(patchCommand)
+
+	patchCommand = func(tool, base, patch, next string) *exec.Cmd {
+		return exec.Command("cp", patch, next)
+	}
+
+	client := &urlClient{
+		responses: map[string]fakeClient{
+			"https://full/v1":     {body: release("v1")},
+			"https://delta/v1-v2": {body: release("v2")},
+			"https://full/v3":     {body: release("v3")},
+		},
+	}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {
+					Target: filepath.Join(tmpDir, "target"),
+					Delta:  config.Delta{URL: "https://delta/{previous_tag}-{tag}"},
+					Adopt:  true,
+				},
+			},
+		},
+		client: client,
+		logger: zerolog.New(io.Discard),
+	}
+
+	deploy := func(tag string) {
+		releaseURL, _ := url.Parse("https://full/" + tag)
+
+		_, err := fd.handleJob(job{releaseID: "XX", tag: tag, releaseURL: releaseURL})
+		require.NoError(t, err)
+
+		buf, err := os.ReadFile(filepath.Join(tmpDir, "target", "app.js"))
+		require.NoError(t, err)
+		require.Equal(t, tag, string(buf))
+
+		buf, err = os.ReadFile(filepath.Join(tmpDir, ".hodor-cache", "XX.tag"))
+		require.NoError(t, err)
+		require.Equal(t, tag, string(buf))
+	}
+
+	// no cached archive yet
+	deploy("v1")
+	deploy("v2")
+	// the diff is not found
+	deploy("v3")
+
+	require.Equal(t, []string{"https://full/v1", "https://delta/v1-v2",
+		"https://delta/v2-v3", "https://full/v3"}, client.calls)
+}
+
+func TestRollback(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	release := func(content string) fakeClient {
+		writeFile(t, filepath.Join(tmpDir, "release", "app.js"), content)
+
+		releaseGz := new(bytes.Buffer)
+		err := compress(filepath.Join(tmpDir, "release"), releaseGz)
+		require.NoError(t, err)
+
+		return fakeClient{body: releaseGz}
+	}
+
+	target := filepath.Join(tmpDir, "target")
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: target, Keep: 2},
+				"YY": {Target: filepath.Join(tmpDir, "other")},
+			},
+		},
+		client: &urlClient{
+			responses: map[string]fakeClient{
+				"https://xx/v1": release("v1"),
+				"https://xx/v2": release("v2"),
+				"https://xx/v3": release("v3"),
+				"https://xx/v4": release("v4"),
+			},
+		},
+		jobs:   make(chan job, 1),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	requireTarget := func(tag string) {
+		buf, err := os.ReadFile(filepath.Join(target, "app.js"))
+		require.NoError(t, err)
+		require.Equal(t, tag, string(buf))
+
+		latest, err := fd.GetLatestTag("XX")
+		require.NoError(t, err)
+		require.Equal(t, tag, latest)
+	}
+
+	requirePrevious := func(tags ...string) {
+		previous, err := fd.getPrevious("XX")
+		require.NoError(t, err)
+		require.Len(t, previous, len(tags))
+
+		for i, tag := range tags {
+			require.Equal(t, tag, previous[i].Tag)
+			require.Equal(t, "https://xx/"+tag, previous[i].ReleaseURL)
+		}
+
+		entries, err := os.ReadDir(previousDir(target))
+		require.NoError(t, err)
+		require.Len(t, entries, len(tags))
+	}
+
+	for _, tag := range []string{"v1", "v2", "v3", "v4"} {
+		releaseURL, _ := url.Parse("https://xx/" + tag)
+		job := job{id: tag, releaseID: "XX", tag: tag, releaseURL: releaseURL}
+
+		d, err := fd.handleJob(job)
+		require.NoError(t, err)
+
+		fd.succeed(job, d)
+	}
+
+	requireTarget("v4")
+	requirePrevious("v3", "v2")
+
+	for _, tag := range []string{"v3", "v2"} {
+		jobID, err := fd.Rollback("XX")
+		require.NoError(t, err)
+
+		job := <-fd.jobs
+		require.Equal(t, jobID, job.id)
+		require.True(t, job.rollback)
+
+		d, err := fd.handleRollback(job)
+		require.NoError(t, err)
+		require.Equal(t, "https://xx/"+tag, d.manifest.ReleaseURL)
+
+		fd.succeed(job, d)
+
+		requireTarget(tag)
+	}
+
+	requirePrevious()
+
+	_, err = fd.Rollback("XX")
+	require.Equal(t, ErrNoPrevious, err)
+
+	_, err = fd.Rollback("YY")
+	require.Equal(t, ErrNoPrevious, err)
+
+	_, err = fd.Rollback("ZZ")
+	require.EqualError(t, err, "releaseID \"ZZ\" not found from the config")
+}
+
+func TestPromote(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	writeFile(t, filepath.Join(tmpDir, "release", "app.js"), "v1")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	client := &urlClient{
+		responses: map[string]fakeClient{
+			"https://xx/v1": {body: releaseGz},
+		},
+	}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: filepath.Join(tmpDir, "staging"), Promote: "YY"},
+				"YY": {Target: filepath.Join(tmpDir, "prod")},
+			},
+		},
+		client: client,
+		jobs:   make(chan job, 1),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.Promote("XX")
+	require.Equal(t, ErrNoArchive, err)
+
+	_, err = fd.Promote("YY")
+	require.Equal(t, ErrNoPromotion, err)
+
+	_, err = fd.Promote("ZZ")
+	require.EqualError(t, err, "releaseID \"ZZ\" not found from the config")
+
+	releaseURL, _ := url.Parse("https://xx/v1")
+	staging := job{id: "v1", releaseID: "XX", tag: "v1", releaseURL: releaseURL}
+
+	d, err := fd.handleJob(staging)
+	require.NoError(t, err)
+
+	fd.succeed(staging, d)
+
+	promote := func() job {
+		jobID, err := fd.Promote("XX")
+		require.NoError(t, err)
+
+		job := <-fd.jobs
+		require.Equal(t, jobID, job.id)
+		require.Equal(t, "YY", job.releaseID)
+		require.Equal(t, "v1", job.tag)
+		require.Equal(t, "XX", job.promoted)
+
+		status, err := fd.GetStatus(jobID)
+		require.NoError(t, err)
+		require.Equal(t, "XX", status.Promoted)
+
+		return job
+	}
+
+	prod := promote()
+
+	d, err = fd.handleJob(prod)
+	require.NoError(t, err)
+
+	fd.succeed(prod, d)
+
+	buf, err := os.ReadFile(filepath.Join(tmpDir, "prod", "app.js"))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(buf))
+
+	history, err := fd.GetHistory("YY")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "v1", history[0].Tag)
+
+	// the archive is not downloaded again
+	require.Equal(t, []string{"https://xx/v1"}, client.calls)
+
+	// the archive changed since the promotion
+	job := promote()
+
+	writeFile(t, filepath.Join(tmpDir, ".hodor-cache", "XX.archive"), "changed")
+
+	_, err = fd.handleJob(job)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to verify archive: checksum mismatch")
+}
+
+func TestHandleJob_Symlink(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	release := func(content string) fakeClient {
+		writeFile(t, filepath.Join(tmpDir, "release", "app.js"), content)
+
+		releaseGz := new(bytes.Buffer)
+		err := compress(filepath.Join(tmpDir, "release"), releaseGz)
+		require.NoError(t, err)
+
+		return fakeClient{body: releaseGz}
+	}
+
+	target := filepath.Join(tmpDir, "target")
+
+	// a target deployed with another strategy is moved to the releases
+	writeFile(t, filepath.Join(target, "app.js"), "v0")
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: target, Strategy: config.StrategySymlink, Keep: 1, Adopt: true},
+			},
+		},
+		client: &urlClient{
+			responses: map[string]fakeClient{
+				"https://xx/v1": release("v1"),
+				"https://xx/v2": release("v2"),
+				"https://xx/v3": release("v3"),
+			},
+		},
+		jobs:   make(chan job, 1),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	requireTarget := func(tag string, releases ...string) {
+		link, err := os.Readlink(target)
+		require.NoError(t, err)
+		require.False(t, filepath.IsAbs(link))
+
+		buf, err := os.ReadFile(filepath.Join(target, "app.js"))
+		require.NoError(t, err)
+		require.Equal(t, tag, string(buf))
+
+		entries, err := os.ReadDir(releasesDir(target))
+		require.NoError(t, err)
+
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name()
+		}
+
+		require.Equal(t, releases, names)
+	}
+
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		releaseURL, _ := url.Parse("https://xx/" + tag)
+		job := job{id: tag, releaseID: "XX", tag: tag, releaseURL: releaseURL}
+
+		d, err := fd.handleJob(job)
+		require.NoError(t, err)
+
+		fd.succeed(job, d)
+	}
+
+	requireTarget("v3", "v2-v2", "v3-v3")
+
+	jobID, err := fd.Rollback("XX")
+	require.NoError(t, err)
+
+	job := <-fd.jobs
+	require.Equal(t, jobID, job.id)
+
+	d, err := fd.handleRollback(job)
+	require.NoError(t, err)
+
+	fd.succeed(job, d)
+
+	requireTarget("v2", "v2-v2")
+
+	_, err = fd.Rollback("XX")
+	require.Equal(t, ErrNoPrevious, err)
+}
+
+func TestSetMaintenance(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: "/srv/xx"},
+				"YY": {Target: "/srv/yy"},
+			},
+		},
+		jobs:   make(chan job, 2),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.SetMaintenance("ZZ", true)
+	require.EqualError(t, err, "releaseID \"ZZ\" not found from the config")
+
+	deferred, err := fd.SetMaintenance("XX", true)
+	require.NoError(t, err)
+	require.Equal(t, 0, deferred)
+
+	job := newJob(Request{ReleaseID: "XX", Tag: "v1"})
+
+	require.True(t, fd.deferJob(job))
+	require.False(t, fd.deferJob(newJob(Request{ReleaseID: "YY"})))
+
+	status, err := fd.GetStatus(job.id)
+	require.NoError(t, err)
+	require.Equal(t, "deferred", status.Status)
+	require.Equal(t, "\"XX\" is in maintenance", status.Message)
+
+	releases, err := fd.GetReleases()
+	require.NoError(t, err)
+	require.True(t, releases[0].Maintenance)
+	require.False(t, releases[1].Maintenance)
+
+	deferred, err = fd.SetMaintenance("XX", true)
+	require.NoError(t, err)
+	require.Equal(t, 1, deferred)
+
+	// lifting the maintenance queues the deferred jobs again
+	deferred, err = fd.SetMaintenance("XX", false)
+	require.NoError(t, err)
+	require.Equal(t, 1, deferred)
+	require.Equal(t, 1, fd.QueueLength())
+	require.Equal(t, job.id, (<-fd.jobs).id)
+
+	status, err = fd.GetStatus(job.id)
+	require.NoError(t, err)
+	require.Equal(t, "created", status.Status)
+
+	require.False(t, fd.deferJob(job))
+}
+
+func TestFreeze(t *testing.T) {
+	setLocal(t, time.FixedZone("CET", 3600))
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: "/srv/xx"},
+				"YY": {Target: "/srv/yy"},
+			},
+		},
+		jobs:   make(chan job, 2),
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
+	}
+
+	freeze := Freeze{
+		ReleaseIDs:  []string{"XX"},
+		Until:       time.Now().Add(time.Hour),
+		Reason:      "release week",
+		RequestedBy: "alice",
+	}
+
+	wrong := freeze
+	wrong.ReleaseIDs = []string{"ZZ"}
+	_, err = fd.Freeze(wrong)
+	require.EqualError(t, err, "releaseID \"ZZ\" not found from the config")
+
+	wrong = freeze
+	wrong.Until = time.Now()
+	_, err = fd.Freeze(wrong)
+	require.EqualError(t, err, "the freeze must end in the future")
+
+	wrong = freeze
+	wrong.RequestedBy = ""
+	_, err = fd.Freeze(wrong)
+	require.EqualError(t, err, "requestedBy is missing")
+
+	long, err := fd.Freeze(freeze)
+	require.NoError(t, err)
+	require.NotEmpty(t, long.ID)
+	require.Equal(t, time.UTC, long.Until.Location())
+	require.Equal(t, time.UTC, long.CreatedAt.Location())
+
+	job := newJob(Request{ReleaseID: "XX", Tag: "v1"})
+
+	require.True(t, fd.deferJob(job))
+	require.False(t, fd.deferJob(newJob(Request{ReleaseID: "YY"})))
+
+	status, err := fd.GetStatus(job.id)
+	require.NoError(t, err)
+	require.Equal(t, "deferred", status.Status)
+	require.Equal(t, fmt.Sprintf("\"XX\" is frozen until %s: release week",
+		freeze.Until.UTC().Format(time.RFC3339)), status.Message)
+
+	releases, err := fd.GetReleases()
+	require.NoError(t, err)
+	require.True(t, freeze.Until.Equal(*releases[0].FrozenUntil))
+	require.Nil(t, releases[1].FrozenUntil)
+
+	// a shorter freeze resumes the jobs once it ends
+	freeze.ReleaseIDs = []string{"YY"}
+	freeze.Until = time.Now().Add(100 * time.Millisecond)
+
+	short, err := fd.Freeze(freeze)
+	require.NoError(t, err)
+
+	other := newJob(Request{ReleaseID: "YY", Tag: "v1"})
+	require.True(t, fd.deferJob(other))
+
+	require.Eventually(t, func() bool { return fd.QueueLength() == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, other.id, (<-fd.jobs).id)
+
+	freezes, err := fd.GetFreezes()
+	require.NoError(t, err)
+	require.Len(t, freezes, 2)
+	require.Equal(t, short.ID, freezes[0].ID)
+	require.False(t, freezes[0].Active(time.Now()))
+	require.True(t, freezes[1].Active(time.Now()))
+
+	// lifting the freeze resumes the jobs right away
+	lifted, err := fd.LiftFreeze(long.ID, "bob")
+	require.NoError(t, err)
+	require.Equal(t, "bob", lifted.LiftedBy)
+	require.NotNil(t, lifted.LiftedAt)
+
+	require.Equal(t, 1, fd.QueueLength())
+	require.Equal(t, job.id, (<-fd.jobs).id)
+
+	_, err = fd.LiftFreeze(long.ID, "bob")
+	require.EqualError(t, err, fmt.Sprintf("freeze %q already ended", long.ID))
+
+	_, err = fd.LiftFreeze("unknown", "bob")
+	require.Equal(t, ErrFreezeNotFound, err)
+}
+
+func TestSaveJobStatus_Timestamps(t *testing.T) {
+	setLocal(t, time.FixedZone("CET", 3600))
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{db: db, serde: defaultSerde}
+
+	job := newJob(Request{ReleaseID: "XX", Tag: "v1"})
+
+	require.NoError(t, fd.saveJobStatus(job, "created", "job has been created"))
+
+	status, err := fd.GetStatus(job.id)
+	require.NoError(t, err)
+	require.Equal(t, "XX", status.ReleaseID)
+	require.Equal(t, "v1", status.Tag)
+	require.NotNil(t, status.CreatedAt)
+	require.Nil(t, status.StartedAt)
+	require.Nil(t, status.FinishedAt)
+
+	createdAt := *status.CreatedAt
+
+	require.NoError(t, fd.saveJobStatus(job, "running", "job is running"))
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, fd.saveJobStatus(job, "ok", "job done"))
+
+	status, err = fd.GetStatus(job.id)
+	require.NoError(t, err)
+	require.True(t, createdAt.Equal(*status.CreatedAt))
+	require.NotNil(t, status.StartedAt)
+	require.NotNil(t, status.FinishedAt)
+	require.Equal(t, status.FinishedAt.Sub(*status.StartedAt), status.Duration)
+	require.GreaterOrEqual(t, status.Duration, 10*time.Millisecond)
+
+	// the timestamps are saved in UTC, whatever the local timezone
+	require.Equal(t, time.UTC, status.CreatedAt.Location())
+	require.Equal(t, time.UTC, status.StartedAt.Location())
+	require.Equal(t, time.UTC, status.FinishedAt.Location())
+
+	summaries, err := fd.ListJobs("XX", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, time.UTC, summaries[0].UpdatedAt.Location())
+}
+
+func TestListJobs(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{db: db, serde: defaultSerde}
+
+	var jobs []job
+
+	for _, releaseID := range []string{"XX", "YY", "XX", "XX"} {
+		job := newJob(Request{ReleaseID: releaseID, Tag: "v1"})
+		jobs = append(jobs, job)
+
+		require.NoError(t, fd.saveJobStatus(job, "created", "job has been created"))
+	}
+
+	summaries, err := fd.ListJobs("XX", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, summaries, 3)
+	require.Equal(t, jobs[3].id, summaries[0].JobID)
+	require.Equal(t, jobs[2].id, summaries[1].JobID)
+	require.Equal(t, jobs[0].id, summaries[2].JobID)
+
+	createdAt := summaries[2].CreatedAt
+
+	// the creation time is kept once the job is updated
+	require.NoError(t, fd.saveJobStatus(jobs[0], "running", "job is running"))
+	require.NoError(t, fd.saveJobStatus(jobs[0], "ok", "job done"))
+
+	summaries, err = fd.ListJobs("XX", 2, 1)
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	require.Equal(t, jobs[2].id, summaries[0].JobID)
+	require.Equal(t, jobs[0].id, summaries[1].JobID)
+	require.Equal(t, "XX", summaries[1].ReleaseID)
+	require.Equal(t, "v1", summaries[1].Tag)
+	require.Equal(t, "ok", summaries[1].Status)
+	require.Equal(t, "job done", summaries[1].Message)
+	require.True(t, createdAt.Equal(summaries[1].CreatedAt))
+	require.False(t, summaries[1].UpdatedAt.Before(createdAt))
+
+	summaries, err = fd.ListJobs("", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, summaries, 4)
+	require.Equal(t, jobs[1].id, summaries[2].JobID)
+
+	summaries, err = fd.ListJobs("ZZ", 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, summaries)
+
+	summaries, err = fd.ListJobs("XX", 1, 3)
+	require.NoError(t, err)
+	require.Empty(t, summaries)
+}
+
+func TestCheckOwnership(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{db: db}
+
+	target := filepath.Join(tmpDir, "target")
+
+	// missing and empty targets are created by Hodor
+	require.NoError(t, fd.checkOwnership("XX", config.Entry{Target: target}))
+
+	require.NoError(t, os.Mkdir(target, 0755))
+	require.NoError(t, fd.checkOwnership("XX", config.Entry{Target: target}))
+
+	writeFile(t, filepath.Join(target, "index.html"), "index")
+
+	err = fd.checkOwnership("XX", config.Entry{Target: target})
+	require.EqualError(t, err, fmt.Sprintf("%q was not deployed by Hodor, set "+
+		"\"adopt\" to deploy into it", target))
+
+	require.NoError(t, fd.checkOwnership("XX", config.Entry{Target: target, Adopt: true}))
+
+	err = db.Update(func(tx store.Tx) error {
+		return tx.Set("XX", "v1")
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, fd.checkOwnership("XX", config.Entry{Target: target}))
+}
+
+func TestLockTarget(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+
+	defer func(wait, retry time.Duration) {
+		lockWait, lockRetry = wait, retry
+	}(lockWait, lockRetry)
+
+	lockWait, lockRetry = time.Millisecond*50, time.Millisecond*10
+
+	fd := FileDeployer{logger: zerolog.New(io.Discard)}
+
+	unlock, err := fd.lockTarget(job{id: "AA"}, target)
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(target + ".lock")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("pid %d, job AA\n", os.Getpid()), string(buf))
+
+	if runtime.GOOS == "linux" {
+		// flock locks are per open file, so a second open file of the same
+		// process conflicts, as another process would
+		_, err = fd.lockTarget(job{id: "BB"}, target)
+		require.EqualError(t, err, fmt.Sprintf("%q is locked by another process after 50ms",
+			target+".lock"))
+	}
+
+	unlock()
+
+	unlock, err = fd.lockTarget(job{id: "BB"}, target)
+	require.NoError(t, err)
+
+	unlock()
+}
+
+func TestPatchCommand_Zstd(t *testing.T) {
+	_, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	tmpDir := t.TempDir()
+
+	base := filepath.Join(tmpDir, "base")
+	next := filepath.Join(tmpDir, "next")
+	patch := filepath.Join(tmpDir, "patch")
+
+	writeFile(t, base, strings.Repeat("hodor ", 1000))
+	writeFile(t, next, strings.Repeat("hodor ", 1000)+"hold the door")
+
+	out, err := exec.Command("zstd", "-q", "--long=31", "--patch-from="+base, next,
+		"-o", patch).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	require.NoError(t, os.Remove(next))
+
+	out, err = patchCommand("zstd", base, patch, next).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	buf, err := os.ReadFile(next)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("hodor ", 1000)+"hold the door", string(buf))
+}
+
+// The folders created for the lock use the entry's permission.
+func TestLockTarget_Dir_Mode(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "www", "target")
+
+	fd := FileDeployer{
+		logger: zerolog.New(io.Discard),
+		config: config.Config{
+			DirMode: 0755,
+			Entries: map[string]config.Entry{"XX": {Target: target, DirMode: 0700}},
+		},
+	}
+
+	unlock, err := fd.lockTarget(job{id: "AA", releaseID: "XX"}, target)
+	require.NoError(t, err)
+
+	defer unlock()
+
+	info, err := os.Stat(filepath.Dir(target))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestStagingDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "www", "target")
+
+	dir, err := stagingDir(job{id: "AA"}, config.StagingDisk, target, defaultDirMode)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(tmpDir, "www"), filepath.Dir(dir))
+	require.True(t, strings.HasPrefix(filepath.Base(dir), ".hodor-AA-"))
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+
+	defer func(dir string) { tmpfsDir = dir }(tmpfsDir)
+
+	tmpfsDir = filepath.Join(tmpDir, "shm")
+
+	_, err = stagingDir(job{}, config.StagingTmpfs, target, defaultDirMode)
+	require.EqualError(t, err, fmt.Sprintf("tmpfs %q is not available", tmpfsDir))
+
+	err = os.Mkdir(tmpfsDir, 0755)
+	require.NoError(t, err)
+
+	dir, err = stagingDir(job{}, config.StagingTmpfs, target, defaultDirMode)
+	require.NoError(t, err)
+	require.Equal(t, tmpfsDir, filepath.Dir(dir))
+
+	_, err = stagingDir(job{}, "xx", target, defaultDirMode)
+	require.EqualError(t, err, "unknown staging \"xx\"")
+}
+
+func TestCleanSubpath(t *testing.T) {
+	clean, err := CleanSubpath("a/./b/")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("a", "b"), clean)
+
+	_, err = CleanSubpath("/a")
+	require.EqualError(t, err, "\"/a\" is absolute")
+
+	_, err = CleanSubpath("a/../..")
+	require.EqualError(t, err, "\"a/../..\" is out of the target")
+
+	_, err = CleanSubpath("..\\a")
+	require.EqualError(t, err, "\"..\\\\a\" is out of the target")
+}
+
+func TestHandleJob_Release_Notes(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	writeFile(t, filepath.Join(tmpDir, "release", notesFile), "notes from file")
+
+	releaseGz := new(bytes.Buffer)
+	err = compress(filepath.Join(tmpDir, "release"), releaseGz)
+	require.NoError(t, err)
+
+	releaseID := "XX"
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:       filepath.Join(tmpDir, "target"),
+					ReleaseNotes: true,
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		logger: zerolog.New(io.Discard),
+	}
+
+	deployment, err := fd.handleJob(job{releaseID: releaseID, releaseURL: &url.URL{}})
+	require.NoError(t, err)
+	require.Equal(t, "notes from file", deployment.notes)
+}
+
+func TestHandleJob_Release_Notes_From_Request(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:       filepath.Join(tmpDir, "target"),
+					ReleaseNotes: true,
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		logger: zerolog.New(io.Discard),
+	}
+
+	deployment, err := fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+		notes:      "notes from request",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "notes from request", deployment.notes)
+}
+
+func TestDiffTrees(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(tmpDir)
+
+	release := filepath.Join(tmpDir, "release")
+	target := filepath.Join(tmpDir, "target")
+
+	writeFile(t, filepath.Join(release, "same.txt"), "same")
+	writeFile(t, filepath.Join(release, "changed.txt"), "new")
+	writeFile(t, filepath.Join(release, "sub", "added.txt"), "added")
+
+	writeFile(t, filepath.Join(target, "same.txt"), "same")
+	writeFile(t, filepath.Join(target, "changed.txt"), "old")
+	writeFile(t, filepath.Join(target, "removed.txt"), "removed")
+
+	changes, err := diffTrees(release, target, true)
+	require.NoError(t, err)
+	require.Equal(t, Changes{Added: 1, Changed: 1, Removed: 1}, changes)
+
+	changes, err = diffTrees(release, target, false)
+	require.NoError(t, err)
+	require.Equal(t, Changes{Added: 1, Changed: 1}, changes)
+
+	changes, err = diffTrees(release, filepath.Join(tmpDir, "none"), true)
+	require.NoError(t, err)
+	require.Equal(t, Changes{Added: 3}, changes)
+}
+
+func TestCheckTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	writeFile(t, filepath.Join(tmpDir, "yy", "a.txt"), "12")
+	writeFile(t, filepath.Join(tmpDir, "ww", "assets", "a.txt"), "1")
+	// files that are not part of the deployment are ignored
+	writeFile(t, filepath.Join(tmpDir, "ww", "data.db"), "data")
+
+	fd := &FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: filepath.Join(tmpDir, "xx"), Recover: true},
+				"YY": {Target: filepath.Join(tmpDir, "yy")},
+				"WW": {Target: filepath.Join(tmpDir, "ww")},
+				"ZZ": {Target: filepath.Join(tmpDir, "zz")},
+			},
+		},
+		jobs:   make(chan job, 1),
+		logger: zerolog.New(io.Discard),
+		serde:  defaultSerde,
+	}
+
+	files := map[string]int64{"a.txt": 1}
+
+	require.NoError(t, fd.saveManifest("XX", manifest{Tag: "v1",
+		ReleaseURL: "https://xx", Files: files}))
+	require.NoError(t, fd.saveManifest("YY", manifest{Tag: "v2", Files: files}))
+	require.NoError(t, fd.saveManifest("WW", manifest{Tag: "v3", Subpath: "assets",
+		Files: files}))
+
+	fd.checkTargets()
+
+	health := fd.GetTargetsHealth()
+	require.Len(t, health, 2)
+
+	require.Equal(t, "missing", health["XX"].Status)
+	require.Equal(t, "v1", health["XX"].Tag)
+	require.Equal(t, TargetHealth{Status: "modified", Tag: "v2",
+		Message: "1 of 1 files are missing or changed, such as \"a.txt\""}, health["YY"])
+
+	// only XX recovers
+	require.Len(t, fd.jobs, 1)
+
+	job := <-fd.jobs
+	require.Equal(t, "XX", job.releaseID)
+	require.Equal(t, "v1", job.tag)
+	require.Equal(t, "https://xx", job.releaseURL.String())
+
+	fd.succeed(job, deployment{manifest: &manifest{Tag: "v1", Files: files}})
+
+	health = fd.GetTargetsHealth()
+	require.Len(t, health, 1)
+	require.Contains(t, health, "YY")
+}
+
+func TestListFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "a.txt"), "a")
+	writeFile(t, filepath.Join(tmpDir, "b", "c.txt"), "cc")
+
+	files, err := listFiles(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"a.txt": 1, "b/c.txt": 2}, files)
+}
+
+func TestFindOrphans(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := &FileDeployer{db: db, serde: defaultSerde}
+
+	require.NoError(t, fd.saveManifest("XX", manifest{Tag: "v1",
+		Target: filepath.Join(tmpDir, "xx")}))
+	require.NoError(t, fd.saveManifest("YY", manifest{Tag: "v2",
+		Target: filepath.Join(tmpDir, "yy"), Subpath: "assets"}))
+	// the target is used by a configured release
+	require.NoError(t, fd.saveManifest("ZZ", manifest{Tag: "v3",
+		Target: filepath.Join(tmpDir, "zz")}))
+	// the target was not recorded
+	require.NoError(t, fd.saveManifest("WW", manifest{Tag: "v4"}))
+
+	orphans, err := FindOrphans(db, config.Config{
+		Entries: map[string]config.Entry{
+			"XX":  {Target: filepath.Join(tmpDir, "xx")},
+			"NEW": {Target: filepath.Join(tmpDir, "zz", "new")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Orphan{
+		{ReleaseID: "YY", Target: filepath.Join(tmpDir, "yy", "assets"), Tag: "v2"},
+	}, orphans)
+}
+
+func TestRemoveOrphan(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := &FileDeployer{db: db, serde: defaultSerde}
+
+	target := filepath.Join(tmpDir, "yy")
+	writeFile(t, filepath.Join(target, "a.txt"), "a")
+	writeFile(t, filepath.Join(target, "b", "c.txt"), "cc")
+
+	require.NoError(t, fd.saveManifest("YY", manifest{Tag: "v2", Target: target}))
+	err = db.Update(func(tx store.Tx) error {
+		return tx.Set("YY", "v2")
+	})
+	require.NoError(t, err)
+
+	conf := config.Config{DirMode: 0700}
+
+	archivePath, err := RemoveOrphan(db, conf, Orphan{ReleaseID: "YY", Target: target, Tag: "v2"},
+		filepath.Join(tmpDir, "archives"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(tmpDir, "archives", "YY-v2.tar.gz"), archivePath)
+
+	info, err := os.Stat(filepath.Join(tmpDir, "archives"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.NoDirExists(t, target)
+
+	m, err := fd.getManifest("YY")
+	require.NoError(t, err)
+	require.Nil(t, m)
+
+	err = db.View(func(tx store.Tx) error {
+		_, err := tx.Get("YY")
+		return err
+	})
+	require.Equal(t, store.ErrNotFound, err)
+
+	// the archive can be deployed again
+	release := filepath.Join(tmpDir, "release")
+
+	archive, err := os.Open(archivePath)
+	require.NoError(t, err)
+
+	defer archive.Close()
+
+	root, err := saveTar(archive, release, extractOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "yy", root)
+
+	buf, err := os.ReadFile(filepath.Join(release, "yy", "b", "c.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "cc", string(buf))
+}
+
+func TestGetHistory(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+	}
+
+	err = fd.saveHistory(newJob(Request{ReleaseID: "XX", Tag: "v1"}), deployment{})
+	require.NoError(t, err)
+
+	err = fd.saveHistory(newJob(Request{ReleaseID: "XX", Tag: "v2"}), deployment{notes: "notes"})
+	require.NoError(t, err)
+
+	err = fd.saveHistory(newJob(Request{ReleaseID: "XX:YY", Tag: "v3"}), deployment{})
+	require.NoError(t, err)
+
+	history, err := fd.GetHistory("XX")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	require.Equal(t, "v2", history[0].Tag)
+	require.Equal(t, "notes", history[0].Notes)
+	require.Equal(t, "unknown", history[0].PreviousTag)
+	require.Equal(t, "v1", history[1].Tag)
+
+	history, err = fd.GetHistory("ZZ")
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
+
+func TestGetFailures(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+	}
+
+	err = fd.saveFailure(newJob(Request{ReleaseID: "XX", Tag: "v1"}), "fake")
+	require.NoError(t, err)
+
+	failures, err := fd.GetFailures("XX")
+	require.NoError(t, err)
+	require.Len(t, failures, 1)
+
+	require.Equal(t, "v1", failures[0].Tag)
+	require.Equal(t, "fake", failures[0].Message)
+
+	history, err := fd.GetHistory("XX")
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
+
+func TestGetHistory_Unmarshal_Fail(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: fakeSerde{err: errors.New("fake")},
+	}
+
+	db.Update(func(tx store.Tx) error {
+		return tx.Set(historyPrefix("XX")+"AA", "{}")
+	})
+
+	_, err = fd.GetHistory("XX")
+	require.EqualError(t, err, "failed to unmarshal history entry \"history:XX:AA\": fake")
+}
+
+func TestHandleJob_Hooks(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+	target := filepath.Join(tmpDir, "target")
+
+	hooks := &fakeExecutor{}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:     target,
+					Env:        map[string]string{"APP_ENV": "prod"},
+					PreDeploy:  []string{"pre"},
+					PostDeploy: []string{"post"},
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  hooks,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{
+		id:         "YY",
+		releaseID:  releaseID,
+		tag:        "ZZ",
+		releaseURL: &url.URL{},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, hooks.commands, 2)
+	require.Equal(t, "pre", hooks.commands[0].Line)
+	require.NotEqual(t, target, hooks.commands[0].Dir)
+	require.Equal(t, "post", hooks.commands[1].Line)
+	require.Equal(t, target, hooks.commands[1].Dir)
+
+	require.Equal(t, map[string]string{
+		"APP_ENV":          "prod",
+		"HODOR_JOB_ID":     "YY",
+		"HODOR_RELEASE_ID": releaseID,
+		"HODOR_TAG":        "ZZ",
+		"HODOR_TARGET":     target,
+	}, hooks.commands[1].Env)
+}
+
+func TestRunHooks_Output(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	hooks := &fakeExecutor{out: []byte("reloaded\n")}
+
+	fd := FileDeployer{
+		db:     db,
+		serde:  defaultSerde,
+		hooks:  hooks,
+		logger: zerolog.New(io.Discard),
+	}
+
+	j := job{id: "AA", releaseID: "XX"}
+
+	err = fd.saveJobStatus(j, "running", "")
+	require.NoError(t, err)
+
+	err = fd.runHooks(j, "post_deploy", []string{"first", "second"}, "", nil, nil, nil)
+	require.NoError(t, err)
+
+	hooks.err = errors.New("fake")
+
+	err = fd.runHooks(j, "post_deploy", []string{"third", "fourth"}, "", nil, nil, nil)
+	require.EqualError(t, err, "fake")
+
+	// the outputs are kept once the job ends
+	err = fd.saveJobStatus(j, "failed", "failed to run post-deploy hooks: fake")
+	require.NoError(t, err)
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, []HookOutput{
+		{Phase: "post_deploy", Command: "first", Output: "reloaded\n"},
+		{Phase: "post_deploy", Command: "second", Output: "reloaded\n"},
+		{Phase: "post_deploy", Command: "third", Output: "reloaded\n", Error: "fake"},
+	}, status.Hooks)
+}
+
+func TestTruncateOutput(t *testing.T) {
+	require.Equal(t, "ok", truncateOutput([]byte("ok")))
+
+	out := strings.Repeat("a", maxHookOutput) + "end"
+	require.Equal(t, out[3:], truncateOutput([]byte(out)))
+
+	// a character cut in half is dropped
+	out = "é" + strings.Repeat("a", maxHookOutput-1)
+	require.Equal(t, strings.Repeat("a", maxHookOutput-1), truncateOutput([]byte(out)))
+}
+
+func TestHandleJob_Run_As(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	releaseID := "XX"
+	hooks := &fakeExecutor{}
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:     filepath.Join(tmpDir, "target"),
+					PostDeploy: []string{"post"},
+					RunAs:      config.RunAs{User: current.Username},
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  hooks,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, hooks.commands, 1)
+	require.NotNil(t, hooks.commands[0].Credential)
+	require.Equal(t, current.Uid, fmt.Sprint(hooks.commands[0].Credential.UID))
+}
+
+func TestHandleJob_Run_As_Unknown(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+
+	fd := FileDeployer{
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target: filepath.Join(tmpDir, "target"),
+					RunAs:  config.RunAs{User: "hodor-unknown-user"},
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to get run_as credential")
+}
+
+func TestHandleJob_Pre_Deploy_Failed(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+	target := filepath.Join(tmpDir, "target")
+
+	fd := FileDeployer{
+		db: db,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:    target,
+					PreDeploy: []string{"pre"},
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  &fakeExecutor{err: errors.New("fake")},
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	})
+	require.EqualError(t, err, "failed to run pre-deploy hooks: fake")
+
+	// the target must not be touched
+	_, err = os.Stat(target)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRun_Retained(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+	debugDir := filepath.Join(tmpDir, "debug")
+
+	// the extraction fails once it reads the start of the archive
+	archive := append([]byte("not a tar.gz"), make([]byte, 64*1024)...)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {
+					Target: filepath.Join(tmpDir, "target"),
+					Debug:  config.Debug{RetainDays: 2, Dir: debugDir},
+				},
+			},
+		},
+		client: bytesClient{body: archive},
+		logger: zerolog.New(io.Discard),
+	}
+
+	start := time.Now().Truncate(time.Second)
+
+	fd.run(job{id: "AA", releaseID: "XX", releaseURL: &url.URL{}})
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.NotNil(t, status.RetainedUntil)
+	require.False(t, status.RetainedUntil.Before(start.Add(48*time.Hour)))
+
+	f, err := fd.GetRetained("AA", RetainedArchive)
+	require.NoError(t, err)
+
+	// the archive is retained whole
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, archive, content)
+	f.Close()
+
+	f, err = fd.GetRetained("AA", RetainedLog)
+	require.NoError(t, err)
+
+	content, err = io.ReadAll(f)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "info [extract] using temp folder")
+	require.Contains(t, string(content), "error job failed: failed to save tar file: ")
+	f.Close()
+
+	_, err = fd.GetRetained("AA", "other")
+	require.EqualError(t, err, "unknown file \"other\"")
+
+	_, err = fd.GetRetained("BB", RetainedLog)
+	require.Equal(t, ErrNotRetained, err)
+
+	// the retained files are removed once they expire
+	fd.purgeRetained(time.Now().Add(49 * time.Hour))
+
+	_, err = fd.GetRetained("AA", RetainedLog)
+	require.Equal(t, ErrNotRetained, err)
+	require.NoDirExists(t, filepath.Join(debugDir, "AA"))
+}
+
+func TestRun_Retained_Ok(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+	debugDir := filepath.Join(tmpDir, "debug")
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {
+					Target: filepath.Join(tmpDir, "target"),
+					Debug:  config.Debug{RetainDays: 2, Dir: debugDir},
+				},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  &fakeExecutor{},
+		logger: zerolog.New(io.Discard),
+	}
+
+	fd.run(job{id: "AA", releaseID: "XX", releaseURL: &url.URL{}})
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "ok", status.Status, status.Message)
+	require.Nil(t, status.RetainedUntil)
+
+	// the capture of a successful job is removed
+	_, err = fd.GetRetained("AA", RetainedArchive)
+	require.Equal(t, ErrNotRetained, err)
+	require.NoDirExists(t, filepath.Join(debugDir, "AA"))
 }
 
-func TestProcessJobs_Stop(t *testing.T) {
-	jobs := make(chan job, 2)
-	jobs <- job{}
-	jobs <- job{}
+func TestRun_Insufficient_Space(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "target")
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+
+	freeSpace = func(dir string) (int64, error) {
+		return 1 << 20, nil
+	}
 
 	fd := FileDeployer{
-		stop: true,
-		jobs: jobs,
+		db:    db,
+		serde: defaultSerde,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: target, MinFreeSpace: 2 << 20},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  &fakeExecutor{},
+		logger: zerolog.New(io.Discard),
 	}
 
-	fd.processJobs()
+	fd.run(job{id: "AA", releaseID: "XX", releaseURL: &url.URL{}})
 
-	// only one jobs should be processed
-	require.Len(t, jobs, 1)
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, fmt.Sprintf("insufficient disk space: %q has 1048576 bytes "+
+		"free, the release needs 2097152", tmpDir), status.Message)
+	require.NoDirExists(t, target)
 }
 
-func TestProcessJobs_Handle_Fail(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+func TestRun_Max_Archive_Size(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
 	require.NoError(t, err)
 
-	jobs := make(chan job, 1)
-	jobID := "XX"
-	releaseID := "YY"
-	jobs <- job{
-		id:        jobID,
-		releaseID: releaseID,
-	}
-	close(jobs)
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "target")
+
+	releaseGz, _ := createTar(t, tmpDir)
 
 	fd := FileDeployer{
-		stop:  false,
-		jobs:  jobs,
 		db:    db,
 		serde: defaultSerde,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: target, MaxArchiveSize: 10},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  &fakeExecutor{},
+		logger: zerolog.New(io.Discard),
 	}
 
-	fd.processJobs()
+	fd.run(job{id: "AA", releaseID: "XX", releaseURL: &url.URL{}})
 
-	status, err := fd.GetStatus(jobID)
+	status, err := fd.GetStatus("AA")
 	require.NoError(t, err)
 	require.Equal(t, "failed", status.Status)
-	require.Equal(t, fmt.Sprintf("releaseID %q not found from the config", releaseID), status.Message)
+	require.Contains(t, status.Message, "archive exceeds the maximum size of 10 bytes")
+	require.NoDirExists(t, target)
 }
 
-func TestProcessJobs_Handle_Fail_Status_Fail(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+func TestRun_Insecure_URL(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
 	require.NoError(t, err)
 
-	jobs := make(chan job, 1)
-	jobID := "XX"
-	releaseID := "YY"
-	jobs <- job{
-		id:        jobID,
-		releaseID: releaseID,
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "target")
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	fd := FileDeployer{
+		db:    db,
+		serde: defaultSerde,
+		config: config.Config{
+			Entries: map[string]config.Entry{
+				"XX": {Target: target},
+			},
+		},
+		client: fakeClient{body: releaseGz},
+		hooks:  &fakeExecutor{},
+		logger: zerolog.New(io.Discard),
 	}
-	close(jobs)
 
-	log := new(bytes.Buffer)
-	logger := zerolog.New(log)
+	releaseURL, err := url.Parse("http://xx/release.tar.gz")
+	require.NoError(t, err)
+
+	fd.run(job{id: "AA", releaseID: "XX", releaseURL: releaseURL})
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, "failed to get file: not https: \"http://xx/release.tar.gz\"", status.Message)
+	require.NoDirExists(t, target)
+}
+
+func TestCheckSpace(t *testing.T) {
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+
+	var checked []string
+
+	freeSpace = func(dir string) (int64, error) {
+		checked = append(checked, dir)
+		return 100, nil
+	}
+
+	tmpDir := t.TempDir()
+
+	fd := FileDeployer{logger: zerolog.New(io.Discard)}
+
+	// the closest existing parent of the target is checked, as well as the
+	// staging folder
+	entry := config.Entry{Target: filepath.Join(tmpDir, "a", "b", "target")}
+
+	err := fd.checkSpace(job{}, entry, 100)
+	require.NoError(t, err)
+	require.Equal(t, []string{tmpDir, os.TempDir()}, checked)
+
+	err = fd.checkSpace(job{}, entry, 101)
+	require.ErrorIs(t, err, ErrInsufficientSpace)
+
+	entry.MinFreeSpace = 50
+
+	err = fd.checkSpace(job{}, entry, 50)
+	require.NoError(t, err)
+
+	err = fd.checkSpace(job{}, entry, 51)
+	require.ErrorIs(t, err, ErrInsufficientSpace)
+
+	// an unknown size only needs the minimum free space
+	err = fd.checkSpace(job{}, entry, -1)
+	require.NoError(t, err)
+
+	entry.MaxArchiveSize = 10
+
+	err = fd.checkSpace(job{}, entry, 11)
+	require.EqualError(t, err, "archive of 11 bytes exceeds the maximum size of 10 bytes")
+}
+
+func TestSwap_Copy(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+
+	writeFile(t, filepath.Join(src, "el.txt"), "new")
+	writeFile(t, filepath.Join(src, "sub", "el.txt"), "new sub")
+	writeFile(t, filepath.Join(dst, "el.txt"), "old")
+	writeFile(t, filepath.Join(dst, "stale.txt"), "stale")
+	writeFile(t, filepath.Join(dst, "stale", "el.txt"), "stale")
+
+	err := swap(config.StrategyCopy, src, dst, defaultDirMode)
+	require.NoError(t, err)
+
+	requireFile(t, filepath.Join(dst, "el.txt"), "new")
+	requireFile(t, filepath.Join(dst, "sub", "el.txt"), "new sub")
+
+	fileInfos, err := ioutil.ReadDir(dst)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 2)
+
+	// the source is not moved
+	requireFile(t, filepath.Join(src, "el.txt"), "new")
+}
+
+func TestSwap_Update(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+
+	writeFile(t, filepath.Join(src, "el.txt"), "new")
+	writeFile(t, filepath.Join(dst, "el.txt"), "old")
+	writeFile(t, filepath.Join(dst, "data", "runtime.db"), "data")
+
+	err := swap(config.StrategyUpdate, src, dst, defaultDirMode)
+	require.NoError(t, err)
+
+	requireFile(t, filepath.Join(dst, "el.txt"), "new")
+	requireFile(t, filepath.Join(dst, "data", "runtime.db"), "data")
+
+	_, err = os.Stat(filepath.Join(dst, "el.txt"+tmpSuffix))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSwap_Replace(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+
+	writeFile(t, filepath.Join(src, "el.txt"), "new")
+	writeFile(t, filepath.Join(dst, "stale.txt"), "stale")
+
+	err := swap(config.StrategyReplace, src, dst, defaultDirMode)
+	require.NoError(t, err)
+
+	requireFile(t, filepath.Join(dst, "el.txt"), "new")
+
+	fileInfos, err := ioutil.ReadDir(dst)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+
+	_, err = os.Stat(src)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSwap_Unknown(t *testing.T) {
+	err := swap("XX", "", "", defaultDirMode)
+	require.EqualError(t, err, "unknown strategy \"XX\"")
+}
+
+func TestSwapReplace(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	release := filepath.Join(tmpDir, "staging", "release")
+	target := filepath.Join(tmpDir, "target")
+
+	writeFile(t, filepath.Join(release, "el.txt"), "new")
+	writeFile(t, filepath.Join(target, "stale.txt"), "stale")
 
 	fd := FileDeployer{
-		stop:   false,
-		jobs:   jobs,
 		db:     db,
-		serde:  fakeSerde{errors.New("fakes")},
-		logger: logger,
+		serde:  defaultSerde,
+		logger: zerolog.New(io.Discard),
 	}
 
-	fd.processJobs()
+	previous, err := fd.swapReplace(job{id: "AA", releaseID: "XX"}, filepath.Join(tmpDir, "staging"),
+		release, target, "", false)
+	require.NoError(t, err)
+	require.Nil(t, previous)
 
-	_, err = fd.GetStatus(jobID)
-	require.EqualError(t, err, fmt.Sprintf("key %q not found", "XX"))
+	requireFile(t, filepath.Join(target, "el.txt"), "new")
+	require.False(t, exists(filepath.Join(target, "stale.txt")))
+	require.False(t, exists(target+".hodor-old-AA"))
+	require.False(t, exists(release))
 
-	require.Contains(t, log.String(), "job failed: failed to save status")
+	// the journal is cleared once the swap is done
+	err = db.View(func(tx store.Tx) error {
+		_, err := tx.Get(journalKey("XX"))
+		return err
+	})
+	require.Equal(t, store.ErrNotFound, err)
 }
 
-func TestProcessJobs_Handle_Pass_Status_Fail(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+func TestRecoverSwap(t *testing.T) {
+	newJournal := func(t *testing.T) swapJournal {
+		tmpDir := t.TempDir()
+
+		return swapJournal{
+			Target:  filepath.Join(tmpDir, "target"),
+			Release: filepath.Join(tmpDir, "staging", "release"),
+			Staging: filepath.Join(tmpDir, "staging"),
+			Aside:   filepath.Join(tmpDir, "target.hodor-old-AA"),
+		}
+	}
+
+	// the target is moved aside and the release is partially moved
+	journal := newJournal(t)
+	writeFile(t, filepath.Join(journal.Aside, "el.txt"), "old")
+	writeFile(t, filepath.Join(journal.Target, "el.txt"), "new")
+
+	outcome, err := recoverSwap(journal)
+	require.NoError(t, err)
+	require.Equal(t, "rolled back", outcome)
+	requireFile(t, filepath.Join(journal.Target, "el.txt"), "old")
+	require.False(t, exists(journal.Aside))
+
+	// the target is not moved yet
+	journal = newJournal(t)
+	writeFile(t, filepath.Join(journal.Target, "el.txt"), "old")
+
+	outcome, err = recoverSwap(journal)
+	require.NoError(t, err)
+	require.Equal(t, "not started", outcome)
+	requireFile(t, filepath.Join(journal.Target, "el.txt"), "old")
+
+	// there was no target and the release is not moved yet
+	journal = newJournal(t)
+	journal.Aside = ""
+	writeFile(t, filepath.Join(journal.Release, "el.txt"), "new")
+
+	outcome, err = recoverSwap(journal)
 	require.NoError(t, err)
+	require.Equal(t, "completed", outcome)
+	requireFile(t, filepath.Join(journal.Target, "el.txt"), "new")
 
+	// there was no target and the release is moved
+	outcome, err = recoverSwap(journal)
+	require.NoError(t, err)
+	require.Equal(t, "completed", outcome)
+
+	// everything is missing
+	journal = newJournal(t)
+
+	_, err = recoverSwap(journal)
+	require.EqualError(t, err, "target, release, and previous target are missing")
+}
+
+func TestRecoverSwaps(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	journal := swapJournal{
+		JobID:     "AA",
+		ReleaseID: "XX",
+		Tag:       "v1",
+		Target:    filepath.Join(tmpDir, "target"),
+		Release:   filepath.Join(tmpDir, "staging", "release"),
+		Staging:   filepath.Join(tmpDir, "staging"),
+		Aside:     filepath.Join(tmpDir, "target.hodor-old-AA"),
+	}
+
+	writeFile(t, filepath.Join(journal.Aside, "el.txt"), "old")
+	writeFile(t, filepath.Join(journal.Release, "el.txt"), "new")
+
+	fd := NewFileDeployer(db, config.Config{}, fakeClient{}, zerolog.New(io.Discard)).(*FileDeployer)
+
+	err = fd.saveJournal(journal)
+	require.NoError(t, err)
+
+	fd.recoverSwaps()
+
+	requireFile(t, filepath.Join(journal.Target, "el.txt"), "old")
+	require.False(t, exists(journal.Aside))
+	require.False(t, exists(journal.Staging))
+
+	status, err := fd.GetStatus("AA")
+	require.NoError(t, err)
+	require.Equal(t, "failed", status.Status)
+	require.Equal(t, "interrupted during the swap, which was rolled back", status.Message)
+
+	err = db.View(func(tx store.Tx) error {
+		_, err := tx.Get(journalKey("XX"))
+		return err
+	})
+	require.Equal(t, store.ErrNotFound, err)
+}
+
+func TestSaveTar_Pass(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "hodortest")
 	require.NoError(t, err)
 
-	releaseGz, _ := createTar(t, tmpDir)
+	releaseGz, releaseContent := createTar(t, tmpDir)
 
 	t.Logf("using temp folder %q", tmpDir)
 	defer os.RemoveAll(tmpDir)
 
-	jobs := make(chan job, 1)
-	jobID := "XX"
-	releaseID := "YY"
-	jobs <- job{
-		id:         jobID,
-		releaseID:  releaseID,
-		releaseURL: &url.URL{},
-	}
-	close(jobs)
+	target := filepath.Join(tmpDir, "target")
 
-	log := new(bytes.Buffer)
-	logger := zerolog.New(log)
+	rootTar, err := saveTar(releaseGz, target, extractOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "release", rootTar)
+
+	fileInfos, err := ioutil.ReadDir(filepath.Join(target, rootTar))
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 2)
+
+	buf, err := os.ReadFile(filepath.Join(target, rootTar, "el.txt"))
+	require.NoError(t, err)
+	require.Equal(t, releaseContent, string(buf))
+}
+
+func TestHandleJob_Restorecon(t *testing.T) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	releaseGz, _ := createTar(t, tmpDir)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	releaseID := "XX"
+	target := filepath.Join(tmpDir, "target")
+	hooks := &fakeExecutor{}
 
 	fd := FileDeployer{
-		stop:   false,
-		jobs:   jobs,
-		db:     db,
-		serde:  fakeSerde{errors.New("fakes")},
-		logger: logger,
-		client: fakeClient{body: releaseGz},
+		db: db,
 		config: config.Config{
-			Entries: map[string]string{
-				releaseID: filepath.Join(tmpDir, "YY"),
+			Entries: map[string]config.Entry{
+				releaseID: {
+					Target:     target,
+					Restorecon: true,
+				},
 			},
 		},
+		client: fakeClient{body: releaseGz},
+		hooks:  hooks,
+		logger: zerolog.New(io.Discard),
+	}
+
+	_, err = fd.handleJob(job{
+		releaseID:  releaseID,
+		releaseURL: &url.URL{},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, hooks.commands, 1)
+	require.Equal(t, "restorecon -R .", hooks.commands[0].Line)
+	require.Equal(t, target, hooks.commands[0].Dir)
+}
+
+func TestSaveTar_Case_Conflict(t *testing.T) {
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		t.Skip("only on case-insensitive filesystems")
+	}
+
+	releaseGz := new(bytes.Buffer)
+	zr := gzip.NewWriter(releaseGz)
+	tw := tar.NewWriter(zr)
+
+	for _, name := range []string{"release/", "release/el/", "release/EL/"} {
+		err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755})
+		require.NoError(t, err)
 	}
 
-	fd.processJobs()
+	require.NoError(t, tw.Close())
+	require.NoError(t, zr.Close())
+
+	_, err := saveTar(releaseGz, t.TempDir(), extractOptions{})
+	require.EqualError(t, err, fmt.Sprintf("failed to extract: case conflict "+
+		"between %q and %q", filepath.Join("release", "el"), filepath.Join("release", "EL")))
+}
+
+func TestNormalizeName(t *testing.T) {
+	name, err := normalizeName("release\\sub\\el.txt", "linux")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("release", "sub", "el.txt"), name)
+
+	name, err = normalizeName("./release/sub/", "windows")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("release", "sub"), name)
+
+	name, err = normalizeName("release/con.txt", "linux")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("release", "con.txt"), name)
+
+	_, err = normalizeName("release/con.txt", "windows")
+	require.EqualError(t, err, "\"release/con.txt\" uses the reserved name \"con.txt\"")
+
+	_, err = normalizeName("release/a:b", "windows")
+	require.EqualError(t, err, "\"release/a:b\" contains an invalid character")
+
+	_, err = normalizeName("release/el. ", "windows")
+	require.EqualError(t, err, "\"release/el. \" has an element ending with a dot or space")
+
+	name, err = normalizeName("release/sub/../el.txt", "linux")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("release", "el.txt"), name)
 
-	require.Contains(t, log.String(), "job ok: failed to save status")
+	_, err = normalizeName("/etc/passwd", "linux")
+	require.EqualError(t, err, "\"/etc/passwd\" is absolute")
+
+	_, err = normalizeName(`\\server\share`, "windows")
+	require.EqualError(t, err, `"\\\\server\\share" is absolute`)
+
+	_, err = normalizeName("release/../../el.txt", "linux")
+	require.EqualError(t, err, "\"release/../../el.txt\" is out of the release")
+
+	_, err = normalizeName(`..\el.txt`, "windows")
+	require.EqualError(t, err, `"..\\el.txt" is out of the release`)
 }
 
-func TestDeploy_Not_Started(t *testing.T) {
-	fd := FileDeployer{
-		stop: true,
+func TestSaveTar_Hostile(t *testing.T) {
+	dir := func(name string) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}
 	}
 
-	_, err := fd.Deploy("", "", nil)
-	require.EqualError(t, err, "deployer is stopped")
-}
+	file := func(name string) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: 4}
+	}
 
-func TestDeploy_Update_Status_Fail(t *testing.T) {
-	fd := FileDeployer{
-		serde: fakeSerde{err: errors.New("fake")},
+	tests := []struct {
+		headers []*tar.Header
+		flat    bool
+		err     string
+	}{
+		{
+			headers: []*tar.Header{dir("release/"), file("release/../../evil.txt")},
+			err:     "failed to extract: wrong entry: \"release/../../evil.txt\" is out of the release",
+		},
+		{
+			headers: []*tar.Header{dir("release/"), file("/evil.txt")},
+			err:     "failed to extract: wrong entry: \"/evil.txt\" is absolute",
+		},
+		{
+			headers: []*tar.Header{dir("../")},
+			err:     "wrong root folder: \"../\" is out of the release",
+		},
+		{
+			headers: []*tar.Header{dir("release/"), file("release/a.txt"), file("other/x")},
+			err:     "failed to extract: wrong entry: \"other/x\" is out of the root folder \"release\"",
+		},
+		{
+			headers: []*tar.Header{dir("release/"), file("release/../other/x")},
+			err: "failed to extract: wrong entry: \"release/../other/x\" is out of the root " +
+				"folder \"release\"",
+		},
+		{
+			headers: []*tar.Header{dir("release/"), file("release.txt")},
+			err:     "failed to extract: wrong entry: \"release.txt\" is out of the root folder \"release\"",
+		},
+		{
+			headers: []*tar.Header{dir("./"), file("evil.txt")},
+			err:     "wrong root folder: \"./\" is not a folder of the release",
+		},
+		{
+			headers: []*tar.Header{file("../evil.txt")},
+			flat:    true,
+			err:     "failed to extract: wrong entry: \"../evil.txt\" is out of the release",
+		},
+		{
+			headers: []*tar.Header{
+				dir("release/"),
+				{Typeflag: tar.TypeSymlink, Name: "release/link", Linkname: "../.."},
+				file("release/link/evil.txt"),
+			},
+			err: "failed to extract: \"release/link\" is a link to \"../..\", links are not supported",
+		},
+		{
+			headers: []*tar.Header{
+				dir("release/"),
+				{Typeflag: tar.TypeLink, Name: "release/passwd", Linkname: "/etc/passwd"},
+			},
+			err: "failed to extract: \"release/passwd\" is a link to \"/etc/passwd\", links " +
+				"are not supported",
+		},
+		{
+			headers: []*tar.Header{
+				dir("release/"),
+				{Typeflag: tar.TypeChar, Name: "release/null", Devmajor: 1, Devminor: 3},
+			},
+			err: "failed to extract: \"release/null\" has the unsupported type '3'",
+		},
+		{
+			headers: []*tar.Header{
+				dir("release/"),
+				{Typeflag: tar.TypeFifo, Name: "release/fifo"},
+			},
+			err: "failed to extract: \"release/fifo\" has the unsupported type '6'",
+		},
 	}
 
-	_, err := fd.Deploy("", "", nil)
-	require.EqualError(t, err, "failed to set job status: failed to marshal status: fake")
-}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(zw)
 
-func TestDeploy_Update_Buffer_Full(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+		for _, header := range test.headers {
+			err := tw.WriteHeader(header)
+			require.NoError(t, err)
 
-	fd := FileDeployer{
-		serde: fakeSerde{},
-		db:    db,
-		jobs:  make(chan job),
-	}
+			if header.Typeflag == tar.TypeReg {
+				_, err = tw.Write([]byte("evil"))
+				require.NoError(t, err)
+			}
+		}
 
-	_, err = fd.Deploy("", "", nil)
-	require.EqualError(t, err, "buffer is full, re-try later")
-}
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
 
-func TestGetStatus_Key_Not_Found(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+		tmpDir := t.TempDir()
+		dest := filepath.Join(tmpDir, "a", "b", "dest")
 
-	fd := FileDeployer{
-		db: db,
-	}
+		_, err := saveTar(buf, dest, extractOptions{flat: test.flat})
+		require.EqualError(t, err, test.err)
 
-	key := "XX"
+		// nothing is written out of the destination
+		err = filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-	_, err = fd.GetStatus(key)
-	require.EqualError(t, err, fmt.Sprintf("key %q not found", key))
+			if !info.IsDir() && !strings.HasPrefix(path, dest+string(filepath.Separator)) {
+				return fmt.Errorf("%q is out of the destination", path)
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
 }
 
-func TestGetStatus_Unmarshal_Fail(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+func TestSaveTar_Modes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "hodortest")
 	require.NoError(t, err)
 
-	key := "XX"
+	releaseGz, _ := createTar(t, tmpDir)
 
-	err = db.Update(func(tx *buntdb.Tx) error {
-		_, _, err = tx.Set(key, "", nil)
-		require.NoError(t, err)
-		return nil
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	target := filepath.Join(tmpDir, "target")
+
+	rootTar, err := saveTar(releaseGz, target, extractOptions{
+		dirMode:  0750,
+		fileMode: 0640,
 	})
 	require.NoError(t, err)
 
-	fd := FileDeployer{
-		db:    db,
-		serde: fakeSerde{err: errors.New("fake")},
-	}
+	info, err := os.Stat(filepath.Join(target, rootTar))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
 
-	_, err = fd.GetStatus(key)
-	require.EqualError(t, err, "failed to unmarshal job status: fake")
+	info, err = os.Stat(filepath.Join(target, rootTar, "sub"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(target, rootTar, "el.txt"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
 }
 
-func TestGetLatestTag_Not_Found(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
+func TestSaveTar_Flat(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writeFile(t, filepath.Join(tmpDir, "index.html"), "index")
+
+	releaseGz := new(bytes.Buffer)
+
+	err := compress(filepath.Join(tmpDir, "index.html"), releaseGz)
 	require.NoError(t, err)
 
-	fd := FileDeployer{
-		db: db,
-	}
+	target := filepath.Join(tmpDir, "target")
 
-	tag, err := fd.GetLatestTag("XX")
+	rootTar, err := saveTar(releaseGz, target, extractOptions{flat: true})
+	require.NoError(t, err)
+	require.Equal(t, flatRoot, rootTar)
 
+	buf, err := os.ReadFile(filepath.Join(target, flatRoot, "index.html"))
 	require.NoError(t, err)
-	require.Equal(t, "unknown", tag)
+	require.Equal(t, "index", string(buf))
 }
 
-func TestHandleJob_Release_Not_Found(t *testing.T) {
-	releaseID := "XX"
+func TestSaveTar_Long_Names(t *testing.T) {
+	longDir := "release/" + strings.Repeat("d", 120) + "/"
+	longFile := longDir + strings.Repeat("f", 120) + ".txt"
 
-	conf := config.Config{
-		Entries: map[string]string{},
-	}
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(zw)
 
-	fd := FileDeployer{
-		config: conf,
-	}
+		headers := []*tar.Header{
+			// as written by git archive
+			{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header",
+				PAXRecords: map[string]string{"comment": "abc"}, Format: tar.FormatPAX},
+			{Typeflag: tar.TypeDir, Name: "release/", Mode: 0755, Format: format},
+			{Typeflag: tar.TypeDir, Name: longDir, Mode: 0755, Format: format},
+			{Typeflag: tar.TypeReg, Name: longFile, Mode: 0644, Size: 3, Format: format},
+		}
 
-	job := job{
-		id:         "",
-		releaseID:  releaseID,
-		releaseURL: &url.URL{},
-	}
+		for _, header := range headers {
+			err := tw.WriteHeader(header)
+			require.NoError(t, err)
+		}
 
-	err := fd.handleJob(job)
-	require.EqualError(t, err, fmt.Sprintf("releaseID %q not found from the config", releaseID))
-}
+		_, err := tw.Write([]byte("abc"))
+		require.NoError(t, err)
 
-func TestHandleJob_Release_GET_Failed(t *testing.T) {
-	releaseID := "XX"
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
 
-	client := fakeClient{
-		err: errors.New("fake"),
-	}
+		dest := t.TempDir()
 
-	conf := config.Config{
-		Entries: map[string]string{
-			releaseID: "YY",
-		},
-	}
+		rootTar, err := saveTar(buf, dest, extractOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "release", rootTar)
 
-	fd := FileDeployer{
-		config: conf,
-		client: client,
-	}
+		content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(longFile)))
+		require.NoError(t, err)
+		require.Equal(t, "abc", string(content))
 
-	job := job{
-		id:         "",
-		releaseID:  releaseID,
-		releaseURL: &url.URL{},
+		entries, err := os.ReadDir(filepath.Join(dest, "release"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
 	}
-
-	err := fd.handleJob(job)
-	require.EqualError(t, err, "failed to get file: fake")
 }
 
-func TestHandleJob_Untar_Failed(t *testing.T) {
-	releaseID := "XX"
+func TestSaveTar_Duplicate_File(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
 
-	client := fakeClient{
-		body: &bytes.Buffer{},
-	}
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "release/", Mode: 0755})
+	require.NoError(t, err)
 
-	conf := config.Config{
-		Entries: map[string]string{
-			releaseID: "YY",
-		},
-	}
+	for _, content := range []string{"long content", "short"} {
+		err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "release/a.txt",
+			Mode: 0644, Size: int64(len(content))})
+		require.NoError(t, err)
 
-	fd := FileDeployer{
-		config: conf,
-		client: client,
+		_, err = tw.Write([]byte(content))
+		require.NoError(t, err)
 	}
 
-	job := job{
-		id:         "",
-		releaseID:  releaseID,
-		releaseURL: &url.URL{},
-	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
 
-	err := fd.handleJob(job)
-	require.EqualError(t, err, "failed to save tar file: failed to create reader: EOF")
+	dest := t.TempDir()
+
+	_, err = saveTar(buf, dest, extractOptions{})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dest, "release", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "short", string(content))
 }
 
-func TestSaveTar_Pass(t *testing.T) {
-	tmpDir, err := ioutil.TempDir("", "hodortest")
+func TestSaveTar_Max_Size(t *testing.T) {
+	releaseGz, _ := createTar(t, t.TempDir())
+	content := releaseGz.Bytes()
+
+	_, err := saveTar(bytes.NewReader(content), t.TempDir(), extractOptions{maxSize: 2})
 	require.NoError(t, err)
 
-	releaseGz, releaseContent := createTar(t, tmpDir)
+	_, err = saveTar(bytes.NewReader(content), t.TempDir(), extractOptions{maxSize: 1})
+	require.EqualError(t, err, "failed to extract: release exceeds the maximum size of 1 bytes")
+}
 
-	t.Logf("using temp folder %q", tmpDir)
-	defer os.RemoveAll(tmpDir)
+func TestVerifyFiles(t *testing.T) {
+	tmpDir := t.TempDir()
 
-	target := filepath.Join(tmpDir, "target")
+	a := filepath.Join(tmpDir, "a.txt")
+	b := filepath.Join(tmpDir, "b.txt")
 
-	rootTar, err := saveTar(releaseGz, target)
-	require.NoError(t, err)
-	require.Equal(t, filepath.Join(tmpDir, "release"), rootTar)
+	writeFile(t, a, "abc")
+	writeFile(t, b, "de")
 
-	fileInfos, err := ioutil.ReadDir(filepath.Join(target, rootTar))
+	err := verifyFiles(map[string]int64{a: 3, b: 2})
 	require.NoError(t, err)
-	require.Len(t, fileInfos, 2)
 
-	buf, err := os.ReadFile(filepath.Join(target, rootTar, "el.txt"))
-	require.NoError(t, err)
-	require.Equal(t, releaseContent, string(buf))
+	// truncated
+	err = verifyFiles(map[string]int64{a: 3, b: 4})
+	require.EqualError(t, err, "found 1 files of 3 bytes instead of 2 files of 7 bytes")
+
+	// missing
+	err = verifyFiles(map[string]int64{a: 3, filepath.Join(tmpDir, "c.txt"): 1})
+	require.EqualError(t, err, "found 1 files of 3 bytes instead of 2 files of 4 bytes")
 }
 
 func TestSaveTar_Not_Folder(t *testing.T) {
@@ -417,26 +4554,177 @@ func TestSaveTar_Not_Folder(t *testing.T) {
 	err = compress(releaseEl, releaseGz)
 	require.NoError(t, err)
 
-	_, err = saveTar(releaseGz, target)
+	_, err = saveTar(releaseGz, target, extractOptions{})
 	require.EqualError(t, err, "tar must be a folder")
 }
 
 // ----------------------------------------------------------------------------
 // Utility functions
 
+// setLocal sets the local timezone for the duration of the test
+func setLocal(t *testing.T, loc *time.Location) {
+	local := time.Local
+	time.Local = loc
+
+	t.Cleanup(func() {
+		time.Local = local
+	})
+}
+
 type fakeClient struct {
 	body io.Reader
 	err  error
 }
 
-func (c fakeClient) Get(url string) (resp *http.Response, err error) {
+func (c fakeClient) Do(req *http.Request) (*http.Response, error) {
 	body := io.NopCloser(c.body)
 
 	return &http.Response{
-		Body: body,
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       body,
 	}, c.err
 }
 
+// bytesClient returns the same body on each call
+type bytesClient struct {
+	body []byte
+}
+
+func (c bytesClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(c.body)),
+	}, nil
+}
+
+// urlClient returns a different response per URL
+type urlClient struct {
+	sync.Mutex
+	responses map[string]fakeClient
+	calls     []string
+}
+
+func (c *urlClient) Do(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+
+	c.Lock()
+	c.calls = append(c.calls, url)
+	c.Unlock()
+
+	client, found := c.responses[url]
+	if !found {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Body:       io.NopCloser(new(bytes.Buffer)),
+		}, nil
+	}
+
+	return client.Do(req)
+}
+
+// rateLimitedClient returns a rate-limited response on the first call
+type rateLimitedClient struct {
+	header http.Header
+	calls  int
+}
+
+func (c *rateLimitedClient) Do(req *http.Request) (*http.Response, error) {
+	c.calls++
+
+	if c.calls == 1 {
+		return &http.Response{
+			Status:     "403 Forbidden",
+			StatusCode: http.StatusForbidden,
+			Header:     c.header,
+			Body:       io.NopCloser(new(bytes.Buffer)),
+		}, nil
+	}
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(new(bytes.Buffer)),
+	}, nil
+}
+
+// groupAssets are the assets of the group created by newGroupDeployer
+var groupAssets = []asset.Asset{
+	{Name: "front-v1.tar.gz", BrowserDownloadURL: "https://front"},
+	{Name: "back-v1.tar.gz", BrowserDownloadURL: "https://back"},
+}
+
+// newGroupDeployer returns a deployer with a "bundle" group of a "front" and
+// a "back" release, whose targets contain an "old.txt" file.
+func newGroupDeployer(t *testing.T) (*FileDeployer, string) {
+	db, err := store.OpenBunt(":memory:")
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+
+	for _, target := range []string{"front", "back"} {
+		err = os.MkdirAll(filepath.Join(tmpDir, target), 0755)
+		require.NoError(t, err)
+
+		err = os.WriteFile(filepath.Join(tmpDir, target, "old.txt"), []byte("old"), 0644)
+		require.NoError(t, err)
+	}
+
+	conf := config.Config{
+		Entries: map[string]config.Entry{
+			"bundle": {Group: []string{"front", "back"}},
+			"front": {
+				Target: filepath.Join(tmpDir, "front"),
+				Assets: config.AssetRules{Patterns: []string{"front-*"}},
+				Adopt:  true,
+			},
+			"back": {
+				Target: filepath.Join(tmpDir, "back"),
+				Assets: config.AssetRules{Patterns: []string{"back-*"}},
+				Adopt:  true,
+			},
+		},
+	}
+
+	fd := &FileDeployer{
+		db:     db,
+		config: conf,
+		serde:  defaultSerde,
+		hooks:  &fakeExecutor{},
+		jobs:   make(chan job, 1),
+		logger: zerolog.New(io.Discard),
+	}
+
+	return fd, tmpDir
+}
+
+type fakeExecutor struct {
+	commands []hook.Command
+	out      []byte
+	err      error
+}
+
+func (e *fakeExecutor) Execute(cmd hook.Command) ([]byte, error) {
+	e.commands = append(e.commands, cmd)
+	return e.out, e.err
+}
+
+// blockingExecutor sends the hook commands on started, and blocks them until
+// release is closed
+type blockingExecutor struct {
+	started chan string
+	release chan struct{}
+}
+
+func (e *blockingExecutor) Execute(cmd hook.Command) ([]byte, error) {
+	e.started <- cmd.Line
+	<-e.release
+
+	return nil, nil
+}
+
 type fakeSerde struct {
 	err error
 }
@@ -472,6 +4760,20 @@ func createTar(t *testing.T, folder string) (*bytes.Buffer, string) {
 	return releaseGz, releaseContent
 }
 
+func writeFile(t *testing.T, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(path, []byte(content), 0644)
+	require.NoError(t, err)
+}
+
+func requireFile(t *testing.T, path, content string) {
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(buf))
+}
+
 // https://gist.github.com/mimoo/25fc9716e0f1353791f5908f94d6e726
 func compress(src string, buf io.Writer) error {
 	// tar > gzip > buf
@@ -490,9 +4792,14 @@ func compress(src string, buf io.Writer) error {
 			return err
 		}
 
-		// must provide real name
+		// must provide real name, relative to the parent of src
 		// (see https://golang.org/src/archive/tar/common.go?#L626)
-		header.Name = filepath.ToSlash(file)
+		name, err := filepath.Rel(filepath.Dir(src), file)
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(name)
 
 		// write header
 		if err := tw.WriteHeader(header); err != nil {
@@ -522,3 +4829,41 @@ func compress(src string, buf io.Writer) error {
 
 	return nil
 }
+
+// fakeClamd accepts a connection per reply, sends the content of its INSTREAM
+// command to received, and writes the reply
+func fakeClamd(t *testing.T, listener net.Listener, received chan []byte, replies ...string) {
+	for _, reply := range replies {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r := bufio.NewReader(conn)
+
+		command, err := r.ReadString(0)
+		require.NoError(t, err)
+		require.Equal(t, "zINSTREAM\x00", command)
+
+		content := new(bytes.Buffer)
+
+		for {
+			var size uint32
+
+			err = binary.Read(r, binary.BigEndian, &size)
+			require.NoError(t, err)
+
+			if size == 0 {
+				break
+			}
+
+			_, err = io.CopyN(content, r, int64(size))
+			require.NoError(t, err)
+		}
+
+		received <- content.Bytes()
+
+		conn.Write([]byte(reply))
+		conn.Close()
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package deployer
+
+// diskFree is not supported on this platform: the space is not checked
+func diskFree(dir string) (int64, error) {
+	return 0, errNoFreeSpace
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package deployer
+
+import "golang.org/x/sys/unix"
+
+// diskFree returns the number of bytes available to unprivileged users on the
+// filesystem of the folder
+func diskFree(dir string) (int64, error) {
+	var stat unix.Statfs_t
+
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package deployer
+
+import "errors"
+
+// lsetxattr is not supported on this platform
+func lsetxattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
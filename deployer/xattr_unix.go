@@ -0,0 +1,10 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package deployer
+
+import "golang.org/x/sys/unix"
+
+// lsetxattr sets an extended attribute without following symbolic links
+func lsetxattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
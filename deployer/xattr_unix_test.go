@@ -0,0 +1,67 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package deployer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSaveTar_Xattrs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hodortest")
+	require.NoError(t, err)
+
+	t.Logf("using temp folder %q", tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	// check that the filesystem supports user xattrs
+	err = lsetxattr(tmpDir, "user.hodor", []byte("XX"))
+	if err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+
+	releaseGz := new(bytes.Buffer)
+	zr := gzip.NewWriter(releaseGz)
+	tw := tar.NewWriter(zr)
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "release/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	})
+	require.NoError(t, err)
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:       "release/el.txt",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       2,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.hodor": "YY"},
+	})
+	require.NoError(t, err)
+
+	_, err = tw.Write([]byte("ZZ"))
+	require.NoError(t, err)
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, zr.Close())
+
+	target := filepath.Join(tmpDir, "target")
+
+	_, err = saveTar(releaseGz, target, extractOptions{xattrs: true})
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+	n, err := unix.Lgetxattr(filepath.Join(target, "release", "el.txt"), "user.hodor", buf)
+	require.NoError(t, err)
+	require.Equal(t, "YY", string(buf[:n]))
+}
@@ -0,0 +1,228 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nkcr/hodor/asset"
+	"github.com/nkcr/hodor/config"
+)
+
+// pageSize is the number of repositories requested per page, which is the
+// maximum allowed by GitHub
+const pageSize = 100
+
+// archiveExtensions are the extensions of the assets Hodor can deploy, from
+// most to least preferred
+var archiveExtensions = []string{".tar.gz", ".tgz"}
+
+// HTTPClient defines the function we expect from an HTTP client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Discoverer defines the primitive needed to find the repositories whose
+// releases can be deployed
+type Discoverer interface {
+	// Discover returns the repositories of the organization that have a
+	// release, sorted by name.
+	Discover(ctx context.Context, org string) ([]Repository, error)
+}
+
+// Repository is a repository that has a release
+type Repository struct {
+	Name      string        `json:"name"`
+	FullName  string        `json:"full_name"`
+	LatestTag string        `json:"latest_tag"`
+	Assets    []asset.Asset `json:"assets"`
+}
+
+// NewGitHubDiscoverer returns a new initialized discoverer that uses the
+// GitHub API at baseURL. The token, if not empty, raises the rate limit and
+// gives access to private repositories.
+func NewGitHubDiscoverer(baseURL, token string, client HTTPClient) Discoverer {
+	return GitHubDiscoverer{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  client,
+	}
+}
+
+// GitHubDiscoverer implements a discoverer that lists the repositories of a
+// GitHub organization and their latest release. Archived repositories are
+// ignored.
+//
+// - implements discover.Discoverer
+type GitHubDiscoverer struct {
+	baseURL string
+	token   string
+	client  HTTPClient
+}
+
+// githubRepository is a repository, as listed by GitHub
+type githubRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Archived bool   `json:"archived"`
+}
+
+// githubRelease is a release, as returned by GitHub
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []asset.Asset `json:"assets"`
+}
+
+// Discover implements discover.Discoverer
+func (d GitHubDiscoverer) Discover(ctx context.Context, org string) ([]Repository, error) {
+	repositories := []Repository{}
+
+	for page := 1; ; page++ {
+		var repos []githubRepository
+
+		found, err := d.get(ctx, fmt.Sprintf("/orgs/%s/repos?per_page=%d&page=%d",
+			url.PathEscape(org), pageSize, page), &repos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %v", err)
+		}
+
+		if !found {
+			return nil, fmt.Errorf("organization %q not found", org)
+		}
+
+		for _, repo := range repos {
+			if repo.Archived {
+				continue
+			}
+
+			var release githubRelease
+
+			found, err := d.get(ctx, "/repos/"+repo.FullName+"/releases/latest", &release)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get release of %q: %v", repo.FullName, err)
+			}
+
+			if !found {
+				continue
+			}
+
+			repositories = append(repositories, Repository{
+				Name:      repo.Name,
+				FullName:  repo.FullName,
+				LatestTag: release.TagName,
+				Assets:    release.Assets,
+			})
+		}
+
+		if len(repos) < pageSize {
+			break
+		}
+	}
+
+	sort.Slice(repositories, func(i, j int) bool {
+		return repositories[i].Name < repositories[j].Name
+	})
+
+	return repositories, nil
+}
+
+// get decodes the JSON response of the API path into v. It returns false if
+// the response is 404 Not Found.
+func (d GitHubDiscoverer) get(ctx context.Context, path string, v interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.baseURL+path, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return false, fmt.Errorf("unexpected status %q: %s", res.Status,
+			strings.TrimSpace(string(body)))
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return true, nil
+}
+
+// EntryStub is the start of a configuration entry, to be completed by hand
+type EntryStub struct {
+	Target string `json:"target"`
+	// Assets is set if the release has several assets
+	Assets *AssetsStub `json:"assets,omitempty"`
+}
+
+// AssetsStub selects the asset of a release, see config.AssetRules
+type AssetsStub struct {
+	Patterns []string `json:"patterns"`
+}
+
+// Stubs returns the entry of each repository, by name, deployed in the folder
+// named after it in targetRoot. The repositories whose latest release has no
+// archive that Hodor can deploy are returned as warnings.
+func Stubs(repos []Repository, targetRoot string) (map[string]EntryStub, []string) {
+	stubs := make(map[string]EntryStub, len(repos))
+
+	var warnings []string
+
+	for _, repo := range repos {
+		stub := EntryStub{
+			Target: filepath.Join(targetRoot, repo.Name),
+		}
+
+		archive, err := asset.Select(repo.Assets, config.AssetRules{
+			Extensions: archiveExtensions,
+		})
+
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: release %s has no .tar.gz asset",
+				repo.FullName, repo.LatestTag))
+		} else if len(repo.Assets) > 1 {
+			stub.Assets = &AssetsStub{
+				Patterns: []string{assetPattern(archive.Name, repo.LatestTag)},
+			}
+		}
+
+		stubs[repo.Name] = stub
+	}
+
+	return stubs, warnings
+}
+
+// assetPattern returns the asset name where the version of the tag is
+// replaced by "*", so that the pattern matches the next releases.
+func assetPattern(name, tag string) string {
+	for _, version := range []string{tag, strings.TrimPrefix(tag, "v")} {
+		if version != "" && strings.Contains(name, version) {
+			return strings.Replace(name, version, "*", 1)
+		}
+	}
+
+	return name
+}
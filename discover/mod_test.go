@@ -0,0 +1,108 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nkcr/hodor/asset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubDiscoverer_Discover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/orgs/org/repos":
+			require.Equal(t, "100", r.URL.Query().Get("per_page"))
+
+			// a full page is followed by the next one
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, "[")
+				for i := 0; i < pageSize; i++ {
+					if i != 0 {
+						fmt.Fprint(w, ",")
+					}
+					fmt.Fprintf(w, `{"name":"r%d","full_name":"org/r%d","archived":true}`, i, i)
+				}
+				fmt.Fprint(w, "]")
+				return
+			}
+
+			fmt.Fprint(w, `[{"name":"web","full_name":"org/web"},{"name":"app","full_name":"org/app"},`+
+				`{"name":"lib","full_name":"org/lib"}]`)
+
+		case "/repos/org/web/releases/latest":
+			fmt.Fprint(w, `{"tag_name":"v2","assets":[{"name":"web.tar.gz"}]}`)
+		case "/repos/org/app/releases/latest":
+			fmt.Fprint(w, `{"tag_name":"v1","assets":[]}`)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	discoverer := NewGitHubDiscoverer(server.URL+"/", "token", http.DefaultClient)
+
+	repos, err := discoverer.Discover(context.Background(), "org")
+	require.NoError(t, err)
+	require.Equal(t, []Repository{
+		{Name: "app", FullName: "org/app", LatestTag: "v1", Assets: []asset.Asset{}},
+		{Name: "web", FullName: "org/web", LatestTag: "v2", Assets: []asset.Asset{{Name: "web.tar.gz"}}},
+	}, repos)
+}
+
+func TestGitHubDiscoverer_Discover_Fail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orgs/unknown/repos" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.Error(w, "rate limited", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	discoverer := NewGitHubDiscoverer(server.URL, "", http.DefaultClient)
+
+	_, err := discoverer.Discover(context.Background(), "unknown")
+	require.EqualError(t, err, "organization \"unknown\" not found")
+
+	_, err = discoverer.Discover(context.Background(), "org")
+	require.EqualError(t, err, "failed to list repositories: unexpected status "+
+		"\"403 Forbidden\": rate limited")
+}
+
+func TestStubs(t *testing.T) {
+	stubs, warnings := Stubs([]Repository{
+		{Name: "web", FullName: "org/web", LatestTag: "v2", Assets: []asset.Asset{
+			{Name: "web.tar.gz"},
+		}},
+		{Name: "app", FullName: "org/app", LatestTag: "v1.2.0", Assets: []asset.Asset{
+			{Name: "app-1.2.0.zip"},
+			{Name: "app-1.2.0-linux.tar.gz"},
+		}},
+		{Name: "cli", FullName: "org/cli", LatestTag: "v3", Assets: []asset.Asset{
+			{Name: "cli.exe"},
+		}},
+	}, "/srv")
+
+	require.Equal(t, map[string]EntryStub{
+		"web": {Target: "/srv/web"},
+		"app": {Target: "/srv/app", Assets: &AssetsStub{Patterns: []string{"app-*-linux.tar.gz"}}},
+		"cli": {Target: "/srv/cli"},
+	}, stubs)
+
+	require.Equal(t, []string{"org/cli: release v3 has no .tar.gz asset"}, warnings)
+}
+
+func TestAssetPattern(t *testing.T) {
+	require.Equal(t, "app-*.tar.gz", assetPattern("app-v1.0.0.tar.gz", "v1.0.0"))
+	require.Equal(t, "app-*.tar.gz", assetPattern("app-1.0.0.tar.gz", "v1.0.0"))
+	require.Equal(t, "app.tar.gz", assetPattern("app.tar.gz", "v1.0.0"))
+	require.Equal(t, "app.tar.gz", assetPattern("app.tar.gz", ""))
+}
@@ -24,10 +24,11 @@ require (
 
 require (
 	github.com/jessevdk/go-flags v1.5.0
-	github.com/mattn/go-colorable v0.1.12 // indirect
-	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/mattn/go-colorable v0.1.12
+	github.com/mattn/go-isatty v0.0.14
 	github.com/narqo/go-badge v0.0.0-20220127184443-140af28a266e
 	github.com/rs/xid v1.4.0
 	github.com/tidwall/buntdb v1.2.9
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6
 )
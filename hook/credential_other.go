@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package hook
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setCredential is not supported on this platform
+func setCredential(cmd *exec.Cmd, cred *Credential) error {
+	return errors.New("running as another account is not supported on this platform")
+}
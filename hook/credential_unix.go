@@ -0,0 +1,20 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package hook
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCredential makes the command run as the credential's account
+func setCredential(cmd *exec.Cmd, cred *Credential) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: cred.UID,
+			Gid: cred.GID,
+		},
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package hook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+// Command defines a hook command to execute
+type Command struct {
+	// Line is the command, interpreted by the shell
+	Line string
+	// Dir is the working directory of the command
+	Dir string
+	// Env contains environment variables added to the current environment
+	Env map[string]string
+	// Credential defines the account that runs the command. The current
+	// account is used if nil.
+	Credential *Credential
+	// Sandbox defines the restrictions applied to the command. The command
+	// is not restricted if nil.
+	Sandbox *Sandbox
+}
+
+// Sandbox defines the restrictions applied to a command. The command doesn't
+// inherit the current environment and gets a private home and temporary
+// folder.
+type Sandbox struct {
+	// AllowEnv lists the variables kept from the current environment, in
+	// addition to PATH.
+	AllowEnv []string
+}
+
+// Credential defines the user and group ids of an account
+type Credential struct {
+	UID uint32
+	GID uint32
+}
+
+// Executor defines the primitive needed to execute hook commands
+type Executor interface {
+	// Execute runs the command and returns its combined stdout and stderr.
+	Execute(cmd Command) ([]byte, error)
+}
+
+// NewShellExecutor returns a new initialized shell executor
+func NewShellExecutor() Executor {
+	return ShellExecutor{}
+}
+
+// ShellExecutor implements an executor that runs commands with the system's
+// shell.
+//
+// - implements hook.Executor
+type ShellExecutor struct{}
+
+// Execute implements hook.Executor
+func (ShellExecutor) Execute(cmd Command) ([]byte, error) {
+	var execCmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		execCmd = exec.Command("cmd", "/C", cmd.Line)
+	} else {
+		execCmd = exec.Command("/bin/sh", "-c", cmd.Line)
+	}
+
+	execCmd.Dir = cmd.Dir
+	execCmd.Env = append(os.Environ(), Environ(cmd.Env)...)
+
+	if cmd.Credential != nil {
+		err := setCredential(execCmd, cmd.Credential)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set credential: %v", err)
+		}
+	}
+
+	if cmd.Sandbox != nil {
+		home, err := ioutil.TempDir("", "hodor-hook")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sandbox home: %v", err)
+		}
+
+		defer os.RemoveAll(home)
+
+		if cmd.Credential != nil {
+			err = os.Chown(home, int(cmd.Credential.UID), int(cmd.Credential.GID))
+			if err != nil {
+				return nil, fmt.Errorf("failed to chown sandbox home: %v", err)
+			}
+		}
+
+		execCmd.Env = append(sandboxEnv(cmd.Sandbox, home), Environ(cmd.Env)...)
+	}
+
+	out, err := execCmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("failed to run %q: %v", cmd.Line, err)
+	}
+
+	return out, nil
+}
+
+// LookupCredential returns the credential of a user and group, given by name
+// or id. If the group is empty, the user's primary group is used.
+func LookupCredential(userName, groupName string) (*Credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		u, err = user.LookupId(userName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup user %q: %v", userName, err)
+		}
+	}
+
+	gid := u.Gid
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to lookup group %q: %v", groupName, err)
+			}
+		}
+
+		gid = g.Gid
+	}
+
+	uidNum, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user id %q is not numeric: %v", u.Uid, err)
+	}
+
+	gidNum, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("group id %q is not numeric: %v", gid, err)
+	}
+
+	return &Credential{
+		UID: uint32(uidNum),
+		GID: uint32(gidNum),
+	}, nil
+}
+
+// Chown recursively changes the owner of a folder and its content to the
+// credential's account. Symbolic links are not followed.
+func Chown(root string, cred *Credential) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		err = os.Lchown(path, int(cred.UID), int(cred.GID))
+		if err != nil {
+			return fmt.Errorf("failed to chown %s: %v", path, err)
+		}
+
+		return nil
+	})
+}
+
+// sandboxEnv returns the environment of a sandboxed command, using home as
+// the home and temporary folder.
+func sandboxEnv(sandbox *Sandbox, home string) []string {
+	env := []string{
+		"HOME=" + home,
+		"TMPDIR=" + home,
+	}
+
+	for _, key := range append([]string{"PATH"}, sandbox.AllowEnv...) {
+		value, found := os.LookupEnv(key)
+		if found {
+			env = append(env, key+"="+value)
+		}
+	}
+
+	return env
+}
+
+// Environ returns the environment variables in the key=value form, sorted by
+// key.
+func Environ(env map[string]string) []string {
+	res := make([]string, 0, len(env))
+
+	for k, v := range env {
+		res = append(res, k+"="+v)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
@@ -0,0 +1,144 @@
+package hook
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellExecutor_Pass(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix shell")
+	}
+
+	dir := t.TempDir()
+
+	executor := NewShellExecutor()
+
+	out, err := executor.Execute(Command{
+		Line: "echo $XX && pwd",
+		Dir:  dir,
+		Env:  map[string]string{"XX": "YY"},
+	})
+	require.NoError(t, err)
+	require.Contains(t, string(out), "YY\n")
+	require.Contains(t, string(out), dir)
+}
+
+func TestShellExecutor_Fail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix shell")
+	}
+
+	executor := NewShellExecutor()
+
+	out, err := executor.Execute(Command{
+		Line: "echo XX && exit 3",
+	})
+	require.EqualError(t, err, "failed to run \"echo XX && exit 3\": exit status 3")
+	require.Equal(t, "XX\n", string(out))
+}
+
+func TestEnviron(t *testing.T) {
+	env := Environ(map[string]string{
+		"B": "2",
+		"A": "1",
+	})
+
+	require.Equal(t, []string{"A=1", "B=2"}, env)
+}
+
+func TestLookupCredential_Current(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no numeric ids")
+	}
+
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	cred, err := LookupCredential(current.Username, "")
+	require.NoError(t, err)
+	require.Equal(t, current.Uid, strconv.Itoa(int(cred.UID)))
+	require.Equal(t, current.Gid, strconv.Itoa(int(cred.GID)))
+
+	// by id
+	cred, err = LookupCredential(current.Uid, current.Gid)
+	require.NoError(t, err)
+	require.Equal(t, current.Uid, strconv.Itoa(int(cred.UID)))
+	require.Equal(t, current.Gid, strconv.Itoa(int(cred.GID)))
+}
+
+func TestLookupCredential_Unknown_User(t *testing.T) {
+	_, err := LookupCredential("hodor-unknown-user", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to lookup user \"hodor-unknown-user\"")
+}
+
+func TestShellExecutor_Credential(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix shell")
+	}
+
+	executor := NewShellExecutor()
+
+	out, err := executor.Execute(Command{
+		Line: "id -u",
+		Credential: &Credential{
+			UID: uint32(os.Getuid()),
+			GID: uint32(os.Getgid()),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(os.Getuid())+"\n", string(out))
+}
+
+func TestChown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("chown not supported")
+	}
+
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "el.txt"), []byte("XX"), 0644)
+	require.NoError(t, err)
+
+	err = Chown(dir, &Credential{
+		UID: uint32(os.Getuid()),
+		GID: uint32(os.Getgid()),
+	})
+	require.NoError(t, err)
+}
+
+func TestShellExecutor_Sandbox(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix shell")
+	}
+
+	t.Setenv("HODOR_TEST_SECRET", "XX")
+	t.Setenv("HODOR_TEST_ALLOWED", "YY")
+
+	executor := NewShellExecutor()
+
+	out, err := executor.Execute(Command{
+		Line: "echo \"$HODOR_TEST_SECRET|$HODOR_TEST_ALLOWED|$ZZ\" && test -d \"$HOME\" && echo $TMPDIR",
+		Env:  map[string]string{"ZZ": "ZZ"},
+		Sandbox: &Sandbox{
+			AllowEnv: []string{"HODOR_TEST_ALLOWED"},
+		},
+	})
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, "|YY|ZZ", lines[0])
+
+	// the private home must be removed
+	_, err = os.Stat(lines[1])
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,54 @@
+package logs
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// Field names shared by the subsystems, so that the lines of a deployment can
+// be followed from the API request to the end of the job.
+const (
+	JobIDKey     = "jobID"
+	ReleaseIDKey = "releaseID"
+	TagKey       = "tag"
+	RequestIDKey = "requestID"
+	PhaseKey     = "phase"
+)
+
+// Phases of a job, used as the value of PhaseKey
+const (
+	PhaseQueue      = "queue"
+	PhaseDownload   = "download"
+	PhaseExtract    = "extract"
+	PhasePreDeploy  = "pre_deploy"
+	PhaseSwap       = "swap"
+	PhasePostDeploy = "post_deploy"
+)
+
+// WithRequest returns a logger that adds the request ID to each line. An empty
+// request ID is omitted.
+func WithRequest(logger zerolog.Logger, requestID string) zerolog.Logger {
+	if requestID == "" {
+		return logger
+	}
+
+	return logger.With().Str(RequestIDKey, requestID).Logger()
+}
+
+// WithJob returns a logger that adds the job's fields to each line. An empty
+// request ID is omitted.
+func WithJob(logger zerolog.Logger, jobID, releaseID, tag,
+	requestID string) zerolog.Logger {
+
+	logger = logger.With().
+		Str(JobIDKey, jobID).
+		Str(ReleaseIDKey, releaseID).
+		Str(TagKey, tag).
+		Logger()
+
+	return WithRequest(logger, requestID)
+}
+
+// WithPhase returns a logger that adds the job's phase to each line
+func WithPhase(logger zerolog.Logger, phase string) zerolog.Logger {
+	return logger.With().Str(PhaseKey, phase).Logger()
+}
@@ -0,0 +1,31 @@
+package logs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithJob(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	logger := WithJob(zerolog.New(buf), "AA", "BB", "CC", "DD")
+	logger = WithPhase(logger, PhaseDownload)
+
+	logger.Info().Msg("xx")
+
+	require.Equal(t, `{"level":"info","jobID":"AA","releaseID":"BB","tag":"CC",`+
+		`"requestID":"DD","phase":"download","message":"xx"}`+"\n", buf.String())
+}
+
+func TestWithRequest_Empty(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	logger := WithRequest(zerolog.New(buf), "")
+
+	logger.Info().Msg("xx")
+
+	require.Equal(t, `{"level":"info","message":"xx"}`+"\n", buf.String())
+}
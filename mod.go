@@ -1,18 +1,39 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	// embeds the timezones of the reports, for systems without them
+	_ "time/tzdata"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/mattn/go-colorable"
+	"github.com/mattn/go-isatty"
+	"github.com/nkcr/hodor/client"
+	"github.com/nkcr/hodor/compactor"
 	"github.com/nkcr/hodor/config"
 	"github.com/nkcr/hodor/deployer"
+	"github.com/nkcr/hodor/discover"
+	"github.com/nkcr/hodor/notifier"
+	"github.com/nkcr/hodor/report"
 	"github.com/nkcr/hodor/server"
+	"github.com/nkcr/hodor/store"
+	"github.com/nkcr/hodor/trigger"
+	"github.com/nkcr/hodor/watcher"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/buntdb"
 )
@@ -20,7 +41,7 @@ import (
 // Version contains the current or build version. This variable can be changed
 // at build time with:
 //
-//   go build -ldflags="-X 'main.Version=v1.0.0'"
+//	go build -ldflags="-X 'main.Version=v1.0.0'"
 //
 // Version should be fetched from git: `git describe --tags`
 var Version = "unknown"
@@ -29,6 +50,9 @@ var Version = "unknown"
 // as with Version.
 var BuildTime = "unknown"
 
+// defaultDBDirMode is the permission of the database folder if not configured
+const defaultDBDirMode os.FileMode = 0744
+
 var logout = zerolog.ConsoleWriter{
 	Out:        os.Stdout,
 	TimeFormat: time.RFC3339,
@@ -36,15 +60,129 @@ var logout = zerolog.ConsoleWriter{
 
 // args defines the CLI arguments. You can always use -h to see the help.
 type args struct {
-	Config     string `short:"c" long:"config" default:"config.json" description:"File path of the configuration."`
-	DBFilePath string `short:"d" long:"dbfilepath" default:"hodor.db" description:"File path of the database."`
-	HTTPListen string `short:"l" long:"listen" default:"0.0.0.0:3333" description:"The listen address of the HTTP server that servers the API."`
-	Version    bool   `short:"v" long:"version" description:"Displays the version."`
+	Config      string        `short:"c" long:"config" default:"config.json" description:"File path of the configuration."`
+	DBFilePath  string        `short:"d" long:"dbfilepath" default:"hodor.db" description:"File path of the database."`
+	HTTPListen  string        `short:"l" long:"listen" default:"0.0.0.0:3333" description:"The listen address of the HTTP server that servers the API."`
+	ReadOnly    bool          `long:"read-only" description:"Serves status, tags, and badges only. Deployments are rejected."`
+	Version     bool          `short:"v" long:"version" description:"Displays the version."`
+	WatchConfig time.Duration `long:"watch-config" default:"5s" description:"The interval at which the configuration file is checked for changes to reload it. 0 reloads it on SIGHUP only."`
+	TLSCert     string        `long:"tls-cert" description:"File path of the PEM certificate, to serve the API with HTTPS. Requires --tls-key."`
+	TLSKey      string        `long:"tls-key" description:"File path of the PEM private key of the certificate."`
+	TLSReload   time.Duration `long:"tls-reload" description:"The interval at which the certificate files are checked for changes to reload them, such as after a renewal. 0 loads them once."`
+	DBRetry     time.Duration `long:"db-retry" description:"How long to retry opening the database, with a backoff, such as while another instance stops. 0 fails right away."`
+	PIDFile     string        `long:"pid-file" description:"File path where the PID of the serving process is written, such as for systemd to follow upgrades."`
+
+	Serve  struct{}      `command:"serve" description:"Serves the API and deploys the releases. This is the default command."`
+	Deploy deployCommand `command:"deploy" description:"Deploys a release on a running instance."`
+	Status statusCommand `command:"status" description:"Displays the status of a job of a running instance."`
+	Tags   tagsCommand   `command:"tags" description:"Displays the deployed tags of releases of a running instance."`
+	Jobs   jobsCommand   `command:"jobs" description:"Displays the jobs of a running instance."`
+
+	DB       dbCommand       `command:"db" description:"Database maintenance commands."`
+	Check    checkCommand    `command:"check" description:"Checks the configuration."`
+	Orphans  orphansCommand  `command:"orphans" description:"Cleans up the targets of releases removed from the configuration. Hodor must not be running."`
+	Discover discoverCommand `command:"discover" description:"Generates the entries of the repositories that have releases."`
+}
+
+// discoverCommand defines the discover command
+type discoverCommand struct {
+	GitHubOrg  string `long:"github-org" required:"yes" description:"The GitHub organization whose repositories are listed."`
+	Token      string `long:"token" env:"GITHUB_TOKEN" description:"A GitHub token, to raise the rate limit and list private repositories."`
+	APIURL     string `long:"api-url" default:"https://api.github.com" description:"The URL of the GitHub API."`
+	TargetRoot string `long:"target-root" default:"/srv" description:"The folder that contains the targets of the entries."`
+}
+
+// orphansCommand groups the commands on the targets of releases that are no
+// longer configured
+type orphansCommand struct {
+	List   struct{}             `command:"list" description:"Lists the orphaned targets."`
+	Remove orphansRemoveCommand `command:"remove" description:"Removes orphaned targets."`
+}
+
+// orphansRemoveCommand defines the remove orphans command
+type orphansRemoveCommand struct {
+	Archive string `short:"a" long:"archive" description:"Saves each target as a tar.gz in this folder before removing it."`
+
+	Args struct {
+		ReleaseIDs []string `positional-arg-name:"release-id" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// checkCommand defines the check command
+type checkCommand struct {
+	API  apiOptions
+	Diff bool `long:"diff" description:"Displays what the configuration would change on the running instance."`
+}
+
+// apiOptions are the options of the commands that use the HTTP API of a
+// running instance
+type apiOptions struct {
+	Server string `short:"s" long:"server" env:"HODOR_URL" default:"http://localhost:3333" description:"The URL of the running instance."`
+	Token  string `long:"token" env:"HODOR_TOKEN" description:"The token sent as Authorization: Bearer <token>."`
+}
+
+// deployCommand defines the deploy command
+type deployCommand struct {
+	API     apiOptions
+	URL     string `short:"u" long:"url" required:"yes" description:"The URL of the release's archive."`
+	Options deployOptions
+
+	Args struct {
+		ReleaseID string `positional-arg-name:"release-id"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// statusCommand defines the status command
+type statusCommand struct {
+	API    apiOptions
+	Follow bool `short:"f" long:"follow" description:"Displays the status each time it changes, until the job is done. Exits with 1 if the job failed."`
+	JSON   bool `long:"json" description:"Displays the status as JSON."`
+
+	Args struct {
+		JobID string `positional-arg-name:"job-id"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// tagsCommand defines the tags command
+type tagsCommand struct {
+	API apiOptions
+
+	Args struct {
+		ReleaseIDs []string `positional-arg-name:"release-id" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// jobsCommand defines the jobs command
+type jobsCommand struct {
+	API  apiOptions
+	Jobs jobsOptions
+}
+
+// deployOptions are the options of the deploy commands
+type deployOptions struct {
+	Tag     string        `short:"t" long:"tag" description:"The tag of the release."`
+	Wait    bool          `short:"w" long:"wait" description:"Waits for the job to finish. Exits with 1 if the job failed."`
+	Timeout time.Duration `long:"timeout" default:"10m" description:"The maximum time to wait for the job."`
+	SHA256  string        `long:"sha256" description:"The hex-encoded SHA-256 of the archive, verified before its extraction."`
+}
+
+// jobsOptions are the options of the jobs command
+type jobsOptions struct {
+	Watch     bool   `short:"w" long:"watch" description:"Displays the job updates as they happen, until interrupted."`
+	ReleaseID string `short:"r" long:"release-id" description:"Lists the jobs of this release only."`
+	Limit     int    `short:"n" long:"limit" default:"20" description:"The number of jobs to list."`
+	Offset    int    `long:"offset" description:"The number of recent jobs to skip."`
+}
+
+// dbCommand groups the database maintenance commands
+type dbCommand struct {
+	Compact struct{} `command:"compact" description:"Compacts the database file. Hodor must not be running."`
 }
 
 func main() {
 	var args args
 	parser := flags.NewParser(&args, flags.Default)
+	parser.SubcommandsOptional = true
 
 	remaining, err := parser.Parse()
 	if err != nil {
@@ -67,6 +205,56 @@ func main() {
 		os.Exit(0)
 	}
 
+	if parser.Active != nil && parser.Active.Name == "db" {
+		err = compactDB(args)
+		if err != nil {
+			fmt.Println("failed to compact db:", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if parser.Active != nil && isAPICommand(parser.Active.Name) {
+		err = runAPICommand(parser.Active.Name, args)
+		if err != nil {
+			fmt.Printf("%s failed: %v\n", parser.Active.Name, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if parser.Active != nil && parser.Active.Name == "orphans" {
+		err = runOrphans(parser.Active.Active.Name, args)
+		if err != nil {
+			fmt.Println("orphans failed:", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if parser.Active != nil && parser.Active.Name == "discover" {
+		err = runDiscover(args.Discover)
+		if err != nil {
+			fmt.Println("discover failed:", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if parser.Active != nil && parser.Active.Name == "check" {
+		err = runCheck(args)
+		if err != nil {
+			fmt.Println("check failed:", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
 	var logger = zerolog.New(logout).Level(zerolog.InfoLevel).
 		With().Timestamp().Logger().
 		With().Caller().Logger()
@@ -82,8 +270,11 @@ func main() {
 		"│ DBFilePath %s\t│\n"+
 		"├───────────────────────────────────────────────┤\n"+
 		"│ HTTPListen %s\t│\n"+
+		"├───────────────────────────────────────────────┤\n"+
+		"│ ReadOnly %t\t\t\t\t│\n"+
 		"└───────────────────────────────────────────────┘\n",
-		Version, BuildTime, args.Config, args.DBFilePath, args.HTTPListen)
+		Version, BuildTime, args.Config, args.DBFilePath, args.HTTPListen,
+		args.ReadOnly)
 
 	var conf config.Config
 
@@ -92,20 +283,190 @@ func main() {
 		logger.Panic().Msgf("failed to load config: %v", err)
 	}
 
-	err = os.MkdirAll(filepath.Dir(args.DBFilePath), 0744)
+	// the config file is checked when loaded, the database only known here
+	err = conf.CheckTargets(args.DBFilePath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create db dir: %v", err))
+		logger.Panic().Msgf("wrong target: %v", err)
 	}
 
-	db, err := buntdb.Open(args.DBFilePath)
+	err = os.MkdirAll(filepath.Dir(args.DBFilePath), conf.DB.DirMode.Or(defaultDBDirMode))
 	if err != nil {
-		panic(err)
+		logger.Fatal().Msgf("failed to create db dir: %v%s", err, dbHint(err, conf.DB))
 	}
 
-	defer db.Close()
+	ln, err := inheritListener()
+	if err != nil {
+		logger.Fatal().Msgf("failed to upgrade: %v", err)
+	}
+
+	dbRetry := args.DBRetry
+
+	// the pipe where the previous process of an upgrade is told that this one
+	// started, and then that it serves
+	var readyPipe *os.File
+
+	if ln != nil {
+		logger.Info().Msgf("upgrading, listening on the inherited %s", ln.Addr())
+
+		// the previous process releases the database once its running job
+		// finished
+		if dbRetry < upgradeDBRetry {
+			dbRetry = upgradeDBRetry
+		}
+
+		writePIDFile(args.PIDFile, logger)
+
+		readyPipe, err = inheritReadyPipe()
+		if err == nil {
+			err = notifyPrevious(readyPipe, "started")
+		}
+
+		if err != nil {
+			logger.Fatal().Msgf("failed to upgrade: %v", err)
+		}
+	}
+
+	db, bunt, err := openStoreRetry(conf.DB, args.DBFilePath, dbRetry, logger)
+	if err != nil {
+		logger.Fatal().Msgf("failed to open db %q: %v%s", args.DBFilePath, err,
+			dbHint(err, conf.DB))
+	}
+
+	// closeDB can be called before returning, to release the database
+	closeOnce := sync.Once{}
+	closeDB := func() {
+		closeOnce.Do(func() {
+			db.Close()
+		})
+	}
+
+	defer closeDB()
+
+	if ln == nil {
+		ln, err = net.Listen("tcp", args.HTTPListen)
+		if err != nil {
+			logger.Fatal().Msgf("failed to listen on %s: %v", args.HTTPListen, err)
+		}
+
+		writePIDFile(args.PIDFile, logger)
+	}
+
+	defer removePIDFile(args.PIDFile, logger)
+
+	last, err := getShutdownReport(db)
+	if err != nil {
+		logger.Warn().Msgf("failed to get the last shutdown report: %v", err)
+	} else if last != nil {
+		last.log(logger.Info(), "last shutdown")
+	}
+
+	if bunt != nil {
+		err = compactor.SetShrinkConfig(bunt, conf.DB)
+		if err != nil {
+			logger.Panic().Msgf("failed to configure db: %v", err)
+		}
+	}
+
+	userAgent := conf.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+
+	httpClient := newHTTPClient(userAgent)
+
+	deployer := deployer.NewFileDeployer(db, conf, httpClient, logger)
+	var serverOpts []server.Option
+
+	tokens := make(map[string]string)
+	for releaseID, entry := range conf.Entries {
+		if entry.Token != "" {
+			tokens[releaseID] = entry.Token
+		}
+	}
+
+	if len(tokens) != 0 {
+		serverOpts = append(serverOpts, server.WithTokens(tokens))
+	}
+
+	if conf.Auth.Token != "" {
+		serverOpts = append(serverOpts, server.WithGlobalToken(conf.Auth.Token))
+	}
+
+	if conf.Auth.Private {
+		serverOpts = append(serverOpts, server.WithPrivate(conf.Auth.PublicBadges))
+	}
+
+	if conf.Auth.BadgeSecret != "" {
+		serverOpts = append(serverOpts, server.WithBadgeSecret(conf.Auth.BadgeSecret))
+	}
+
+	secrets := make(map[string]string)
+	for releaseID, entry := range conf.Entries {
+		secret := entry.WebhookSecret
+		if secret == "" {
+			secret = conf.WebhookSecret
+		}
+
+		if secret != "" {
+			secrets[releaseID] = secret
+		}
+	}
+
+	if len(secrets) != 0 {
+		serverOpts = append(serverOpts, server.WithWebhookSecrets(secrets))
+	}
+
+	registry := make(map[string][]server.RegistryRelease)
+	for releaseID, entry := range conf.Entries {
+		if entry.Repository != "" {
+			registry[entry.Repository] = append(registry[entry.Repository],
+				server.RegistryRelease{ReleaseID: releaseID, URL: entry.RegistryURL})
+		}
+	}
+
+	for _, releases := range registry {
+		sort.Slice(releases, func(i, j int) bool {
+			return releases[i].ReleaseID < releases[j].ReleaseID
+		})
+	}
+
+	if len(registry) != 0 {
+		serverOpts = append(serverOpts, server.WithRegistry(registry))
+	}
+
+	badges := make(map[string]config.Badge)
+	for releaseID, entry := range conf.Entries {
+		if entry.Badge != (config.Badge{}) {
+			badges[releaseID] = entry.Badge
+		}
+	}
+
+	if len(badges) != 0 {
+		serverOpts = append(serverOpts, server.WithBadges(badges))
+	}
+
+	if args.ReadOnly {
+		serverOpts = append(serverOpts, server.WithReadOnly())
+	}
+
+	if args.TLSCert != "" || args.TLSKey != "" {
+		if args.TLSCert == "" || args.TLSKey == "" {
+			logger.Panic().Msg("--tls-cert and --tls-key must be set together")
+		}
+
+		cert, err := server.NewCertificate(args.TLSCert, args.TLSKey, args.TLSReload, logger)
+		if err != nil {
+			logger.Panic().Msgf("failed to load TLS certificate: %v", err)
+		}
 
-	deployer := deployer.NewFileDeployer(db, conf, http.DefaultClient, logger)
-	server := server.NewHookHTTP(args.HTTPListen, deployer, logger)
+		serverOpts = append(serverOpts, server.WithTLS(cert))
+	}
+
+	served := newServedListener(ln)
+
+	serverOpts = append(serverOpts, server.WithListener(served), server.WithMiddlewares(conf.HTTP))
+
+	server := server.NewHookHTTP(args.HTTPListen, deployer, logger, serverOpts...)
 
 	wait := sync.WaitGroup{}
 
@@ -116,22 +477,1026 @@ func main() {
 		logger.Info().Msg("http server done")
 	}()
 
+	// closed once the deployer saved the jobs left
+	deployerDone := make(chan struct{})
+
 	wait.Add(1)
 	go func() {
 		defer wait.Done()
+		defer close(deployerDone)
 		deployer.Start()
 		logger.Info().Msg("deployer done")
 	}()
 
+	if readyPipe != nil {
+		<-served.served
+
+		err = notifyPrevious(readyPipe, "ready")
+		if err != nil {
+			logger.Warn().Msgf("failed to notify the previous process: %v", err)
+		}
+
+		readyPipe.Close()
+	}
+
+	var notifiers []notifier.Notifier
+
+	if conf.Grafana.URL != "" {
+		notifiers = append(notifiers, notifier.NewGrafanaNotifier(conf.Grafana, httpClient))
+	}
+
+	if conf.Discovery.Consul.URL != "" {
+		notifiers = append(notifiers, notifier.NewConsulNotifier(conf.Discovery.Consul, httpClient))
+	}
+
+	if conf.Discovery.Etcd.URL != "" {
+		notifiers = append(notifiers, notifier.NewEtcdNotifier(conf.Discovery.Etcd, httpClient))
+	}
+
+	for _, entry := range conf.Entries {
+		if len(entry.Purge.Cloudflare) != 0 || len(entry.Purge.Endpoints) != 0 {
+			notifiers = append(notifiers, notifier.NewPurgeNotifier(conf.Entries, httpClient))
+			break
+		}
+	}
+
+	if conf.DurationAlert.URL != "" {
+		notifiers = append(notifiers, notifier.NewDurationAlertNotifier(conf.DurationAlert, httpClient))
+	}
+
+	for _, entry := range conf.Entries {
+		if len(entry.Forward) != 0 {
+			notifiers = append(notifiers, notifier.NewForwardNotifier(conf.Entries, httpClient))
+			break
+		}
+	}
+
+	var dispatcher notifier.Dispatcher
+
+	// slow deployments are logged even without notifiers
+	if len(notifiers) != 0 || conf.DurationAlert.Factor != 0 {
+		dispatcher = notifier.NewEventDispatcher(deployer, notifiers, conf.PublicURL,
+			conf.DurationAlert, logger)
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			dispatcher.Start()
+			logger.Info().Msg("notifier done")
+		}()
+	}
+
+	callbacks := notifier.NewCallbackDispatcher(deployer, conf.CallbackSecret,
+		httpClient, logger)
+
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		callbacks.Start()
+		logger.Info().Msg("callbacks done")
+	}()
+
+	var reporter report.Scheduler
+
+	if conf.Report.Period != "" {
+		reporter, err = newReporter(conf, deployer, httpClient, logger)
+		if err != nil {
+			logger.Panic().Msgf("failed to create reporter: %v", err)
+		}
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			reporter.Start()
+			logger.Info().Msg("reporter done")
+		}()
+	}
+
+	mqttTrigger, err := newMQTTTrigger(conf, args.ReadOnly, deployer, logger)
+	if err != nil {
+		logger.Panic().Msgf("failed to create mqtt trigger: %v", err)
+	}
+
+	if mqttTrigger != nil {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			mqttTrigger.Start()
+			logger.Info().Msg("mqtt trigger done")
+		}()
+	}
+
+	var dbCompactor compactor.Compactor
+
+	// the configuration only sets a compaction interval for buntdb
+	if conf.DB.CompactInterval > 0 {
+		dbCompactor = compactor.NewPeriodicCompactor(bunt,
+			time.Duration(conf.DB.CompactInterval), logger)
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			dbCompactor.Start()
+			logger.Info().Msg("compactor done")
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	configWatcher := watcher.NewConfigWatcher(args.Config, args.WatchConfig, hup,
+		reloadConfig(conf, args.DBFilePath, deployer), logger)
+
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		configWatcher.Start()
+		logger.Info().Msg("config watcher done")
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 
-	<-quit
+	upgrades := make(chan os.Signal, 1)
+	notifyUpgrade(upgrades)
+
+	next := waitQuit(quit, upgrades, ln, logger)
+
+	signal.Stop(hup)
+	signal.Stop(upgrades)
+
+	shutdown := shutdownReport{
+		StartedAt:       time.Now().UTC(),
+		OpenConnections: server.Connections(),
+	}
+
+	configWatcher.Stop()
+
+	if next != nil {
+		// the requests are served until the running job is done, as the new
+		// process can't serve before it opens the database
+		deployer.Stop()
+		<-deployerDone
+	}
 
 	server.Stop()
-	deployer.Stop()
 
+	if mqttTrigger != nil {
+		mqttTrigger.Stop()
+	}
+
+	if next == nil {
+		deployer.Stop()
+	}
+
+	if dispatcher != nil {
+		dispatcher.Stop()
+	}
+
+	callbacks.Stop()
+
+	if reporter != nil {
+		reporter.Stop()
+	}
+
+	if dbCompactor != nil {
+		dbCompactor.Stop()
+	}
 	wait.Wait()
 
+	shutdown.FinishedAt = time.Now().UTC()
+	shutdown.Drain = deployer.Drained()
+	shutdown.DroppedConnections = server.Connections()
+
+	shutdown.log(logger.Info(), "shutdown report")
+
+	err = saveShutdownReport(db, shutdown)
+	if err != nil {
+		logger.Err(err).Msg("failed to save the shutdown report")
+	}
+
+	if next != nil {
+		// the new process of the upgrade waits for the database to serve
+		closeDB()
+
+		err = next.waitReady(upgradeDBRetry)
+		if err != nil {
+			logger.Error().Msgf("process %d didn't take over: %v", next.pid, err)
+		} else {
+			logger.Info().Msgf("process %d took over", next.pid)
+		}
+	}
+
 	logger.Info().Msg("done")
 }
+
+// reloadConfig returns the function that gives a reloaded configuration to the
+// deployer, starting from the current one. The other subsystems keep the
+// configuration they started with.
+func reloadConfig(current config.Config, dbFilePath string, d deployer.Deployer) watcher.Reload {
+	return func(conf config.Config) error {
+		err := conf.CheckTargets(dbFilePath)
+		if err != nil {
+			return fmt.Errorf("wrong target: %v", err)
+		}
+
+		err = checkReload(current, conf)
+		if err != nil {
+			return err
+		}
+
+		d.Reload(conf)
+		current = conf
+
+		return nil
+	}
+}
+
+// newMQTTTrigger returns the trigger subscribed to the broker of the
+// configuration, or nil if there is no broker. The trigger deploys, so it is
+// not started in read-only mode.
+func newMQTTTrigger(conf config.Config, readOnly bool, d deployer.Deployer,
+	logger zerolog.Logger) (trigger.Trigger, error) {
+
+	if conf.MQTT.Broker == "" {
+		return nil, nil
+	}
+
+	if readOnly {
+		logger.Warn().Msg("mqtt trigger disabled in read-only mode")
+		return nil, nil
+	}
+
+	releaseIDs := make([]string, 0, len(conf.Entries))
+	for releaseID := range conf.Entries {
+		releaseIDs = append(releaseIDs, releaseID)
+	}
+
+	return trigger.NewMQTTTrigger(conf.MQTT, releaseIDs, d, logger)
+}
+
+// checkReload returns an error if the new configuration changes how the API is
+// protected, as the server reads the tokens and secrets at startup only. A new
+// entry with a token would otherwise be deployable without it, as would a new
+// entry without a webhook secret of its own when a global one is set, and a new
+// entry would not be subscribed to MQTT, whose topics are set at startup. The
+// global token is held by the server, so it applies to the new entries. The
+// database backend can't change either, as the database is open, nor can the
+// badges and the middlewares.
+func checkReload(current, next config.Config) error {
+	if next.Auth != current.Auth || next.WebhookSecret != current.WebhookSecret {
+		return errors.New("the auth settings or the webhook secret changed, which requires a restart")
+	}
+
+	if next.DB.Backend != current.DB.Backend {
+		return errors.New("the database backend changed, which requires a restart")
+	}
+
+	if !reflect.DeepEqual(next.HTTP, current.HTTP) {
+		return errors.New("the http middlewares changed, which requires a restart")
+	}
+
+	for releaseID, entry := range next.Entries {
+		previous, found := current.Entries[releaseID]
+
+		if !found && next.WebhookSecret != "" {
+			return fmt.Errorf("the new entry %q requires the webhook secret, "+
+				"which requires a restart", releaseID)
+		}
+
+		if !found && next.MQTT.Broker != "" {
+			return fmt.Errorf("the new entry %q requires an MQTT subscription, "+
+				"which requires a restart", releaseID)
+		}
+
+		if entry.Token != previous.Token || entry.WebhookSecret != previous.WebhookSecret ||
+			entry.Repository != previous.Repository || entry.RegistryURL != previous.RegistryURL {
+
+			return fmt.Errorf("the token, webhook secret, or registry of %q changed, "+
+				"which requires a restart", releaseID)
+		}
+
+		if entry.Badge != previous.Badge {
+			return fmt.Errorf("the badge of %q changed, which requires a restart", releaseID)
+		}
+	}
+
+	return nil
+}
+
+// upgradeTimeout is the maximum time for the new process of an upgrade to
+// start, and upgradeDBRetry the minimum time it waits for the database, while
+// the previous process stops
+const (
+	upgradeTimeout = 30 * time.Second
+	upgradeDBRetry = 10 * time.Minute
+)
+
+// waitQuit waits for an interrupt, or for an upgrade whose new process
+// started, which it returns. A failed upgrade is logged, and Hodor keeps
+// running.
+func waitQuit(quit, upgrades <-chan os.Signal, ln net.Listener,
+	logger zerolog.Logger) *upgradeProcess {
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-upgrades:
+			logger.Info().Msg("upgrading")
+
+			next, err := upgrade(ln, upgradeTimeout)
+			if err != nil {
+				logger.Err(err).Msg("failed to upgrade")
+				continue
+			}
+
+			logger.Info().Msgf("upgrading to process %d, stopping", next.pid)
+
+			return next
+		}
+	}
+}
+
+// notifyPrevious tells the previous process of an upgrade, through its pipe,
+// that this one is in the state, "started" or "ready". It does nothing if the
+// pipe is nil.
+func notifyPrevious(pipe *os.File, state string) error {
+	if pipe == nil {
+		return nil
+	}
+
+	_, err := pipe.Write([]byte(state + "\n"))
+	if err != nil {
+		return fmt.Errorf("failed to notify: %v", err)
+	}
+
+	return nil
+}
+
+// servedListener is a listener whose served chan is closed on the first call
+// to Accept, once the server serves
+type servedListener struct {
+	net.Listener
+	once   sync.Once
+	served chan struct{}
+}
+
+// newServedListener returns a new initialized served listener
+func newServedListener(ln net.Listener) *servedListener {
+	return &servedListener{
+		Listener: ln,
+		served:   make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener
+func (l *servedListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		close(l.served)
+	})
+
+	return l.Listener.Accept()
+}
+
+// writePIDFile writes the PID of the process in the file, if any, replacing
+// it at once so that it is never read half written
+func writePIDFile(path string, logger zerolog.Logger) {
+	if path == "" {
+		return
+	}
+
+	tmp := path + ".tmp"
+
+	err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		logger.Warn().Msgf("failed to write pid file: %v", err)
+	}
+}
+
+// removePIDFile removes the PID file, if any, unless it was replaced by the new
+// process of an upgrade
+func removePIDFile(path string, logger zerolog.Logger) {
+	if path == "" {
+		return
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(buf)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		logger.Warn().Msgf("failed to remove pid file: %v", err)
+	}
+}
+
+// shutdownKey is the database key of the last shutdown report
+const shutdownKey = "shutdown"
+
+// shutdownReport summarizes a shutdown, so that operators can check that a
+// restart didn't lose anything
+type shutdownReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	deployer.Drain
+	// OpenConnections counts the connections open when the shutdown started
+	OpenConnections int `json:"openConnections"`
+	// DroppedConnections counts the connections still open once the server
+	// stopped
+	DroppedConnections int `json:"droppedConnections"`
+}
+
+// log logs the report as the event's fields
+func (r shutdownReport) log(event *zerolog.Event, msg string) {
+	event.Time("started_at", r.StartedAt).
+		Dur("duration", r.FinishedAt.Sub(r.StartedAt)).
+		Int("completed", r.Completed).
+		Int("requeued", r.Requeued).
+		Int("abandoned", r.Abandoned).
+		Int("open_connections", r.OpenConnections).
+		Int("dropped_connections", r.DroppedConnections).
+		Msg(msg)
+}
+
+// openStore opens the database file with the configured backend, after taking
+// its lock so that a second instance of Hodor fails right away. The buntdb
+// database is also returned to be shrunk, or nil for another backend. Closing
+// the store releases the lock.
+func openStore(conf config.DBConfig, path string) (store.Store, *buntdb.DB, error) {
+	lock, err := store.Lock(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock db: %w", err)
+	}
+
+	if conf.Backend == config.BackendBolt {
+		db, err := store.OpenBolt(path, 0600)
+		if err != nil {
+			lock.Close()
+			return nil, nil, err
+		}
+
+		return store.WithLock(db, lock), nil, nil
+	}
+
+	db, err := store.OpenBuntDB(path)
+	if err != nil {
+		lock.Close()
+		return nil, nil, err
+	}
+
+	return store.WithLock(store.NewBuntStore(db), lock), db, nil
+}
+
+// The backoff between the attempts to open the database
+const (
+	dbRetryMin = 500 * time.Millisecond
+	dbRetryMax = 10 * time.Second
+)
+
+// openStoreRetry opens the database as openStore does. If it fails, it is
+// retried with an exponential backoff until the retry duration elapsed.
+func openStoreRetry(conf config.DBConfig, path string, retry time.Duration,
+	logger zerolog.Logger) (store.Store, *buntdb.DB, error) {
+
+	deadline := time.Now().Add(retry)
+	wait := dbRetryMin
+
+	for {
+		db, bunt, err := openStore(conf, path)
+		if err == nil {
+			return db, bunt, nil
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return nil, nil, err
+		}
+
+		logger.Warn().Msgf("failed to open db, retrying in %s: %v%s", wait, err,
+			dbHint(err, conf))
+
+		time.Sleep(wait)
+
+		wait *= 2
+		if wait > dbRetryMax {
+			wait = dbRetryMax
+		}
+	}
+}
+
+// dbHint returns a sentence, starting with ". ", that explains how to fix the
+// error of opening the database, or an empty string if it has no known cause
+func dbHint(err error, conf config.DBConfig) string {
+	backend := conf.Backend
+	if backend == "" {
+		backend = config.BackendBunt
+	}
+
+	switch {
+	case errors.Is(err, store.ErrLocked):
+		return ". Another instance of Hodor, or a db or orphans command, is " +
+			"running with it: stop it first, use another --dbfilepath, or wait " +
+			"for it with --db-retry"
+	case errors.Is(err, store.ErrInvalid):
+		return fmt.Sprintf(". The file is not a %s database, or is corrupted: "+
+			"check the backend of the configuration, or restore a backup", backend)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Sprintf(". The account running Hodor (uid %d) must be able to "+
+			"read and write the file, and to create files in its folder", os.Getuid())
+	case errors.Is(err, syscall.EISDIR):
+		return ". --dbfilepath must be a file, not a folder"
+	case errors.Is(err, syscall.EROFS):
+		return ". The file is on a read-only filesystem"
+	default:
+		return ""
+	}
+}
+
+// saveShutdownReport saves the report, replacing the previous one
+func saveShutdownReport(db store.Store, report shutdownReport) error {
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %v", err)
+	}
+
+	return db.Update(func(tx store.Tx) error {
+		return tx.Set(shutdownKey, string(buf))
+	})
+}
+
+// getShutdownReport returns the last shutdown report, or nil if Hodor never
+// stopped since it saves them.
+func getShutdownReport(db store.Store) (*shutdownReport, error) {
+	var report *shutdownReport
+
+	err := db.View(func(tx store.Tx) error {
+		value, err := tx.Get(shutdownKey)
+		if err == store.ErrNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		report = &shutdownReport{}
+
+		return json.Unmarshal([]byte(value), report)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// newReporter returns the scheduler of the deployment reports, with the
+// configured senders
+func newReporter(conf config.Config, source report.Source, client *http.Client,
+	logger zerolog.Logger) (report.Scheduler, error) {
+
+	var senders []report.Sender
+
+	if conf.Report.Email.Host != "" {
+		senders = append(senders, report.NewEmailSender(conf.Report.Email))
+	}
+
+	if conf.Report.WebhookURL != "" {
+		senders = append(senders, report.NewWebhookSender(conf.Report.WebhookURL, client))
+	}
+
+	if len(senders) == 0 {
+		return nil, errors.New("no email or webhook to send the reports")
+	}
+
+	releaseIDs := make([]string, 0, len(conf.Entries))
+	for releaseID := range conf.Entries {
+		releaseIDs = append(releaseIDs, releaseID)
+	}
+
+	return report.NewPeriodicReporter(source, releaseIDs, conf.Report, senders, logger)
+}
+
+// compactDB shrinks the database file and displays its size before and after.
+func compactDB(args args) error {
+	// the backend is only known from the configuration, if it can be loaded
+	var conf config.Config
+
+	err := conf.LoadFromJSON(args.Config)
+	if err == nil && conf.DB.Backend == config.BackendBolt {
+		return fmt.Errorf("only %q databases can be compacted", config.BackendBunt)
+	}
+
+	before, err := os.Stat(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat db: %v", err)
+	}
+
+	lock, err := store.Lock(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to lock db: %v%s", err, dbHint(err, conf.DB))
+	}
+
+	defer lock.Close()
+
+	db, err := store.OpenBuntDB(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open db: %v%s", err, dbHint(err, conf.DB))
+	}
+
+	defer db.Close()
+
+	err = db.Shrink()
+	if err != nil {
+		return fmt.Errorf("failed to shrink: %v", err)
+	}
+
+	after, err := os.Stat(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat db: %v", err)
+	}
+
+	fmt.Printf("compacted %s: %d bytes -> %d bytes\n", args.DBFilePath,
+		before.Size(), after.Size())
+
+	return nil
+}
+
+// runDiscover prints the entry stubs of the repositories that have releases,
+// as a configuration file. Warnings are printed on stderr.
+func runDiscover(args discoverCommand) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	discoverer := discover.NewGitHubDiscoverer(args.APIURL, args.Token,
+		newHTTPClient(defaultUserAgent()))
+
+	repos, err := discoverer.Discover(ctx, args.GitHubOrg)
+	if err != nil {
+		return err
+	}
+
+	stubs, warnings := discover.Stubs(repos, args.TargetRoot)
+
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+
+	buf, err := json.MarshalIndent(map[string]interface{}{"entries": stubs}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal entries: %v", err)
+	}
+
+	fmt.Println(string(buf))
+
+	return nil
+}
+
+// runOrphans lists or removes the targets of the releases that are no longer
+// in the configuration
+func runOrphans(command string, args args) error {
+	var conf config.Config
+
+	err := conf.LoadFromJSON(args.Config)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	_, err = os.Stat(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat db: %v", err)
+	}
+
+	db, _, err := openStore(conf.DB, args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open db: %v%s", err, dbHint(err, conf.DB))
+	}
+
+	defer db.Close()
+
+	orphans, err := deployer.FindOrphans(db, conf)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "list":
+		for _, orphan := range orphans {
+			fmt.Printf("%s %s %s\n", orphan.ReleaseID, orphan.Tag, orphan.Target)
+		}
+
+		return nil
+
+	case "remove":
+		byReleaseID := make(map[string]deployer.Orphan, len(orphans))
+		for _, orphan := range orphans {
+			byReleaseID[orphan.ReleaseID] = orphan
+		}
+
+		// nothing is removed if one of the releases is not an orphan
+		for _, releaseID := range args.Orphans.Remove.Args.ReleaseIDs {
+			_, found := byReleaseID[releaseID]
+			if !found {
+				return fmt.Errorf("%q is not an orphan", releaseID)
+			}
+		}
+
+		for _, releaseID := range args.Orphans.Remove.Args.ReleaseIDs {
+			orphan := byReleaseID[releaseID]
+
+			archivePath, err := deployer.RemoveOrphan(db, conf, orphan, args.Orphans.Remove.Archive)
+			if err != nil {
+				return fmt.Errorf("failed to remove %q: %v", releaseID, err)
+			}
+
+			if archivePath != "" {
+				fmt.Printf("archived %s to %s\n", orphan.Target, archivePath)
+			}
+
+			fmt.Printf("removed %s\n", orphan.Target)
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// isAPICommand returns true if the top-level command uses the HTTP API of a
+// running instance
+func isAPICommand(command string) bool {
+	switch command {
+	case "deploy", "status", "tags", "jobs":
+		return true
+	default:
+		return false
+	}
+}
+
+// runAPICommand runs a top-level command that uses the HTTP API of a running
+// instance
+func runAPICommand(command string, args args) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	switch command {
+	case "deploy":
+		return runDeploy(ctx, newAPIClient(args.Deploy.API), args.Deploy.Args.ReleaseID,
+			args.Deploy.URL, args.Deploy.Options)
+
+	case "status":
+		return runStatus(ctx, newAPIClient(args.Status.API), args.Status)
+
+	case "tags":
+		return runTags(ctx, newAPIClient(args.Tags.API), args.Tags.Args.ReleaseIDs)
+
+	case "jobs":
+		return runJobs(ctx, newAPIClient(args.Jobs.API), args.Jobs.Jobs)
+
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// newAPIClient returns a client of the HTTP API of the instance, which sends
+// the token if set
+func newAPIClient(api apiOptions) client.Client {
+	httpClient := newHTTPClient(defaultUserAgent())
+	httpClient.Transport = bearerTransport{token: api.Token, next: httpClient.Transport}
+
+	return client.NewAPIClient(api.Server, httpClient)
+}
+
+// runJobs lists the jobs or, if asked, displays the job updates until
+// interrupted
+func runJobs(ctx context.Context, hodor client.Client, args jobsOptions) error {
+	out := colorable.NewColorableStdout()
+	color := isatty.IsTerminal(os.Stdout.Fd())
+
+	if !args.Watch {
+		jobs, err := hodor.ListJobs(ctx, args.ReleaseID, args.Limit, args.Offset)
+		if err != nil {
+			return fmt.Errorf("failed to list jobs: %v", err)
+		}
+
+		for _, job := range jobs {
+			fmt.Fprintln(out, client.FormatJob(job, color))
+		}
+
+		return nil
+	}
+
+	return hodor.WatchJobs(ctx, func(event deployer.JobEvent) {
+		fmt.Fprintln(out, client.FormatEvent(event, color))
+	})
+}
+
+// runStatus displays the status of a job and, if asked, follows it until the
+// job is done. It returns an error if the followed job failed so that the exit
+// status reflects it.
+func runStatus(ctx context.Context, hodor client.Client, args statusCommand) error {
+	out := colorable.NewColorableStdout()
+	color := isatty.IsTerminal(os.Stdout.Fd())
+
+	display := func(status deployer.JobStatus) {
+		if !args.JSON {
+			fmt.Fprintln(out, client.FormatStatus(args.Args.JobID, status, color))
+			return
+		}
+
+		buf, err := json.Marshal(status)
+		if err == nil {
+			fmt.Fprintln(out, string(buf))
+		}
+	}
+
+	if !args.Follow {
+		status, err := hodor.GetStatus(ctx, args.Args.JobID)
+		if err != nil {
+			return fmt.Errorf("failed to get status: %v", err)
+		}
+
+		display(status)
+
+		return nil
+	}
+
+	status, err := hodor.FollowStatus(ctx, args.Args.JobID, display)
+	if err != nil {
+		return fmt.Errorf("failed to follow status: %v", err)
+	}
+
+	if status.Status != "ok" {
+		return fmt.Errorf("job %s ended with status %q", args.Args.JobID, status.Status)
+	}
+
+	return nil
+}
+
+// runTags displays the deployed tag of each release, prefixed by the
+// releaseID if there are several
+func runTags(ctx context.Context, hodor client.Client, releaseIDs []string) error {
+	for _, releaseID := range releaseIDs {
+		tag, err := hodor.GetTag(ctx, releaseID)
+		if err != nil {
+			return fmt.Errorf("failed to get tag of %q: %v", releaseID, err)
+		}
+
+		if len(releaseIDs) == 1 {
+			fmt.Println(tag)
+			continue
+		}
+
+		fmt.Printf("%s %s\n", releaseID, tag)
+	}
+
+	return nil
+}
+
+// runCheck loads the configuration with the checks done at startup and, if
+// asked, compares it against the releases of the running instance.
+func runCheck(args args) error {
+	var conf config.Config
+
+	err := conf.LoadFromJSON(args.Config)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = conf.CheckTargets(args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("wrong target: %v", err)
+	}
+
+	fmt.Printf("%s is valid\n", args.Config)
+
+	if !args.Check.Diff {
+		return nil
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	// the global token of the configuration is sent if none is given
+	api := args.Check.API
+	if api.Token == "" {
+		api.Token = conf.Auth.Token
+	}
+
+	hodor := newAPIClient(api)
+
+	releases, err := hodor.GetReleases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get releases: %v", err)
+	}
+
+	fmt.Print(client.Diff(conf, releases))
+
+	return nil
+}
+
+// runDeploy deploys a release and, if asked, waits for the job to finish. It
+// returns an error if the job failed so that the exit status reflects it.
+func runDeploy(ctx context.Context, hodor client.Client, releaseID, asset string,
+	args deployOptions) error {
+
+	req := client.DeployRequest{
+		BrowserDownloadURL: asset,
+		Tag:                args.Tag,
+		SHA256:             args.SHA256,
+	}
+
+	if !args.Wait {
+		jobID, err := hodor.Deploy(ctx, releaseID, req)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(jobID)
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, args.Timeout)
+	defer cancel()
+
+	jobID, status, err := hodor.DeployAndWait(ctx, releaseID, req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s %s\n", jobID, status.Status, status.Message)
+
+	if status.Status != "ok" {
+		return fmt.Errorf("job %s ended with status %q", jobID, status.Status)
+	}
+
+	return nil
+}
+
+// defaultUserAgent returns the User-Agent of outbound requests if not
+// configured
+func defaultUserAgent() string {
+	return "hodor/" + Version
+}
+
+// newHTTPClient returns an HTTP client that identifies its requests with the
+// User-Agent
+func newHTTPClient(userAgent string) *http.Client {
+	return &http.Client{
+		Transport: userAgentTransport{
+			userAgent: userAgent,
+			next:      http.DefaultTransport,
+		},
+	}
+}
+
+// userAgentTransport sets the User-Agent of requests that don't have one
+//
+// - implements http.RoundTripper
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+
+	return t.next.RoundTrip(req)
+}
+
+// bearerTransport sets the Authorization of requests that don't have one, if
+// the token is not empty
+//
+// - implements http.RoundTripper
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" || req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// A read-only instance must not deploy the releases announced over MQTT.
+func TestNewMQTTTrigger_Read_Only(t *testing.T) {
+	conf := config.Config{
+		MQTT:    config.MQTTConfig{Broker: "tcp://localhost:1883"},
+		Entries: map[string]config.Entry{"XX": {Target: "/tmp/xx"}},
+	}
+
+	logger := zerolog.New(io.Discard)
+
+	mqttTrigger, err := newMQTTTrigger(conf, true, nil, logger)
+	require.NoError(t, err)
+	require.Nil(t, mqttTrigger)
+
+	mqttTrigger, err = newMQTTTrigger(conf, false, nil, logger)
+	require.NoError(t, err)
+	require.NotNil(t, mqttTrigger)
+
+	mqttTrigger, err = newMQTTTrigger(config.Config{}, false, nil, logger)
+	require.NoError(t, err)
+	require.Nil(t, mqttTrigger)
+}
+
+func TestCheckReload(t *testing.T) {
+	current := config.Config{
+		Entries: map[string]config.Entry{"XX": {Target: "/tmp/xx"}},
+	}
+
+	next := config.Config{
+		Entries: map[string]config.Entry{
+			"XX": {Target: "/tmp/xx2"},
+			"YY": {Target: "/tmp/yy"},
+		},
+	}
+
+	require.NoError(t, checkReload(current, next))
+
+	next.Entries["YY"] = config.Entry{Target: "/tmp/yy", Token: "secret"}
+	require.Error(t, checkReload(current, next))
+}
+
+// A new entry would be deployable without the global webhook secret, as the
+// server reads the secrets at startup only.
+func TestCheckReload_Webhook_Secret(t *testing.T) {
+	current := config.Config{
+		WebhookSecret: "secret",
+		Entries:       map[string]config.Entry{"XX": {Target: "/tmp/xx"}},
+	}
+
+	next := config.Config{
+		WebhookSecret: "secret",
+		Entries:       map[string]config.Entry{"XX": {Target: "/tmp/xx2"}},
+	}
+
+	require.NoError(t, checkReload(current, next))
+
+	next.Entries["YY"] = config.Entry{Target: "/tmp/yy"}
+
+	err := checkReload(current, next)
+	require.EqualError(t, err, `the new entry "YY" requires the webhook secret, `+
+		"which requires a restart")
+}
+
+// A new entry would not be deployed from MQTT, as the topics are subscribed at
+// startup.
+func TestCheckReload_MQTT(t *testing.T) {
+	current := config.Config{
+		MQTT:    config.MQTTConfig{Broker: "tcp://localhost:1883"},
+		Entries: map[string]config.Entry{"XX": {Target: "/tmp/xx"}},
+	}
+
+	next := config.Config{
+		MQTT:    config.MQTTConfig{Broker: "tcp://localhost:1883"},
+		Entries: map[string]config.Entry{"XX": {Target: "/tmp/xx2"}},
+	}
+
+	require.NoError(t, checkReload(current, next))
+
+	next.Entries["YY"] = config.Entry{Target: "/tmp/yy"}
+
+	err := checkReload(current, next)
+	require.EqualError(t, err, `the new entry "YY" requires an MQTT subscription, `+
+		"which requires a restart")
+}
+
+func TestServedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	served := newServedListener(ln)
+
+	defer served.Close()
+
+	select {
+	case <-served.served:
+		t.Fatal("served before accepting")
+	default:
+	}
+
+	go served.Accept()
+
+	select {
+	case <-served.served:
+	case <-time.After(time.Second):
+		t.Fatal("not served")
+	}
+
+	require.NoError(t, notifyPrevious(nil, "ready"))
+}
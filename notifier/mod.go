@@ -0,0 +1,836 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/nkcr/hodor/logs"
+	"github.com/rs/zerolog"
+)
+
+// HTTPClient defines the function we expect from an HTTP client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Notifier defines the primitive needed to notify an external service of a
+// successful deployment
+type Notifier interface {
+	Notify(deployment Deployment) error
+}
+
+// Deployment contains the information about a successful deployment
+type Deployment struct {
+	deployer.HistoryEntry
+	// JobURL is the link to the job's status. It is empty if Hodor's public
+	// URL is not configured.
+	JobURL string
+	// ReleaseURL is the URL of the deployed release, empty for rollbacks
+	ReleaseURL string
+	// Subpath is the subpath of the deployment's request, if any
+	Subpath string
+	// Slow is set when the deployment took much longer than the previous
+	// ones of its release, according to the duration alert.
+	Slow *Slowdown
+}
+
+// Slowdown compares the duration of a slow deployment with the previous
+// deployments of its release
+type Slowdown struct {
+	// P95 is the 95th percentile of the durations of the previous deployments
+	P95 time.Duration `json:"p95"`
+	// Factor is the duration of the deployment divided by P95
+	Factor float64 `json:"factor"`
+	// Samples is the number of previous deployments
+	Samples int `json:"samples"`
+}
+
+// defaultMinSamples is the number of previous deployments needed to detect a
+// slow deployment, if not configured
+const defaultMinSamples = 5
+
+// Summary returns a compact description of the deployment, such as
+// "siteX v1 → v2 in 1.2s: 1 added, 2 changed, 0 removed", followed by the
+// slowdown if any.
+func (d Deployment) Summary() string {
+	summary := fmt.Sprintf("%s %s → %s in %s: %d added, %d changed, %d removed",
+		d.ReleaseID, d.PreviousTag, d.Tag, d.Duration.Round(time.Millisecond),
+		d.Changes.Added, d.Changes.Changed, d.Changes.Removed)
+
+	if d.Slow != nil {
+		summary += fmt.Sprintf(" (slow: %.1f× p95 of %s)", d.Slow.Factor,
+			d.Slow.P95.Round(time.Millisecond))
+	}
+
+	if d.JobURL != "" {
+		summary += " " + d.JobURL
+	}
+
+	return summary
+}
+
+// Dispatcher defines the primitives needed to notify the deployments as they
+// happen
+type Dispatcher interface {
+	// Start must be called only once to start the notification loop
+	Start()
+	// Stop must be called only once and when start has been called
+	Stop()
+}
+
+// NewEventDispatcher returns a new initialized dispatcher that calls the
+// notifiers on each successful job of the deployer. publicURL is the base URL
+// of Hodor, used to link the jobs, and can be empty. The deployments are
+// checked against the duration alert if its factor is set.
+func NewEventDispatcher(deployer deployer.Deployer, notifiers []Notifier,
+	publicURL string, alert config.DurationAlert, logger zerolog.Logger) Dispatcher {
+
+	logger = logger.With().Str("role", "notifier").Logger()
+
+	return &EventDispatcher{
+		deployer:  deployer,
+		notifiers: notifiers,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		alert:     alert,
+		logger:    logger,
+		quit:      make(chan struct{}),
+	}
+}
+
+// EventDispatcher implements a dispatcher that subscribes to the deployer's
+// job events. Notifications are best effort: a failing notifier doesn't stop
+// the others, and events are dropped if the notifiers are too slow.
+//
+// - implements notifier.Dispatcher
+type EventDispatcher struct {
+	deployer  deployer.Deployer
+	notifiers []Notifier
+	publicURL string
+	alert     config.DurationAlert
+	logger    zerolog.Logger
+	quit      chan struct{}
+}
+
+// Start implements notifier.Dispatcher. This is a blocking function that
+// returns once Stop has been called.
+func (d *EventDispatcher) Start() {
+	events, unsubscribe := d.deployer.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case event := <-events:
+			if event.Status != "ok" {
+				continue
+			}
+
+			d.notify(event)
+		}
+	}
+}
+
+// Stop implements notifier.Dispatcher
+func (d *EventDispatcher) Stop() {
+	close(d.quit)
+}
+
+// notify calls all the notifiers with the deployment of the event
+func (d *EventDispatcher) notify(event deployer.JobEvent) {
+	logger := logs.WithJob(d.logger, event.JobID, event.ReleaseID, event.Tag,
+		event.RequestID)
+
+	deployment, err := d.getDeployment(event)
+	if err != nil {
+		logger.Err(err).Msg("failed to get deployment")
+		return
+	}
+
+	if deployment.Slow != nil {
+		logger.Warn().Dur("duration", deployment.Duration).
+			Dur("p95", deployment.Slow.P95).
+			Msgf("deployment is %.1f times slower than the p95", deployment.Slow.Factor)
+	}
+
+	for _, notifier := range d.notifiers {
+		err := notifier.Notify(deployment)
+		if err != nil {
+			logger.Err(err).Msgf("failed to notify with %T", notifier)
+		}
+	}
+}
+
+// getDeployment returns the deployment of the event, from the history
+func (d *EventDispatcher) getDeployment(event deployer.JobEvent) (Deployment, error) {
+	history, err := d.deployer.GetHistory(event.ReleaseID)
+	if err != nil {
+		return Deployment{}, fmt.Errorf("failed to get history: %v", err)
+	}
+
+	for i, entry := range history {
+		if entry.JobID != event.JobID {
+			continue
+		}
+
+		deployment := Deployment{HistoryEntry: entry, ReleaseURL: event.ReleaseURL,
+			Subpath: event.Subpath}
+
+		if d.publicURL != "" {
+			deployment.JobURL = d.publicURL + "/api/status/" + url.PathEscape(entry.JobID)
+		}
+
+		// the history is from the most recent, so the previous deployments
+		// follow
+		deployment.Slow = slowdown(d.alert, entry.Duration, history[i+1:])
+
+		return deployment, nil
+	}
+
+	return Deployment{}, fmt.Errorf("job %q not found in the history", event.JobID)
+}
+
+// slowdown returns the slowdown of a deployment that took duration, or nil if
+// it is not slow compared to the previous deployments or if the alert is
+// disabled.
+func slowdown(alert config.DurationAlert, duration time.Duration,
+	previous []deployer.HistoryEntry) *Slowdown {
+
+	minSamples := alert.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultMinSamples
+	}
+
+	if alert.Factor == 0 || len(previous) < minSamples {
+		return nil
+	}
+
+	p95 := P95(previous)
+	if p95 <= 0 {
+		return nil
+	}
+
+	factor := float64(duration) / float64(p95)
+	if factor <= alert.Factor {
+		return nil
+	}
+
+	return &Slowdown{
+		P95:     p95,
+		Factor:  factor,
+		Samples: len(previous),
+	}
+}
+
+// P95 returns the 95th percentile of the durations of the deployments, with
+// the nearest-rank method.
+func P95(history []deployer.HistoryEntry) time.Duration {
+	if len(history) == 0 {
+		return 0
+	}
+
+	durations := make([]time.Duration, len(history))
+	for i, entry := range history {
+		durations[i] = entry.Duration
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	// rank is ceil(0.95 * n), from 1
+	rank := (95*len(durations) + 99) / 100
+
+	return durations[rank-1]
+}
+
+// SignatureHeader is the header that contains the signature of the callbacks,
+// as "sha256=<hex HMAC of the body>".
+const SignatureHeader = "X-Hodor-Signature"
+
+// callbackTimeout bounds each callback, so that a hanging callback doesn't
+// delay the shutdown
+const callbackTimeout = time.Second * 30
+
+// notifyTimeout bounds each request of the notifiers, which are called one
+// after the other, so that a hanging service doesn't block the next
+// notifications nor delay the shutdown
+var notifyTimeout = time.Second * 30
+
+// NewCallbackDispatcher returns a new initialized dispatcher that posts the
+// final status of the jobs to their callback URL. The callbacks are signed
+// with secret, if not empty.
+func NewCallbackDispatcher(deployer deployer.Deployer, secret string,
+	client HTTPClient, logger zerolog.Logger) Dispatcher {
+
+	logger = logger.With().Str("role", "callback").Logger()
+
+	return &CallbackDispatcher{
+		deployer: deployer,
+		secret:   secret,
+		client:   client,
+		logger:   logger,
+		quit:     make(chan struct{}),
+	}
+}
+
+// CallbackDispatcher implements a dispatcher that posts the job event, as
+// JSON, once a job with a callback URL reaches a terminal status. Callbacks
+// are best effort and are not retried.
+//
+// - implements notifier.Dispatcher
+type CallbackDispatcher struct {
+	deployer deployer.Deployer
+	secret   string
+	client   HTTPClient
+	logger   zerolog.Logger
+	quit     chan struct{}
+	pending  sync.WaitGroup
+}
+
+// Start implements notifier.Dispatcher. This is a blocking function that
+// returns once Stop has been called and the pending callbacks are done.
+func (d *CallbackDispatcher) Start() {
+	events, unsubscribe := d.deployer.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-d.quit:
+			d.pending.Wait()
+			return
+		case event := <-events:
+			if event.CallbackURL == "" || !deployer.IsTerminal(event.Status) {
+				continue
+			}
+
+			// a slow callback must not delay the others
+			d.pending.Add(1)
+			go func() {
+				defer d.pending.Done()
+
+				err := d.callback(event)
+				if err != nil {
+					logger := logs.WithJob(d.logger, event.JobID, event.ReleaseID,
+						event.Tag, event.RequestID)
+					logger.Err(err).Msg("failed to call back")
+				}
+			}()
+		}
+	}
+}
+
+// Stop implements notifier.Dispatcher
+func (d *CallbackDispatcher) Stop() {
+	close(d.quit)
+}
+
+// callback posts the event to its callback URL
+func (d *CallbackDispatcher) callback(event deployer.JobEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, event.CallbackURL,
+		bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if d.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(d.secret, buf))
+	}
+
+	return send(d.client, req)
+}
+
+// Sign returns the signature of the body, as set in the SignatureHeader of
+// the callbacks.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewGrafanaNotifier returns a new initialized notifier that posts Grafana
+// annotations
+func NewGrafanaNotifier(conf config.GrafanaConfig, client HTTPClient) Notifier {
+	return GrafanaNotifier{
+		conf:   conf,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// GrafanaNotifier implements a notifier that posts an annotation to Grafana's
+// HTTP API, so that dashboards show the deployments.
+//
+// - implements notifier.Notifier
+type GrafanaNotifier struct {
+	conf   config.GrafanaConfig
+	client HTTPClient
+	now    func() time.Time
+}
+
+// grafanaAnnotation is the body of a Grafana annotation request
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+// Notify implements notifier.Notifier
+func (n GrafanaNotifier) Notify(deployment Deployment) error {
+	tags := append([]string{}, n.conf.Tags...)
+	tags = append(tags, deployment.ReleaseID, deployment.Tag)
+
+	if deployment.Slow != nil {
+		tags = append(tags, "slow")
+	}
+
+	annotation := grafanaAnnotation{
+		DashboardUID: n.conf.DashboardUID,
+		Time:         n.now().UnixNano() / int64(time.Millisecond),
+		Tags:         tags,
+		Text:         "Deployed " + deployment.Summary(),
+	}
+
+	buf, err := json.Marshal(&annotation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal annotation: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(n.conf.URL, "/")+"/api/annotations", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if n.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.conf.Token)
+	}
+
+	return send(n.client, req)
+}
+
+// NewDurationAlertNotifier returns a new initialized notifier that posts the
+// slow deployments to the URL of the alert
+func NewDurationAlertNotifier(conf config.DurationAlert, client HTTPClient) Notifier {
+	return DurationAlertNotifier{
+		conf:   conf,
+		client: client,
+	}
+}
+
+// DurationAlertNotifier implements a notifier that posts the deployments
+// marked as slow by the dispatcher, and ignores the others.
+//
+// - implements notifier.Notifier
+type DurationAlertNotifier struct {
+	conf   config.DurationAlert
+	client HTTPClient
+}
+
+// durationAlert is the body of an alert. Durations are in nanoseconds.
+type durationAlert struct {
+	deployer.HistoryEntry
+	Slowdown
+	JobURL string `json:"jobURL,omitempty"`
+	// Text is the summary of the deployment, for chat webhooks
+	Text string `json:"text"`
+}
+
+// Notify implements notifier.Notifier
+func (n DurationAlertNotifier) Notify(deployment Deployment) error {
+	if deployment.Slow == nil {
+		return nil
+	}
+
+	alert := durationAlert{
+		HistoryEntry: deployment.HistoryEntry,
+		Slowdown:     *deployment.Slow,
+		JobURL:       deployment.JobURL,
+		Text:         "Slow deployment " + deployment.Summary(),
+	}
+
+	buf, err := json.Marshal(&alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.conf.URL, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, value := range n.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	return send(n.client, req)
+}
+
+// cloudflareAPI is the base URL of Cloudflare's API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// NewPurgeNotifier returns a new initialized notifier that purges the CDN
+// caches of the deployed releases
+func NewPurgeNotifier(entries map[string]config.Entry, client HTTPClient) Notifier {
+	return PurgeNotifier{
+		entries:       entries,
+		client:        client,
+		cloudflareAPI: cloudflareAPI,
+	}
+}
+
+// PurgeNotifier implements a notifier that purges the Cloudflare zones and
+// calls the purge endpoints of the release's entry, so that users get the new
+// content immediately.
+//
+// - implements notifier.Notifier
+type PurgeNotifier struct {
+	entries       map[string]config.Entry
+	client        HTTPClient
+	cloudflareAPI string
+}
+
+// cloudflarePurgeRequest is the body of a Cloudflare purge request
+type cloudflarePurgeRequest struct {
+	PurgeEverything bool     `json:"purge_everything,omitempty"`
+	Files           []string `json:"files,omitempty"`
+}
+
+// Notify implements notifier.Notifier. All the caches are purged even if one
+// fails, in which case the errors are returned.
+func (n PurgeNotifier) Notify(deployment Deployment) error {
+	purge := n.entries[deployment.ReleaseID].Purge
+
+	var errs []string
+
+	for _, zone := range purge.Cloudflare {
+		err := n.purgeCloudflare(zone)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to purge zone %q: %v", zone.ZoneID, err))
+		}
+	}
+
+	for _, endpoint := range purge.Endpoints {
+		err := n.purgeEndpoint(endpoint)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to purge %q: %v", endpoint.URL, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to purge: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// purgeCloudflare purges the files of a zone, or everything if no file is set
+func (n PurgeNotifier) purgeCloudflare(zone config.CloudflarePurge) error {
+	purgeReq := cloudflarePurgeRequest{
+		PurgeEverything: len(zone.Files) == 0,
+		Files:           zone.Files,
+	}
+
+	buf, err := json.Marshal(&purgeReq)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		n.cloudflareAPI+"/zones/"+zone.ZoneID+"/purge_cache", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+zone.Token)
+
+	return send(n.client, req)
+}
+
+// purgeEndpoint sends the request of a purge endpoint
+func (n PurgeNotifier) purgeEndpoint(endpoint config.PurgeEndpoint) error {
+	method := endpoint.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	var body io.Reader
+
+	if endpoint.Body != "" {
+		body = strings.NewReader(endpoint.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.URL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	for k, v := range endpoint.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return send(n.client, req)
+}
+
+// hookSignatureHeader is the header of the signature of the forwarded hooks,
+// as checked by the server
+const hookSignatureHeader = "X-Hub-Signature-256"
+
+// NewForwardNotifier returns a new initialized notifier that forwards the
+// deployed releases to other Hodor instances
+func NewForwardNotifier(entries map[string]config.Entry, client HTTPClient) Notifier {
+	return ForwardNotifier{
+		entries: entries,
+		client:  client,
+	}
+}
+
+// ForwardNotifier implements a notifier that sends a hook to the instances of
+// the release's entry, so that they deploy the same release, such as a
+// production instance after a staging one. Rollbacks are not forwarded.
+//
+// - implements notifier.Notifier
+type ForwardNotifier struct {
+	entries map[string]config.Entry
+	client  HTTPClient
+}
+
+// forwardedHook is the body of a forwarded hook, as a GitHub release. It
+// carries the digest of the deployed archive, so that the instance deploys the
+// same bytes.
+type forwardedHook struct {
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Tag                string `json:"tag"`
+	Body               string `json:"body,omitempty"`
+	Subpath            string `json:"subpath,omitempty"`
+	SHA256             string `json:"sha256,omitempty"`
+}
+
+// Notify implements notifier.Notifier. The hook is sent to all the instances
+// even if one fails, in which case the errors are returned.
+func (n ForwardNotifier) Notify(deployment Deployment) error {
+	if deployment.ReleaseURL == "" {
+		return nil
+	}
+
+	hook := forwardedHook{
+		BrowserDownloadURL: deployment.ReleaseURL,
+		Tag:                deployment.Tag,
+		Body:               deployment.Notes,
+		Subpath:            deployment.Subpath,
+	}
+
+	if deployment.Provenance != nil {
+		hook.SHA256 = deployment.Provenance.SHA256
+	}
+
+	buf, err := json.Marshal(hook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook: %v", err)
+	}
+
+	var errs []string
+
+	for _, forward := range n.entries[deployment.ReleaseID].Forward {
+		err := n.forward(forward, buf)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to forward to %q: %v", forward.URL, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to forward: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// forward sends the hook to an instance
+func (n ForwardNotifier) forward(forward config.Forward, hook []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, forward.URL, bytes.NewReader(hook))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if forward.Secret != "" {
+		req.Header.Set(hookSignatureHeader, Sign(forward.Secret, hook))
+	}
+
+	if forward.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+forward.Token)
+	}
+
+	return send(n.client, req)
+}
+
+// defaultKVPrefix is the prefix of the discovery keys if not configured
+const defaultKVPrefix = "hodor/releases/"
+
+// NewConsulNotifier returns a new initialized notifier that saves the
+// deployed tags in Consul's KV store
+func NewConsulNotifier(conf config.KVConfig, client HTTPClient) Notifier {
+	return ConsulNotifier{
+		conf:   conf,
+		client: client,
+	}
+}
+
+// ConsulNotifier implements a notifier that saves the tag of the deployed
+// release in Consul's KV store, so that other systems can discover what is
+// running.
+//
+// - implements notifier.Notifier
+type ConsulNotifier struct {
+	conf   config.KVConfig
+	client HTTPClient
+}
+
+// Notify implements notifier.Notifier
+func (n ConsulNotifier) Notify(deployment Deployment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		strings.TrimSuffix(n.conf.URL, "/")+"/v1/kv/"+kvKey(n.conf, deployment.ReleaseID),
+		strings.NewReader(deployment.Tag))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	if n.conf.Token != "" {
+		req.Header.Set("X-Consul-Token", n.conf.Token)
+	}
+
+	return send(n.client, req)
+}
+
+// NewEtcdNotifier returns a new initialized notifier that saves the deployed
+// tags in etcd
+func NewEtcdNotifier(conf config.KVConfig, client HTTPClient) Notifier {
+	return EtcdNotifier{
+		conf:   conf,
+		client: client,
+	}
+}
+
+// EtcdNotifier implements a notifier that saves the tag of the deployed
+// release in etcd, with the v3 HTTP gateway.
+//
+// - implements notifier.Notifier
+type EtcdNotifier struct {
+	conf   config.KVConfig
+	client HTTPClient
+}
+
+// etcdPutRequest is the body of an etcd put request. []byte values are
+// base64 encoded, as expected by the gateway.
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Notify implements notifier.Notifier
+func (n EtcdNotifier) Notify(deployment Deployment) error {
+	putReq := etcdPutRequest{
+		Key:   []byte(kvKey(n.conf, deployment.ReleaseID)),
+		Value: []byte(deployment.Tag),
+	}
+
+	buf, err := json.Marshal(&putReq)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(n.conf.URL, "/")+"/v3/kv/put", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if n.conf.Token != "" {
+		req.Header.Set("Authorization", n.conf.Token)
+	}
+
+	return send(n.client, req)
+}
+
+// kvKey returns the discovery key of a release
+func kvKey(conf config.KVConfig, releaseID string) string {
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = defaultKVPrefix
+	}
+
+	return prefix + releaseID
+}
+
+// send sends the request and returns an error if the response is not
+// successful
+func send(client HTTPClient, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", res.Status, body)
+	}
+
+	return nil
+}
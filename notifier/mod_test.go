@@ -0,0 +1,594 @@
+package notifier
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcher_Scenario(t *testing.T) {
+	events := make(chan deployer.JobEvent, 3)
+	notifier := &fakeNotifier{}
+	failing := &fakeNotifier{err: errors.New("fake")}
+	log := new(bytes.Buffer)
+
+	history := []deployer.HistoryEntry{{JobID: "CC", ReleaseID: "XX"}}
+
+	dispatcher := NewEventDispatcher(fakeDeployer{events: events, history: history},
+		[]Notifier{failing, notifier}, "http://hodor/", config.DurationAlert{},
+		zerolog.New(log))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		dispatcher.Start()
+	}()
+
+	events <- deployer.JobEvent{JobID: "AA", JobStatus: deployer.JobStatus{Status: "created"}}
+	events <- deployer.JobEvent{JobID: "BB", JobStatus: deployer.JobStatus{Status: "failed"}}
+	events <- deployer.JobEvent{JobID: "CC", ReleaseID: "XX", JobStatus: deployer.JobStatus{Status: "ok"}}
+
+	time.Sleep(time.Millisecond * 100)
+
+	dispatcher.Stop()
+	wait.Wait()
+
+	require.Equal(t, []string{"http://hodor/api/status/CC"}, notifier.getJobURLs())
+	require.Contains(t, log.String(), "failed to notify with *notifier.fakeNotifier")
+	require.Contains(t, log.String(), `"jobID":"CC"`)
+}
+
+func TestDispatcher_Not_In_History(t *testing.T) {
+	log := new(bytes.Buffer)
+
+	dispatcher := EventDispatcher{
+		deployer: fakeDeployer{},
+		logger:   zerolog.New(log),
+	}
+
+	dispatcher.notify(deployer.JobEvent{JobID: "AA"})
+
+	require.Contains(t, log.String(), `failed to get deployment`)
+	require.Contains(t, log.String(), `job \"AA\" not found in the history`)
+}
+
+func TestDispatcher_Release_URL(t *testing.T) {
+	history := []deployer.HistoryEntry{{JobID: "AA", ReleaseID: "XX"}}
+
+	dispatcher := EventDispatcher{
+		deployer: fakeDeployer{history: history},
+	}
+
+	deployment, err := dispatcher.getDeployment(deployer.JobEvent{JobID: "AA",
+		ReleaseID: "XX", ReleaseURL: "http://xx/release.tar.gz"})
+	require.NoError(t, err)
+	require.Equal(t, "http://xx/release.tar.gz", deployment.ReleaseURL)
+}
+
+func TestDispatcher_Slow(t *testing.T) {
+	log := new(bytes.Buffer)
+
+	history := []deployer.HistoryEntry{
+		{JobID: "EE", Duration: time.Second * 30},
+		{JobID: "DD", Duration: time.Second * 7},
+		{JobID: "CC", Duration: time.Second * 2},
+		{JobID: "BB", Duration: time.Second * 3},
+		{JobID: "AA", Duration: time.Second},
+	}
+
+	dispatcher := EventDispatcher{
+		deployer: fakeDeployer{history: history},
+		alert:    config.DurationAlert{Factor: 3, MinSamples: 4},
+		logger:   zerolog.New(log),
+	}
+
+	deployment, err := dispatcher.getDeployment(deployer.JobEvent{JobID: "EE"})
+	require.NoError(t, err)
+	require.Equal(t, &Slowdown{P95: time.Second * 7, Factor: 30.0 / 7, Samples: 4},
+		deployment.Slow)
+
+	// below the factor
+	deployment, err = dispatcher.getDeployment(deployer.JobEvent{JobID: "DD"})
+	require.NoError(t, err)
+	require.Nil(t, deployment.Slow)
+
+	// not enough samples
+	deployment, err = dispatcher.getDeployment(deployer.JobEvent{JobID: "CC"})
+	require.NoError(t, err)
+	require.Nil(t, deployment.Slow)
+
+	dispatcher.notify(deployer.JobEvent{JobID: "EE"})
+	require.Contains(t, log.String(), `"level":"warn"`)
+	require.Contains(t, log.String(), "deployment is 4.3 times slower than the p95")
+
+	// disabled
+	dispatcher.alert = config.DurationAlert{}
+
+	deployment, err = dispatcher.getDeployment(deployer.JobEvent{JobID: "EE"})
+	require.NoError(t, err)
+	require.Nil(t, deployment.Slow)
+}
+
+func TestP95(t *testing.T) {
+	history := make([]deployer.HistoryEntry, 20)
+	for i := range history {
+		history[i].Duration = time.Duration(20-i) * time.Second
+	}
+
+	require.Equal(t, time.Second*19, P95(history))
+	require.Equal(t, time.Second*20, P95(history[:1]))
+	require.Equal(t, time.Duration(0), P95(nil))
+}
+
+func TestCallbackDispatcher_Scenario(t *testing.T) {
+	var header string
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(SignatureHeader)
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	events := make(chan deployer.JobEvent, 3)
+
+	dispatcher := NewCallbackDispatcher(fakeDeployer{events: events}, "secret",
+		http.DefaultClient, zerolog.New(io.Discard))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		dispatcher.Start()
+	}()
+
+	events <- deployer.JobEvent{JobID: "AA", CallbackURL: server.URL,
+		JobStatus: deployer.JobStatus{Status: "running"}}
+	events <- deployer.JobEvent{JobID: "BB", JobStatus: deployer.JobStatus{Status: "ok"}}
+	events <- deployer.JobEvent{JobID: "AA", CallbackURL: server.URL,
+		JobStatus: deployer.JobStatus{Status: "failed", Message: "fake"}}
+
+	time.Sleep(time.Millisecond * 100)
+
+	dispatcher.Stop()
+	wait.Wait()
+
+	require.Equal(t, `{"jobID":"AA","releaseID":"","tag":"","status":"failed","message":"fake"}`,
+		string(body))
+	require.Equal(t, Sign("secret", body), header)
+}
+
+func TestCallbackDispatcher_Fail(t *testing.T) {
+	dispatcher := CallbackDispatcher{client: fakeClient{err: errors.New("fake")}}
+
+	err := dispatcher.callback(deployer.JobEvent{CallbackURL: "http://xx"})
+	require.EqualError(t, err, "failed to send request: fake")
+}
+
+func TestSign(t *testing.T) {
+	require.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestDeployment_Summary(t *testing.T) {
+	deployment := Deployment{
+		HistoryEntry: deployer.HistoryEntry{
+			ReleaseID:   "XX",
+			Tag:         "v2",
+			PreviousTag: "v1",
+			Duration:    time.Millisecond * 1234,
+			Changes:     deployer.Changes{Added: 1, Changed: 2, Removed: 3},
+		},
+		JobURL: "http://hodor/api/status/AA",
+	}
+
+	require.Equal(t, "XX v1 → v2 in 1.234s: 1 added, 2 changed, 3 removed "+
+		"http://hodor/api/status/AA", deployment.Summary())
+}
+
+func TestGrafanaNotifier_Pass(t *testing.T) {
+	var req *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := GrafanaNotifier{
+		conf: config.GrafanaConfig{
+			URL:          server.URL + "/",
+			Token:        "TOKEN",
+			DashboardUID: "DASH",
+			Tags:         []string{"deploy"},
+		},
+		client: http.DefaultClient,
+		now:    func() time.Time { return time.Unix(1, 0) },
+	}
+
+	err := notifier.Notify(Deployment{
+		HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX", Tag: "v1", PreviousTag: "v0"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "/api/annotations", req.URL.Path)
+	require.Equal(t, "Bearer TOKEN", req.Header.Get("Authorization"))
+	require.Equal(t, `{"dashboardUID":"DASH","time":1000,"tags":["deploy","XX","v1"],`+
+		`"text":"Deployed XX v0 → v1 in 0s: 0 added, 0 changed, 0 removed"}`, string(body))
+}
+
+// A hanging service must not block the notifications that follow
+func TestGrafanaNotifier_Timeout(t *testing.T) {
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	defer func(timeout time.Duration) {
+		notifyTimeout = timeout
+	}(notifyTimeout)
+
+	notifyTimeout = time.Millisecond * 100
+
+	notifier := GrafanaNotifier{
+		conf:   config.GrafanaConfig{URL: server.URL},
+		client: http.DefaultClient,
+		now:    time.Now,
+	}
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"}})
+	require.ErrorContains(t, err, "context deadline exceeded")
+}
+
+func TestGrafanaNotifier_Slow(t *testing.T) {
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := GrafanaNotifier{
+		conf:   config.GrafanaConfig{URL: server.URL},
+		client: http.DefaultClient,
+		now:    func() time.Time { return time.Unix(1, 0) },
+	}
+
+	err := notifier.Notify(Deployment{
+		HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX", Tag: "v1", PreviousTag: "v0",
+			Duration: time.Second * 9},
+		Slow: &Slowdown{P95: time.Second * 2, Factor: 4.5, Samples: 5},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, `{"time":1000,"tags":["XX","v1","slow"],`+
+		`"text":"Deployed XX v0 → v1 in 9s: 0 added, 0 changed, 0 removed `+
+		`(slow: 4.5× p95 of 2s)"}`, string(body))
+}
+
+func TestGrafanaNotifier_Status_Fail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no permission", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	notifier := NewGrafanaNotifier(config.GrafanaConfig{URL: server.URL}, http.DefaultClient)
+
+	err := notifier.Notify(Deployment{})
+	require.EqualError(t, err, "unexpected status \"403 Forbidden\": no permission\n")
+}
+
+func TestGrafanaNotifier_Send_Fail(t *testing.T) {
+	notifier := NewGrafanaNotifier(config.GrafanaConfig{URL: "http://xx"},
+		fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{})
+	require.EqualError(t, err, "failed to send request: fake")
+}
+
+func TestDurationAlertNotifier_Pass(t *testing.T) {
+	var req *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := NewDurationAlertNotifier(config.DurationAlert{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer TOKEN"},
+	}, http.DefaultClient)
+
+	// not slow
+	err := notifier.Notify(Deployment{})
+	require.NoError(t, err)
+	require.Nil(t, req)
+
+	err = notifier.Notify(Deployment{
+		HistoryEntry: deployer.HistoryEntry{JobID: "AA", ReleaseID: "XX", Tag: "v1",
+			PreviousTag: "v0", DeployedAt: time.Unix(1, 0).UTC(), Duration: time.Second * 9},
+		JobURL: "http://hodor/api/status/AA",
+		Slow:   &Slowdown{P95: time.Second * 2, Factor: 4.5, Samples: 5},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "Bearer TOKEN", req.Header.Get("Authorization"))
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	require.Equal(t, `{"jobID":"AA","releaseID":"XX","tag":"v1","previousTag":"v0",`+
+		`"deployedAt":"1970-01-01T00:00:01Z","duration":9000000000,`+
+		`"changes":{"added":0,"changed":0,"removed":0},"p95":2000000000,"factor":4.5,`+
+		`"samples":5,"jobURL":"http://hodor/api/status/AA","text":"Slow deployment `+
+		`XX v0 → v1 in 9s: 0 added, 0 changed, 0 removed (slow: 4.5× p95 of 2s) `+
+		`http://hodor/api/status/AA"}`, string(body))
+}
+
+func TestDurationAlertNotifier_Fail(t *testing.T) {
+	notifier := NewDurationAlertNotifier(config.DurationAlert{URL: "http://xx"},
+		fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{Slow: &Slowdown{}})
+	require.EqualError(t, err, "failed to send request: fake")
+}
+
+func TestPurgeNotifier_Pass(t *testing.T) {
+	var paths, bodies, auths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, string(body))
+		auths = append(auths, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	entries := map[string]config.Entry{
+		"XX": {
+			Purge: config.Purge{
+				Cloudflare: []config.CloudflarePurge{
+					{ZoneID: "Z1", Token: "T1"},
+					{ZoneID: "Z2", Token: "T2", Files: []string{"https://xx/index.html"}},
+				},
+				Endpoints: []config.PurgeEndpoint{
+					{URL: server.URL + "/purge", Method: "PURGE",
+						Headers: map[string]string{"Authorization": "T3"}, Body: "all"},
+				},
+			},
+		},
+	}
+
+	notifier := PurgeNotifier{
+		entries:       entries,
+		client:        http.DefaultClient,
+		cloudflareAPI: server.URL,
+	}
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"}})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"POST /zones/Z1/purge_cache",
+		"POST /zones/Z2/purge_cache",
+		"PURGE /purge",
+	}, paths)
+
+	require.Equal(t, []string{
+		`{"purge_everything":true}`,
+		`{"files":["https://xx/index.html"]}`,
+		"all",
+	}, bodies)
+
+	require.Equal(t, []string{"Bearer T1", "Bearer T2", "T3"}, auths)
+}
+
+func TestPurgeNotifier_Not_Configured(t *testing.T) {
+	notifier := NewPurgeNotifier(map[string]config.Entry{}, fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"}})
+	require.NoError(t, err)
+}
+
+func TestPurgeNotifier_Fail(t *testing.T) {
+	entries := map[string]config.Entry{
+		"XX": {
+			Purge: config.Purge{
+				Cloudflare: []config.CloudflarePurge{{ZoneID: "Z1"}},
+				Endpoints:  []config.PurgeEndpoint{{URL: "http://xx"}},
+			},
+		},
+	}
+
+	notifier := NewPurgeNotifier(entries, fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"}})
+	require.EqualError(t, err, "failed to purge: failed to purge zone \"Z1\": "+
+		"failed to send request: fake; failed to purge \"http://xx\": failed to send request: fake")
+}
+
+func TestForwardNotifier_Pass(t *testing.T) {
+	var paths, bodies, signatures, auths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, string(body))
+		signatures = append(signatures, r.Header.Get("X-Hub-Signature-256"))
+		auths = append(auths, r.Header.Get("Authorization"))
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	entries := map[string]config.Entry{
+		"XX": {
+			Forward: []config.Forward{
+				{URL: server.URL + "/api/hook/xx", Secret: "secret"},
+				{URL: server.URL + "/api/hook/yy", Token: "token"},
+			},
+		},
+	}
+
+	notifier := NewForwardNotifier(entries, http.DefaultClient)
+
+	err := notifier.Notify(Deployment{
+		HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX", Tag: "v1", Notes: "fixes",
+			Provenance: &deployer.Provenance{SHA256: "abcd"}},
+		ReleaseURL: "http://xx/release.tar.gz",
+		Subpath:    "docs",
+	})
+	require.NoError(t, err)
+
+	hook := `{"browser_download_url":"http://xx/release.tar.gz","tag":"v1","body":"fixes",` +
+		`"subpath":"docs","sha256":"abcd"}`
+
+	require.Equal(t, []string{"POST /api/hook/xx", "POST /api/hook/yy"}, paths)
+	require.Equal(t, []string{hook, hook}, bodies)
+	require.Equal(t, []string{Sign("secret", []byte(hook)), ""}, signatures)
+	require.Equal(t, []string{"", "Bearer token"}, auths)
+}
+
+func TestForwardNotifier_Rollback(t *testing.T) {
+	entries := map[string]config.Entry{
+		"XX": {Forward: []config.Forward{{URL: "http://xx"}}},
+	}
+
+	notifier := NewForwardNotifier(entries, fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"}})
+	require.NoError(t, err)
+}
+
+func TestForwardNotifier_Fail(t *testing.T) {
+	entries := map[string]config.Entry{
+		"XX": {Forward: []config.Forward{{URL: "http://xx"}, {URL: "http://yy"}}},
+	}
+
+	notifier := NewForwardNotifier(entries, fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{
+		HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX"},
+		ReleaseURL:   "http://xx/release.tar.gz",
+	})
+	require.EqualError(t, err, "failed to forward: failed to forward to \"http://xx\": "+
+		"failed to send request: fake; failed to forward to \"http://yy\": failed to send request: fake")
+}
+
+func TestConsulNotifier_Pass(t *testing.T) {
+	var req *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := NewConsulNotifier(config.KVConfig{URL: server.URL, Token: "TOKEN"},
+		http.DefaultClient)
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX", Tag: "v1"}})
+	require.NoError(t, err)
+
+	require.Equal(t, http.MethodPut, req.Method)
+	require.Equal(t, "/v1/kv/hodor/releases/XX", req.URL.Path)
+	require.Equal(t, "TOKEN", req.Header.Get("X-Consul-Token"))
+	require.Equal(t, "v1", string(body))
+}
+
+func TestEtcdNotifier_Pass(t *testing.T) {
+	var req *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := NewEtcdNotifier(config.KVConfig{URL: server.URL, Prefix: "x/"},
+		http.DefaultClient)
+
+	err := notifier.Notify(Deployment{HistoryEntry: deployer.HistoryEntry{ReleaseID: "XX", Tag: "v1"}})
+	require.NoError(t, err)
+
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "/v3/kv/put", req.URL.Path)
+	require.Empty(t, req.Header.Get("Authorization"))
+	// base64 of "x/XX" and "v1"
+	require.Equal(t, `{"key":"eC9YWA==","value":"djE="}`, string(body))
+}
+
+func TestEtcdNotifier_Fail(t *testing.T) {
+	notifier := NewEtcdNotifier(config.KVConfig{URL: "http://xx"},
+		fakeClient{err: errors.New("fake")})
+
+	err := notifier.Notify(Deployment{})
+	require.EqualError(t, err, "failed to send request: fake")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+type fakeDeployer struct {
+	deployer.Deployer
+
+	events  chan deployer.JobEvent
+	history []deployer.HistoryEntry
+}
+
+func (d fakeDeployer) Subscribe() (<-chan deployer.JobEvent, func()) {
+	return d.events, func() {}
+}
+
+func (d fakeDeployer) GetHistory(releaseID string) ([]deployer.HistoryEntry, error) {
+	return d.history, nil
+}
+
+type fakeNotifier struct {
+	sync.Mutex
+	jobURLs []string
+	err     error
+}
+
+func (n *fakeNotifier) Notify(deployment Deployment) error {
+	n.Lock()
+	defer n.Unlock()
+
+	n.jobURLs = append(n.jobURLs, deployment.JobURL)
+	return n.err
+}
+
+func (n *fakeNotifier) getJobURLs() []string {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.jobURLs
+}
+
+type fakeClient struct {
+	err error
+}
+
+func (c fakeClient) Do(req *http.Request) (*http.Response, error) {
+	return nil, c.err
+}
@@ -0,0 +1,412 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/rs/zerolog"
+)
+
+// Source defines the primitives needed to get the deployments of a release
+type Source interface {
+	GetHistory(releaseID string) ([]deployer.HistoryEntry, error)
+	GetFailures(releaseID string) ([]deployer.Failure, error)
+}
+
+// Sender defines the primitive needed to send a report
+type Sender interface {
+	Send(report Report) error
+}
+
+// Scheduler defines the primitives needed to periodically send reports
+type Scheduler interface {
+	// Start must be called only once to start the scheduling loop
+	Start()
+	// Stop must be called only once and when start has been called
+	Stop()
+}
+
+// Report summarizes the deployments of a period
+type Report struct {
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Releases []ReleaseReport `json:"releases"`
+}
+
+// ReleaseReport summarizes the deployments of a release
+type ReleaseReport struct {
+	ReleaseID   string `json:"releaseID"`
+	Deployments int    `json:"deployments"`
+	Failures    int    `json:"failures"`
+	// MeanDuration is the mean duration of the successful deployments
+	MeanDuration time.Duration `json:"meanDuration"`
+}
+
+// Subject returns the title of the report
+func (r Report) Subject() string {
+	return fmt.Sprintf("Hodor report from %s to %s", r.From.Format(dateFormat),
+		r.To.Format(dateFormat))
+}
+
+// String returns the report as a text table
+func (r Report) String() string {
+	buf := new(strings.Builder)
+
+	fmt.Fprintf(buf, "%s (%s)\n\n", r.Subject(), r.From.Location())
+
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "release\tdeployments\tfailures\tmean duration")
+
+	for _, release := range r.Releases {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", release.ReleaseID, release.Deployments,
+			release.Failures, release.MeanDuration.Round(time.Millisecond))
+	}
+
+	w.Flush()
+
+	return buf.String()
+}
+
+// dateFormat is the format of the report's dates
+const dateFormat = "2006-01-02 15:04"
+
+// Generate returns the report of the deployments made in [from, to) for the
+// releases.
+func Generate(source Source, releaseIDs []string, from, to time.Time) (Report, error) {
+	report := Report{
+		From:     from,
+		To:       to,
+		Releases: make([]ReleaseReport, 0, len(releaseIDs)),
+	}
+
+	inPeriod := func(t time.Time) bool {
+		return !t.Before(from) && t.Before(to)
+	}
+
+	sorted := append([]string{}, releaseIDs...)
+	sort.Strings(sorted)
+
+	for _, releaseID := range sorted {
+		release := ReleaseReport{ReleaseID: releaseID}
+
+		history, err := source.GetHistory(releaseID)
+		if err != nil {
+			return report, fmt.Errorf("failed to get history of %q: %v", releaseID, err)
+		}
+
+		var total time.Duration
+
+		for _, entry := range history {
+			if inPeriod(entry.DeployedAt) {
+				release.Deployments++
+				total += entry.Duration
+			}
+		}
+
+		if release.Deployments != 0 {
+			release.MeanDuration = total / time.Duration(release.Deployments)
+		}
+
+		failures, err := source.GetFailures(releaseID)
+		if err != nil {
+			return report, fmt.Errorf("failed to get failures of %q: %v", releaseID, err)
+		}
+
+		for _, failure := range failures {
+			if inPeriod(failure.FailedAt) {
+				release.Failures++
+			}
+		}
+
+		report.Releases = append(report.Releases, release)
+	}
+
+	return report, nil
+}
+
+// schedule defines when reports are generated
+type schedule struct {
+	weekly   bool
+	weekday  time.Weekday
+	hour     int
+	minute   int
+	location *time.Location
+}
+
+// weekdays maps the configured weekdays
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseSchedule returns the schedule of the config
+func parseSchedule(conf config.ReportConfig) (schedule, error) {
+	s := schedule{
+		weekday:  time.Monday,
+		hour:     8,
+		location: time.Local,
+	}
+
+	switch conf.Period {
+	case "daily":
+	case "weekly":
+		s.weekly = true
+	default:
+		return s, fmt.Errorf("unknown period %q", conf.Period)
+	}
+
+	if conf.Time != "" {
+		t, err := time.Parse("15:04", conf.Time)
+		if err != nil {
+			return s, fmt.Errorf("failed to parse time: %v", err)
+		}
+
+		s.hour, s.minute = t.Hour(), t.Minute()
+	}
+
+	if conf.Weekday != "" {
+		weekday, found := weekdays[strings.ToLower(conf.Weekday)]
+		if !found {
+			return s, fmt.Errorf("unknown weekday %q", conf.Weekday)
+		}
+
+		s.weekday = weekday
+	}
+
+	if conf.Timezone != "" {
+		location, err := time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return s, fmt.Errorf("failed to load timezone: %v", err)
+		}
+
+		s.location = location
+	}
+
+	return s, nil
+}
+
+// next returns the first report time strictly after now
+func (s schedule) next(now time.Time) time.Time {
+	now = now.In(s.location)
+
+	t := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, s.location)
+
+	for !t.After(now) || (s.weekly && t.Weekday() != s.weekday) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, s.hour, s.minute, 0, 0, s.location)
+	}
+
+	return t
+}
+
+// previous returns the start of the period that ends at t. Days are used
+// instead of 24 hours to handle daylight saving time.
+func (s schedule) previous(t time.Time) time.Time {
+	if s.weekly {
+		return t.AddDate(0, 0, -7)
+	}
+
+	return t.AddDate(0, 0, -1)
+}
+
+// NewPeriodicReporter returns a new initialized scheduler that sends the
+// report of the releases with each sender, as configured.
+func NewPeriodicReporter(source Source, releaseIDs []string, conf config.ReportConfig,
+	senders []Sender, logger zerolog.Logger) (Scheduler, error) {
+
+	schedule, err := parseSchedule(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedule: %v", err)
+	}
+
+	logger = logger.With().Str("role", "report").Logger()
+
+	return &PeriodicReporter{
+		source:     source,
+		releaseIDs: releaseIDs,
+		schedule:   schedule,
+		senders:    senders,
+		logger:     logger,
+		quit:       make(chan struct{}),
+	}, nil
+}
+
+// PeriodicReporter implements a scheduler that sends the reports daily or
+// weekly.
+//
+// - implements report.Scheduler
+type PeriodicReporter struct {
+	source     Source
+	releaseIDs []string
+	schedule   schedule
+	senders    []Sender
+	logger     zerolog.Logger
+	quit       chan struct{}
+}
+
+// Start implements report.Scheduler. This is a blocking function that returns
+// once Stop has been called.
+func (pr *PeriodicReporter) Start() {
+	next := pr.schedule.next(time.Now())
+
+	for {
+		pr.logger.Info().Msgf("next report at %s", next)
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-pr.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+			err := pr.send(pr.schedule.previous(next), next)
+			if err != nil {
+				pr.logger.Err(err).Msg("failed to send report")
+			}
+		}
+
+		next = pr.schedule.next(next)
+	}
+}
+
+// Stop implements report.Scheduler
+func (pr *PeriodicReporter) Stop() {
+	close(pr.quit)
+}
+
+// send generates the report of [from, to) and sends it with all the senders.
+// A failing sender doesn't stop the others.
+func (pr *PeriodicReporter) send(from, to time.Time) error {
+	report, err := Generate(pr.source, pr.releaseIDs, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to generate report: %v", err)
+	}
+
+	var errs []string
+
+	for _, sender := range pr.senders {
+		err = sender.Send(report)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to send: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// NewEmailSender returns a new initialized sender that sends the reports by
+// email
+func NewEmailSender(conf config.EmailConfig) Sender {
+	return EmailSender{
+		conf:     conf,
+		sendMail: smtp.SendMail,
+	}
+}
+
+// EmailSender implements a sender that sends the reports as plain text
+// emails, with an SMTP server.
+//
+// - implements report.Sender
+type EmailSender struct {
+	conf     config.EmailConfig
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Send implements report.Sender
+func (s EmailSender) Send(report Report) error {
+	var auth smtp.Auth
+
+	if s.conf.Username != "" {
+		host := strings.Split(s.conf.Host, ":")[0]
+		auth = smtp.PlainAuth("", s.conf.Username, s.conf.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		s.conf.From, strings.Join(s.conf.To, ", "), report.Subject(),
+		strings.ReplaceAll(report.String(), "\n", "\r\n"))
+
+	err := s.sendMail(s.conf.Host, auth, s.conf.From, s.conf.To, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+
+	return nil
+}
+
+// HTTPClient defines the function we expect from an HTTP client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// NewWebhookSender returns a new initialized sender that posts the reports to
+// a URL
+func NewWebhookSender(url string, client HTTPClient) Sender {
+	return WebhookSender{
+		url:    url,
+		client: client,
+	}
+}
+
+// WebhookSender implements a sender that posts the reports as JSON, with the
+// text version in the "text" field.
+//
+// - implements report.Sender
+type WebhookSender struct {
+	url    string
+	client HTTPClient
+}
+
+// webhookReport is the body of a webhook request
+type webhookReport struct {
+	Report
+	Text string `json:"text"`
+}
+
+// Send implements report.Sender
+func (s WebhookSender) Send(report Report) error {
+	buf, err := json.Marshal(webhookReport{Report: report, Text: report.String()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", res.Status, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	from := time.Date(2022, 1, 1, 8, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	source := fakeSource{
+		history: map[string][]deployer.HistoryEntry{
+			"XX": {
+				{DeployedAt: to, Duration: time.Hour},
+				{DeployedAt: from.Add(time.Hour), Duration: time.Second},
+				{DeployedAt: from, Duration: time.Second * 3},
+				{DeployedAt: from.Add(-time.Second), Duration: time.Hour},
+			},
+		},
+		failures: map[string][]deployer.Failure{
+			"XX": {{FailedAt: from.Add(time.Minute)}},
+			"YY": {{FailedAt: from.Add(time.Minute)}, {FailedAt: to}},
+		},
+	}
+
+	report, err := Generate(source, []string{"YY", "XX"}, from, to)
+	require.NoError(t, err)
+
+	require.Equal(t, []ReleaseReport{
+		{ReleaseID: "XX", Deployments: 2, Failures: 1, MeanDuration: time.Second * 2},
+		{ReleaseID: "YY", Failures: 1},
+	}, report.Releases)
+
+	require.Equal(t, "Hodor report from 2022-01-01 08:00 to 2022-01-02 08:00 (UTC)\n\n"+
+		"release  deployments  failures  mean duration\n"+
+		"XX       2            1         2s\n"+
+		"YY       0            1         0s\n", report.String())
+}
+
+func TestGenerate_Fail(t *testing.T) {
+	_, err := Generate(fakeSource{err: errors.New("fake")}, []string{"XX"},
+		time.Time{}, time.Time{})
+	require.EqualError(t, err, "failed to get history of \"XX\": fake")
+}
+
+func TestSchedule_Next(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+
+	daily, err := parseSchedule(config.ReportConfig{
+		Period:   "daily",
+		Time:     "09:30",
+		Timezone: "Europe/Zurich",
+	})
+	require.NoError(t, err)
+
+	// 2022-01-03 is a monday, at 09:00 in Zurich
+	now := time.Date(2022, 1, 3, 8, 0, 0, 0, time.UTC)
+
+	next := daily.next(now)
+	require.Equal(t, time.Date(2022, 1, 3, 9, 30, 0, 0, zurich), next)
+	require.Equal(t, time.Date(2022, 1, 2, 9, 30, 0, 0, zurich), daily.previous(next))
+
+	next = daily.next(next)
+	require.Equal(t, time.Date(2022, 1, 4, 9, 30, 0, 0, zurich), next)
+
+	weekly, err := parseSchedule(config.ReportConfig{
+		Period:  "weekly",
+		Weekday: "Friday",
+	})
+	require.NoError(t, err)
+
+	next = weekly.next(now)
+	require.Equal(t, time.Date(2022, 1, 7, 8, 0, 0, 0, time.Local), next)
+	require.Equal(t, time.Date(2021, 12, 31, 8, 0, 0, 0, time.Local), weekly.previous(next))
+}
+
+func TestSchedule_Next_DST(t *testing.T) {
+	daily, err := parseSchedule(config.ReportConfig{
+		Period:   "daily",
+		Timezone: "Europe/Zurich",
+	})
+	require.NoError(t, err)
+
+	// the clocks go forward on 2022-03-27 at 02:00
+	next := daily.next(time.Date(2022, 3, 26, 12, 0, 0, 0, time.UTC))
+	require.Equal(t, "2022-03-27T08:00:00+02:00", next.Format(time.RFC3339))
+	require.Equal(t, time.Hour*23, next.Sub(daily.previous(next)))
+}
+
+func TestParseSchedule_Fail(t *testing.T) {
+	_, err := parseSchedule(config.ReportConfig{Period: "hourly"})
+	require.EqualError(t, err, "unknown period \"hourly\"")
+
+	_, err = parseSchedule(config.ReportConfig{Period: "daily", Time: "x"})
+	require.EqualError(t, err, "failed to parse time: parsing time \"x\" as \"15:04\": "+
+		"cannot parse \"x\" as \"15\"")
+
+	_, err = parseSchedule(config.ReportConfig{Period: "weekly", Weekday: "xx"})
+	require.EqualError(t, err, "unknown weekday \"xx\"")
+
+	_, err = parseSchedule(config.ReportConfig{Period: "daily", Timezone: "xx"})
+	require.EqualError(t, err, "failed to load timezone: unknown time zone xx")
+}
+
+func TestReporter_Send(t *testing.T) {
+	sender := &fakeSender{}
+	failing := &fakeSender{err: errors.New("fake")}
+
+	scheduler, err := NewPeriodicReporter(fakeSource{}, []string{"XX"},
+		config.ReportConfig{Period: "daily"}, []Sender{failing, sender},
+		zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	to := time.Now()
+
+	err = scheduler.(*PeriodicReporter).send(to.Add(-time.Hour), to)
+	require.EqualError(t, err, "failed to send: fake")
+
+	require.Len(t, sender.reports, 1)
+	require.Equal(t, to, sender.reports[0].To)
+}
+
+func TestEmailSender(t *testing.T) {
+	var addr, from string
+	var to []string
+	var msg []byte
+
+	sender := EmailSender{
+		conf: config.EmailConfig{
+			Host: "smtp.example.com:587",
+			From: "hodor@example.com",
+			To:   []string{"a@example.com", "b@example.com"},
+		},
+		sendMail: func(a string, auth smtp.Auth, f string, t []string, m []byte) error {
+			addr, from, to, msg = a, f, t, m
+			return nil
+		},
+	}
+
+	report := Report{From: time.Unix(0, 0).UTC(), To: time.Unix(0, 0).UTC()}
+
+	err := sender.Send(report)
+	require.NoError(t, err)
+
+	require.Equal(t, "smtp.example.com:587", addr)
+	require.Equal(t, "hodor@example.com", from)
+	require.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+	require.Contains(t, string(msg), "To: a@example.com, b@example.com\r\n")
+	require.Contains(t, string(msg), "Subject: Hodor report from 1970-01-01 00:00 to 1970-01-01 00:00\r\n")
+	require.Contains(t, string(msg), "release  deployments  failures  mean duration\r\n")
+}
+
+func TestWebhookSender(t *testing.T) {
+	var body webhookReport
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	sender := NewWebhookSender(server.URL, http.DefaultClient)
+
+	report := Report{
+		From:     time.Unix(0, 0).UTC(),
+		To:       time.Unix(0, 0).UTC(),
+		Releases: []ReleaseReport{{ReleaseID: "XX", Deployments: 1}},
+	}
+
+	err := sender.Send(report)
+	require.NoError(t, err)
+
+	require.Equal(t, report.Releases, body.Releases)
+	require.Equal(t, report.String(), body.Text)
+}
+
+func TestWebhookSender_Fail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fake", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	sender := NewWebhookSender(server.URL, http.DefaultClient)
+
+	err := sender.Send(Report{})
+	require.EqualError(t, err, "unexpected status \"502 Bad Gateway\": fake\n")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+type fakeSource struct {
+	history  map[string][]deployer.HistoryEntry
+	failures map[string][]deployer.Failure
+	err      error
+}
+
+func (s fakeSource) GetHistory(releaseID string) ([]deployer.HistoryEntry, error) {
+	return s.history[releaseID], s.err
+}
+
+func (s fakeSource) GetFailures(releaseID string) ([]deployer.Failure, error) {
+	return s.failures[releaseID], s.err
+}
+
+type fakeSender struct {
+	reports []Report
+	err     error
+}
+
+func (s *fakeSender) Send(report Report) error {
+	s.reports = append(s.reports, report)
+	return s.err
+}
@@ -0,0 +1,214 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+)
+
+// defaultTimeout is the maximum duration of a scan if not configured
+const defaultTimeout = 5 * time.Minute
+
+// defaultSeverity is the lowest severity that blocks a deployment if not
+// configured
+const defaultSeverity = "high"
+
+// HTTPClient defines the function we expect from an HTTP client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Finding is a vulnerability found by a scanner
+type Finding struct {
+	ID string `json:"id"`
+	// Severity is one of config.ScanSeverities
+	Severity string `json:"severity"`
+	Package  string `json:"package,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// Scanner defines the primitive needed to scan a release
+type Scanner interface {
+	// Scan submits the content, of the given media type, and returns the
+	// findings of the scanner
+	Scan(content io.Reader, mediaType string) ([]Finding, error)
+}
+
+// NewHTTPScanner returns a new initialized scanner that submits the content
+// to the URL of the scan
+func NewHTTPScanner(conf config.Scan, client HTTPClient) Scanner {
+	return HTTPScanner{
+		conf:   conf,
+		client: client,
+	}
+}
+
+// HTTPScanner implements a scanner that posts the content to a scanner, such
+// as a Grype or Trivy server, and reads its JSON report.
+//
+// - implements scan.Scanner
+type HTTPScanner struct {
+	conf   config.Scan
+	client HTTPClient
+}
+
+// Scan implements scan.Scanner
+func (s HTTPScanner) Scan(content io.Reader, mediaType string) ([]Finding, error) {
+	timeout := time.Duration(s.conf.Timeout)
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.URL, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("Accept", "application/json")
+
+	for key, value := range s.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("unexpected status %q: %s", res.Status, body)
+	}
+
+	findings, err := ParseReport(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report: %v", err)
+	}
+
+	return findings, nil
+}
+
+// report is a Grype or Trivy JSON report, reduced to the vulnerabilities
+type report struct {
+	// Matches are the vulnerabilities of a Grype report
+	Matches *[]struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	// Results are the scanned targets of a Trivy report
+	Results *[]struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string
+			Severity         string
+			PkgName          string
+			InstalledVersion string
+		}
+	}
+}
+
+// ParseReport returns the findings of a Grype or Trivy JSON report
+func ParseReport(r io.Reader) ([]Finding, error) {
+	var rep report
+
+	err := json.NewDecoder(r).Decode(&rep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode: %v", err)
+	}
+
+	findings := []Finding{}
+
+	switch {
+	case rep.Matches != nil:
+		for _, match := range *rep.Matches {
+			findings = append(findings, Finding{
+				ID:       match.Vulnerability.ID,
+				Severity: severity(match.Vulnerability.Severity),
+				Package:  match.Artifact.Name,
+				Version:  match.Artifact.Version,
+			})
+		}
+
+	case rep.Results != nil:
+		for _, result := range *rep.Results {
+			for _, vuln := range result.Vulnerabilities {
+				findings = append(findings, Finding{
+					ID:       vuln.VulnerabilityID,
+					Severity: severity(vuln.Severity),
+					Package:  vuln.PkgName,
+					Version:  vuln.InstalledVersion,
+				})
+			}
+		}
+
+	default:
+		return nil, errors.New("neither a Grype nor a Trivy report")
+	}
+
+	return findings, nil
+}
+
+// severity returns the severity among config.ScanSeverities, or "unknown"
+func severity(s string) string {
+	s = strings.ToLower(s)
+
+	for _, severity := range config.ScanSeverities {
+		if s == severity {
+			return s
+		}
+	}
+
+	return "unknown"
+}
+
+// Blocking returns the findings at or above the severity
+func Blocking(findings []Finding, severity string) []Finding {
+	blocking := []Finding{}
+
+	for _, finding := range findings {
+		if rank(finding.Severity) <= rank(severity) {
+			blocking = append(blocking, finding)
+		}
+	}
+
+	return blocking
+}
+
+// Severity returns the configured severity of the scan, or the default one
+func Severity(conf config.Scan) string {
+	if conf.Severity == "" {
+		return defaultSeverity
+	}
+
+	return conf.Severity
+}
+
+// rank returns the position of the severity in config.ScanSeverities, the
+// highest first
+func rank(severity string) int {
+	for i, s := range config.ScanSeverities {
+		if s == severity {
+			return i
+		}
+	}
+
+	return len(config.ScanSeverities)
+}
@@ -0,0 +1,157 @@
+package scan
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPScanner_Scan(t *testing.T) {
+	var received string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/spdx+json", r.Header.Get("Content-Type"))
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		buf, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		received = string(buf)
+
+		w.Write([]byte(grypeReport))
+	}))
+	defer server.Close()
+
+	scanner := NewHTTPScanner(config.Scan{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}, server.Client())
+
+	findings, err := scanner.Scan(strings.NewReader("sbom"), "application/spdx+json")
+	require.NoError(t, err)
+	require.Equal(t, "sbom", received)
+	require.Equal(t, []Finding{
+		{ID: "CVE-2022-1", Severity: "critical", Package: "openssl", Version: "1.1.1"},
+		{ID: "CVE-2022-2", Severity: "negligible", Package: "zlib", Version: "1.2"},
+	}, findings)
+}
+
+func TestHTTPScanner_Scan_Wrong(t *testing.T) {
+	tests := map[string]struct {
+		handler http.HandlerFunc
+		err     string
+	}{
+		"status": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "no database", http.StatusServiceUnavailable)
+			},
+			err: "unexpected status \"503 Service Unavailable\": no database\n",
+		},
+		"report": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"findings": []}`))
+			},
+			err: "failed to parse report: neither a Grype nor a Trivy report",
+		},
+	}
+
+	for name, test := range tests {
+		server := httptest.NewServer(test.handler)
+
+		scanner := NewHTTPScanner(config.Scan{URL: server.URL}, server.Client())
+
+		_, err := scanner.Scan(strings.NewReader("sbom"), "application/spdx+json")
+		require.EqualError(t, err, test.err, name)
+
+		server.Close()
+	}
+}
+
+func TestHTTPScanner_Scan_Timeout(t *testing.T) {
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	scanner := NewHTTPScanner(config.Scan{
+		URL:     server.URL,
+		Timeout: config.Duration(time.Millisecond * 50),
+	}, server.Client())
+
+	_, err := scanner.Scan(strings.NewReader("sbom"), "application/spdx+json")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "context deadline exceeded")
+}
+
+func TestParseReport_Trivy(t *testing.T) {
+	findings, err := ParseReport(strings.NewReader(trivyReport))
+	require.NoError(t, err)
+	require.Equal(t, []Finding{
+		{ID: "CVE-2022-3", Severity: "high", Package: "lodash", Version: "4.17.0"},
+		{ID: "CVE-2022-4", Severity: "unknown", Package: "lodash", Version: "4.17.0"},
+	}, findings)
+
+	// a report without vulnerabilities has no finding
+	findings, err = ParseReport(strings.NewReader(`{"Results": [{"Target": "app"}]}`))
+	require.NoError(t, err)
+	require.Empty(t, findings)
+}
+
+func TestParseReport_Wrong(t *testing.T) {
+	_, err := ParseReport(strings.NewReader(`{`))
+	require.EqualError(t, err, "failed to decode: unexpected EOF")
+}
+
+func TestBlocking(t *testing.T) {
+	findings := []Finding{
+		{ID: "A", Severity: "critical"},
+		{ID: "B", Severity: "high"},
+		{ID: "C", Severity: "medium"},
+		{ID: "D", Severity: "unknown"},
+	}
+
+	require.Equal(t, findings[:2], Blocking(findings, Severity(config.Scan{})))
+	require.Equal(t, findings[:1], Blocking(findings, "critical"))
+	require.Equal(t, findings, Blocking(findings, "unknown"))
+	require.Empty(t, Blocking(findings[2:3], "high"))
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+const grypeReport = `{
+  "matches": [
+    {
+      "vulnerability": {"id": "CVE-2022-1", "severity": "Critical"},
+      "artifact": {"name": "openssl", "version": "1.1.1"}
+    },
+    {
+      "vulnerability": {"id": "CVE-2022-2", "severity": "Negligible"},
+      "artifact": {"name": "zlib", "version": "1.2"}
+    }
+  ],
+  "source": {"type": "sbom"}
+}`
+
+const trivyReport = `{
+  "SchemaVersion": 2,
+  "Results": [
+    {
+      "Target": "package-lock.json",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2022-3", "PkgName": "lodash", "InstalledVersion": "4.17.0", "Severity": "HIGH"},
+        {"VulnerabilityID": "CVE-2022-4", "PkgName": "lodash", "InstalledVersion": "4.17.0", "Severity": "UNKNOWN"}
+      ]
+    }
+  ]
+}`
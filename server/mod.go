@@ -1,16 +1,36 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nkcr/hodor/asset"
+	"github.com/nkcr/hodor/config"
 	"github.com/nkcr/hodor/deployer"
+	"github.com/nkcr/hodor/logs"
 	"github.com/rs/zerolog"
 
 	"github.com/narqo/go-badge"
@@ -18,15 +38,270 @@ import (
 
 // request is the expected input from a hook request
 type request struct {
-	BrowserDownloadURL string `json:"browser_download_url"`
-	Tag                string `json:"tag"`
+	BrowserDownloadURL string        `json:"browser_download_url"`
+	Tag                string        `json:"tag"`
+	FallbackURLs       []string      `json:"fallback_urls"`
+	Assets             []asset.Asset `json:"assets"`
+	// Body contains the release notes, as in a GitHub release
+	Body string `json:"body"`
+	// Subpath is the folder of the target replaced by the release
+	Subpath string `json:"subpath"`
+	// CallbackURL receives the final status of the job
+	CallbackURL string `json:"callback_url"`
+	// SHA256 is the hex-encoded SHA-256 of the archive
+	SHA256 string `json:"sha256"`
+	// Sender is the account that triggered the hook, as in a GitHub event
+	Sender hookSender `json:"sender"`
+}
+
+// hookSender is the account that triggered a hook
+type hookSender struct {
+	Login string `json:"login"`
+}
+
+// response is the output of a hook request. URLs are relative to the server.
+type response struct {
+	JobID string `json:"jobID"`
+	// StatusURL is where the job's status can be polled
+	StatusURL string `json:"statusURL"`
+	// StreamURL is where the job updates can be streamed
+	StreamURL string `json:"streamURL"`
+	// QueuePosition is the number of jobs waiting to be handled, including
+	// this one. It is 0 if the job is already being handled.
+	QueuePosition int `json:"queuePosition"`
+	// Status is the final status of the job, if the request waited for it
+	Status *deployer.JobStatus `json:"status,omitempty"`
 }
 
+// SignatureHeader contains the signature of the hook requests, as set by
+// GitHub
+const SignatureHeader = "X-Hub-Signature-256"
+
 // HTTP defines the primitives expected from a basic HTTP server
 type HTTP interface {
 	Start() error
 	Stop()
 	GetAddr() net.Addr
+	// Connections returns the number of open connections
+	Connections() int
+}
+
+// Option defines an option to customize the HTTP server
+type Option func(*options)
+
+// WithReadOnly makes the server reject any request that changes a deployment
+// with a 503 status. Status, tags, and badges remain available.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithTokens requires the token of a release, by releaseID, to deploy it.
+// Releases without a token can be deployed by anyone, unless there is a global
+// token.
+func WithTokens(tokens map[string]string) Option {
+	return func(o *options) {
+		o.tokens.releases = tokens
+	}
+}
+
+// WithGlobalToken accepts the token for all the releases, and requires it to
+// deploy the releases without a token.
+func WithGlobalToken(token string) Option {
+	return func(o *options) {
+		o.tokens.global = token
+	}
+}
+
+// WithPrivate requires a token for the read endpoints too, except the health
+// endpoint. The token of the release is accepted if the endpoint is about a
+// release, or else the token of any release. If publicBadges is true, the
+// badges remain public.
+func WithPrivate(publicBadges bool) Option {
+	return func(o *options) {
+		o.private = true
+		o.publicBadges = publicBadges
+	}
+}
+
+// WithBadgeSecret accepts the badge URLs signed with the secret, until they
+// expire, without a token on a private server. See SignBadge.
+func WithBadgeSecret(secret string) Option {
+	return func(o *options) {
+		o.badgeSecret = secret
+	}
+}
+
+// WithBadges customizes the badges of the tags, by releaseID
+func WithBadges(badges map[string]config.Badge) Option {
+	return func(o *options) {
+		o.badges = badges
+	}
+}
+
+// WithRegistry sets the releases triggered by image pushes, by repository
+func WithRegistry(releases map[string][]RegistryRelease) Option {
+	return func(o *options) {
+		o.registry = releases
+	}
+}
+
+// WithWebhookSecrets requires the hooks of a release, by releaseID, to be
+// signed with its secret, as GitHub does with the X-Hub-Signature-256 header.
+// The other endpoints that deploy such a release then require a token.
+func WithWebhookSecrets(secrets map[string]string) Option {
+	return func(o *options) {
+		o.secrets = secrets
+
+		o.tokens.signed = make(map[string]bool, len(secrets))
+		for releaseID, secret := range secrets {
+			o.tokens.signed[releaseID] = secret != ""
+		}
+	}
+}
+
+// WithListener serves the requests accepted by the listener, such as one
+// inherited from another process, instead of listening on the address
+func WithListener(ln net.Listener) Option {
+	return func(o *options) {
+		o.listener = ln
+	}
+}
+
+// WithMiddlewares enables or disables the middlewares of the server, see
+// config.Middlewares. Without it, the middlewares keep their default.
+func WithMiddlewares(conf config.HTTPConfig) Option {
+	return func(o *options) {
+		o.http = conf
+	}
+}
+
+// WithTLS serves HTTPS with the certificate instead of plain HTTP
+func WithTLS(cert *Certificate) Option {
+	return func(o *options) {
+		o.cert = cert
+	}
+}
+
+// options holds the settings that can be customized with Option
+type options struct {
+	readOnly     bool
+	tokens       apiTokens
+	registry     map[string][]RegistryRelease
+	secrets      map[string]string
+	private      bool
+	publicBadges bool
+	badgeSecret  string
+	badges       map[string]config.Badge
+	listener     net.Listener
+	http         config.HTTPConfig
+	cert         *Certificate
+}
+
+// NewCertificate loads the PEM certificate and key files. If reload is not 0,
+// the files are checked for changes at most once per reload, during a TLS
+// handshake, so that a renewed certificate is served without a restart.
+func NewCertificate(certFile, keyFile string, reload time.Duration,
+	logger zerolog.Logger) (*Certificate, error) {
+
+	c := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		reload:   reload,
+		logger:   logger.With().Str("role", "tls").Logger(),
+		now:      time.Now,
+	}
+
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Certificate is the certificate of the server, reloaded once its files
+// change. A failed reload keeps the current certificate.
+type Certificate struct {
+	sync.Mutex
+
+	certFile string
+	keyFile  string
+	reload   time.Duration
+	logger   zerolog.Logger
+	now      func() time.Time
+
+	cert *tls.Certificate
+	// modTimes are the modification times of the loaded files
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+// GetCertificate returns the current certificate. It matches
+// tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.reload == 0 || c.now().Sub(c.checked) < c.reload {
+		return c.cert, nil
+	}
+
+	modTimes, err := c.stat()
+	if err != nil {
+		c.logger.Warn().Msgf("failed to check certificate: %v", err)
+		c.checked = c.now()
+
+		return c.cert, nil
+	}
+
+	if !modTimes[0].Equal(c.modTimes[0]) || !modTimes[1].Equal(c.modTimes[1]) {
+		err = c.load()
+		if err != nil {
+			c.logger.Warn().Msgf("failed to reload certificate: %v", err)
+		} else {
+			c.logger.Info().Msgf("reloaded certificate %q", c.certFile)
+		}
+	}
+
+	c.checked = c.now()
+
+	return c.cert, nil
+}
+
+// load loads the certificate and saves the modification times of its files
+func (c *Certificate) load() error {
+	modTimes, err := c.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	c.cert = &cert
+	c.modTimes = modTimes
+
+	return nil
+}
+
+// stat returns the modification times of the certificate and key files
+func (c *Certificate) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to stat: %v", err)
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
 }
 
 type key int
@@ -34,36 +309,196 @@ type key int
 const requestIDKey key = 0
 
 // NewHookHTTP returns a new initialized HTTP server that responds to hooks.
-func NewHookHTTP(addr string, deployer deployer.Deployer, logger zerolog.Logger) HTTP {
+func NewHookHTTP(addr string, deployer deployer.Deployer, logger zerolog.Logger,
+	opts ...Option) HTTP {
 
 	logger = logger.With().Str("role", "http").Logger()
 	logger.Info().Msg("Server is starting...")
 
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// write wraps handlers that change a deployment
+	write := func(handler http.HandlerFunc) http.HandlerFunc {
+		return handler
+	}
+
+	if o.readOnly {
+		logger.Info().Msg("Server is in read-only mode")
+		write = readOnly
+	}
+
+	// read wraps handlers that read deployments, and readRelease the ones
+	// whose last part of the URL is the releaseID. readBadge and
+	// readReleaseBadge wrap the handlers that also render badges.
+	read := func(handler http.HandlerFunc) http.HandlerFunc {
+		return handler
+	}
+
+	readRelease := read
+	readBadge := read
+	readReleaseBadge := read
+
+	if o.private {
+		logger.Info().Msg("Server requires a token to read")
+		read = private(o.tokens, false, "", false)
+		readRelease = private(o.tokens, false, "", true)
+		readBadge = private(o.tokens, o.publicBadges, o.badgeSecret, false)
+		readReleaseBadge = private(o.tokens, o.publicBadges, o.badgeSecret, true)
+	}
+
 	nextRequestID := func() string {
 		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
 
+	// closed when the server shuts down, to end the streams and the hooks
+	// waiting for their job
+	done := make(chan struct{})
+
 	mux := http.NewServeMux()
 
+	// records the requests of each route, labeled with its pattern
+	metrics := newRequestMetrics()
+	instrument := metrics.instrument
+
 	// POST /api/hook/:releaseID
-	mux.HandleFunc("/api/hook/", getHookHandler(deployer))
+	mux.Handle("/api/hook/", instrument("/api/hook/:releaseID",
+		waitable(write(getHookHandler(deployer, done, o.tokens, o.secrets)))))
+	// POST /api/deploy
+	mux.Handle("/api/deploy", instrument("/api/deploy",
+		waitable(write(getDeployHandler(deployer, done, o.tokens)))))
+	// POST /api/registry
+	mux.Handle("/api/registry", instrument("/api/registry",
+		timeout(write(getRegistryHandler(deployer, o.registry, o.tokens)))))
+	// POST /api/rollback/:releaseID
+	mux.Handle("/api/rollback/", instrument("/api/rollback/:releaseID",
+		waitable(write(getRollbackHandler(deployer, done, o.tokens)))))
 	// GET /api/status/:jobID
-	mux.HandleFunc("/api/status/", getStatusHandler(deployer))
+	// GET /api/status/:jobID/stream
+	mux.Handle("/api/status/", statusActions(
+		instrument("/api/status/:jobID", waitable(readBadge(getStatusHandler(deployer, done)))),
+		instrument("/api/status/:jobID/stream", read(getStatusStreamHandler(deployer, done)))))
 	// GET /api/tags/:releaseID
-	mux.HandleFunc("/api/tags/", getTagsHandler(deployer))
+	mux.Handle("/api/tags/", instrument("/api/tags/:releaseID",
+		timeout(readReleaseBadge(getTagsHandler(deployer, o.badges)))))
+	// GET /api/history/:releaseID
+	mux.Handle("/api/history/", instrument("/api/history/:releaseID",
+		timeout(readRelease(getHistoryHandler(deployer)))))
+	// POST /api/list
+	mux.Handle("/api/list", instrument("/api/list",
+		timeout(read(write(getListHandler(deployer, o.tokens))))))
+	// GET /api/releases
+	mux.Handle("/api/releases", instrument("/api/releases",
+		timeout(read(getReleasesHandler(deployer)))))
+	// POST /api/releases/:releaseID/maintenance
+	// POST /api/releases/:releaseID/promote
+	// GET /api/releases/:releaseID/sbom
+	mux.Handle("/api/releases/", releaseActions(map[string]http.Handler{
+		"maintenance": instrument("/api/releases/:releaseID/maintenance",
+			timeout(write(getMaintenanceHandler(deployer, o.tokens)))),
+		"promote": instrument("/api/releases/:releaseID/promote",
+			waitable(write(getPromoteHandler(deployer, done, o.tokens)))),
+		"sbom": instrument("/api/releases/:releaseID/sbom",
+			timeout(readRelease(getSBOMHandler(deployer)))),
+	}))
+	// GET /api/freezes, POST /api/freezes
+	mux.Handle("/api/freezes", instrument("/api/freezes", timeout(read(getFreezesHandler(deployer,
+		write(getFreezeHandler(deployer, o.tokens)))))))
+	// POST /api/freezes/:freezeID/lift
+	mux.Handle("/api/freezes/", instrument("/api/freezes/:freezeID/lift",
+		timeout(write(getLiftFreezeHandler(deployer, o.tokens)))))
+	// POST /api/badges
+	mux.Handle("/api/badges", instrument("/api/badges",
+		timeout(getBadgeHandler(deployer, o.badgeSecret, o.tokens))))
+	// GET /api/jobs
+	mux.Handle("/api/jobs", instrument("/api/jobs", timeout(read(getJobsHandler(deployer)))))
+	// POST /api/jobs/:jobID/status
+	// GET /api/jobs/:jobID/archive
+	// GET /api/jobs/:jobID/log
+	mux.Handle("/api/jobs/", jobActions(map[string]http.Handler{
+		"status": instrument("/api/jobs/:jobID/status",
+			timeout(write(getSetStatusHandler(deployer, o.tokens)))),
+		// the archive can be too large to be buffered by timeout
+		"archive": instrument("/api/jobs/:jobID/archive",
+			http.HandlerFunc(getRetainedHandler(deployer, o.tokens))),
+		"log": instrument("/api/jobs/:jobID/log",
+			timeout(getRetainedHandler(deployer, o.tokens))),
+	}))
+	// GET /api/jobs/stream
+	mux.Handle("/api/jobs/stream", instrument("/api/jobs/stream",
+		read(getJobsStreamHandler(deployer, done))))
+	// GET /healthz
+	mux.Handle("/healthz", instrument("/healthz", timeout(getHealthHandler(deployer))))
+	// GET /metrics
+	mux.Handle("/metrics", timeout(read(metrics.ServeHTTP)))
+
+	handler := http.Handler(mux)
+
+	if !o.http.Enabled("cors") {
+		handler = noCORS(handler)
+	}
+
+	if o.http.Enabled("compression") {
+		handler = compress(handler)
+	}
+
+	if o.http.Enabled("rate_limit") {
+		handler = rateLimit(o.http.RateLimit, time.Now)(handler)
+	}
+
+	if o.http.Enabled("access_log") {
+		handler = logging(logger)(handler)
+	}
+
+	if o.http.Enabled("tracing") {
+		handler = tracing(nextRequestID)(handler)
+	}
 
+	// The write timeout is set per handler, as streams stay open.
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      tracing(nextRequestID)(logging(logger)(mux)),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		Addr:        addr,
+		Handler:     handler,
+		ReadTimeout: 5 * time.Second,
+		IdleTimeout: 15 * time.Second,
+	}
+
+	server.RegisterOnShutdown(func() {
+		close(done)
+	})
+
+	conns := new(int64)
+
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(conns, 1)
+		case http.StateHijacked, http.StateClosed:
+			atomic.AddInt64(conns, -1)
+		}
+	}
+
+	if o.cert != nil {
+		logger.Info().Msg("Server uses TLS")
+
+		server.TLSConfig = &tls.Config{
+			GetCertificate: o.cert.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	ln := new(atomic.Value)
+	if o.listener != nil {
+		ln.Store(o.listener)
 	}
 
 	return &HookHTTP{
 		logger: logger,
 		server: server,
 		quit:   make(chan struct{}),
+		ln:     ln,
+		conns:  conns,
 	}
 }
 
@@ -75,23 +510,36 @@ type HookHTTP struct {
 	logger zerolog.Logger
 	server *http.Server
 	quit   chan struct{}
-	ln     net.Listener
+	// ln holds the net.Listener, once it is given or created by Start, so
+	// that it can be read while the server starts
+	ln *atomic.Value
+	// conns counts the open connections
+	conns *int64
 }
 
 // Start implements server.HTTP
 func (n *HookHTTP) Start() error {
-	ln, err := net.Listen("tcp", n.server.Addr)
-	if err != nil {
-		return fmt.Errorf("failed to create conn '%s': %v", n.server.Addr, err)
-	}
+	ln := n.listener()
+
+	var err error
+
+	if ln == nil {
+		ln, err = net.Listen("tcp", n.server.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to create conn '%s': %v", n.server.Addr, err)
+		}
 
-	n.ln = ln
+		if n.ln != nil {
+			n.ln.Store(ln)
+		}
+	}
 
 	done := make(chan bool)
 
 	go func() {
 		<-n.quit
-		n.logger.Info().Msg("Server is shutting down...")
+		n.logger.Info().Msgf("Server is shutting down with %d open connections...",
+			n.Connections())
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
@@ -107,7 +555,13 @@ func (n *HookHTTP) Start() error {
 
 	n.logger.Info().Msgf("Server is ready to handle requests at %s", ln.Addr().String())
 
-	err = n.server.Serve(ln)
+	if n.server.TLSConfig != nil {
+		// the certificate is given by the TLS config
+		err = n.server.ServeTLS(ln, "", "")
+	} else {
+		err = n.server.Serve(ln)
+	}
+
 	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to listen on %s: %v", ln.Addr().String(), err)
 	}
@@ -128,19 +582,53 @@ func (n HookHTTP) Stop() {
 	}
 }
 
+// Connections implements server.HTTP
+func (n HookHTTP) Connections() int {
+	if n.conns == nil {
+		return 0
+	}
+
+	return int(atomic.LoadInt64(n.conns))
+}
+
 // GetAddr implements server
 func (n HookHTTP) GetAddr() net.Addr {
+	ln := n.listener()
+	if ln == nil {
+		return nil
+	}
+
+	return ln.Addr()
+}
+
+// listener returns the listener of the server, or nil if it has none yet
+func (n HookHTTP) listener() net.Listener {
 	if n.ln == nil {
 		return nil
 	}
 
-	return n.ln.Addr()
+	ln, _ := n.ln.Load().(net.Listener)
+
+	return ln
 }
 
+// maxHookSize is the maximum size of the body of a hook, which is the maximum
+// size of a GitHub webhook payload
+const maxHookSize = 25 * 1024 * 1024
+
 // getHookHandler returns an HTTP handler that responds to POST action to deploy
-// a release. The call is blocking until the release has been deployed. The last
-// part of the URL must be the releaseID.
-func getHookHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+// a release. If the release has a webhook secret, the body must be signed with
+// it in the SignatureHeader. Otherwise, if the release has a token, it must be
+// given as a bearer token. The request is checked and the job is queued, but the call
+// doesn't wait for the deployment: it responds with 202 Accepted and the jobID,
+// whose status can then be followed. With "?wait=true", it waits for the job to
+// finish, up to maxHookWait or until done is closed, and responds with 200 OK
+// and the final status. The last part of the URL must be the releaseID. The
+// GitHub, GitLab, and Gitea release webhooks are accepted too, see
+// decodeHook.
+func getHookHandler(d deployer.Deployer, done <-chan struct{},
+	tokens apiTokens, secrets map[string]string) func(http.ResponseWriter, *http.Request) {
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 
@@ -151,134 +639,2745 @@ func getHookHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.
 
 		key := path.Base(r.URL.Path)
 
-		var req request
-		decoder := json.NewDecoder(r.Body)
-
-		err := decoder.Decode(&req)
+		// the body is read before its signature is checked
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookSize))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		releaseURL, err := url.ParseRequestURI(req.BrowserDownloadURL)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("wrong url: %v", err), http.StatusBadRequest)
+		secret := secrets[key]
+
+		if secret != "" && !signedHook(secret, body, r) {
+			http.Error(w, "wrong signature", http.StatusUnauthorized)
+			return
+		}
+
+		// GitLab sends its secret token in its own header
+		token := bearerToken(r)
+		if token == "" {
+			token = r.Header.Get(gitlabTokenHeader)
+		}
+
+		if secret == "" && !authorized(tokens, key, token) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		req, err := decodeHook(r, body)
+		if errors.Is(err, errIgnoredEvent) {
+			w.Header().Add("Content-Type", "text/plain")
+			fmt.Fprintln(w, err.Error())
 			return
 		}
 
-		jobID, err := deployer.Deploy(key, req.Tag, releaseURL)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to deploy: %v", err),
-				http.StatusInternalServerError)
+			hookError(w, err)
 			return
 		}
 
-		w.Header().Add("Content-Type", "application/json")
+		sender := newSender(r, tokenAuth(tokens, key))
+		if secret != "" {
+			sender.Auth = "signature"
+		}
 
-		response := fmt.Sprintf("{\"jobID\":\"%s\"}", jobID)
+		sender.Login = req.Sender.Login
 
-		w.Write([]byte(response))
+		deploy(w, r, d, done, key, req, sender)
 	}
 }
 
-// getStatusHandler return a handler that responds to GET requests to get the
-// status of a job. The jobID must be the last part of the URL.
-func getStatusHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "wrong action", http.StatusForbidden)
-			return
+// The headers of the GitHub, GitLab, and Gitea webhooks
+const (
+	githubEventHeader    = "X-GitHub-Event"
+	gitlabEventHeader    = "X-Gitlab-Event"
+	gitlabTokenHeader    = "X-Gitlab-Token"
+	giteaEventHeader     = "X-Gitea-Event"
+	giteaSignatureHeader = "X-Gitea-Signature"
+)
+
+// errIgnoredEvent is returned by decodeHook for the webhook events that don't
+// deploy, such as an updated release
+var errIgnoredEvent = errors.New("ignored event")
+
+// gitlabRelease is a GitLab release hook, reduced to what a deployment needs
+type gitlabRelease struct {
+	ObjectKind  string `json:"object_kind"`
+	Action      string `json:"action"`
+	Tag         string `json:"tag"`
+	Description string `json:"description"`
+	Assets      struct {
+		Links []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+// releaseEvent is a GitHub release event, or a Gitea one which has the same
+// shape, reduced to what a deployment needs
+type releaseEvent struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName string        `json:"tag_name"`
+		Body    string        `json:"body"`
+		Assets  []asset.Asset `json:"assets"`
+	} `json:"release"`
+	Sender hookSender `json:"sender"`
+}
+
+// decodeHook decodes the body of a hook as a GitLab release hook, or a Gitea or
+// GitHub release event, detected by their headers, or else as a request,
+// validated against hookSchema. The assets of a release are selected as those
+// of a request. It returns errIgnoredEvent for the other events, such as a
+// ping, and for the releases that are not created or published, and a
+// validationError if the body is not valid.
+func decodeHook(r *http.Request, body []byte) (request, error) {
+	switch {
+	case r.Header.Get(gitlabEventHeader) != "":
+		event := r.Header.Get(gitlabEventHeader)
+		if event != "Release Hook" {
+			return request{}, fmt.Errorf("%w: GitLab %q", errIgnoredEvent, event)
 		}
 
-		jobID := path.Base(r.URL.Path)
+		var release gitlabRelease
 
-		status, err := deployer.GetStatus(jobID)
+		err := json.Unmarshal(body, &release)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to get status: %v", err),
-				http.StatusInternalServerError)
-			return
+			return request{}, validationError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
 		}
 
-		w.Header().Add("Content-Type", "application/json")
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		if release.Action != "create" {
+			return request{}, fmt.Errorf("%w: GitLab release %q", errIgnoredEvent, release.Action)
+		}
 
-		encoder := json.NewEncoder(w)
+		if len(release.Assets.Links) == 0 {
+			return request{}, validationError{{Field: "assets.links", Message: "missing"}}
+		}
 
-		err = encoder.Encode(status)
+		req := request{Tag: release.Tag, Body: release.Description}
+
+		for _, link := range release.Assets.Links {
+			req.Assets = append(req.Assets, asset.Asset{Name: link.Name, BrowserDownloadURL: link.URL})
+		}
+
+		return req, nil
+
+	// Gitea also sets the header of GitHub
+	case r.Header.Get(giteaEventHeader) != "":
+		return decodeReleaseEvent("Gitea", r.Header.Get(giteaEventHeader), body)
+
+	case r.Header.Get(githubEventHeader) != "":
+		return decodeReleaseEvent("GitHub", r.Header.Get(githubEventHeader), body)
+
+	default:
+		var value interface{}
+
+		err := json.NewDecoder(bytes.NewReader(body)).Decode(&value)
 		if err != nil {
-			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
-				http.StatusInternalServerError)
-			return
+			return request{}, validationError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
 		}
-	}
-}
 
-// getTagsHandler return a handler that responds to GET requests to get the
-// latest tag saved for a releaseID.
-func getTagsHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "wrong action", http.StatusForbidden)
-			return
+		errs := hookSchema.validate("", value)
+		if len(errs) != 0 {
+			return request{}, errs
 		}
 
-		releaseID := path.Base(r.URL.Path)
+		var req request
 
-		tag, err := deployer.GetLatestTag(releaseID)
+		err = json.NewDecoder(bytes.NewReader(body)).Decode(&req)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to get tag: %v", err),
-				http.StatusInternalServerError)
-			return
+			return request{}, validationError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
 		}
 
-		cacheSince := time.Now().Format(http.TimeFormat)
-		cacheUntil := time.Now().Add(time.Minute * 2).Format(http.TimeFormat)
+		return req, nil
+	}
+}
 
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Cache-Control", "max-age=120, s-maxage=120")
-		w.Header().Set("Date", cacheSince)
-		w.Header().Set("Last-Modified", cacheSince)
-		w.Header().Set("Expires", cacheUntil)
+// decodeReleaseEvent decodes a release event of GitHub or Gitea, the forge. It
+// returns errIgnoredEvent for the other events, and for the releases that are
+// not published.
+func decodeReleaseEvent(forge, event string, body []byte) (request, error) {
+	if event != "release" {
+		return request{}, fmt.Errorf("%w: %s %q", errIgnoredEvent, forge, event)
+	}
 
-		format := r.FormValue("format")
+	var release releaseEvent
 
-		switch format {
-		case "svg":
-			w.Header().Add("Content-Type", "image/svg+xml;charset=utf-8")
-			badge.Render("Deployed", tag, badge.ColorBlue, w)
-		default:
-			w.Header().Add("Content-Type", "text/plain")
-			w.Write([]byte(tag))
-		}
+	err := json.Unmarshal(body, &release)
+	if err != nil {
+		return request{}, validationError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
 	}
-}
 
-// logging is a utility function that logs the http server events
-func logging(logger zerolog.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
-				}
-				logger.Info().Str("requestID", requestID).
-					Str("method", r.Method).
-					Str("url", r.URL.Path).
-					Str("remoteAddr", r.RemoteAddr).
-					Str("agent", r.UserAgent()).Msg("")
-			}()
-			next.ServeHTTP(w, r)
-		})
+	// GitHub also sends "created" and "released" for the same release
+	if release.Action != "published" {
+		return request{}, fmt.Errorf("%w: %s release %q", errIgnoredEvent, forge, release.Action)
+	}
+
+	if len(release.Release.Assets) == 0 {
+		return request{}, validationError{{Field: "release.assets", Message: "missing"}}
 	}
+
+	return request{
+		Tag:    release.Release.TagName,
+		Body:   release.Release.Body,
+		Assets: release.Release.Assets,
+		Sender: release.Sender,
+	}, nil
 }
 
-// tracing is a utility function that adds header tracing
-func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestID := r.Header.Get("X-Request-Id")
-			if requestID == "" {
+// fieldError is the error of a field of a hook request. Field is the path of
+// the field, such as "assets[0].name", or empty if the error is about the whole
+// request.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// validationError is returned when a hook request is not valid, with the error
+// of each wrong field
+type validationError []fieldError
+
+// Error implements error
+func (v validationError) Error() string {
+	messages := make([]string, len(v))
+
+	for i, e := range v {
+		messages[i] = e.Message
+		if e.Field != "" {
+			messages[i] = e.Field + " " + e.Message
+		}
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+// validationResponse is the output of a hook request that is not valid
+type validationResponse struct {
+	Error  string       `json:"error"`
+	Errors []fieldError `json:"errors"`
+}
+
+// hookError responds with 400 Bad Request and the field errors in JSON if the
+// error is a validationError, or in plain text otherwise
+func hookError(w http.ResponseWriter, err error) {
+	var errs validationError
+
+	if !errors.As(err, &errs) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf, err := json.Marshal(validationResponse{Error: "invalid request", Errors: errs})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+
+	w.Write(append(buf, '\n'))
+}
+
+// jsonSchema describes the expected JSON value of a field: its kind, the
+// schema of its items if it is an array, or of its fields if it is an object
+type jsonSchema struct {
+	kind   string
+	items  *jsonSchema
+	fields map[string]jsonSchema
+}
+
+var stringSchema = jsonSchema{kind: "string"}
+
+// hookSchema is the schema of a request. The unknown fields are ignored, so
+// that the events of the forges, which contain many more, are accepted.
+var hookSchema = jsonSchema{kind: "object", fields: map[string]jsonSchema{
+	"browser_download_url": stringSchema,
+	"tag":                  stringSchema,
+	"fallback_urls":        {kind: "array", items: &stringSchema},
+	"assets": {kind: "array", items: &jsonSchema{kind: "object", fields: map[string]jsonSchema{
+		"name":                 stringSchema,
+		"browser_download_url": stringSchema,
+	}}},
+	"body":         stringSchema,
+	"subpath":      stringSchema,
+	"callback_url": stringSchema,
+	"sha256":       stringSchema,
+	"sender": {kind: "object", fields: map[string]jsonSchema{
+		"login": stringSchema,
+	}},
+}}
+
+// validate returns the errors of the decoded JSON value, at the path, against
+// the schema. A null value is accepted as a missing field.
+func (s jsonSchema) validate(path string, value interface{}) validationError {
+	if value == nil {
+		return nil
+	}
+
+	var errs validationError
+
+	switch s.kind {
+	case "string":
+		_, ok := value.(string)
+		if !ok {
+			return validationError{{Field: path, Message: "must be a string"}}
+		}
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return validationError{{Field: path, Message: "must be an array"}}
+		}
+
+		for i, item := range items {
+			errs = append(errs, s.items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+
+	case "object":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return validationError{{Field: path, Message: "must be an object"}}
+		}
+
+		names := make([]string, 0, len(fields))
+
+		for name := range fields {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			schema, found := s.fields[name]
+			if !found {
+				continue
+			}
+
+			field := name
+			if path != "" {
+				field = path + "." + name
+			}
+
+			errs = append(errs, schema.validate(field, fields[name])...)
+		}
+	}
+
+	return errs
+}
+
+// signedHook returns true if the hook is signed with the secret, as GitHub and
+// Gitea do, or if it contains the secret as GitLab does
+func signedHook(secret string, body []byte, r *http.Request) bool {
+	if validSignature(secret, body, r.Header.Get(SignatureHeader)) {
+		return true
+	}
+
+	if r.Header.Get(giteaSignatureHeader) != "" &&
+		validSignature(secret, body, "sha256="+r.Header.Get(giteaSignatureHeader)) {
+		return true
+	}
+
+	token := r.Header.Get(gitlabTokenHeader)
+
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// getRollbackHandler returns an HTTP handler that responds to POST action to
+// restore the previous release kept for a release, as the hook does. It
+// responds with 409 Conflict if no previous release is kept. The last part of
+// the URL must be the releaseID.
+func getRollbackHandler(d deployer.Deployer, done <-chan struct{},
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		releaseID := path.Base(r.URL.Path)
+
+		if !authorized(tokens, releaseID, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		queue(w, r, d, done, func() (string, error) {
+			jobID, err := d.Rollback(releaseID)
+			if err != nil {
+				return "", fmt.Errorf("failed to roll back: %w", err)
+			}
+
+			return jobID, nil
+		})
+	}
+}
+
+// deployRequest is the input of the deploy endpoint, as JSON, or as form or
+// query parameters
+type deployRequest struct {
+	ReleaseID string `json:"releaseID"`
+	URL       string `json:"url"`
+	Tag       string `json:"tag"`
+	Token     string `json:"token"`
+	SHA256    string `json:"sha256"`
+}
+
+// getDeployHandler returns an HTTP handler that responds to POST action to
+// deploy a release, as the hook does, for CI systems that can only send simple
+// form posts. The token, if the release has one, can be given as a parameter
+// or as a bearer token.
+func getDeployHandler(d deployer.Deployer, done <-chan struct{},
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		var req deployRequest
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		if mediaType == "application/json" {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+					http.StatusBadRequest)
+				return
+			}
+		} else {
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to parse form: %v", err),
+					http.StatusBadRequest)
+				return
+			}
+
+			req = deployRequest{
+				ReleaseID: r.Form.Get("releaseID"),
+				URL:       r.Form.Get("url"),
+				Tag:       r.Form.Get("tag"),
+				Token:     r.Form.Get("token"),
+				SHA256:    r.Form.Get("sha256"),
+			}
+		}
+
+		if req.ReleaseID == "" {
+			http.Error(w, "missing releaseID", http.StatusBadRequest)
+			return
+		}
+
+		token := req.Token
+		if token == "" {
+			token = bearerToken(r)
+		}
+
+		if !authorized(tokens, req.ReleaseID, token) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		deploy(w, r, d, done, req.ReleaseID, request{
+			BrowserDownloadURL: req.URL,
+			Tag:                req.Tag,
+			SHA256:             req.SHA256,
+		}, newSender(r, tokenAuth(tokens, req.ReleaseID)))
+	}
+}
+
+// RegistryRelease is a release triggered by the pushes of an image repository
+type RegistryRelease struct {
+	ReleaseID string
+	// URL is the download URL of the release, where "{tag}" is replaced by the
+	// pushed tag.
+	URL string
+}
+
+// registryPush is the input of the registry endpoint. It contains the fields
+// of both DockerHub and Harbor webhooks.
+type registryPush struct {
+	// DockerHub
+	PushData struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+
+	// Harbor
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Tag string `json:"tag"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// repository returns the pushed repository and tags
+func (p registryPush) repository() (string, []string) {
+	if p.Repository.RepoName != "" {
+		return p.Repository.RepoName, []string{p.PushData.Tag}
+	}
+
+	// Harbor notifies other events on the same webhook
+	if p.Type != "PUSH_ARTIFACT" {
+		return "", nil
+	}
+
+	tags := make([]string, 0, len(p.EventData.Resources))
+
+	for _, resource := range p.EventData.Resources {
+		if resource.Tag != "" {
+			tags = append(tags, resource.Tag)
+		}
+	}
+
+	return p.EventData.Repository.RepoFullName, tags
+}
+
+// registryResponse is the output of the registry endpoint
+type registryResponse struct {
+	Jobs []response `json:"jobs"`
+}
+
+// getRegistryHandler returns an HTTP handler that responds to the image push
+// webhooks of DockerHub and Harbor. Each pushed tag deploys the releases of the
+// repository, from their URL. The token of the releases, if any, can be given
+// with "?token=" or as a bearer token. It responds with 202 Accepted and the
+// jobs, or 200 OK if the event is not a push.
+func getRegistryHandler(d deployer.Deployer, releases map[string][]RegistryRelease,
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		var push registryPush
+
+		err := json.NewDecoder(r.Body).Decode(&push)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		repository, tags := push.repository()
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = bearerToken(r)
+		}
+
+		res := registryResponse{Jobs: []response{}}
+
+		if repository != "" {
+			if len(releases[repository]) == 0 {
+				http.Error(w, fmt.Sprintf("no release for repository %q", repository),
+					http.StatusNotFound)
+				return
+			}
+
+			for _, release := range releases[repository] {
+				if !authorized(tokens, release.ReleaseID, token) {
+					http.Error(w, "wrong token", http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+
+		requestID, _ := r.Context().Value(requestIDKey).(string)
+
+		for _, tag := range tags {
+			for _, release := range releases[repository] {
+				req := request{
+					BrowserDownloadURL: strings.ReplaceAll(release.URL, "{tag}", tag),
+					Tag:                tag,
+				}
+
+				deployReq, err := checkHookRequest(d, release.ReleaseID, req)
+				if err != nil {
+					hookError(w, err)
+					return
+				}
+
+				deployReq.RequestID = requestID
+				deployReq.Sender = newSender(r, tokenAuth(tokens, release.ReleaseID))
+
+				jobID, err := d.Deploy(deployReq)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to deploy: %v", err),
+						http.StatusInternalServerError)
+					return
+				}
+
+				res.Jobs = append(res.Jobs, response{
+					JobID:         jobID,
+					StatusURL:     "/api/status/" + url.PathEscape(jobID),
+					StreamURL:     "/api/jobs/stream",
+					QueuePosition: d.QueueLength(),
+				})
+			}
+		}
+
+		buf, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		code := http.StatusOK
+		if len(res.Jobs) != 0 {
+			code = http.StatusAccepted
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+
+		w.Write(append(buf, '\n'))
+	}
+}
+
+// bearerToken returns the token of the "Authorization: Bearer" header, if any
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(header, prefix)
+}
+
+// validSignature returns true if the signature, as "sha256=<hex>", is the
+// HMAC-SHA256 of the body with the secret
+func validSignature(secret string, body []byte, signature string) bool {
+	const prefix = "sha256="
+
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(sum, mac.Sum(nil))
+}
+
+// apiTokens holds the tokens accepted by the API
+type apiTokens struct {
+	// global is accepted for all the releases
+	global string
+	// releases are the tokens of the releases, by releaseID
+	releases map[string]string
+	// signed are the releases whose hooks must be signed with a webhook
+	// secret, by releaseID
+	signed map[string]bool
+}
+
+// authorized returns true if the token is the global token or the token of the
+// release. If the release has no token, it returns true if there is no global
+// token either, and if the hooks of the release don't need to be signed, as
+// it would otherwise be deployable by anyone through the other endpoints.
+func authorized(tokens apiTokens, releaseID, token string) bool {
+	if tokens.global != "" && sameToken(tokens.global, token) {
+		return true
+	}
+
+	expected := tokens.releases[releaseID]
+	if expected == "" {
+		return tokens.global == "" && !tokens.signed[releaseID]
+	}
+
+	return sameToken(expected, token)
+}
+
+// authorizedAny returns true if the token is the global token or the token of
+// any release
+func authorizedAny(tokens apiTokens, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	if sameToken(tokens.global, token) {
+		return true
+	}
+
+	for _, expected := range tokens.releases {
+		if sameToken(expected, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenAuth returns how an authorized request for the release is
+// authenticated: "token" if a token is required, or "none"
+func tokenAuth(tokens apiTokens, releaseID string) string {
+	if tokens.global == "" && tokens.releases[releaseID] == "" && !tokens.signed[releaseID] {
+		return "none"
+	}
+
+	return "token"
+}
+
+// newSender returns the identity of the sender of the request, for the
+// provenance of its deployment
+func newSender(r *http.Request, auth string) deployer.Sender {
+	return deployer.Sender{
+		Auth:      auth,
+		Addr:      r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Delivery:  r.Header.Get("X-GitHub-Delivery"),
+	}
+}
+
+// sameToken compares the tokens in constant time
+func sameToken(expected, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// deploy checks the request, queues the job, and responds with the jobID, as
+// described in getHookHandler.
+func deploy(w http.ResponseWriter, r *http.Request, d deployer.Deployer,
+	done <-chan struct{}, releaseID string, req request, sender deployer.Sender) {
+
+	deployReq, err := checkHookRequest(d, releaseID, req)
+	if err != nil {
+		hookError(w, err)
+		return
+	}
+
+	deployReq.RequestID, _ = r.Context().Value(requestIDKey).(string)
+	deployReq.Sender = sender
+
+	queue(w, r, d, done, func() (string, error) {
+		jobID, err := d.Deploy(deployReq)
+		if err != nil {
+			return "", fmt.Errorf("failed to deploy: %v", err)
+		}
+
+		return jobID, nil
+	})
+}
+
+// queue starts a job and responds with its jobID, or with its final status if
+// the request waits for it with "?wait=true".
+func queue(w http.ResponseWriter, r *http.Request, d deployer.Deployer,
+	done <-chan struct{}, start func() (string, error)) {
+
+	wait := r.URL.Query().Get("wait") == "true"
+
+	var events <-chan deployer.JobEvent
+
+	if wait {
+		// subscribed before deploying, so that no event is missed
+		var unsubscribe func()
+
+		events, unsubscribe = d.Subscribe()
+		defer unsubscribe()
+	}
+
+	jobID, err := start()
+	if errors.Is(err, deployer.ErrNoPrevious) || errors.Is(err, deployer.ErrNoArchive) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if errors.Is(err, deployer.ErrNoPromotion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := response{
+		JobID:         jobID,
+		StatusURL:     "/api/status/" + url.PathEscape(jobID),
+		StreamURL:     "/api/jobs/stream",
+		QueuePosition: d.QueueLength(),
+	}
+
+	code := http.StatusAccepted
+
+	if wait {
+		res.Status = waitJob(r.Context(), events, jobID, done)
+		if res.Status != nil {
+			code = http.StatusOK
+		}
+	}
+
+	buf, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Location", res.StatusURL)
+	w.WriteHeader(code)
+
+	w.Write(append(buf, '\n'))
+}
+
+// maxHookWait is the maximum time a hook waits for its job to finish
+const maxHookWait = 10 * time.Minute
+
+// waitJob returns the final status of the job from the events, or nil if the
+// job doesn't finish within maxHookWait, the request is canceled, or done is
+// closed.
+func waitJob(ctx context.Context, events <-chan deployer.JobEvent, jobID string,
+	done <-chan struct{}) *deployer.JobStatus {
+
+	timer := time.NewTimer(maxHookWait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.JobID == jobID && deployer.IsTerminal(event.Status) {
+				return &event.JobStatus
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// checkHookRequest validates a hook request and returns the corresponding
+// deployment request. It doesn't do any deployment work, so that the hook can
+// respond right away. If the request is not valid, it returns a
+// validationError with the error of each wrong field.
+func checkHookRequest(d deployer.Deployer, releaseID string, req request) (deployer.Request, error) {
+	var errs validationError
+	var releaseURL *url.URL
+	var err error
+
+	urlField := "browser_download_url"
+
+	switch {
+	case req.BrowserDownloadURL == "" && len(req.Assets) != 0:
+		urlField = "assets"
+
+		releaseURL, err = d.SelectAsset(releaseID, req.Assets)
+		if err != nil {
+			errs = append(errs, fieldError{Field: urlField, Message: err.Error()})
+		}
+	case req.BrowserDownloadURL == "":
+		errs = append(errs, fieldError{Field: urlField, Message: "missing, and no assets"})
+	default:
+		releaseURL, err = url.ParseRequestURI(req.BrowserDownloadURL)
+		if err != nil {
+			errs = append(errs, fieldError{Field: urlField, Message: err.Error()})
+		}
+	}
+
+	// the URL of a group is nil, its members check their own
+	if releaseURL != nil {
+		err = d.CheckURL(releaseID, releaseURL)
+		if err != nil {
+			errs = append(errs, fieldError{Field: urlField, Message: err.Error()})
+		}
+	}
+
+	fallbackURLs := make([]*url.URL, len(req.FallbackURLs))
+
+	for i, fallback := range req.FallbackURLs {
+		fallbackURLs[i], err = url.ParseRequestURI(fallback)
+		if err == nil {
+			err = d.CheckURL(releaseID, fallbackURLs[i])
+		}
+
+		if err != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("fallback_urls[%d]", i),
+				Message: err.Error()})
+		}
+	}
+
+	if req.Subpath != "" {
+		_, err = deployer.CleanSubpath(req.Subpath)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "subpath", Message: err.Error()})
+		}
+	}
+
+	var callbackURL *url.URL
+
+	if req.CallbackURL != "" {
+		callbackURL, err = url.ParseRequestURI(req.CallbackURL)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "callback_url", Message: err.Error()})
+		} else if callbackURL.Scheme != "http" && callbackURL.Scheme != "https" {
+			errs = append(errs, fieldError{Field: "callback_url",
+				Message: fmt.Sprintf("unsupported scheme %q", callbackURL.Scheme)})
+		} else {
+			// the callback carries the job event, and its signature, as the
+			// download carries the token
+			err = d.CheckURL(releaseID, callbackURL)
+			if err != nil {
+				errs = append(errs, fieldError{Field: "callback_url", Message: err.Error()})
+			}
+		}
+	}
+
+	if req.SHA256 != "" {
+		err = config.CheckSHA256(req.SHA256)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "sha256", Message: err.Error()})
+		}
+	}
+
+	if len(errs) != 0 {
+		return deployer.Request{}, errs
+	}
+
+	return deployer.Request{
+		ReleaseID:    releaseID,
+		Tag:          req.Tag,
+		ReleaseURL:   releaseURL,
+		FallbackURLs: fallbackURLs,
+		Notes:        req.Body,
+		Assets:       req.Assets,
+		Subpath:      req.Subpath,
+		CallbackURL:  callbackURL,
+		SHA256:       req.SHA256,
+	}, nil
+}
+
+// getStatusHandler return a handler that responds to GET requests to get the
+// status of a job. The jobID must be the last part of the URL. With "?wait=30s",
+// if the job is not done, it waits up to that duration, bounded by
+// maxStatusWait, for the status to change before responding. The status is
+// encoded in JSON, in plain text, or as a badge, see statusFormat.
+func getStatusHandler(d deployer.Deployer,
+	done <-chan struct{}) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		jobID := path.Base(r.URL.Path)
+
+		format, err := statusFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var wait time.Duration
+
+		if r.URL.Query().Get("wait") != "" {
+			var err error
+
+			wait, err = time.ParseDuration(r.URL.Query().Get("wait"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("wrong wait: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			if wait > maxStatusWait {
+				wait = maxStatusWait
+			}
+		}
+
+		var events <-chan deployer.JobEvent
+
+		if wait > 0 {
+			// subscribed before getting the status, so that no change is
+			// missed
+			var unsubscribe func()
+
+			events, unsubscribe = d.Subscribe()
+			defer unsubscribe()
+		}
+
+		status, err := d.GetStatus(jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if wait > 0 && !deployer.IsTerminal(status.Status) &&
+			waitChange(r.Context(), events, jobID, wait, done) {
+
+			status, err = d.GetStatus(jobID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to get status: %v", err),
+					http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Vary", "Accept")
+
+		switch format {
+		case "svg":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Add("Content-Type", "image/svg+xml;charset=utf-8")
+			badge.Render(statusLabel(status), statusValue(status), statusColor(status), w)
+		case "text":
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(statusText(status)))
+		default:
+			w.Header().Add("Content-Type", "application/json")
+
+			encoder := json.NewEncoder(w)
+
+			err = encoder.Encode(status)
+			if err != nil {
+				http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+					http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+}
+
+// statusActions routes the requests to /api/status/:jobID/stream to stream,
+// and the others to status
+func statusActions(status, stream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobID, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/status/"))
+		jobID = strings.TrimSuffix(jobID, "/")
+
+		if jobID == "" {
+			status.ServeHTTP(w, r)
+			return
+		}
+
+		if action != "stream" || strings.Contains(jobID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		stream.ServeHTTP(w, r)
+	})
+}
+
+// getStatusStreamHandler returns a handler that responds to GET requests to
+// /api/status/:jobID/stream with Server-Sent Events. It sends the current
+// status of the job, then its status each time it changes, and closes the
+// stream once the status is terminal.
+func getStatusStreamHandler(d deployer.Deployer,
+	done <-chan struct{}) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		jobID := path.Base(path.Dir(r.URL.Path))
+
+		// subscribed before getting the status, so that no change is missed
+		events, unsubscribe := d.Subscribe()
+		defer unsubscribe()
+
+		status, err := d.GetStatus(jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			err = writeEvent(w, "status", status)
+			if err != nil || deployer.IsTerminal(status.Status) {
+				flusher.Flush()
+				return
+			}
+
+			flusher.Flush()
+
+			changed := false
+
+			for !changed {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-done:
+					return
+				case <-keepAlive.C:
+					// comments are ignored by clients but keep proxies from
+					// closing the connection.
+					w.Write([]byte(": keep-alive\n\n"))
+					flusher.Flush()
+				case event := <-events:
+					changed = event.JobID == jobID
+				}
+			}
+
+			status, err = d.GetStatus(jobID)
+			if err != nil {
+				writeEvent(w, "error", err.Error())
+				flusher.Flush()
+				return
+			}
+		}
+	}
+}
+
+// statusMediaTypes are the formats of a job status, by media type
+var statusMediaTypes = map[string]string{
+	"application/json": "json",
+	"text/plain":       "text",
+	"image/svg+xml":    "svg",
+}
+
+// statusFormat returns the format of the status requested with "?format=",
+// which is "json", "text", or "svg". Otherwise, it returns the format of the
+// first media type of the Accept header that has one, or "json".
+func statusFormat(r *http.Request) (string, error) {
+	format := r.FormValue("format")
+
+	switch format {
+	case "json", "text", "svg":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		format, found := statusMediaTypes[mediaType]
+		if found {
+			return format, nil
+		}
+	}
+
+	return "json", nil
+}
+
+// statusColors are the badge colors of the job statuses
+var statusColors = map[string]badge.Color{
+	"created": badge.ColorLightgrey,
+	"running": badge.ColorBlue,
+	"ok":      badge.ColorBrightgreen,
+	"failed":  badge.ColorRed,
+}
+
+// statusLabel returns the label of the badge of a status, which is the
+// releaseID and tag of the job
+func statusLabel(status deployer.JobStatus) string {
+	label := strings.TrimSpace(status.ReleaseID + " " + status.Tag)
+	if label == "" {
+		return "Deployment"
+	}
+
+	return label
+}
+
+// statusValue returns the status shown by a badge, which is the combined one
+// if the job triggered other jobs
+func statusValue(status deployer.JobStatus) string {
+	if status.Combined != "" {
+		return status.Combined
+	}
+
+	return status.Status
+}
+
+// statusColor returns the badge color of a status
+func statusColor(status deployer.JobStatus) badge.Color {
+	color, found := statusColors[statusValue(status)]
+	if !found {
+		return badge.ColorLightgrey
+	}
+
+	return color
+}
+
+// statusText returns the status in a human-readable form, with a field per
+// line
+func statusText(status deployer.JobStatus) string {
+	var sb strings.Builder
+
+	sb.WriteString(status.Status)
+
+	if status.Message != "" {
+		sb.WriteString(": " + status.Message)
+	}
+
+	sb.WriteString("\n")
+
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sb, "%s: %s\n", name, value)
+		}
+	}
+
+	field("release", strings.TrimSpace(status.ReleaseID+" "+status.Tag))
+	field("combined", status.Combined)
+
+	for _, t := range []struct {
+		name string
+		time *time.Time
+	}{
+		{"created", status.CreatedAt},
+		{"started", status.StartedAt},
+		{"finished", status.FinishedAt},
+	} {
+		if t.time != nil {
+			field(t.name, t.time.Format(time.RFC3339))
+		}
+	}
+
+	if status.Duration != 0 {
+		field("duration", status.Duration.String())
+	}
+
+	field("request", status.RequestID)
+	field("chained", strings.Join(status.Chained, ", "))
+	field("group", strings.Join(status.Group, ", "))
+
+	if status.Progress != nil {
+		field("progress", progressText(*status.Progress))
+	}
+
+	if status.Scan != nil {
+		field("scan", scanText(*status.Scan))
+	}
+
+	return sb.String()
+}
+
+// progressText returns the progress of a job as a line of text
+func progressText(progress deployer.Progress) string {
+	percent := "?"
+	if progress.Percent >= 0 {
+		percent = fmt.Sprintf("%d%%", progress.Percent)
+	}
+
+	return fmt.Sprintf("%s %s, %d bytes, %d files", progress.Phase, percent,
+		progress.Bytes, progress.Files)
+}
+
+// scanText returns the result of a vulnerability scan as a line of text
+func scanText(result deployer.ScanResult) string {
+	verdict := "passed"
+	if !result.Passed {
+		verdict = fmt.Sprintf("blocked by %d at or above %s", len(result.Blocking), result.Severity)
+	}
+
+	total := 0
+	for _, count := range result.Counts {
+		total += count
+	}
+
+	return fmt.Sprintf("%s %s, %d findings", result.Target, verdict, total)
+}
+
+// maxStatusWait is the maximum time a status request waits for a change
+const maxStatusWait = time.Minute
+
+// waitChange returns true once an event of the job is received, or false if
+// none is received within the wait, the request is canceled, or done is
+// closed.
+func waitChange(ctx context.Context, events <-chan deployer.JobEvent, jobID string,
+	wait time.Duration, done <-chan struct{}) bool {
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.JobID == jobID {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-done:
+			return false
+		}
+	}
+}
+
+// health is the output of the health endpoint
+type health struct {
+	// Status is "ok", "degraded" if a target is flagged or the queue is full,
+	// or "stopped" if the deployer doesn't handle jobs
+	Status  string                           `json:"status"`
+	Targets map[string]deployer.TargetHealth `json:"targets,omitempty"`
+}
+
+// healthColors are the badge colors of the health statuses
+var healthColors = map[string]badge.Color{
+	"ok":       badge.ColorBrightgreen,
+	"degraded": badge.ColorOrange,
+	"stopped":  badge.ColorRed,
+}
+
+// getHealthHandler returns a handler that responds to GET requests to get the
+// health of Hodor. It responds with 503 Service Unavailable if the deployer is
+// stopped, if its queue is full, or if a target didn't match its last
+// deployment at startup. With "?format=svg", it responds with a badge of the
+// status, always with 200 OK so that it is displayed.
+func getHealthHandler(d deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		res := health{
+			Status:  "ok",
+			Targets: d.GetTargetsHealth(),
+		}
+
+		switch {
+		case !d.Running():
+			res.Status = "stopped"
+		case len(res.Targets) != 0 || d.QueueLength() >= deployer.QueueSize:
+			res.Status = "degraded"
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.FormValue("format") == "svg" {
+			w.Header().Add("Access-Control-Allow-Origin", "*")
+			w.Header().Add("Content-Type", "image/svg+xml;charset=utf-8")
+			badge.Render("Hodor", res.Status, healthColors[res.Status], w)
+			return
+		}
+
+		code := http.StatusOK
+
+		if res.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+
+		buf, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+
+		w.Write(append(buf, '\n'))
+	}
+}
+
+// getReleasesHandler returns a handler that responds to GET requests to get
+// the configured releases and their deployed tag.
+func getReleasesHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		releases, err := deployer.GetReleases()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get releases: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(releases)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// maintenanceRequest is the input of the maintenance endpoint
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// maintenanceResponse is the output of the maintenance endpoint
+type maintenanceResponse struct {
+	ReleaseID   string `json:"release_id"`
+	Maintenance bool   `json:"maintenance"`
+	// Deferred is the number of jobs deferred, or resumed if the maintenance
+	// is lifted
+	Deferred int `json:"deferred"`
+}
+
+// getMaintenanceHandler returns a handler that responds to POST requests to
+// put a release in maintenance, or lift it, with {"enabled": true|false}. The
+// URL must be /api/releases/:releaseID/maintenance.
+func getMaintenanceHandler(d deployer.Deployer,
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseID, action, ok := releaseAction(r)
+		if !ok || action != "maintenance" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		if !authorized(tokens, releaseID, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		var req maintenanceRequest
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		if req.Enabled == nil {
+			http.Error(w, "\"enabled\" is missing", http.StatusBadRequest)
+			return
+		}
+
+		deferred, err := d.SetMaintenance(releaseID, *req.Enabled)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to set maintenance: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(maintenanceResponse{
+			ReleaseID:   releaseID,
+			Maintenance: *req.Enabled,
+			Deferred:    deferred,
+		})
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getPromoteHandler returns a handler that responds to POST requests to deploy
+// the archive of a release's last deployment to the release it promotes to,
+// such as from staging to production, as the hook does. It requires the token
+// of the release it promotes to, and responds with 409 Conflict if the archive
+// is not kept. The URL must be /api/releases/:releaseID/promote.
+func getPromoteHandler(d deployer.Deployer, done <-chan struct{},
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseID, action, ok := releaseAction(r)
+		if !ok || action != "promote" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		releases, err := d.GetReleases()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get releases: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		// the deployer rejects a release that doesn't promote
+		promoted := releaseID
+
+		for _, release := range releases {
+			if release.ReleaseID == releaseID && release.Promote != "" {
+				promoted = release.Promote
+			}
+		}
+
+		if !authorized(tokens, promoted, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		queue(w, r, d, done, func() (string, error) {
+			jobID, err := d.Promote(releaseID)
+			if err != nil {
+				return "", fmt.Errorf("failed to promote: %w", err)
+			}
+
+			return jobID, nil
+		})
+	}
+}
+
+// getSBOMHandler returns a handler that responds to GET requests to get the
+// SBOM of the release's last deployment, with the media type of its format. It
+// responds with 404 Not Found if the deployed release has no SBOM. The URL
+// must be /api/releases/:releaseID/sbom.
+func getSBOMHandler(d deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseID, action, ok := releaseAction(r)
+		if !ok || action != "sbom" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		sbom, content, err := d.GetSBOM(releaseID)
+		if errors.Is(err, deployer.ErrNoSBOM) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get SBOM: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", sbom.MediaType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": sbom.File}))
+		w.Header().Set("ETag", strconv.Quote(sbom.SHA256))
+
+		w.Write(content)
+	}
+}
+
+// releaseActions routes the requests to /api/releases/:releaseID/:action to
+// the handler of the action
+func releaseActions(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, action, ok := releaseAction(r)
+
+		handler, found := handlers[action]
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// releaseAction returns the releaseID and the action of a request to
+// /api/releases/:releaseID/:action. It returns false if the URL doesn't have
+// this form.
+func releaseAction(r *http.Request) (string, string, bool) {
+	releaseID, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/releases/"))
+	releaseID = strings.TrimSuffix(releaseID, "/")
+
+	if releaseID == "" || strings.Contains(releaseID, "/") {
+		return "", "", false
+	}
+
+	return releaseID, action, true
+}
+
+// getTagsHandler return a handler that responds to GET requests to get the
+// latest tag saved for a releaseID. The badge of the release can be customized
+// with the label, color, and style query parameters, and shows "failed" if the
+// last deployment of the release failed.
+func getTagsHandler(deployer deployer.Deployer,
+	badges map[string]config.Badge) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		releaseID := path.Base(r.URL.Path)
+
+		tag, err := deployer.GetLatestTag(releaseID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get tag: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		cacheSince := time.Now().Format(http.TimeFormat)
+		cacheUntil := time.Now().Add(time.Minute * 2).Format(http.TimeFormat)
+
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "max-age=120, s-maxage=120")
+		w.Header().Set("Date", cacheSince)
+		w.Header().Set("Last-Modified", cacheSince)
+		w.Header().Set("Expires", cacheUntil)
+
+		format := r.FormValue("format")
+
+		switch format {
+		case "svg":
+			conf := tagBadge(badges[releaseID], r)
+
+			err = config.CheckBadge(conf)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("wrong badge: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			failed, err := lastFailed(deployer, releaseID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to get failures: %v", err),
+					http.StatusInternalServerError)
+				return
+			}
+
+			if failed {
+				tag = "failed"
+				conf.Color = string(badge.ColorRed)
+			}
+
+			w.Header().Add("Content-Type", "image/svg+xml;charset=utf-8")
+			renderBadge(conf, tag, w)
+		default:
+			w.Header().Add("Content-Type", "text/plain")
+			w.Write([]byte(tag))
+		}
+	}
+}
+
+// tagBadge returns the badge of a release, overridden by the query parameters
+// of the request, with the default label and color
+func tagBadge(conf config.Badge, r *http.Request) config.Badge {
+	if r.FormValue("label") != "" {
+		conf.Label = r.FormValue("label")
+	}
+
+	if r.FormValue("color") != "" {
+		conf.Color = r.FormValue("color")
+	}
+
+	if r.FormValue("style") != "" {
+		conf.Style = r.FormValue("style")
+	}
+
+	if conf.Label == "" {
+		conf.Label = "Deployed"
+	}
+
+	if conf.Color == "" {
+		conf.Color = string(badge.ColorBlue)
+	}
+
+	return conf
+}
+
+// lastFailed returns true if the last deployment of the release failed, that
+// is if its most recent failure is more recent than its most recent
+// deployment
+func lastFailed(d deployer.Deployer, releaseID string) (bool, error) {
+	failures, err := d.GetFailures(releaseID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(failures) == 0 {
+		return false, nil
+	}
+
+	history, err := d.GetHistory(releaseID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(history) == 0 {
+		return true, nil
+	}
+
+	return failures[0].FailedAt.After(history[0].DeployedAt), nil
+}
+
+// renderBadge renders the badge in the color and style of the configuration,
+// which must be valid. The flat-square style is the flat badge without its
+// rounded corners and gradient.
+func renderBadge(conf config.Badge, value string, w io.Writer) error {
+	color := badge.Color(conf.Color)
+
+	_, named := badge.ColorScheme[conf.Color]
+	if !named && !strings.HasPrefix(conf.Color, "#") {
+		color = badge.Color("#" + conf.Color)
+	}
+
+	if conf.Style != "flat-square" {
+		return badge.Render(conf.Label, value, color, w)
+	}
+
+	svg, err := badge.RenderBytes(conf.Label, value, color)
+	if err != nil {
+		return err
+	}
+
+	svg = bytes.Replace(svg, []byte(`rx="3"`), []byte(`rx="0"`), -1)
+	svg = bytes.Replace(svg, []byte(`fill="url(#smooth)"`), []byte(`fill="none"`), -1)
+
+	_, err = w.Write(svg)
+
+	return err
+}
+
+// getHistoryHandler returns a handler that responds to GET requests to get the
+// deployment history of a release, from the most recent. The releaseID must be
+// the last part of the URL.
+func getHistoryHandler(deployer deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		releaseID := path.Base(r.URL.Path)
+
+		history, err := deployer.GetHistory(releaseID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get history: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(history)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getFreezesHandler returns a handler that responds to GET requests to list
+// the freezes, from the most recent, and passes POST requests to create.
+func getFreezesHandler(d deployer.Deployer, create http.HandlerFunc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			create(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		freezes, err := d.GetFreezes()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get freezes: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(freezes)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getFreezeHandler returns a handler that responds to POST requests to freeze
+// releases. It requires the token of each release, if set.
+func getFreezeHandler(d deployer.Deployer, tokens apiTokens) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var freeze deployer.Freeze
+
+		err := json.NewDecoder(r.Body).Decode(&freeze)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		for _, releaseID := range freeze.ReleaseIDs {
+			if !authorized(tokens, releaseID, bearerToken(r)) {
+				http.Error(w, "wrong token", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		freeze, err = d.Freeze(freeze)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to freeze: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		writeFreeze(w, http.StatusCreated, freeze)
+	}
+}
+
+// liftRequest is the input of the lift endpoint
+type liftRequest struct {
+	LiftedBy string `json:"liftedBy"`
+}
+
+// getLiftFreezeHandler returns a handler that responds to POST requests to
+// lift a freeze before it ends. The URL must be /api/freezes/:freezeID/lift.
+// It requires the token of each frozen release, if set.
+func getLiftFreezeHandler(d deployer.Deployer, tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		freezeID, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/freezes/"))
+		freezeID = strings.TrimSuffix(freezeID, "/")
+
+		if action != "lift" || freezeID == "" || strings.Contains(freezeID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		freezes, err := d.GetFreezes()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get freezes: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		for _, freeze := range freezes {
+			if freeze.ID != freezeID {
+				continue
+			}
+
+			for _, releaseID := range freeze.ReleaseIDs {
+				if !authorized(tokens, releaseID, bearerToken(r)) {
+					http.Error(w, "wrong token", http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+
+		var req liftRequest
+
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		freeze, err := d.LiftFreeze(freezeID, req.LiftedBy)
+		if errors.Is(err, deployer.ErrFreezeNotFound) {
+			http.Error(w, fmt.Sprintf("failed to lift freeze: %v", err), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to lift freeze: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		writeFreeze(w, http.StatusOK, freeze)
+	}
+}
+
+// writeFreeze responds with the freeze, as JSON
+func writeFreeze(w http.ResponseWriter, code int, freeze deployer.Freeze) {
+	buf, err := json.Marshal(freeze)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	w.Write(append(buf, '\n'))
+}
+
+const (
+	// defaultJobsLimit is the number of jobs listed by default
+	defaultJobsLimit = 20
+	// maxJobsLimit is the maximum number of jobs listed at once
+	maxJobsLimit = 100
+)
+
+// jobsPage is the output of the jobs endpoint
+type jobsPage struct {
+	Jobs   []deployer.JobSummary `json:"jobs"`
+	Limit  int                   `json:"limit"`
+	Offset int                   `json:"offset"`
+	// NextOffset is the offset of the next page, if there are more jobs
+	NextOffset int `json:"nextOffset,omitempty"`
+}
+
+// getJobsHandler returns a handler that responds to GET requests to list the
+// jobs, from the most recent. The jobs can be filtered with "?releaseID=", and
+// paginated with "?limit=" and "?offset=".
+func getJobsHandler(d deployer.Deployer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		page := jobsPage{Limit: defaultJobsLimit}
+
+		var err error
+
+		if r.FormValue("limit") != "" {
+			page.Limit, err = strconv.Atoi(r.FormValue("limit"))
+			if err != nil || page.Limit < 1 || page.Limit > maxJobsLimit {
+				http.Error(w, fmt.Sprintf("wrong limit: must be between 1 and %d",
+					maxJobsLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if r.FormValue("offset") != "" {
+			page.Offset, err = strconv.Atoi(r.FormValue("offset"))
+			if err != nil || page.Offset < 0 {
+				http.Error(w, "wrong offset: must be positive", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// one more job tells if there is a next page
+		jobs, err := d.ListJobs(r.FormValue("releaseID"), page.Limit+1, page.Offset)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list jobs: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if len(jobs) > page.Limit {
+			jobs = jobs[:page.Limit]
+			page.NextOffset = page.Offset + page.Limit
+		}
+
+		page.Jobs = jobs
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(page)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// setStatusRequest is the expected input from a set status request
+type setStatusRequest struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// getSetStatusHandler returns a handler that responds to POST requests to set
+// a custom status of a running job, or to set it back to "running". The URL
+// must be /api/jobs/:jobID/status. It requires the token of the job's release,
+// if set, and responds with the updated status.
+func getSetStatusHandler(d deployer.Deployer, tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID, action, ok := jobAction(r)
+		if !ok || action != "status" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		status, err := d.GetStatus(jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusNotFound)
+			return
+		}
+
+		if !authorized(tokens, status.ReleaseID, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		var req setStatusRequest
+
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		err = d.SetStatus(jobID, req.Status, req.Message)
+		if errors.Is(err, deployer.ErrTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to set status: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		status, err = d.GetStatus(jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(status)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getRetainedHandler returns a handler that responds to GET requests to
+// /api/jobs/:jobID/archive and /api/jobs/:jobID/log with the files retained
+// for a failed job, if its entry retains them. It requires the token of the
+// job's release, if set, even if the server is not private.
+func getRetainedHandler(d deployer.Deployer, tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID, file, ok := jobAction(r)
+		if !ok || (file != deployer.RetainedArchive && file != deployer.RetainedLog) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		status, err := d.GetStatus(jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusNotFound)
+			return
+		}
+
+		if !authorized(tokens, status.ReleaseID, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		f, err := d.GetRetained(jobID, file)
+		if errors.Is(err, deployer.ErrNotRetained) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get retained file: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		defer f.Close()
+
+		stat, err := f.Stat()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to stat retained file: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if file == deployer.RetainedLog {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+				map[string]string{"filename": jobID + ".archive"}))
+		}
+
+		http.ServeContent(w, r, "", stat.ModTime(), f)
+	}
+}
+
+// jobActions routes the requests to /api/jobs/:jobID/:action to the handler
+// of the action
+func jobActions(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, action, ok := jobAction(r)
+
+		handler, found := handlers[action]
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// jobAction returns the jobID and the action of a request to
+// /api/jobs/:jobID/:action. It returns false if the URL doesn't have this
+// form.
+func jobAction(r *http.Request) (string, string, bool) {
+	jobID, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	jobID = strings.TrimSuffix(jobID, "/")
+
+	if jobID == "" || strings.Contains(jobID, "/") {
+		return "", "", false
+	}
+
+	return jobID, action, true
+}
+
+// listRequest is the expected input from a list request
+type listRequest struct {
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// getListHandler returns a handler that responds to POST requests by listing
+// the content of a release, without deploying it. It is a write handler since
+// it makes Hodor download any URL, with the GitHub token for GitHub's, so it
+// requires the global token or the token of a release, checked by
+// authorizedAny. The download is canceled with the request.
+func getListHandler(deployer deployer.Deployer, tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		if !authorizedAny(tokens, bearerToken(r)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		var req listRequest
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		releaseURL, err := url.ParseRequestURI(req.BrowserDownloadURL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("wrong url: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		listing, err := deployer.List(r.Context(), releaseURL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+
+		err = encoder.Encode(listing)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getJobsStreamHandler returns a handler that responds to GET requests by
+// streaming the job events as Server-Sent Events, until the client
+// disconnects or done is closed.
+func getJobsStreamHandler(deployer deployer.Deployer,
+	done <-chan struct{}) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := deployer.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-done:
+				return
+			case <-keepAlive.C:
+				// comments are ignored by clients but keep proxies from
+				// closing the connection.
+				w.Write([]byte(": keep-alive\n\n"))
+			case event := <-events:
+				err := writeEvent(w, "status", event)
+				if err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// keepAliveInterval is the interval at which a comment is sent on streams
+const keepAliveInterval = 15 * time.Second
+
+// writeEvent writes a Server-Sent Event with the JSON encoded data
+func writeEvent(w io.Writer, name string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, buf)
+	if err != nil {
+		return fmt.Errorf("failed to write event: %v", err)
+	}
+
+	return nil
+}
+
+// writeTimeout is the time a non-streaming handler has to respond
+const writeTimeout = 10 * time.Second
+
+// timeout is a utility function that limits the time a handler has to
+// respond.
+func timeout(handler http.HandlerFunc) http.Handler {
+	return http.TimeoutHandler(handler, writeTimeout, "request timeout")
+}
+
+// waitable is like timeout, except for requests with a "wait" parameter, whose
+// handler bounds the time it waits.
+func waitable(handler http.HandlerFunc) http.Handler {
+	limited := timeout(handler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "" {
+			handler(w, r)
+			return
+		}
+
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// private returns a utility function that rejects the requests without a
+// token accepted by authorized, with the last part of the URL as releaseID, or
+// the releaseID of /api/releases/:releaseID/:action, if perRelease is true, or
+// else by authorizedAny. Badges are not rejected if publicBadges is true, or if
+// their URL is signed with badgeSecret and not expired, so both must only be
+// set for the handlers that render badges.
+func private(tokens apiTokens, publicBadges bool, badgeSecret string,
+	perRelease bool) func(http.HandlerFunc) http.HandlerFunc {
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if publicBadges && r.FormValue("format") == "svg" {
+				next(w, r)
+				return
+			}
+
+			if badgeSecret != "" && validBadge(badgeSecret, r, time.Now()) {
+				next(w, r)
+				return
+			}
+
+			token := bearerToken(r)
+
+			ok := authorizedAny(tokens, token)
+			if perRelease {
+				releaseID := path.Base(r.URL.Path)
+
+				// the releaseID of /api/releases/:releaseID/:action is not
+				// the last part of the URL
+				actionReleaseID, _, isAction := releaseAction(r)
+				if isAction {
+					releaseID = actionReleaseID
+				}
+
+				ok = token != "" && authorized(tokens, releaseID, token)
+			}
+
+			if !ok {
+				w.Header().Add("Access-Control-Allow-Origin", "*")
+				http.Error(w, "wrong token", http.StatusUnauthorized)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// badgeRequest is the expected input of a request to sign a badge URL
+type badgeRequest struct {
+	// Path is the path of the badge, "/api/tags/:releaseID" or
+	// "/api/status/:jobID"
+	Path string `json:"path"`
+	// TTL is how long the URL is valid, such as "720h". Defaults to
+	// defaultBadgeTTL.
+	TTL string `json:"ttl"`
+}
+
+// badgeResponse is the output of a request to sign a badge URL
+type badgeResponse struct {
+	// URL is relative to the server
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// defaultBadgeTTL is how long a signed badge URL is valid if not requested
+const defaultBadgeTTL = 30 * 24 * time.Hour
+
+// getBadgeHandler returns a handler that responds to POST requests to sign the
+// URL of a badge, so that it can be embedded without a token on a private
+// server. It requires the token of the badge's release: the one of the tags,
+// or the one of the job.
+func getBadgeHandler(d deployer.Deployer, secret string,
+	tokens apiTokens) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "wrong action", http.StatusForbidden)
+			return
+		}
+
+		if secret == "" {
+			http.Error(w, "signed badges are not configured", http.StatusNotFound)
+			return
+		}
+
+		var req badgeRequest
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		ttl := defaultBadgeTTL
+
+		if req.TTL != "" {
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("wrong ttl %q", req.TTL), http.StatusBadRequest)
+				return
+			}
+		}
+
+		prefix, id := path.Split(req.Path)
+
+		var releaseID string
+
+		switch {
+		case id == "":
+			http.Error(w, fmt.Sprintf("wrong path %q", req.Path), http.StatusBadRequest)
+			return
+
+		case prefix == "/api/tags/":
+			releaseID = id
+
+		case prefix == "/api/status/":
+			status, err := d.GetStatus(id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusNotFound)
+				return
+			}
+
+			releaseID = status.ReleaseID
+
+		default:
+			http.Error(w, fmt.Sprintf("wrong path %q: not a badge", req.Path),
+				http.StatusBadRequest)
+			return
+		}
+
+		token := bearerToken(r)
+
+		if token == "" || !authorized(tokens, releaseID, token) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+
+		buf, err := json.Marshal(badgeResponse{
+			URL:     SignBadge(secret, req.Path, expires),
+			Expires: expires.UTC(),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal response: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(buf, '\n'))
+	}
+}
+
+// SignBadge returns the URL of the badge at the path, such as
+// "/api/tags/siteX", with a signature that is valid until expires.
+func SignBadge(secret, badgePath string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("format", "svg")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", badgeSignature(secret, badgePath, expires.Unix()))
+
+	u := url.URL{Path: badgePath, RawQuery: query.Encode()}
+
+	return u.String()
+}
+
+// badgeSignature returns the hex-encoded HMAC-SHA256 of the badge path and of
+// its expiry, in Unix time
+func badgeSignature(secret, badgePath string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%d", badgePath, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validBadge returns true if the request is for a badge, signed with the
+// secret, and not expired
+func validBadge(secret string, r *http.Request, now time.Time) bool {
+	query := r.URL.Query()
+
+	if query.Get("format") != "svg" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return false
+	}
+
+	expected, _ := hex.DecodeString(badgeSignature(secret, r.URL.Path, expires))
+
+	return hmac.Equal(signature, expected)
+}
+
+// readOnly is a utility function that rejects all requests with a 503 status
+func readOnly(http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		http.Error(w, "server is in read-only mode", http.StatusServiceUnavailable)
+	}
+}
+
+// logging is a utility function that logs the http server events
+func logging(logger zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				requestID, ok := r.Context().Value(requestIDKey).(string)
+				if !ok {
+					requestID = "unknown"
+				}
+				logger.Info().Str(logs.RequestIDKey, requestID).
+					Str("method", r.Method).
+					Str("url", r.URL.Path).
+					Str("remoteAddr", r.RemoteAddr).
+					Str("agent", r.UserAgent()).Msg("")
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// request durations
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeKey identifies the requests of a route with a method
+type routeKey struct {
+	route  string
+	method string
+}
+
+// routeMetrics are the metrics of the requests of a route with a method
+type routeMetrics struct {
+	// statuses counts the requests per status class, such as "2xx"
+	statuses map[string]uint64
+	// buckets counts the requests per duration bucket, not cumulated
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// newRequestMetrics returns new empty request metrics
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		routes: make(map[routeKey]*routeMetrics),
+		now:    time.Now,
+	}
+}
+
+// requestMetrics records the count, the status class, and the duration of the
+// requests per route and method, and serves them in the Prometheus text
+// format.
+//
+// - implements http.Handler
+type requestMetrics struct {
+	sync.Mutex
+	routes map[routeKey]*routeMetrics
+	now    func() time.Time
+}
+
+// instrument returns a handler that records the requests to the route, such
+// as "/api/status/:jobID", before passing them to next
+func (m *requestMetrics) instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := m.now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			m.record(routeKey{route: route, method: r.Method}, recorder.status,
+				m.now().Sub(start))
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// record adds a request with its status and duration
+func (m *requestMetrics) record(key routeKey, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	metrics, found := m.routes[key]
+	if !found {
+		metrics = &routeMetrics{
+			statuses: make(map[string]uint64),
+			buckets:  make([]uint64, len(durationBuckets)),
+		}
+		m.routes[key] = metrics
+	}
+
+	metrics.statuses[fmt.Sprintf("%dxx", status/100)]++
+
+	seconds := duration.Seconds()
+
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			metrics.buckets[i]++
+			break
+		}
+	}
+
+	metrics.sum += seconds
+	metrics.count++
+}
+
+// ServeHTTP implements http.Handler. It writes the metrics in the Prometheus
+// text format, sorted by route and method.
+func (m *requestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	keys := make([]routeKey, 0, len(m.routes))
+	for key := range m.routes {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+
+		return keys[i].method < keys[j].method
+	})
+
+	buf := new(bytes.Buffer)
+
+	buf.WriteString("# HELP hodor_http_requests_total Number of HTTP requests per route, method, and status class.\n")
+	buf.WriteString("# TYPE hodor_http_requests_total counter\n")
+
+	for _, key := range keys {
+		statuses := m.routes[key].statuses
+
+		classes := make([]string, 0, len(statuses))
+		for class := range statuses {
+			classes = append(classes, class)
+		}
+
+		sort.Strings(classes)
+
+		for _, class := range classes {
+			fmt.Fprintf(buf, "hodor_http_requests_total{route=%q,method=%q,status=%q} %d\n",
+				key.route, key.method, class, statuses[class])
+		}
+	}
+
+	buf.WriteString("# HELP hodor_http_request_duration_seconds Duration of the HTTP requests per route and method.\n")
+	buf.WriteString("# TYPE hodor_http_request_duration_seconds histogram\n")
+
+	for _, key := range keys {
+		metrics := m.routes[key]
+		labels := fmt.Sprintf("route=%q,method=%q", key.route, key.method)
+
+		var cumulated uint64
+
+		for i, bound := range durationBuckets {
+			cumulated += metrics.buckets[i]
+			fmt.Fprintf(buf, "hodor_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulated)
+		}
+
+		fmt.Fprintf(buf, "hodor_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, metrics.count)
+		fmt.Fprintf(buf, "hodor_http_request_duration_seconds_sum{%s} %s\n",
+			labels, strconv.FormatFloat(metrics.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "hodor_http_request_duration_seconds_count{%s} %d\n",
+			labels, metrics.count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// statusRecorder records the status of a response. It keeps the response
+// flushable, for the streams.
+//
+// - implements http.ResponseWriter
+// - implements http.Flusher
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (r *statusRecorder) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// tracing is a utility function that adds header tracing
+func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-Id")
+			if requestID == "" {
 				requestID = nextRequestID()
 			}
 			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
@@ -287,3 +3386,277 @@ func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// noCORS is a utility function that removes the CORS headers of the
+// responses, so that browsers don't let other origins read them
+func noCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerFilter{ResponseWriter: w, prefix: "Access-Control-"}, r)
+	})
+}
+
+// headerFilter removes the headers with a prefix before they are written.
+//
+// - implements http.ResponseWriter
+// - implements http.Flusher
+type headerFilter struct {
+	http.ResponseWriter
+	prefix      string
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (f *headerFilter) WriteHeader(status int) {
+	if !f.wroteHeader {
+		f.wroteHeader = true
+
+		for key := range f.Header() {
+			if strings.HasPrefix(key, f.prefix) {
+				f.Header().Del(key)
+			}
+		}
+	}
+
+	f.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (f *headerFilter) Write(b []byte) (int, error) {
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+
+	return f.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (f *headerFilter) Flush() {
+	flusher, ok := f.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// compress is a utility function that compresses the text responses with gzip
+// if the client accepts it
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of the request
+// contains gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(strings.Split(encoding, ";")[0])
+		if encoding == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressible returns true if responses of the content type are worth
+// compressing. Streams are not, so that their events are not delayed by
+// proxies.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "image/svg+xml":
+		return true
+	default:
+		return false
+	}
+}
+
+// gzipWriter compresses the response once its headers show that it is
+// compressible. It keeps the response flushable, for the streams.
+//
+// - implements http.ResponseWriter
+// - implements http.Flusher
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	header := w.Header()
+
+	if compressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusPartialContent &&
+		status != http.StatusNotModified {
+
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// close writes the end of the compressed response, if any
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// The default rate limit of each client address
+const (
+	defaultRateRequests = 10
+	defaultRateBurst    = 20
+)
+
+// maxRateClients is the number of clients above which the clients that have
+// all their requests again are forgotten
+const maxRateClients = 10000
+
+// rateLimit is a utility function that rejects the requests of a client
+// address that exceeds the rate limit with a 429 status
+func rateLimit(conf config.RateLimit, now func() time.Time) func(http.Handler) http.Handler {
+	limiter := &rateLimiter{
+		rate:    conf.Requests,
+		burst:   float64(conf.Burst),
+		now:     now,
+		buckets: make(map[string]*rateBucket),
+	}
+
+	if limiter.rate == 0 {
+		limiter.rate = defaultRateRequests
+	}
+
+	if limiter.burst == 0 {
+		limiter.burst = defaultRateBurst
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+
+			wait := limiter.take(client)
+			if wait > 0 {
+				retryAfter := int(math.Ceil(wait.Seconds()))
+
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimiter limits the requests of each client with a token bucket, which
+// holds up to burst requests and gains rate requests per second
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	now     func() time.Time
+	buckets map[string]*rateBucket
+}
+
+// rateBucket holds the requests a client can make, as of last
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a request of the client, and returns 0 if it had one, or else
+// the time until it has one
+func (l *rateLimiter) take(client string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateClients {
+			l.forget(now)
+		}
+
+		bucket = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+
+	return 0
+}
+
+// forget removes the clients whose bucket is full again. It must be called
+// with the lock.
+func (l *rateLimiter) forget(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -2,20 +2,40 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/narqo/go-badge"
+	"github.com/nkcr/hodor/asset"
+	"github.com/nkcr/hodor/config"
 	"github.com/nkcr/hodor/deployer"
+	"github.com/nkcr/hodor/scan"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
@@ -27,6 +47,7 @@ func TestScenario(t *testing.T) {
 
 	deployer := fakeDeployer{
 		deployReturn: "XX",
+		queueLength:  2,
 	}
 
 	server := NewHookHTTP("localhost:0", deployer, logger)
@@ -70,12 +91,300 @@ func TestScenario(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
 
 	res, err := ioutil.ReadAll(resp.Body)
 	require.NoError(t, err)
 
-	require.Equal(t, fmt.Sprintf("{\"jobID\":%q}", deployer.deployReturn), string(res))
+	require.Equal(t, "/api/status/XX", resp.Header.Get("Location"))
+	require.Equal(t, "{\"jobID\":\"XX\",\"statusURL\":\"/api/status/XX\","+
+		"\"streamURL\":\"/api/jobs/stream\",\"queuePosition\":2}\n", string(res))
+}
+
+func TestConnections(t *testing.T) {
+	server := NewHookHTTP("localhost:0", fakeDeployer{}, zerolog.New(io.Discard))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		err := server.Start()
+		require.NoError(t, err)
+	}()
+
+	defer func() {
+		server.Stop()
+		wait.Wait()
+	}()
+
+	require.Eventually(t, func() bool {
+		return server.GetAddr() != nil
+	}, time.Second, time.Millisecond*10)
+
+	require.Equal(t, 0, server.Connections())
+
+	conn, err := net.Dial("tcp", server.GetAddr().String())
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return server.Connections() == 1
+	}, time.Second, time.Millisecond*10)
+
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		return server.Connections() == 0
+	}, time.Second, time.Millisecond*10)
+
+	require.Equal(t, 0, HookHTTP{}.Connections())
+}
+
+func TestWithListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	server := NewHookHTTP("", fakeDeployer{latestTag: "v1"}, zerolog.New(io.Discard),
+		WithListener(ln))
+
+	require.Equal(t, ln.Addr(), server.GetAddr())
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		err := server.Start()
+		require.NoError(t, err)
+	}()
+
+	defer func() {
+		server.Stop()
+		wait.Wait()
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/api/tags/XX")
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(buf))
+}
+
+func TestMiddlewares_Default(t *testing.T) {
+	server := NewHookHTTP("", fakeDeployer{latestTag: "v1"}, zerolog.New(io.Discard))
+	handler := server.(*HookHTTP).server.Handler
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.NotEmpty(t, rr.Header().Get("X-Request-Id"))
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "v1", rr.Body.String())
+}
+
+func TestMiddlewares_Toggled(t *testing.T) {
+	server := NewHookHTTP("", fakeDeployer{latestTag: "v1"}, zerolog.New(io.Discard),
+		WithMiddlewares(config.HTTPConfig{Middlewares: map[string]bool{
+			"cors":        false,
+			"tracing":     false,
+			"compression": true,
+		}}))
+	handler := server.(*HookHTTP).server.Handler
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr.Header().Get("X-Request-Id"))
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+
+	buf, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(buf))
+
+	// the clients that don't accept gzip get the plain response
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "v1", rr.Body.String())
+}
+
+func TestMiddlewares_Rate_Limit(t *testing.T) {
+	server := NewHookHTTP("", fakeDeployer{latestTag: "v1"}, zerolog.New(io.Discard),
+		WithMiddlewares(config.HTTPConfig{
+			Middlewares: map[string]bool{"rate_limit": true},
+			RateLimit:   config.RateLimit{Requests: 0.5, Burst: 1},
+		}))
+	handler := server.(*HookHTTP).server.Handler
+
+	statuses := []int{}
+
+	for _, addr := range []string{"1.2.3.4:1000", "1.2.3.4:1001", "5.6.7.8:1000"} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+		require.NoError(t, err)
+
+		req.RemoteAddr = addr
+
+		handler.ServeHTTP(rr, req)
+
+		statuses = append(statuses, rr.Result().StatusCode)
+
+		if rr.Result().StatusCode == http.StatusTooManyRequests {
+			require.Equal(t, "2", rr.Header().Get("Retry-After"))
+		}
+	}
+
+	// the limit is per client address
+	require.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK}, statuses)
+}
+
+func TestRateLimiter_Take(t *testing.T) {
+	now := time.Now()
+
+	limiter := &rateLimiter{
+		rate:    1,
+		burst:   2,
+		now:     func() time.Time { return now },
+		buckets: make(map[string]*rateBucket),
+	}
+
+	require.Equal(t, time.Duration(0), limiter.take("a"))
+	require.Equal(t, time.Duration(0), limiter.take("a"))
+	require.Equal(t, time.Second, limiter.take("a"))
+	require.Equal(t, time.Duration(0), limiter.take("b"))
+
+	now = now.Add(500 * time.Millisecond)
+	require.Equal(t, 500*time.Millisecond, limiter.take("a"))
+
+	now = now.Add(time.Second)
+	require.Equal(t, time.Duration(0), limiter.take("a"))
+
+	// the clients with all their requests are forgotten
+	now = now.Add(time.Minute)
+	limiter.forget(now)
+	require.Empty(t, limiter.buckets)
+}
+
+func TestTLS(t *testing.T) {
+	tmpDir := t.TempDir()
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+
+	writeCertificate(t, certFile, keyFile, "hodor.test")
+
+	cert, err := NewCertificate(certFile, keyFile, 0, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	// the listener is created beforehand, so that its address is known before
+	// the server starts
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	server := NewHookHTTP("", fakeDeployer{}, zerolog.New(io.Discard), WithTLS(cert),
+		WithListener(ln))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		err := server.Start()
+		require.NoError(t, err)
+	}()
+
+	defer func() {
+		server.Stop()
+		wait.Wait()
+	}()
+
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	res, err := client.Get("https://" + server.GetAddr().String() + "/healthz")
+	require.NoError(t, err)
+
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "hodor.test", res.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// plain HTTP is refused
+	res, err = http.Get("http://" + server.GetAddr().String() + "/healthz")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestCertificate_Reload(t *testing.T) {
+	tmpDir := t.TempDir()
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+
+	_, err := NewCertificate(certFile, keyFile, 0, zerolog.New(io.Discard))
+	require.Error(t, err)
+
+	writeCertificate(t, certFile, keyFile, "v1")
+
+	cert, err := NewCertificate(certFile, keyFile, time.Minute, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	now := time.Now()
+	cert.now = func() time.Time { return now }
+
+	commonName := func() string {
+		c, err := cert.GetCertificate(nil)
+		require.NoError(t, err)
+
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		require.NoError(t, err)
+
+		return leaf.Subject.CommonName
+	}
+
+	require.Equal(t, "v1", commonName())
+
+	// a renewed certificate is only checked once the reload interval passed
+	writeCertificate(t, certFile, keyFile, "v2")
+
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	require.Equal(t, "v1", commonName())
+
+	now = now.Add(time.Minute)
+	require.Equal(t, "v2", commonName())
+
+	// a wrong certificate keeps the current one
+	require.NoError(t, os.WriteFile(certFile, []byte("wrong"), 0600))
+
+	later = later.Add(time.Hour)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	now = now.Add(time.Minute)
+	require.Equal(t, "v2", commonName())
 }
 
 func TestWrongAddr(t *testing.T) {
@@ -95,241 +404,2818 @@ func TestGetAddr(t *testing.T) {
 	require.Nil(t, addr)
 }
 
-func TestGetHookHandler_Wrong_Action(t *testing.T) {
-	deployer := fakeDeployer{}
+func TestReadOnly(t *testing.T) {
+	deployer := fakeDeployer{
+		deployReturn: "XX",
+		latestTag:    "YY",
+	}
+
+	server := NewHookHTTP("", deployer, zerolog.New(io.Discard), WithReadOnly())
+	handler := server.(*HookHTTP).server.Handler
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/XX",
+		bytes.NewBufferString("{\"browser_download_url\":\"http://xx\"}"))
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "server is in read-only mode\n", string(buff))
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err = ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "YY", string(buff))
+}
+
+func TestMetrics(t *testing.T) {
+	deployer := fakeDeployer{
+		latestTag: "YY",
+	}
+
+	server := NewHookHTTP("", deployer, zerolog.New(io.Discard), WithReadOnly())
+	handler := server.(*HookHTTP).server.Handler
+
+	for _, target := range []string{"/api/tags/XX", "/api/tags/YY", "/api/hook/XX"} {
+		method := http.MethodGet
+		if strings.HasPrefix(target, "/api/hook/") {
+			method = http.MethodPost
+		}
+
+		req, err := http.NewRequest(method, target, nil)
+		require.NoError(t, err)
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	body := rr.Body.String()
+	require.Contains(t, body, `hodor_http_requests_total{route="/api/hook/:releaseID",method="POST",status="5xx"} 1`)
+	require.Contains(t, body, `hodor_http_requests_total{route="/api/tags/:releaseID",method="GET",status="2xx"} 2`)
+	require.Contains(t, body, `hodor_http_request_duration_seconds_count{route="/api/tags/:releaseID",method="GET"} 2`)
+	require.NotContains(t, body, `route="/metrics"`)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	metrics := newRequestMetrics()
+
+	durations := []time.Duration{0, time.Millisecond * 30, 0, time.Second * 20}
+	now := time.Unix(0, 0)
+
+	metrics.now = func() time.Time {
+		now = now.Add(durations[0])
+		durations = durations[1:]
+
+		return now
+	}
+
+	handler := metrics.instrument("/api/status/:jobID", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("missing") != "" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+
+			// flushing is kept for the streams
+			w.(http.Flusher).Flush()
+		}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/status/AA", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/status/AA?missing=1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	metrics.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	labels := `route="/api/status/:jobID",method="GET"`
+
+	require.Equal(t, `# HELP hodor_http_requests_total Number of HTTP requests per route, method, and status class.
+# TYPE hodor_http_requests_total counter
+hodor_http_requests_total{`+labels+`,status="2xx"} 1
+hodor_http_requests_total{`+labels+`,status="4xx"} 1
+# HELP hodor_http_request_duration_seconds Duration of the HTTP requests per route and method.
+# TYPE hodor_http_request_duration_seconds histogram
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.005"} 0
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.01"} 0
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.025"} 0
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.05"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.1"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.25"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="0.5"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="1"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="2.5"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="5"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="10"} 1
+hodor_http_request_duration_seconds_bucket{`+labels+`,le="+Inf"} 2
+hodor_http_request_duration_seconds_sum{`+labels+`} 20.03
+hodor_http_request_duration_seconds_count{`+labels+`} 2
+`, rr.Body.String())
+}
+
+func TestGetHookHandler_Wrong_Action(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "wrong action\n", string(buff))
+}
+
+func TestGetHookHandler_Wrong_Request(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", new(bytes.Buffer))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Message: "invalid JSON: EOF"})
+}
+
+func TestGetHookHandler_Wrong_URL(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", bytes.NewBufferString("{}"))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "browser_download_url", Message: "missing, and no assets"})
+}
+
+func TestGetHookHandler_Wrong_Fallback_URL(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx","fallback_urls":["xx"]}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "fallback_urls[0]",
+		Message: "parse \"xx\": invalid URI for request"})
+}
+
+func TestGetHookHandler_Assets(t *testing.T) {
+	var deployRequest deployer.Request
+
+	deployer := fakeDeployer{
+		deployReturn:  "XX",
+		deployRequest: &deployRequest,
+		selectAsset:   &url.URL{},
+	}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"assets":[{"name":"xx","browser_download_url":"http://xx"}]}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, []asset.Asset{{Name: "xx", BrowserDownloadURL: "http://xx"}},
+		deployRequest.Assets)
+}
+
+func TestGetHookHandler_Wrong_Subpath(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx","subpath":"../xx"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "subpath", Message: "\"../xx\" is out of the target"})
+}
+
+func TestGetHookHandler_Wrong_Callback(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx","callback_url":"ftp://xx"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "callback_url", Message: "unsupported scheme \"ftp\""})
+}
+
+// A plain HTTP callback follows the policy of the downloads.
+func TestGetHookHandler_Insecure_Callback(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{httpsOnly: true}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"https://xx",` +
+		`"callback_url":"http://ci.lan/done"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr,
+		fieldError{Field: "callback_url", Message: "not https: \"http://ci.lan/done\""})
+}
+
+func TestGetHookHandler_Wrong_SHA256(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx","sha256":"abcd"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "sha256", Message: "expected 32 bytes, got 2"})
+}
+
+func TestGetHookHandler_Wrong_Token(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{}, nil, xxTokens, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/XX", body)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestGetHookHandler_Signature(t *testing.T) {
+	deployRequest := &deployer.Request{}
+	d := fakeDeployer{deployReturn: "AA", deployRequest: deployRequest}
+
+	// the token is not required once the hook is signed
+	handler := getHookHandler(d, nil, apiTokens{releases: map[string]string{"XX": "token"}},
+		map[string]string{"XX": "secret"})
+
+	payload := `{"browser_download_url":"http://xx","sender":{"login":"alice"}}`
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(payload))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(payload))
+	require.NoError(t, err)
+
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+	req.Header.Set("X-GitHub-Delivery", "72d3162e")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+
+	require.Equal(t, deployer.Sender{
+		Auth:      "signature",
+		Addr:      "1.2.3.4:5678",
+		UserAgent: "GitHub-Hookshot/abc",
+		Login:     "alice",
+		Delivery:  "72d3162e",
+	}, deployRequest.Sender)
+
+	// a valid token doesn't replace the signature
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(payload))
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set(SignatureHeader, "sha256=00")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "wrong signature\n", string(buff))
+}
+
+func TestGetHookHandler_GitLab(t *testing.T) {
+	deployRequest := &deployer.Request{}
+	d := fakeDeployer{deployReturn: "AA", deployRequest: deployRequest, selectAsset: &url.URL{}}
+
+	handler := getHookHandler(d, nil, xxTokens, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(gitlabReleaseHook))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitlab-Event", "Release Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "v1.2", deployRequest.Tag)
+	require.Equal(t, "notes", deployRequest.Notes)
+	require.Equal(t, "token", deployRequest.Sender.Auth)
+	require.Equal(t, []asset.Asset{{Name: "site.tar.gz", BrowserDownloadURL: "https://xx/site.tar.gz"}},
+		deployRequest.Assets)
+
+	// the other events are acknowledged without deploying
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/hook/XX",
+		bytes.NewBufferString(strings.Replace(gitlabReleaseHook, `"create"`, `"update"`, 1)))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitlab-Event", "Release Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "ignored event: GitLab release \"update\"\n", rr.Body.String())
+
+	// the token of GitLab is checked as a bearer token
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(gitlabReleaseHook))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitlab-Event", "Release Hook")
+	req.Header.Set("X-Gitlab-Token", "wrong")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	// or as the webhook secret
+	handler = getHookHandler(d, nil, apiTokens{}, map[string]string{"XX": "webhook"})
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(gitlabReleaseHook))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitlab-Event", "Release Hook")
+	req.Header.Set("X-Gitlab-Token", "webhook")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "signature", deployRequest.Sender.Auth)
+}
+
+func TestGetHookHandler_Gitea(t *testing.T) {
+	deployRequest := &deployer.Request{}
+	d := fakeDeployer{deployReturn: "AA", deployRequest: deployRequest, selectAsset: &url.URL{}}
+
+	handler := getHookHandler(d, nil, apiTokens{}, map[string]string{"XX": "secret"})
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(releaseEventPayload))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(releaseEventPayload))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitea-Event", "release")
+	req.Header.Set("X-Gitea-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "v1.2", deployRequest.Tag)
+	require.Equal(t, "notes", deployRequest.Notes)
+	require.Equal(t, "alice", deployRequest.Sender.Login)
+	require.Equal(t, []asset.Asset{{Name: "site.tar.gz", BrowserDownloadURL: "https://xx/site.tar.gz"}},
+		deployRequest.Assets)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(releaseEventPayload))
+	require.NoError(t, err)
+
+	req.Header.Set("X-Gitea-Event", "release")
+	req.Header.Set("X-Gitea-Signature", "00")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestGetHookHandler_GitHub(t *testing.T) {
+	deployRequest := &deployer.Request{}
+	d := fakeDeployer{deployReturn: "AA", deployRequest: deployRequest, selectAsset: &url.URL{}}
+
+	handler := getHookHandler(d, nil, apiTokens{}, map[string]string{"XX": "secret"})
+
+	send := func(event, payload string) *httptest.ResponseRecorder {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(payload))
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/api/hook/XX", bytes.NewBufferString(payload))
+		require.NoError(t, err)
+
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+		handler(rr, req)
+
+		return rr
+	}
+
+	rr := send("release", releaseEventPayload)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "v1.2", deployRequest.Tag)
+	require.Equal(t, "notes", deployRequest.Notes)
+	require.Equal(t, "alice", deployRequest.Sender.Login)
+	require.Equal(t, []asset.Asset{{Name: "site.tar.gz", BrowserDownloadURL: "https://xx/site.tar.gz"}},
+		deployRequest.Assets)
+
+	// GitHub sends a ping once the webhook is created
+	rr = send("ping", `{"zen": "Keep it logically awesome."}`)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "ignored event: GitHub \"ping\"\n", rr.Body.String())
+
+	// a published release is also "released", which is not deployed twice
+	rr = send("release", strings.Replace(releaseEventPayload, `"published"`, `"released"`, 1))
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "ignored event: GitHub release \"released\"\n", rr.Body.String())
+}
+
+func TestDecodeHook_Wrong(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/hook/XX", nil)
+	req.Header.Set("X-Gitea-Event", "push")
+
+	_, err := decodeHook(req, []byte(`{}`))
+	require.True(t, errors.Is(err, errIgnoredEvent), err)
+	require.EqualError(t, err, "ignored event: Gitea \"push\"")
+
+	req.Header.Set("X-Gitea-Event", "release")
+
+	_, err = decodeHook(req, []byte(`{"action":"published","release":{"tag_name":"v1"}}`))
+	require.Equal(t, validationError{{Field: "release.assets", Message: "missing"}}, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/hook/XX", nil)
+	req.Header.Set("X-Gitlab-Event", "Release Hook")
+
+	_, err = decodeHook(req, []byte(`{"action":"create","tag":"v1"}`))
+	require.EqualError(t, err, "assets.links missing")
+
+	_, err = decodeHook(req, []byte(`{`))
+	require.EqualError(t, err, "invalid JSON: unexpected end of JSON input")
+}
+
+func TestDecodeHook_Schema(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/hook/XX", nil)
+
+	_, err := decodeHook(req, []byte(`{"browser_download_url": 1, "tag": "v1", `+
+		`"fallback_urls": ["http://xx", false], "assets": [{"name": ["xx"]}, "xx"], `+
+		`"sender": "alice", "extra": 1}`))
+	require.Equal(t, validationError{
+		{Field: "assets[0].name", Message: "must be a string"},
+		{Field: "assets[1]", Message: "must be an object"},
+		{Field: "browser_download_url", Message: "must be a string"},
+		{Field: "fallback_urls[1]", Message: "must be a string"},
+		{Field: "sender", Message: "must be an object"},
+	}, err)
+
+	_, err = decodeHook(req, []byte(`[]`))
+	require.EqualError(t, err, "must be an object")
+
+	// null values are missing fields
+	hook, err := decodeHook(req, []byte(`{"tag": null, "browser_download_url": "http://xx"}`))
+	require.NoError(t, err)
+	require.Equal(t, request{BrowserDownloadURL: "http://xx"}, hook)
+}
+
+func TestGetHookHandler_Field_Errors(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"xx","subpath":"../xx",` +
+		`"sha256":"abcd","tag":1}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	// the schema is checked first
+	requireFieldErrors(t, rr, fieldError{Field: "tag", Message: "must be a string"})
+
+	body = bytes.NewBufferString(`{"browser_download_url":"xx","subpath":"../xx","sha256":"abcd"}`)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	// all the wrong fields are reported
+	requireFieldErrors(t, rr,
+		fieldError{Field: "browser_download_url", Message: "parse \"xx\": invalid URI for request"},
+		fieldError{Field: "subpath", Message: "\"../xx\" is out of the target"},
+		fieldError{Field: "sha256", Message: "expected 32 bytes, got 2"})
+}
+
+func TestGetHookHandler_Insecure_URL(t *testing.T) {
+	handler := getHookHandler(fakeDeployer{httpsOnly: true}, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx",` +
+		`"fallback_urls":["https://mirror","http://mirror"]}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	requireFieldErrors(t, rr,
+		fieldError{Field: "browser_download_url", Message: "not https: \"http://xx\""},
+		fieldError{Field: "fallback_urls[1]", Message: "not https: \"http://mirror\""})
+}
+
+func TestTokenAuth(t *testing.T) {
+	require.Equal(t, "none", tokenAuth(apiTokens{}, "XX"))
+	require.Equal(t, "token", tokenAuth(xxTokens, "XX"))
+	require.Equal(t, "none", tokenAuth(xxTokens, "YY"))
+	require.Equal(t, "token", tokenAuth(apiTokens{global: "global"}, "YY"))
+}
+
+func TestValidSignature(t *testing.T) {
+	// test vector from the GitHub documentation
+	secret := "It's a Secret to Everybody"
+	body := []byte("Hello, World!")
+
+	require.True(t, validSignature(secret, body,
+		"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"))
+
+	require.False(t, validSignature(secret, body,
+		"sha256=657107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"))
+	require.False(t, validSignature(secret, body,
+		"sha1=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"))
+	require.False(t, validSignature(secret, body, "sha256=xx"))
+	require.False(t, validSignature(secret, body, ""))
+}
+
+func TestGetDeployHandler_Form(t *testing.T) {
+	deployRequest := deployer.Request{}
+
+	deployer := fakeDeployer{
+		deployRequest: &deployRequest,
+		deployReturn:  "AA",
+	}
+
+	handler := getDeployHandler(deployer, nil, xxTokens)
+	body := bytes.NewBufferString("url=http%3A%2F%2Fxx&tag=v1&token=secret")
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/deploy?releaseID=XX", body)
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "XX", deployRequest.ReleaseID)
+	require.Equal(t, "v1", deployRequest.Tag)
+	require.Equal(t, "http://xx", deployRequest.ReleaseURL.String())
+}
+
+func TestGetDeployHandler_JSON(t *testing.T) {
+	deployRequest := deployer.Request{}
+
+	deployer := fakeDeployer{
+		deployRequest: &deployRequest,
+		deployReturn:  "AA",
+	}
+
+	handler := getDeployHandler(deployer, nil, xxTokens)
+	sum := strings.Repeat("ab", 32)
+	body := bytes.NewBufferString(`{"releaseID":"XX","url":"http://xx","sha256":"` + sum + `"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/deploy", body)
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "XX", deployRequest.ReleaseID)
+	require.Equal(t, sum, deployRequest.SHA256)
+}
+
+func TestGetDeployHandler_Fail(t *testing.T) {
+	handler := getDeployHandler(fakeDeployer{}, nil, xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/deploy?url=http://xx", bytes.NewBufferString(""))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "missing releaseID\n", string(buff))
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/deploy?releaseID=XX&token=wrong",
+		bytes.NewBufferString(""))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/deploy", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+}
+
+func TestGetRegistryHandler_DockerHub(t *testing.T) {
+	deployRequest := deployer.Request{}
+
+	deployer := fakeDeployer{
+		deployRequest: &deployRequest,
+		deployReturn:  "AA",
+	}
+
+	releases := map[string][]RegistryRelease{
+		"org/xx": {{ReleaseID: "XX", URL: "http://xx/{tag}.tar.gz"}},
+	}
+
+	handler := getRegistryHandler(deployer, releases, apiTokens{})
+	body := bytes.NewBufferString(`{"push_data":{"tag":"v1"},"repository":{"repo_name":"org/xx"}}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/registry", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "XX", deployRequest.ReleaseID)
+	require.Equal(t, "v1", deployRequest.Tag)
+	require.Equal(t, "http://xx/v1.tar.gz", deployRequest.ReleaseURL.String())
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"jobs":[{"jobID":"AA","statusURL":"/api/status/AA",`+
+		`"streamURL":"/api/jobs/stream","queuePosition":0}]}`+"\n", string(buff))
+}
+
+func TestGetRegistryHandler_Harbor(t *testing.T) {
+	deployRequest := deployer.Request{}
+
+	deployer := fakeDeployer{
+		deployRequest: &deployRequest,
+		deployReturn:  "AA",
+	}
+
+	releases := map[string][]RegistryRelease{
+		"lib/xx": {{ReleaseID: "XX", URL: "http://xx/{tag}.tar.gz"}},
+	}
+
+	handler := getRegistryHandler(deployer, releases, xxTokens)
+	body := bytes.NewBufferString(`{"type":"PUSH_ARTIFACT","event_data":{"resources":` +
+		`[{"tag":"v2"}],"repository":{"repo_full_name":"lib/xx"}}}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/registry?token=secret", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "http://xx/v2.tar.gz", deployRequest.ReleaseURL.String())
+
+	// other events are ignored
+	body = bytes.NewBufferString(`{"type":"DELETE_ARTIFACT","event_data":{"resources":` +
+		`[{"tag":"v2"}],"repository":{"repo_full_name":"lib/xx"}}}`)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/registry", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+}
+
+func TestGetRegistryHandler_Fail(t *testing.T) {
+	releases := map[string][]RegistryRelease{
+		"org/xx": {{ReleaseID: "XX", URL: "http://xx/{tag}.tar.gz"}},
+	}
+
+	handler := getRegistryHandler(fakeDeployer{}, releases, xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/registry",
+		bytes.NewBufferString(`{"push_data":{"tag":"v1"},"repository":{"repo_name":"org/yy"}}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/registry",
+		bytes.NewBufferString(`{"push_data":{"tag":"v1"},"repository":{"repo_name":"org/xx"}}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestGetHealthHandler(t *testing.T) {
+	handler := getHealthHandler(fakeDeployer{})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/healthz", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"status":"ok"}`+"\n", string(buff))
+
+	handler = getHealthHandler(fakeDeployer{
+		targetsHealth: map[string]deployer.TargetHealth{
+			"XX": {Status: "missing", Message: "fake", Tag: "v1"},
+		},
+	})
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+
+	buff, err = ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"status":"degraded","targets":{"XX":{"status":"missing",`+
+		`"message":"fake","tag":"v1"}}}`+"\n", string(buff))
+}
+
+func TestGetHealthHandler_Queue(t *testing.T) {
+	handler := getHealthHandler(fakeDeployer{queueLength: deployer.QueueSize})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/healthz", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"status":"degraded"}`+"\n", string(buff))
+
+	handler = getHealthHandler(fakeDeployer{stopped: true, queueLength: deployer.QueueSize})
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+
+	buff, err = ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"status":"stopped"}`+"\n", string(buff))
+}
+
+func TestGetHealthHandler_Badge(t *testing.T) {
+	handler := getHealthHandler(fakeDeployer{stopped: true})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/healthz?format=svg", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "image/svg+xml;charset=utf-8", rr.Result().Header.Get("Content-Type"))
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buff), ">stopped<")
+	require.Contains(t, string(buff), badge.ColorRed.String())
+}
+
+func TestGetRollbackHandler(t *testing.T) {
+	handler := getRollbackHandler(fakeDeployer{rollbackReturn: "AA"}, nil,
+		xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/rollback/XX", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+
+	var res response
+
+	err = json.NewDecoder(rr.Result().Body).Decode(&res)
+	require.NoError(t, err)
+	require.Equal(t, "AA", res.JobID)
+	require.Equal(t, "/api/status/AA", res.StatusURL)
+
+	// wrong token
+	rr = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer wrong")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestGetRollbackHandler_No_Previous(t *testing.T) {
+	handler := getRollbackHandler(fakeDeployer{rollbackErr: deployer.ErrNoPrevious}, nil, apiTokens{})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/rollback/XX", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusConflict, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to roll back: no previous release\n", string(buff))
+
+	handler = getRollbackHandler(fakeDeployer{rollbackErr: errors.New("fake")}, nil, apiTokens{})
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+}
+
+func TestGetMaintenanceHandler(t *testing.T) {
+	var enabled bool
+
+	handler := getMaintenanceHandler(fakeDeployer{maintenance: &enabled, deferred: 2},
+		xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/releases/XX/maintenance",
+		strings.NewReader(`{"enabled": true}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	req.Body = io.NopCloser(strings.NewReader(`{"enabled": true}`))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.True(t, enabled)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"release_id":"XX","maintenance":true,"deferred":2}`+"\n", string(buff))
+}
+
+func TestGetMaintenanceHandler_Wrong(t *testing.T) {
+	handler := getMaintenanceHandler(fakeDeployer{maintenanceErr: errors.New("fake")}, apiTokens{})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		err    string
+	}{
+		{http.MethodPost, "/api/releases/XX", `{"enabled": true}`, http.StatusNotFound, "404 page not found"},
+		{http.MethodPost, "/api/releases//maintenance", `{"enabled": true}`, http.StatusNotFound, "404 page not found"},
+		{http.MethodGet, "/api/releases/XX/maintenance", "", http.StatusForbidden, "wrong action"},
+		{http.MethodPost, "/api/releases/XX/maintenance", "{}", http.StatusBadRequest, `"enabled" is missing`},
+		{http.MethodPost, "/api/releases/XX/maintenance", `{"enabled": false}`, http.StatusBadRequest,
+			"failed to set maintenance: fake"},
+	}
+
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		require.NoError(t, err)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.path)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestGetPromoteHandler(t *testing.T) {
+	d := fakeDeployer{
+		promoteReturn: "AA",
+		releases:      []deployer.Release{{ReleaseID: "XX", Promote: "YY"}},
+	}
+
+	tokens := apiTokens{releases: map[string]string{"XX": "secret", "YY": "prod"}}
+
+	handler := getPromoteHandler(d, nil, tokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/releases/XX/promote", nil)
+	require.NoError(t, err)
+
+	// the token of the release it promotes to is required
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer prod")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+
+	var res response
+
+	err = json.NewDecoder(rr.Result().Body).Decode(&res)
+	require.NoError(t, err)
+	require.Equal(t, "AA", res.JobID)
+	require.Equal(t, "/api/status/AA", res.StatusURL)
+}
+
+func TestGetPromoteHandler_Wrong(t *testing.T) {
+	tests := []struct {
+		d      fakeDeployer
+		method string
+		path   string
+		code   int
+		err    string
+	}{
+		{fakeDeployer{}, http.MethodPost, "/api/releases/XX/maintenance", http.StatusNotFound,
+			"404 page not found"},
+		{fakeDeployer{}, http.MethodGet, "/api/releases/XX/promote", http.StatusForbidden,
+			"wrong action"},
+		{fakeDeployer{releasesErr: errors.New("fake")}, http.MethodPost, "/api/releases/XX/promote",
+			http.StatusInternalServerError, "failed to get releases: fake"},
+		{fakeDeployer{promoteErr: deployer.ErrNoArchive}, http.MethodPost, "/api/releases/XX/promote",
+			http.StatusConflict, "failed to promote: no archive of the deployed release"},
+		{fakeDeployer{promoteErr: deployer.ErrNoPromotion}, http.MethodPost, "/api/releases/XX/promote",
+			http.StatusBadRequest, "failed to promote: no release to promote to"},
+	}
+
+	for _, test := range tests {
+		handler := getPromoteHandler(test.d, nil, apiTokens{})
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, nil)
+		require.NoError(t, err)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.path)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestGetSBOMHandler(t *testing.T) {
+	d := fakeDeployer{
+		sbom: deployer.SBOM{File: "app.spdx.json", Format: "spdx",
+			MediaType: "application/spdx+json", SHA256: "aa"},
+		sbomContent: []byte(`{"spdxVersion": "SPDX-2.3"}`),
+	}
+
+	handler := getSBOMHandler(d)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/releases/XX/sbom", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/spdx+json", rr.Result().Header.Get("Content-Type"))
+	require.Equal(t, "attachment; filename=app.spdx.json",
+		rr.Result().Header.Get("Content-Disposition"))
+	require.Equal(t, `"aa"`, rr.Result().Header.Get("ETag"))
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"spdxVersion": "SPDX-2.3"}`, string(buff))
+}
+
+func TestGetSBOMHandler_Wrong(t *testing.T) {
+	tests := []struct {
+		d      fakeDeployer
+		method string
+		path   string
+		code   int
+		err    string
+	}{
+		{fakeDeployer{}, http.MethodGet, "/api/releases/XX/promote", http.StatusNotFound,
+			"404 page not found"},
+		{fakeDeployer{}, http.MethodPost, "/api/releases/XX/sbom", http.StatusForbidden,
+			"wrong action"},
+		{fakeDeployer{sbomErr: deployer.ErrNoSBOM}, http.MethodGet, "/api/releases/XX/sbom",
+			http.StatusNotFound, "no SBOM in the deployed release"},
+		{fakeDeployer{sbomErr: errors.New("fake")}, http.MethodGet, "/api/releases/XX/sbom",
+			http.StatusInternalServerError, "failed to get SBOM: fake"},
+	}
+
+	for _, test := range tests {
+		handler := getSBOMHandler(test.d)
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, nil)
+		require.NoError(t, err)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.path)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestReleaseActions(t *testing.T) {
+	handler := releaseActions(map[string]http.Handler{
+		"promote": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	})
+
+	tests := map[string]int{
+		"/api/releases/XX/promote":     http.StatusAccepted,
+		"/api/releases/XX/maintenance": http.StatusNotFound,
+		"/api/releases//promote":       http.StatusNotFound,
+		"/api/releases/XX/YY/promote":  http.StatusNotFound,
+	}
+
+	for path, code := range tests {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, path, nil)
+		require.NoError(t, err)
+
+		handler.ServeHTTP(rr, req)
+
+		require.Equal(t, code, rr.Result().StatusCode, path)
+	}
+}
+
+func TestGetFreezesHandler(t *testing.T) {
+	until := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	d := fakeDeployer{
+		freezes: []deployer.Freeze{
+			{ID: "AA", ReleaseIDs: []string{"XX"}, Until: until, Reason: "fake", RequestedBy: "alice"},
+		},
+	}
+
+	handler := getFreezesHandler(d, getFreezeHandler(d, xxTokens))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/freezes", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `[{"id":"AA","releaseIDs":["XX"],"until":"2022-01-02T03:04:05Z","reason":"fake",`+
+		`"requestedBy":"alice","createdAt":"0001-01-01T00:00:00Z"}]`+"\n", string(buff))
+
+	body := `{"releaseIDs":["XX"],"until":"2022-01-02T03:04:05Z","reason":"fake","requestedBy":"alice"}`
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes", strings.NewReader(body))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusCreated, rr.Result().StatusCode)
+
+	var freeze deployer.Freeze
+
+	err = json.NewDecoder(rr.Result().Body).Decode(&freeze)
+	require.NoError(t, err)
+	require.Equal(t, "AA", freeze.ID)
+	require.Equal(t, "alice", freeze.RequestedBy)
+
+	handler = getFreezesHandler(fakeDeployer{freezeErr: errors.New("fake")}, getFreezeHandler(
+		fakeDeployer{freezeErr: errors.New("fake")}, apiTokens{}))
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes", strings.NewReader(body))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	buff, err = ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to freeze: fake\n", string(buff))
+}
+
+func TestGetLiftFreezeHandler(t *testing.T) {
+	d := fakeDeployer{
+		freezes: []deployer.Freeze{{ID: "AA", ReleaseIDs: []string{"XX"}}},
+	}
+
+	handler := getLiftFreezeHandler(d, xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/freezes/AA/lift",
+		strings.NewReader(`{"liftedBy":"bob"}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes/AA/lift",
+		strings.NewReader(`{"liftedBy":"bob"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buff), `"id":"AA"`)
+	require.Contains(t, string(buff), `"liftedBy":"bob"`)
+
+	handler = getLiftFreezeHandler(fakeDeployer{liftErr: deployer.ErrFreezeNotFound}, apiTokens{})
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes/BB/lift",
+		strings.NewReader(`{"liftedBy":"bob"}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	buff, err = ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to lift freeze: freeze not found\n", string(buff))
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/api/freezes/BB", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+}
+
+func TestGetSetStatusHandler(t *testing.T) {
+	var set [3]string
+
+	d := fakeDeployer{
+		status:    deployer.JobStatus{Status: "canary", ReleaseID: "XX"},
+		setStatus: &set,
+	}
+
+	handler := getSetStatusHandler(d, xxTokens)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/jobs/AA/status",
+		strings.NewReader(`{"status": "canary", "message": "10%"}`))
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	req.Body = io.NopCloser(strings.NewReader(`{"status": "canary", "message": "10%"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, [3]string{"AA", "canary", "10%"}, set)
+
+	var status deployer.JobStatus
+
+	err = json.NewDecoder(rr.Result().Body).Decode(&status)
+	require.NoError(t, err)
+	require.Equal(t, "canary", status.Status)
+}
+
+func TestGetSetStatusHandler_Wrong(t *testing.T) {
+	transitionErr := fmt.Errorf("%w from \"ok\" to \"canary\"", deployer.ErrTransition)
+
+	tests := []struct {
+		deployer fakeDeployer
+		method   string
+		path     string
+		body     string
+		code     int
+		err      string
+	}{
+		{fakeDeployer{}, http.MethodPost, "/api/jobs/AA", "{}", http.StatusNotFound, "404 page not found"},
+		{fakeDeployer{}, http.MethodPost, "/api/jobs//status", "{}", http.StatusNotFound, "404 page not found"},
+		{fakeDeployer{}, http.MethodGet, "/api/jobs/AA/status", "", http.StatusForbidden, "wrong action"},
+		{fakeDeployer{statusErr: errors.New("fake")}, http.MethodPost, "/api/jobs/AA/status", "{}",
+			http.StatusNotFound, "failed to get status: fake"},
+		{fakeDeployer{}, http.MethodPost, "/api/jobs/AA/status", "{", http.StatusBadRequest,
+			"failed to decode request: unexpected EOF"},
+		{fakeDeployer{setStatusErr: transitionErr}, http.MethodPost, "/api/jobs/AA/status",
+			`{"status": "canary"}`, http.StatusConflict, "invalid status transition from \"ok\" to \"canary\""},
+		{fakeDeployer{setStatusErr: errors.New("fake")}, http.MethodPost, "/api/jobs/AA/status",
+			`{"status": "canary"}`, http.StatusInternalServerError, "failed to set status: fake"},
+	}
+
+	for _, test := range tests {
+		handler := getSetStatusHandler(test.deployer, apiTokens{})
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		require.NoError(t, err)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.path)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestGetRetainedHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, deployer.RetainedArchive), []byte("archive"), 0600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, deployer.RetainedLog), []byte("log"), 0600)
+	require.NoError(t, err)
+
+	deployer := fakeDeployer{
+		status:   deployer.JobStatus{ReleaseID: "XX"},
+		retained: dir,
+	}
+
+	handler := jobActions(map[string]http.Handler{
+		"archive": http.HandlerFunc(getRetainedHandler(deployer, xxTokens)),
+		"log":     http.HandlerFunc(getRetainedHandler(deployer, xxTokens)),
+	})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/jobs/AA/archive", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/octet-stream", rr.Result().Header.Get("Content-Type"))
+	require.Equal(t, "attachment; filename=AA.archive", rr.Result().Header.Get("Content-Disposition"))
+	require.Equal(t, "archive", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/jobs/AA/log", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", rr.Result().Header.Get("Content-Type"))
+	require.Equal(t, "log", rr.Body.String())
+}
+
+func TestGetRetainedHandler_Wrong(t *testing.T) {
+	status := deployer.JobStatus{ReleaseID: "XX"}
+
+	tests := []struct {
+		deployer fakeDeployer
+		method   string
+		path     string
+		token    string
+		code     int
+		err      string
+	}{
+		{fakeDeployer{}, http.MethodGet, "/api/jobs/AA/other", "secret", http.StatusNotFound, "404 page not found"},
+		{fakeDeployer{}, http.MethodPost, "/api/jobs/AA/log", "secret", http.StatusForbidden, "wrong action"},
+		{fakeDeployer{statusErr: errors.New("fake")}, http.MethodGet, "/api/jobs/AA/log", "secret",
+			http.StatusNotFound, "failed to get status: fake"},
+		{fakeDeployer{status: status}, http.MethodGet, "/api/jobs/AA/log", "", http.StatusUnauthorized,
+			"wrong token"},
+		{fakeDeployer{status: status, retainedErr: deployer.ErrNotRetained}, http.MethodGet,
+			"/api/jobs/AA/log", "secret", http.StatusNotFound, "no retained files for the job"},
+		{fakeDeployer{status: status, retainedErr: errors.New("fake")}, http.MethodGet,
+			"/api/jobs/AA/archive", "secret", http.StatusInternalServerError,
+			"failed to get retained file: fake"},
+	}
+
+	for _, test := range tests {
+		handler := getRetainedHandler(test.deployer, xxTokens)
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.path)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestGetJobsHandler(t *testing.T) {
+	var request [3]interface{}
+
+	handler := getJobsHandler(fakeDeployer{
+		jobs: []deployer.JobSummary{
+			{JobID: "AA", ReleaseID: "XX", Tag: "v2", Status: "ok"},
+			{JobID: "BB", ReleaseID: "XX", Tag: "v1", Status: "failed"},
+		},
+		jobsRequest: &request,
+	})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/jobs?releaseID=XX&limit=1&offset=2", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, [3]interface{}{"XX", 2, 2}, request)
+
+	var page jobsPage
+
+	err = json.NewDecoder(rr.Result().Body).Decode(&page)
+	require.NoError(t, err)
+	require.Equal(t, 1, page.Limit)
+	require.Equal(t, 2, page.Offset)
+	require.Equal(t, 3, page.NextOffset)
+	require.Len(t, page.Jobs, 1)
+	require.Equal(t, "AA", page.Jobs[0].JobID)
+
+	// the last page has no next offset
+	req, err = http.NewRequest(http.MethodGet, "/api/jobs", nil)
+	require.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, [3]interface{}{"", defaultJobsLimit + 1, 0}, request)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(buff), "nextOffset")
+}
+
+func TestGetJobsHandler_Wrong(t *testing.T) {
+	handler := getJobsHandler(fakeDeployer{jobsErr: errors.New("fake")})
+
+	tests := []struct {
+		method string
+		query  string
+		code   int
+		err    string
+	}{
+		{http.MethodPost, "", http.StatusForbidden, "wrong action"},
+		{http.MethodGet, "?limit=0", http.StatusBadRequest, "wrong limit: must be between 1 and 100"},
+		{http.MethodGet, "?limit=x", http.StatusBadRequest, "wrong limit: must be between 1 and 100"},
+		{http.MethodGet, "?offset=-1", http.StatusBadRequest, "wrong offset: must be positive"},
+		{http.MethodGet, "", http.StatusInternalServerError, "failed to list jobs: fake"},
+	}
+
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, "/api/jobs"+test.query, nil)
+		require.NoError(t, err)
+
+		handler(rr, req)
+
+		require.Equal(t, test.code, rr.Result().StatusCode, test.query)
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Equal(t, test.err+"\n", string(buff))
+	}
+}
+
+func TestGetReleasesHandler(t *testing.T) {
+	handler := getReleasesHandler(fakeDeployer{
+		releases: []deployer.Release{{ReleaseID: "XX", Target: "/srv/xx", Digest: "aa", Tag: "v1"}},
+	})
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/releases", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `[{"release_id":"XX","target":"/srv/xx","digest":"aa","tag":"v1"}]`+"\n",
+		string(buff))
+
+	handler = getReleasesHandler(fakeDeployer{releasesErr: errors.New("fake")})
+
+	rr = httptest.NewRecorder()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+}
+
+func TestGetHookHandler_Wait(t *testing.T) {
+	events := make(chan deployer.JobEvent, 2)
+	events <- deployer.JobEvent{JobID: "OTHER", JobStatus: deployer.JobStatus{Status: "ok"}}
+	events <- deployer.JobEvent{JobID: "XX", JobStatus: deployer.JobStatus{Status: "failed", Message: "fake"}}
+
+	deployer := fakeDeployer{
+		deployReturn: "XX",
+		events:       events,
+	}
+
+	handler := waitable(getHookHandler(deployer, nil, apiTokens{}, nil))
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/YY?wait=true", body)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"jobID":"XX","statusURL":"/api/status/XX","streamURL":"/api/jobs/stream",`+
+		`"queuePosition":0,"status":{"status":"failed","message":"fake"}}`+"\n", string(buff))
+}
+
+func TestGetHookHandler_Wait_Done(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	deployer := fakeDeployer{
+		deployReturn: "XX",
+	}
+
+	handler := getHookHandler(deployer, done, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/hook/YY?wait=true", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+}
+
+func TestGetStatusHandler_Wait(t *testing.T) {
+	events := make(chan deployer.JobEvent, 2)
+	events <- deployer.JobEvent{JobID: "OTHER"}
+	events <- deployer.JobEvent{JobID: "XX"}
+
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "created"},
+		events: events,
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/status/XX?wait=1h", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Empty(t, events)
+}
+
+func TestGetStatusHandler_Wait_Timeout(t *testing.T) {
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "created"},
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/status/XX?wait=10ms", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*10)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/status/XX?wait=xx", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+func TestGetHookHandler_Request_ID(t *testing.T) {
+	var deployRequest deployer.Request
+
+	deployer := fakeDeployer{
+		deployReturn:  "XX",
+		deployRequest: &deployRequest,
+	}
+
+	nextRequestID := func() string { return "YY" }
+	handler := tracing(nextRequestID)(http.HandlerFunc(getHookHandler(deployer, nil, apiTokens{}, nil)))
+
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx","body":"notes"}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	require.Equal(t, "YY", deployRequest.RequestID)
+	require.Equal(t, "notes", deployRequest.Notes)
+}
+
+func TestGetHookHandler_Wrong_Assets(t *testing.T) {
+	deployer := fakeDeployer{
+		selectAssetErr: errors.New("fake"),
+	}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString(`{"assets":[{"name":"xx","browser_download_url":"http://xx"}]}`)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	requireFieldErrors(t, rr, fieldError{Field: "assets", Message: "fake"})
+}
+
+func TestGetHookHandler_Deployer_Fail(t *testing.T) {
+	deployer := fakeDeployer{
+		deployeErr: errors.New("fake"),
+	}
+
+	handler := getHookHandler(deployer, nil, apiTokens{}, nil)
+	body := bytes.NewBufferString("{\"browser_download_url\":\"http://xx\"}")
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", body)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to deploy: fake\n", string(buff))
+}
+
+func TestGetStatusHandler_Wrong_Action(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "wrong action\n", string(buff))
+}
+
+func TestGetStatusHandler_Deployer_Fail(t *testing.T) {
+	deployer := fakeDeployer{
+		statusErr: errors.New("fake"),
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to get status: fake\n", string(buff))
+}
+
+func TestGetStatusHandler_Pass(t *testing.T) {
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "XX"},
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "{\"status\":\"XX\",\"message\":\"\"}\n", string(buff))
+}
+
+func TestGetStatusHandler_Text(t *testing.T) {
+	finishedAt := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "ok", Message: "deployed", ReleaseID: "XX",
+			Tag: "v1", FinishedAt: &finishedAt, Duration: 3 * time.Second,
+			Progress: &deployer.Progress{Phase: "download", Bytes: 512, Size: 1024,
+				Percent: 50, Files: 3},
+			Scan: &deployer.ScanResult{Target: "sbom", Severity: "high",
+				Counts: map[string]int{"high": 1, "low": 2}, Passed: false,
+				Blocking: []scan.Finding{{ID: "CVE-1", Severity: "high"}}}},
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept", "text/plain;q=0.9, */*")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", rr.Result().Header.Get("Content-Type"))
+	require.Equal(t, "Accept", rr.Result().Header.Get("Vary"))
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok: deployed\nrelease: XX v1\nfinished: 2022-01-02T03:04:05Z\n"+
+		"duration: 3s\nprogress: download 50%, 512 bytes, 3 files\n"+
+		"scan: sbom blocked by 1 at or above high, 3 findings\n", string(buff))
+}
+
+func TestGetStatusHandler_Badge(t *testing.T) {
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "ok", Combined: "failed", ReleaseID: "XX", Tag: "v1"},
+	}
+
+	handler := getStatusHandler(deployer, nil)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/status/AA?format=svg", nil),
+		httptest.NewRequest(http.MethodGet, "/api/status/AA", nil),
+	} {
+		req.Header.Set("Accept", "image/svg+xml")
+
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+		require.Equal(t, "image/svg+xml;charset=utf-8", rr.Result().Header.Get("Content-Type"))
+		require.Equal(t, "no-store", rr.Result().Header.Get("Cache-Control"))
+
+		buff, err := ioutil.ReadAll(rr.Result().Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buff), ">XX v1<")
+		require.Contains(t, string(buff), ">failed<")
+		require.Contains(t, string(buff), badge.ColorRed.String())
+	}
+}
+
+func TestGetStatusHandler_Wrong_Format(t *testing.T) {
+	handler := getStatusHandler(fakeDeployer{}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "?format=xml", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "unknown format \"xml\"\n", string(buff))
+}
+
+func TestStatusFormat(t *testing.T) {
+	formats := map[string]string{
+		"":                                  "json",
+		"*/*":                               "json",
+		"text/html, text/plain":             "text",
+		"image/svg+xml, application/json":   "svg",
+		"application/json;q=0.5, image/*":   "json",
+		"wrong;;, text/plain; charset=utf8": "text",
+	}
+
+	for accept, expected := range formats {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+
+		format, err := statusFormat(req)
+		require.NoError(t, err)
+		require.Equal(t, expected, format, accept)
+	}
+
+	// the query parameter has precedence
+	req := httptest.NewRequest(http.MethodGet, "/?format=text", nil)
+	req.Header.Set("Accept", "image/svg+xml")
+
+	format, err := statusFormat(req)
+	require.NoError(t, err)
+	require.Equal(t, "text", format)
+}
+
+func TestGetHistoryHandler_Deployer_Fail(t *testing.T) {
+	deployer := fakeDeployer{
+		historyErr: errors.New("fake"),
+	}
+
+	handler := getHistoryHandler(deployer)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to get history: fake\n", string(buff))
+}
+
+func TestGetHistoryHandler_Pass(t *testing.T) {
+	deployer := fakeDeployer{
+		history: []deployer.HistoryEntry{
+			{JobID: "AA", ReleaseID: "XX", Tag: "v1", PreviousTag: "v0",
+				DeployedAt: time.Unix(0, 0).UTC(), Duration: time.Second,
+				Changes: deployer.Changes{Added: 1}, Notes: "YY"},
+		},
+	}
+
+	handler := getHistoryHandler(deployer)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/history/XX", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, `[{"jobID":"AA","releaseID":"XX","tag":"v1","previousTag":"v0",`+
+		`"deployedAt":"1970-01-01T00:00:00Z","duration":1000000000,`+
+		`"changes":{"added":1,"changed":0,"removed":0},"notes":"YY"}]`+"\n", string(buff))
+}
+
+func TestGetTagsHandler_Wrong_Action(t *testing.T) {
+	deployer := fakeDeployer{}
+
+	handler := getTagsHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "wrong action\n", string(buff))
+}
+
+func TestGetTagsHandler_Deployer_Fail(t *testing.T) {
+	deployer := fakeDeployer{
+		latestTagErr: errors.New("fake"),
+	}
+
+	handler := getTagsHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "failed to get tag: fake\n", string(buff))
+}
+
+func TestGetTagsHandler_Pass_Text(t *testing.T) {
+	deployer := fakeDeployer{
+		latestTag: "XX",
+	}
+
+	handler := getTagsHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "XX", string(buff))
+}
+
+func TestGetTagsHandler_Pass_SVG(t *testing.T) {
+	deployer := fakeDeployer{
+		latestTag: "XX",
+	}
+
+	handler := getTagsHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "?format=svg", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	buff, err := ioutil.ReadAll(rr.Result().Body)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buff), "<svg"))
+}
+
+func TestGetTagsHandler_Badge(t *testing.T) {
+	deployer := fakeDeployer{
+		latestTag: "v1.2",
+	}
+
+	badges := map[string]config.Badge{
+		"XX": {Label: "prod", Color: "green"},
+	}
+
+	handler := getTagsHandler(deployer, badges)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/tags/XX?format=svg", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	svg := rr.Body.String()
+	require.Contains(t, svg, ">prod<")
+	require.Contains(t, svg, ">v1.2<")
+	require.Contains(t, svg, badge.ColorScheme["green"])
+	require.Contains(t, svg, `rx="3"`)
+
+	// the query parameters override the configuration
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet,
+		"/api/tags/XX?format=svg&label=staging&color=4c1&style=flat-square", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	svg = rr.Body.String()
+	require.Contains(t, svg, ">staging<")
+	require.Contains(t, svg, `fill="#4c1"`)
+	require.Contains(t, svg, `rx="0"`)
+	require.NotContains(t, svg, `rx="3"`)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/tags/XX?format=svg&style=plastic", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	require.Equal(t, "wrong badge: unknown style \"plastic\"\n", rr.Body.String())
+}
+
+func TestGetTagsHandler_Badge_Failed(t *testing.T) {
+	now := time.Now()
+
+	deployer := fakeDeployer{
+		latestTag: "v1.2",
+		history:   []deployer.HistoryEntry{{Tag: "v1.2", DeployedAt: now.Add(-time.Hour)}},
+		failures:  []deployer.Failure{{Tag: "v1.3", FailedAt: now}},
+	}
+
+	handler := getTagsHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/tags/XX?format=svg", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	svg := rr.Body.String()
+	require.Contains(t, svg, ">failed<")
+	require.Contains(t, svg, badge.ColorScheme["red"])
+
+	// a deployment after the failure clears it
+	deployer.failures[0].FailedAt = now.Add(-2 * time.Hour)
+	handler = getTagsHandler(deployer, nil)
+
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+
+	require.Contains(t, rr.Body.String(), ">v1.2<")
+
+	// the text format keeps the tag
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/tags/XX", nil)
+	require.NoError(t, err)
+
+	deployer.failures[0].FailedAt = now
+	getTagsHandler(deployer, nil)(rr, req)
+
+	require.Equal(t, "v1.2", rr.Body.String())
+}
+
+func TestGetStatusStreamHandler_Pass(t *testing.T) {
+	events := make(chan deployer.JobEvent, 3)
+	events <- deployer.JobEvent{JobID: "OTHER"}
+	events <- deployer.JobEvent{JobID: "XX"}
+	events <- deployer.JobEvent{JobID: "XX"}
+
+	deployer := fakeDeployer{
+		statuses: &[]deployer.JobStatus{
+			{Status: "created"},
+			{Status: "running", Message: "downloading"},
+			{Status: "ok"},
+		},
+		events: events,
+	}
+
+	handler := getStatusStreamHandler(deployer, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/status/XX/stream", nil)
+	require.NoError(t, err)
+
+	// returns once the status is terminal
+	handler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/event-stream", rr.Result().Header.Get("Content-Type"))
+	require.Equal(t, "event: status\ndata: {\"status\":\"created\",\"message\":\"\"}\n\n"+
+		"event: status\ndata: {\"status\":\"running\",\"message\":\"downloading\"}\n\n"+
+		"event: status\ndata: {\"status\":\"ok\",\"message\":\"\"}\n\n", rr.Body.String())
+	require.Empty(t, events)
+}
+
+func TestGetStatusStreamHandler_Done(t *testing.T) {
+	deployer := fakeDeployer{
+		status: deployer.JobStatus{Status: "running"},
+	}
+
+	done := make(chan struct{})
+	handler := getStatusStreamHandler(deployer, done)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/api/status/XX/stream", nil)
+	require.NoError(t, err)
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		handler(rr, req)
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	close(done)
+	wait.Wait()
+
+	require.Equal(t, "event: status\ndata: {\"status\":\"running\",\"message\":\"\"}\n\n",
+		rr.Body.String())
+}
+
+func TestGetStatusStreamHandler_Wrong(t *testing.T) {
+	handler := getStatusStreamHandler(fakeDeployer{statusErr: errors.New("fake")}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/api/status/XX/stream", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/api/status/XX/stream", nil)
+	require.NoError(t, err)
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+	require.Equal(t, "failed to get status: fake\n", rr.Body.String())
+}
+
+func TestStatusActions(t *testing.T) {
+	var routed []string
 
-	handler := getHookHandler(deployer)
+	route := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routed = append(routed, name)
+		})
+	}
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "", nil)
-	require.NoError(t, err)
+	handler := statusActions(route("status"), route("stream"))
 
-	handler(rr, req)
+	for _, target := range []string{"/api/status/XX", "/api/status/XX/stream",
+		"/api/status/XX/other", "/api/status/XX/YY/stream"} {
 
-	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "wrong action\n", string(buff))
+		if rr.Code == http.StatusNotFound {
+			routed = append(routed, "not found")
+		}
+	}
+
+	require.Equal(t, []string{"status", "stream", "not found", "not found"}, routed)
 }
 
-func TestGetHookHandler_Wrong_Request(t *testing.T) {
-	deployer := fakeDeployer{}
+func TestGetJobsStreamHandler_Pass(t *testing.T) {
+	events := make(chan deployer.JobEvent, 1)
+	events <- deployer.JobEvent{
+		JobID:     "XX",
+		ReleaseID: "YY",
+		JobStatus: deployer.JobStatus{Status: "ok"},
+	}
+
+	deployer := fakeDeployer{
+		events: events,
+	}
 
-	handler := getHookHandler(deployer)
+	done := make(chan struct{})
+	handler := getJobsStreamHandler(deployer, done)
 
 	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodPost, "", new(bytes.Buffer))
+	req, err := http.NewRequest(http.MethodGet, "", nil)
 	require.NoError(t, err)
 
-	handler(rr, req)
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		handler(rr, req)
+	}()
 
-	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	time.Sleep(time.Millisecond * 100)
+	close(done)
+	wait.Wait()
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/event-stream", rr.Result().Header.Get("Content-Type"))
 
 	buff, err := ioutil.ReadAll(rr.Result().Body)
 	require.NoError(t, err)
-	require.Equal(t, "failed to decode request: EOF\n", string(buff))
+	require.Equal(t, "event: status\ndata: {\"jobID\":\"XX\",\"releaseID\":\"YY\","+
+		"\"tag\":\"\",\"status\":\"ok\",\"message\":\"\"}\n\n", string(buff))
 }
 
-func TestGetHookHandler_Wrong_URL(t *testing.T) {
-	deployer := fakeDeployer{}
-
-	handler := getHookHandler(deployer)
+func TestGetJobsStreamHandler_Wrong_Action(t *testing.T) {
+	handler := getJobsStreamHandler(fakeDeployer{}, nil)
 
 	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodPost, "", bytes.NewBufferString("{}"))
+	req, err := http.NewRequest(http.MethodPost, "", nil)
 	require.NoError(t, err)
 
 	handler(rr, req)
 
-	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
-
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "wrong url: parse \"\": empty url\n", string(buff))
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
 }
 
-func TestGetHookHandler_Deployer_Fail(t *testing.T) {
+func TestGetListHandler_Pass(t *testing.T) {
 	deployer := fakeDeployer{
-		deployeErr: errors.New("fake"),
+		listing: deployer.Listing{
+			Entries:   []deployer.ListingEntry{{Name: "a.txt", Size: 2, Type: "file"}},
+			Files:     1,
+			TotalSize: 2,
+		},
 	}
 
-	handler := getHookHandler(deployer)
-	body := bytes.NewBufferString("{\"browser_download_url\":\"http://xx\"}")
+	handler := getListHandler(deployer, xxTokens)
+	body := bytes.NewBufferString(`{"browser_download_url":"http://xx"}`)
 
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest(http.MethodPost, "", body)
 	require.NoError(t, err)
 
+	req.Header.Set("Authorization", "Bearer secret")
+
 	handler(rr, req)
 
-	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
 
 	buff, err := ioutil.ReadAll(rr.Result().Body)
 	require.NoError(t, err)
-	require.Equal(t, "failed to deploy: fake\n", string(buff))
+	require.Equal(t, `{"entries":[{"name":"a.txt","size":2,"type":"file"}],"files":1,"totalSize":2}`+"\n",
+		string(buff))
 }
 
-func TestGetStatusHandler_Wrong_Action(t *testing.T) {
-	deployer := fakeDeployer{}
-
-	handler := getStatusHandler(deployer)
+func TestGetListHandler_Fail(t *testing.T) {
+	handler := getListHandler(fakeDeployer{listErr: errors.New("fake")}, xxTokens)
 
 	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodPost, "", nil)
+	req, err := http.NewRequest(http.MethodPost, "", bytes.NewBufferString(`{"browser_download_url":"http://xx"}`))
 	require.NoError(t, err)
 
+	req.Header.Set("Authorization", "Bearer secret")
+
 	handler(rr, req)
 
-	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	require.Equal(t, http.StatusBadGateway, rr.Result().StatusCode)
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "", bytes.NewBufferString(`{}`))
 	require.NoError(t, err)
-	require.Equal(t, "wrong action\n", string(buff))
+
+	req.Header.Set("Authorization", "Bearer secret")
+
+	handler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
 }
 
-func TestGetStatusHandler_Deployer_Fail(t *testing.T) {
-	deployer := fakeDeployer{
-		statusErr: errors.New("fake"),
+// Listing makes Hodor download any URL, so it always requires a token.
+func TestGetListHandler_Wrong_Token(t *testing.T) {
+	for _, tokens := range []apiTokens{{}, xxTokens} {
+		handler := getListHandler(fakeDeployer{}, tokens)
+
+		for _, token := range []string{"", "wrong"} {
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "",
+				bytes.NewBufferString(`{"browser_download_url":"http://xx"}`))
+			require.NoError(t, err)
+
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			handler(rr, req)
+
+			require.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+		}
 	}
+}
 
-	handler := getStatusHandler(deployer)
+func TestAuthorized(t *testing.T) {
+	tokens := apiTokens{}
+	require.True(t, authorized(tokens, "XX", ""))
+	require.False(t, authorizedAny(tokens, ""))
+
+	tokens = xxTokens
+	require.True(t, authorized(tokens, "XX", "secret"))
+	require.False(t, authorized(tokens, "XX", "wrong"))
+	require.True(t, authorized(tokens, "YY", ""))
+	require.True(t, authorizedAny(tokens, "secret"))
+	require.False(t, authorizedAny(tokens, "wrong"))
+
+	tokens = apiTokens{global: "global", releases: map[string]string{"XX": "secret"}}
+	require.True(t, authorized(tokens, "XX", "global"))
+	require.True(t, authorized(tokens, "XX", "secret"))
+	require.True(t, authorized(tokens, "YY", "global"))
+	require.False(t, authorized(tokens, "YY", ""))
+	require.False(t, authorized(tokens, "YY", "secret"))
+	require.True(t, authorizedAny(tokens, "global"))
+
+	// a release whose hooks are signed is not deployable without a token
+	tokens = apiTokens{signed: map[string]bool{"XX": true}}
+	require.False(t, authorized(tokens, "XX", ""))
+	require.False(t, authorized(tokens, "XX", "wrong"))
+	require.True(t, authorized(tokens, "YY", ""))
+	require.Equal(t, "token", tokenAuth(tokens, "XX"))
+
+	tokens.global = "global"
+	require.True(t, authorized(tokens, "XX", "global"))
+}
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "", nil)
-	require.NoError(t, err)
+// The webhook secret of a release must not be bypassed by the other endpoints
+// that deploy it.
+func TestWebhookSecrets_Other_Endpoints(t *testing.T) {
+	d := fakeDeployer{deployReturn: "AA", selectAsset: &url.URL{}}
 
-	handler(rr, req)
+	server := NewHookHTTP("", d, zerolog.New(io.Discard),
+		WithWebhookSecrets(map[string]string{"XX": "secret"}))
+	handler := server.(*HookHTTP).server.Handler
 
-	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+	send := func(target, body string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		require.NoError(t, err)
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "failed to get status: fake\n", string(buff))
+		req.Header.Set("Content-Type", "application/json")
+
+		handler.ServeHTTP(rr, req)
+
+		return rr.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized,
+		send("/api/deploy", `{"releaseID":"XX","url":"https://xx"}`))
+	require.Equal(t, http.StatusUnauthorized, send("/api/rollback/XX", ""))
+	require.Equal(t, http.StatusUnauthorized,
+		send("/api/hook/XX", `{"browser_download_url":"https://xx"}`))
+
+	// the body of a hook is bounded before its signature is checked
+	large := `{"browser_download_url":"https://xx","notes":"` +
+		strings.Repeat("a", maxHookSize) + `"}`
+	require.Equal(t, http.StatusBadRequest, send("/api/hook/XX", large))
 }
 
-func TestGetStatusHandler_Pass(t *testing.T) {
-	deployer := fakeDeployer{
-		status: deployer.JobStatus{Status: "XX"},
+func TestPrivate(t *testing.T) {
+	tokens := apiTokens{global: "global", releases: map[string]string{"XX": "secret"}}
+
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	send := func(handler http.HandlerFunc, target, token string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		handler(rr, req)
+
+		return rr.Result().StatusCode
 	}
 
-	handler := getStatusHandler(deployer)
+	handler := private(tokens, false, "", false)(next)
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/status/AA", ""))
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/status/AA", "wrong"))
+	require.Equal(t, http.StatusOK, send(handler, "/api/status/AA", "global"))
+	require.Equal(t, http.StatusOK, send(handler, "/api/status/AA", "secret"))
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/status/AA?format=svg", ""))
+
+	handler = private(tokens, true, "", true)(next)
+	require.Equal(t, http.StatusOK, send(handler, "/api/tags/XX", "secret"))
+	require.Equal(t, http.StatusOK, send(handler, "/api/releases/XX/sbom", "secret"))
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/releases/YY/sbom", "secret"))
+	require.Equal(t, http.StatusOK, send(handler, "/api/tags/YY", "global"))
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/tags/YY", "secret"))
+	require.Equal(t, http.StatusOK, send(handler, "/api/tags/YY?format=svg", ""))
+
+	// a release without token is not readable without the global one
+	handler = private(xxTokens, false, "", true)(next)
+	require.Equal(t, http.StatusUnauthorized, send(handler, "/api/tags/YY", ""))
+}
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "", nil)
-	require.NoError(t, err)
+func TestPrivate_Signed_Badge(t *testing.T) {
+	next := func(w http.ResponseWriter, r *http.Request) {}
 
-	handler(rr, req)
+	send := func(target string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
 
-	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+		private(xxTokens, false, "badges", true)(next)(rr, req)
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "{\"status\":\"XX\",\"message\":\"\"}\n", string(buff))
+		return rr.Result().StatusCode
+	}
+
+	expires := time.Now().Add(time.Hour)
+
+	require.Equal(t, http.StatusOK, send(SignBadge("badges", "/api/tags/XX", expires)))
+	require.Equal(t, http.StatusUnauthorized, send(SignBadge("wrong", "/api/tags/XX", expires)))
+	require.Equal(t, http.StatusUnauthorized,
+		send(SignBadge("badges", "/api/tags/XX", time.Now().Add(-time.Second))))
+
+	// the signature is bound to the path and the format
+	signed := SignBadge("badges", "/api/tags/XX", expires)
+	require.Equal(t, http.StatusUnauthorized, send(strings.Replace(signed, "/XX", "/YY", 1)))
+	require.Equal(t, http.StatusUnauthorized, send(strings.Replace(signed, "format=svg", "format=json", 1)))
 }
 
-func TestGetTagsHandler_Wrong_Action(t *testing.T) {
-	deployer := fakeDeployer{}
+// Only the badge routes should be public with "?format=svg".
+func TestPrivate_Public_Badges(t *testing.T) {
+	deployer := fakeDeployer{latestTag: "v1"}
 
-	handler := getTagsHandler(deployer)
+	server := NewHookHTTP("", deployer, zerolog.New(io.Discard),
+		WithGlobalToken("secret"), WithPrivate(true))
+	handler := server.(*HookHTTP).server.Handler
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodPost, "", nil)
-	require.NoError(t, err)
+	send := func(method, target string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, target, nil)
+		require.NoError(t, err)
 
-	handler(rr, req)
+		handler.ServeHTTP(rr, req)
 
-	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+		return rr.Result().StatusCode
+	}
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "wrong action\n", string(buff))
+	require.Equal(t, http.StatusOK, send(http.MethodGet, "/api/tags/XX?format=svg"))
+	require.Equal(t, http.StatusOK, send(http.MethodGet, "/api/status/AA?format=svg"))
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/tags/XX"))
+
+	for _, target := range []string{"/api/jobs", "/api/jobs/stream", "/metrics",
+		"/api/history/XX", "/api/releases", "/api/releases/XX/sbom", "/api/freezes",
+		"/api/status/AA/stream"} {
+
+		require.Equal(t, http.StatusUnauthorized,
+			send(http.MethodGet, target+"?format=svg"), target)
+	}
+
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/api/list?format=svg"))
 }
 
-func TestGetTagsHandler_Deployer_Fail(t *testing.T) {
+func TestGetBadgeHandler(t *testing.T) {
 	deployer := fakeDeployer{
-		latestTagErr: errors.New("fake"),
+		status: deployer.JobStatus{ReleaseID: "XX"},
 	}
 
-	handler := getTagsHandler(deployer)
+	handler := getBadgeHandler(deployer, "badges", xxTokens)
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "", nil)
-	require.NoError(t, err)
+	for _, badgePath := range []string{"/api/tags/XX", "/api/status/AA"} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/api/badges",
+			strings.NewReader(fmt.Sprintf(`{"path": %q, "ttl": "1h"}`, badgePath)))
+		require.NoError(t, err)
 
-	handler(rr, req)
+		req.Header.Set("Authorization", "Bearer secret")
 
-	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+		start := time.Now().Truncate(time.Second)
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "failed to get tag: fake\n", string(buff))
+		handler(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Result().StatusCode, rr.Body.String())
+
+		var res badgeResponse
+
+		err = json.Unmarshal(rr.Body.Bytes(), &res)
+		require.NoError(t, err)
+
+		require.Equal(t, SignBadge("badges", badgePath, res.Expires), res.URL)
+		require.False(t, res.Expires.Before(start.Add(time.Hour)))
+
+		req, err = http.NewRequest(http.MethodGet, res.URL, nil)
+		require.NoError(t, err)
+		require.True(t, validBadge("badges", req, time.Now()))
+	}
 }
 
-func TestGetTagsHandler_Pass_Text(t *testing.T) {
-	deployer := fakeDeployer{
-		latestTag: "XX",
+func TestGetBadgeHandler_Wrong(t *testing.T) {
+	tests := map[string]struct {
+		secret string
+		method string
+		body   string
+		token  string
+		status int
+	}{
+		"action":  {"badges", http.MethodGet, `{"path": "/api/tags/XX"}`, "secret", http.StatusForbidden},
+		"secret":  {"", http.MethodPost, `{"path": "/api/tags/XX"}`, "secret", http.StatusNotFound},
+		"body":    {"badges", http.MethodPost, `{`, "secret", http.StatusBadRequest},
+		"ttl":     {"badges", http.MethodPost, `{"path": "/api/tags/XX", "ttl": "-1h"}`, "secret", http.StatusBadRequest},
+		"path":    {"badges", http.MethodPost, `{"path": "/api/jobs"}`, "secret", http.StatusBadRequest},
+		"empty":   {"badges", http.MethodPost, `{"path": "/api/tags/"}`, "secret", http.StatusBadRequest},
+		"token":   {"badges", http.MethodPost, `{"path": "/api/tags/XX"}`, "wrong", http.StatusUnauthorized},
+		"release": {"badges", http.MethodPost, `{"path": "/api/tags/YY"}`, "secret", http.StatusUnauthorized},
 	}
 
-	handler := getTagsHandler(deployer)
+	tokens := apiTokens{global: "global", releases: map[string]string{"XX": "secret"}}
 
-	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "", nil)
-	require.NoError(t, err)
+	for name, test := range tests {
+		handler := getBadgeHandler(fakeDeployer{}, test.secret, tokens)
 
-	handler(rr, req)
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, "/api/badges", strings.NewReader(test.body))
+		require.NoError(t, err)
 
-	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+		req.Header.Set("Authorization", "Bearer "+test.token)
 
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.Equal(t, "XX", string(buff))
-}
+		handler(rr, req)
 
-func TestGetTagsHandler_Pass_SVG(t *testing.T) {
-	deployer := fakeDeployer{
-		latestTag: "XX",
+		require.Equal(t, test.status, rr.Result().StatusCode, name)
 	}
 
-	handler := getTagsHandler(deployer)
+	// the job of a status badge must exist
+	handler := getBadgeHandler(fakeDeployer{statusErr: errors.New("not found")}, "badges", xxTokens)
 
 	rr := httptest.NewRecorder()
-	req, err := http.NewRequest(http.MethodGet, "?format=svg", nil)
+	req, err := http.NewRequest(http.MethodPost, "/api/badges",
+		strings.NewReader(`{"path": "/api/status/AA"}`))
 	require.NoError(t, err)
 
 	handler(rr, req)
 
-	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
-
-	buff, err := ioutil.ReadAll(rr.Result().Body)
-	require.NoError(t, err)
-	require.True(t, strings.HasPrefix(string(buff), "<svg"))
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
 }
 
 // ----------------------------------------------------------------------------
 // Utility function
 
+// gitlabReleaseHook is a GitLab release hook
+const gitlabReleaseHook = `{
+  "object_kind": "release",
+  "action": "create",
+  "tag": "v1.2",
+  "name": "v1.2",
+  "description": "notes",
+  "assets": {
+    "count": 2,
+    "links": [{"id": 1, "name": "site.tar.gz", "url": "https://xx/site.tar.gz", "link_type": "package"}],
+    "sources": [{"format": "zip", "url": "https://xx/archive/v1.2.zip"}]
+  }
+}`
+
+// releaseEventPayload is a GitHub release event, whose shape Gitea mirrors
+const releaseEventPayload = `{
+  "action": "published",
+  "release": {
+    "tag_name": "v1.2",
+    "body": "notes",
+    "assets": [{"id": 1, "name": "site.tar.gz", "browser_download_url": "https://xx/site.tar.gz"}]
+  },
+  "sender": {"login": "alice"}
+}`
+
+// xxTokens are the API tokens where the "XX" release requires "secret"
+var xxTokens = apiTokens{releases: map[string]string{"XX": "secret"}}
+
 type fakeDeployer struct {
 	deployer.Deployer
 
-	deployReturn string
-	deployeErr   error
+	deployReturn  string
+	deployeErr    error
+	deployRequest *deployer.Request
 
 	status    deployer.JobStatus
 	statusErr error
+	// statuses, if set, are returned one after the other instead of status
+	statuses *[]deployer.JobStatus
 
 	latestTag    string
 	latestTagErr error
+
+	selectAsset    *url.URL
+	selectAssetErr error
+
+	// httpsOnly rejects the plain HTTP URLs in CheckURL
+	httpsOnly bool
+
+	events chan deployer.JobEvent
+
+	queueLength int
+	stopped     bool
+
+	history    []deployer.HistoryEntry
+	historyErr error
+
+	failures    []deployer.Failure
+	failuresErr error
+
+	listing deployer.Listing
+	listErr error
+
+	targetsHealth map[string]deployer.TargetHealth
+
+	releases    []deployer.Release
+	releasesErr error
+
+	rollbackReturn string
+	rollbackErr    error
+
+	promoteReturn string
+	promoteErr    error
+
+	sbom        deployer.SBOM
+	sbomContent []byte
+	sbomErr     error
+
+	maintenance    *bool
+	deferred       int
+	maintenanceErr error
+
+	jobs        []deployer.JobSummary
+	jobsErr     error
+	jobsRequest *[3]interface{}
+
+	freezes    []deployer.Freeze
+	freezesErr error
+	freezeErr  error
+	liftErr    error
+
+	setStatus    *[3]string
+	setStatusErr error
+
+	// retained is the folder of the retained files
+	retained    string
+	retainedErr error
 }
 
-func (d fakeDeployer) Deploy(releaseID, tag string, releaseURL *url.URL) (string, error) {
+func (d fakeDeployer) Deploy(req deployer.Request) (string, error) {
+	if d.deployRequest != nil {
+		*d.deployRequest = req
+	}
+
 	return d.deployReturn, d.deployeErr
 }
 
 func (d fakeDeployer) GetStatus(jobID string) (deployer.JobStatus, error) {
+	if d.statuses != nil && len(*d.statuses) != 0 {
+		status := (*d.statuses)[0]
+		*d.statuses = (*d.statuses)[1:]
+
+		return status, d.statusErr
+	}
+
 	return d.status, d.statusErr
 }
 
+func (d fakeDeployer) GetHistory(releaseID string) ([]deployer.HistoryEntry, error) {
+	return d.history, d.historyErr
+}
+
+func (d fakeDeployer) GetFailures(releaseID string) ([]deployer.Failure, error) {
+	return d.failures, d.failuresErr
+}
+
+func (d fakeDeployer) List(ctx context.Context, releaseURL *url.URL) (deployer.Listing, error) {
+	return d.listing, d.listErr
+}
+
+func (d fakeDeployer) QueueLength() int {
+	return d.queueLength
+}
+
+func (d fakeDeployer) Running() bool {
+	return !d.stopped
+}
+
 func (d fakeDeployer) GetLatestTag(releaseID string) (string, error) {
 	return d.latestTag, d.latestTagErr
 }
+
+func (d fakeDeployer) SelectAsset(releaseID string, assets []asset.Asset) (*url.URL, error) {
+	return d.selectAsset, d.selectAssetErr
+}
+
+func (d fakeDeployer) CheckURL(releaseID string, u *url.URL) error {
+	if d.httpsOnly && u.Scheme == "http" {
+		return fmt.Errorf("%w: %q", deployer.ErrInsecureURL, u.String())
+	}
+
+	return nil
+}
+
+func (d fakeDeployer) GetTargetsHealth() map[string]deployer.TargetHealth {
+	return d.targetsHealth
+}
+
+func (d fakeDeployer) Rollback(releaseID string) (string, error) {
+	return d.rollbackReturn, d.rollbackErr
+}
+
+func (d fakeDeployer) Promote(releaseID string) (string, error) {
+	return d.promoteReturn, d.promoteErr
+}
+
+func (d fakeDeployer) GetSBOM(releaseID string) (deployer.SBOM, []byte, error) {
+	return d.sbom, d.sbomContent, d.sbomErr
+}
+
+func (d fakeDeployer) GetRetained(jobID, file string) (*os.File, error) {
+	if d.retainedErr != nil {
+		return nil, d.retainedErr
+	}
+
+	return os.Open(filepath.Join(d.retained, file))
+}
+
+func (d fakeDeployer) ListJobs(releaseID string, limit, offset int) ([]deployer.JobSummary, error) {
+	if d.jobsRequest != nil {
+		*d.jobsRequest = [3]interface{}{releaseID, limit, offset}
+	}
+
+	return d.jobs, d.jobsErr
+}
+
+func (d fakeDeployer) Freeze(freeze deployer.Freeze) (deployer.Freeze, error) {
+	freeze.ID = "AA"
+	return freeze, d.freezeErr
+}
+
+func (d fakeDeployer) LiftFreeze(freezeID, liftedBy string) (deployer.Freeze, error) {
+	return deployer.Freeze{ID: freezeID, LiftedBy: liftedBy}, d.liftErr
+}
+
+func (d fakeDeployer) GetFreezes() ([]deployer.Freeze, error) {
+	return d.freezes, d.freezesErr
+}
+
+func (d fakeDeployer) SetMaintenance(releaseID string, enabled bool) (int, error) {
+	if d.maintenance != nil {
+		*d.maintenance = enabled
+	}
+
+	return d.deferred, d.maintenanceErr
+}
+
+func (d fakeDeployer) SetStatus(jobID, status, message string) error {
+	if d.setStatus != nil {
+		*d.setStatus = [3]string{jobID, status, message}
+	}
+
+	return d.setStatusErr
+}
+
+func (d fakeDeployer) GetReleases() ([]deployer.Release, error) {
+	return d.releases, d.releasesErr
+}
+
+func (d fakeDeployer) Subscribe() (<-chan deployer.JobEvent, func()) {
+	return d.events, func() {}
+}
+
+// writeCertificate writes a self-signed certificate for localhost, with the
+// common name, and its key as PEM files
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	require.NoError(t, err)
+}
+
+// requireFieldErrors checks that the response is a 400 Bad Request with the
+// field errors of a hook request
+func requireFieldErrors(t *testing.T, rr *httptest.ResponseRecorder, errs ...fieldError) {
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	require.Equal(t, "application/json", rr.Result().Header.Get("Content-Type"))
+
+	var res validationResponse
+
+	err := json.NewDecoder(rr.Result().Body).Decode(&res)
+	require.NoError(t, err)
+	require.Equal(t, validationResponse{Error: "invalid request", Errors: errs}, res)
+}
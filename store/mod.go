@@ -0,0 +1,358 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned by Get and Delete if the key doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrLocked is returned when the database file is opened by another process,
+// such as another instance of Hodor
+var ErrLocked = errors.New("locked by another process")
+
+// ErrInvalid is returned when the file is not a database of the backend, or is
+// corrupted
+var ErrInvalid = errors.New("not a valid database")
+
+// Store defines the primitives of a key/value store. Keys are UTF-8 strings,
+// sorted so that they can be iterated by prefix.
+type Store interface {
+	// View calls fn in a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update calls fn in a read-write transaction, which is committed if fn
+	// returns nil, or else rolled back
+	Update(fn func(tx Tx) error) error
+	// Close closes the store
+	Close() error
+}
+
+// Tx defines the primitives of a transaction. A transaction must not be used
+// once its function returned.
+type Tx interface {
+	// Get returns the value of the key, or ErrNotFound
+	Get(key string) (string, error)
+	// Set sets the value of the key. It fails in a read-only transaction.
+	Set(key, value string) error
+	// Delete removes the key, or returns ErrNotFound
+	Delete(key string) error
+	// Iterate calls fn with the keys that start with the prefix and their
+	// value, in ascending order, or descending if reverse is true, until fn
+	// returns false. fn must not change the keys.
+	Iterate(prefix string, reverse bool, fn func(key, value string) bool) error
+}
+
+// upperBound returns a key greater than all the keys that start with the
+// prefix, since 0xff never appears in UTF-8
+func upperBound(prefix string) string {
+	return prefix + "\xff"
+}
+
+// OpenBunt opens the buntdb database at the path, or in memory if the path is
+// ":memory:", and returns it as a store
+func OpenBunt(path string) (Store, error) {
+	db, err := OpenBuntDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBuntStore(db), nil
+}
+
+// OpenBuntDB opens the buntdb database at the path, for the callers that need
+// the database itself, such as to configure its shrinking. It returns
+// ErrInvalid if the file is not a buntdb database.
+func OpenBuntDB(path string) (*buntdb.DB, error) {
+	db, err := buntdb.Open(path)
+	if errors.Is(err, buntdb.ErrInvalid) {
+		return nil, fmt.Errorf("failed to open buntdb: %w", ErrInvalid)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open buntdb: %w", err)
+	}
+
+	return db, nil
+}
+
+// NewBuntStore returns a store backed by the buntdb database. Closing the
+// store closes the database.
+func NewBuntStore(db *buntdb.DB) Store {
+	return buntStore{db: db}
+}
+
+// buntStore implements a store with buntdb, which keeps all the keys in
+// memory and appends the changes to a file.
+//
+// - implements store.Store
+type buntStore struct {
+	db *buntdb.DB
+}
+
+// View implements store.Store
+func (s buntStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return fn(buntTx{tx: tx})
+	})
+}
+
+// Update implements store.Store
+func (s buntStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return fn(buntTx{tx: tx})
+	})
+}
+
+// Close implements store.Store
+func (s buntStore) Close() error {
+	return s.db.Close()
+}
+
+// buntTx implements a transaction of a buntdb store
+//
+// - implements store.Tx
+type buntTx struct {
+	tx *buntdb.Tx
+}
+
+// Get implements store.Tx
+func (t buntTx) Get(key string) (string, error) {
+	value, err := t.tx.Get(key)
+	if err == buntdb.ErrNotFound {
+		return "", ErrNotFound
+	}
+
+	return value, err
+}
+
+// Set implements store.Tx
+func (t buntTx) Set(key, value string) error {
+	_, _, err := t.tx.Set(key, value, nil)
+	return err
+}
+
+// Delete implements store.Tx
+func (t buntTx) Delete(key string) error {
+	_, err := t.tx.Delete(key)
+	if err == buntdb.ErrNotFound {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Iterate implements store.Tx. The prefix is not a pattern, so that a key
+// with "*" or "?" is matched as is.
+func (t buntTx) Iterate(prefix string, reverse bool, fn func(key, value string) bool) error {
+	iterator := func(key, value string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+
+		return fn(key, value)
+	}
+
+	if reverse {
+		return t.tx.DescendLessOrEqual("", upperBound(prefix), iterator)
+	}
+
+	return t.tx.AscendGreaterOrEqual("", prefix, iterator)
+}
+
+// boltBucket is the bucket of the keys of a bbolt store
+var boltBucket = []byte("hodor")
+
+// Lock takes the lock of the database at the path, in "<path>.lock", so that
+// a single process uses it. It returns ErrLocked right away if another process
+// holds the lock. The lock is released by closing the returned file, or by the
+// system if the process dies. The file is kept, as removing it would let two
+// processes lock different files.
+func Lock(path string) (io.Closer, error) {
+	lockPath := path + ".lock"
+
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	err = flock(f)
+	if errors.Is(err, ErrLocked) {
+		owner, _ := io.ReadAll(io.LimitReader(f, 64))
+		f.Close()
+
+		return nil, fmt.Errorf("%q is %w (%s)", lockPath, err,
+			strings.TrimSpace(string(owner)))
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %w", lockPath, err)
+	}
+
+	// informative, for the operators and the next instances
+	f.Truncate(0)
+	fmt.Fprintf(f, "pid %d\n", os.Getpid())
+
+	return f, nil
+}
+
+// WithLock returns the store, which also releases the lock once closed
+func WithLock(s Store, lock io.Closer) Store {
+	return lockedStore{Store: s, lock: lock}
+}
+
+// lockedStore is a store that holds the lock of its database.
+//
+// - implements store.Store
+type lockedStore struct {
+	Store
+	lock io.Closer
+}
+
+// Close implements store.Store
+func (s lockedStore) Close() error {
+	defer s.lock.Close()
+
+	return s.Store.Close()
+}
+
+// boltTimeout is the maximum time to wait for the lock of a bbolt database
+// file, which only one process can open
+var boltTimeout = 5 * time.Second
+
+// OpenBolt opens or creates the bbolt database at the path, and returns it as
+// a store. It returns ErrLocked if another process keeps the file open, and
+// ErrInvalid if the file is not a bbolt database.
+func OpenBolt(path string, mode os.FileMode) (Store, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: boltTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("failed to open bbolt: %w", ErrLocked)
+	}
+
+	if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrVersionMismatch) ||
+		errors.Is(err, bolt.ErrChecksum) {
+		return nil, fmt.Errorf("failed to open bbolt: %w", ErrInvalid)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bbolt: %w", err)
+	}
+
+	s, err := NewBoltStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewBoltStore returns a store backed by the bbolt database, with its keys in
+// a single bucket. Closing the store closes the database.
+func NewBoltStore(db *bolt.DB) (Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket: %v", err)
+	}
+
+	return boltStore{db: db}, nil
+}
+
+// boltStore implements a store with bbolt, which keeps the keys in a B+tree
+// file mapped in memory.
+//
+// - implements store.Store
+type boltStore struct {
+	db *bolt.DB
+}
+
+// View implements store.Store
+func (s boltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{bucket: tx.Bucket(boltBucket)})
+	})
+}
+
+// Update implements store.Store
+func (s boltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{bucket: tx.Bucket(boltBucket)})
+	})
+}
+
+// Close implements store.Store
+func (s boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx implements a transaction of a bbolt store. The values are copied,
+// since bbolt only keeps them valid during the transaction.
+//
+// - implements store.Tx
+type boltTx struct {
+	bucket *bolt.Bucket
+}
+
+// Get implements store.Tx
+func (t boltTx) Get(key string) (string, error) {
+	value := t.bucket.Get([]byte(key))
+	if value == nil {
+		return "", ErrNotFound
+	}
+
+	return string(value), nil
+}
+
+// Set implements store.Tx
+func (t boltTx) Set(key, value string) error {
+	return t.bucket.Put([]byte(key), []byte(value))
+}
+
+// Delete implements store.Tx
+func (t boltTx) Delete(key string) error {
+	if t.bucket.Get([]byte(key)) == nil {
+		return ErrNotFound
+	}
+
+	return t.bucket.Delete([]byte(key))
+}
+
+// Iterate implements store.Tx
+func (t boltTx) Iterate(prefix string, reverse bool, fn func(key, value string) bool) error {
+	cursor := t.bucket.Cursor()
+
+	next := cursor.Next
+	key, value := cursor.Seek([]byte(prefix))
+
+	if reverse {
+		next = cursor.Prev
+
+		// the last key of the prefix is the one before the upper bound
+		key, _ = cursor.Seek([]byte(upperBound(prefix)))
+		if key == nil {
+			key, value = cursor.Last()
+		} else {
+			key, value = cursor.Prev()
+		}
+	}
+
+	for ; key != nil && strings.HasPrefix(string(key), prefix); key, value = next() {
+		if !fn(string(key), string(value)) {
+			return nil
+		}
+	}
+
+	return nil
+}
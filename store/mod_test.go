@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Scenario(t *testing.T) {
+	for name, open := range openers(t) {
+		s := open()
+
+		err := s.Update(func(tx Tx) error {
+			for _, key := range []string{"job:AA", "job:BB", "job:CC", "jobs", "XX", "empty"} {
+				value := key
+				if key == "empty" {
+					value = ""
+				}
+
+				err := tx.Set(key, value)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err, name)
+
+		err = s.View(func(tx Tx) error {
+			value, err := tx.Get("XX")
+			require.NoError(t, err, name)
+			require.Equal(t, "XX", value, name)
+
+			value, err = tx.Get("empty")
+			require.NoError(t, err, name)
+			require.Equal(t, "", value, name)
+
+			_, err = tx.Get("YY")
+			require.Equal(t, ErrNotFound, err, name)
+
+			require.Equal(t, []string{"job:AA", "job:BB", "job:CC"}, keys(t, tx, "job:", false), name)
+			require.Equal(t, []string{"job:CC", "job:BB", "job:AA"}, keys(t, tx, "job:", true), name)
+			require.Equal(t, []string{"jobs", "job:CC", "job:BB", "job:AA"}, keys(t, tx, "job", true), name)
+			require.Len(t, keys(t, tx, "", false), 6, name)
+			require.Empty(t, keys(t, tx, "zz", true), name)
+
+			// the iteration stops once fn returns false
+			var first []string
+
+			err = tx.Iterate("job:", true, func(key, value string) bool {
+				first = append(first, key)
+				return false
+			})
+			require.NoError(t, err, name)
+			require.Equal(t, []string{"job:CC"}, first, name)
+
+			// a read-only transaction can't change the keys
+			require.Error(t, tx.Set("XX", "YY"), name)
+
+			return nil
+		})
+		require.NoError(t, err, name)
+
+		err = s.Update(func(tx Tx) error {
+			require.NoError(t, tx.Delete("job:BB"), name)
+			require.Equal(t, ErrNotFound, tx.Delete("job:BB"), name)
+
+			return nil
+		})
+		require.NoError(t, err, name)
+
+		// a failed update is rolled back
+		err = s.Update(func(tx Tx) error {
+			require.NoError(t, tx.Set("XX", "changed"), name)
+			return errors.New("fake")
+		})
+		require.EqualError(t, err, "fake", name)
+
+		err = s.View(func(tx Tx) error {
+			value, err := tx.Get("XX")
+			require.NoError(t, err, name)
+			require.Equal(t, "XX", value, name)
+
+			require.Equal(t, []string{"job:AA", "job:CC"}, keys(t, tx, "job:", false), name)
+
+			return nil
+		})
+		require.NoError(t, err, name)
+
+		require.NoError(t, s.Close(), name)
+	}
+}
+
+func TestStore_Reopen(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	for name, open := range map[string]func() (Store, error){
+		"buntdb": func() (Store, error) { return OpenBunt(filepath.Join(tmpDir, "bunt.db")) },
+		"bbolt":  func() (Store, error) { return OpenBolt(filepath.Join(tmpDir, "bolt.db"), 0600) },
+	} {
+		s, err := open()
+		require.NoError(t, err, name)
+
+		err = s.Update(func(tx Tx) error {
+			return tx.Set("XX", "v1")
+		})
+		require.NoError(t, err, name)
+		require.NoError(t, s.Close(), name)
+
+		s, err = open()
+		require.NoError(t, err, name)
+
+		err = s.View(func(tx Tx) error {
+			value, err := tx.Get("XX")
+			require.NoError(t, err, name)
+			require.Equal(t, "v1", value, name)
+
+			return nil
+		})
+		require.NoError(t, err, name)
+		require.NoError(t, s.Close(), name)
+	}
+}
+
+func TestOpenBolt_Wrong_Path(t *testing.T) {
+	_, err := OpenBolt(filepath.Join(t.TempDir(), "missing", "bolt.db"), 0600)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to open bbolt: ")
+}
+
+func TestOpenBolt_Locked(t *testing.T) {
+	timeout := boltTimeout
+	boltTimeout = 10 * time.Millisecond
+
+	defer func() {
+		boltTimeout = timeout
+	}()
+
+	path := filepath.Join(t.TempDir(), "bolt.db")
+
+	s, err := OpenBolt(path, 0600)
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	_, err = OpenBolt(path, 0600)
+	require.True(t, errors.Is(err, ErrLocked), err)
+	require.EqualError(t, err, "failed to open bbolt: locked by another process")
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hodor.db")
+
+	lock, err := Lock(path)
+	require.NoError(t, err)
+
+	_, err = Lock(path)
+	require.True(t, errors.Is(err, ErrLocked), err)
+	require.EqualError(t, err, fmt.Sprintf("%q is locked by another process (pid %d)",
+		path+".lock", os.Getpid()))
+
+	s, err := OpenBunt(path)
+	require.NoError(t, err)
+
+	s = WithLock(s, lock)
+	require.NoError(t, s.Close())
+
+	// closing the store released the lock
+	lock, err = Lock(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garbage.db")
+
+	err := os.WriteFile(path, bytes.Repeat([]byte("garbage\n"), 4096), 0600)
+	require.NoError(t, err)
+
+	_, err = OpenBunt(path)
+	require.True(t, errors.Is(err, ErrInvalid), err)
+
+	_, err = OpenBolt(path, 0600)
+	require.True(t, errors.Is(err, ErrInvalid), err)
+
+	// the other errors are kept
+	_, err = OpenBunt(t.TempDir())
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrInvalid))
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+// openers returns the functions that open an empty store of each backend
+func openers(t *testing.T) map[string]func() Store {
+	return map[string]func() Store{
+		"buntdb": func() Store {
+			s, err := OpenBunt(":memory:")
+			require.NoError(t, err)
+
+			return s
+		},
+		"bbolt": func() Store {
+			s, err := OpenBolt(filepath.Join(t.TempDir(), "bolt.db"), 0600)
+			require.NoError(t, err)
+
+			return s
+		},
+	}
+}
+
+// keys returns the keys with the prefix, in the iteration order
+func keys(t *testing.T, tx Tx, prefix string, reverse bool) []string {
+	result := []string{}
+
+	err := tx.Iterate(prefix, reverse, func(key, value string) bool {
+		result = append(result, key)
+		return true
+	})
+	require.NoError(t, err)
+
+	return result
+}
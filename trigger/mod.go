@@ -0,0 +1,542 @@
+package trigger
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nkcr/hodor/asset"
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/rs/zerolog"
+)
+
+// Trigger defines the primitives needed to deploy releases from an external
+// source of events
+type Trigger interface {
+	// Start must be called only once to start the trigger loop
+	Start()
+	// Stop must be called only once and when start has been called
+	Stop()
+}
+
+// message is the payload of an MQTT message, as the body of a hook request
+type message struct {
+	BrowserDownloadURL string        `json:"browser_download_url"`
+	Tag                string        `json:"tag"`
+	Assets             []asset.Asset `json:"assets"`
+}
+
+const (
+	// defaultTopic is the topic of a release if not configured
+	defaultTopic = "hodor/deploy/{releaseID}"
+	// keepAlive is the interval at which the broker expects a packet
+	keepAlive = 60 * time.Second
+	// retryInterval is the time waited before reconnecting to the broker
+	retryInterval = 10 * time.Second
+	// maxPacketSize bounds the packets read from the broker
+	maxPacketSize = 1 << 20
+)
+
+// MQTT packet types, as the first byte of the packets, without flags
+const (
+	packetConnect    = 0x10
+	packetConnAck    = 0x20
+	packetPublish    = 0x30
+	packetPubAck     = 0x40
+	packetSubscribe  = 0x82
+	packetSubAck     = 0x90
+	packetPingReq    = 0xC0
+	packetPingResp   = 0xD0
+	packetDisconnect = 0xE0
+)
+
+// NewMQTTTrigger returns a new initialized trigger that subscribes to the
+// topic of each release on the broker, and deploys the releases from their
+// messages.
+func NewMQTTTrigger(conf config.MQTTConfig, releaseIDs []string, d deployer.Deployer,
+	logger zerolog.Logger) (Trigger, error) {
+
+	if len(releaseIDs) == 0 {
+		return nil, errors.New("no release to subscribe to")
+	}
+
+	broker, err := url.Parse(conf.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse broker: %v", err)
+	}
+
+	var dial func() (net.Conn, error)
+
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+		addr := withPort(broker.Host, "1883")
+		dial = func() (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, retryInterval)
+		}
+	case "tls", "ssl", "mqtts":
+		addr := withPort(broker.Host, "8883")
+		dial = func() (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: retryInterval}
+			return tls.DialWithDialer(dialer, "tcp", addr, nil)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", broker.Scheme)
+	}
+
+	if conf.ClientID == "" {
+		hostname, _ := os.Hostname()
+		conf.ClientID = "hodor-" + hostname
+	}
+
+	if conf.Topic == "" {
+		conf.Topic = defaultTopic
+	}
+
+	topics := make(map[string]string, len(releaseIDs))
+	for _, releaseID := range releaseIDs {
+		topics[strings.ReplaceAll(conf.Topic, "{releaseID}", releaseID)] = releaseID
+	}
+
+	logger = logger.With().Str("role", "mqtt").Logger()
+
+	return &MQTTTrigger{
+		conf:     conf,
+		topics:   topics,
+		deployer: d,
+		dial:     dial,
+		logger:   logger,
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+// withPort returns the host with the default port if it has none
+func withPort(host, port string) string {
+	_, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return net.JoinHostPort(host, port)
+	}
+
+	return host
+}
+
+// MQTTTrigger implements a trigger that subscribes to an MQTT 3.1.1 broker.
+// Messages are received with QoS 1, and the broker keeps them while Hodor is
+// disconnected. Retained messages are ignored, so that a deployment is not
+// replayed on each connection.
+//
+// - implements trigger.Trigger
+type MQTTTrigger struct {
+	sync.Mutex
+
+	conf     config.MQTTConfig
+	topics   map[string]string
+	deployer deployer.Deployer
+	dial     func() (net.Conn, error)
+	logger   zerolog.Logger
+	quit     chan struct{}
+	conn     net.Conn
+}
+
+// Start implements trigger.Trigger. This is a blocking function that returns
+// once Stop has been called. It reconnects to the broker until then.
+func (t *MQTTTrigger) Start() {
+	for {
+		reader, err := t.connect()
+		if err != nil {
+			t.logger.Err(err).Msg("failed to connect to broker")
+		} else {
+			t.logger.Info().Msgf("subscribed to %d topics", len(t.topics))
+
+			err = t.listen(reader)
+
+			select {
+			case <-t.quit:
+				return
+			default:
+			}
+
+			t.logger.Err(err).Msg("lost connection to broker")
+		}
+
+		select {
+		case <-t.quit:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Stop implements trigger.Trigger
+func (t *MQTTTrigger) Stop() {
+	t.Lock()
+	defer t.Unlock()
+
+	close(t.quit)
+
+	if t.conn != nil {
+		t.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		writePacket(t.conn, packetDisconnect, nil)
+		t.conn.Close()
+	}
+}
+
+// connect connects to the broker and subscribes to the topics. It returns the
+// reader of the connection.
+func (t *MQTTTrigger) connect() (*bufio.Reader, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %v", err)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	select {
+	case <-t.quit:
+		conn.Close()
+		return nil, errors.New("stopped")
+	default:
+	}
+
+	t.conn = conn
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(retryInterval))
+
+	err = t.handshake(conn, reader)
+	if err != nil {
+		conn.Close()
+		t.conn = nil
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return reader, nil
+}
+
+// handshake sends the CONNECT and SUBSCRIBE packets and checks their
+// acknowledgment
+func (t *MQTTTrigger) handshake(conn net.Conn, reader *bufio.Reader) error {
+	// clean session is not set, so that the broker keeps the messages
+	var flags byte
+
+	payload := appendString(nil, t.conf.ClientID)
+
+	if t.conf.Username != "" {
+		flags |= 0x80
+		payload = appendString(payload, t.conf.Username)
+	}
+
+	if t.conf.Password != "" {
+		flags |= 0x40
+		payload = appendString(payload, t.conf.Password)
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(keepAlive/time.Second))
+	body = append(body, payload...)
+
+	err := writePacket(conn, packetConnect, body)
+	if err != nil {
+		return fmt.Errorf("failed to send connect: %v", err)
+	}
+
+	header, body, err := readPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read connack: %v", err)
+	}
+
+	if header != packetConnAck || len(body) != 2 {
+		return fmt.Errorf("unexpected packet %#x instead of connack", header)
+	}
+
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused with code %d", body[1])
+	}
+
+	// the packet identifier is always 1, as only one subscription is sent
+	body = []byte{0, 1}
+
+	for topic := range t.topics {
+		body = appendString(body, topic)
+		body = append(body, 1)
+	}
+
+	err = writePacket(conn, packetSubscribe, body)
+	if err != nil {
+		return fmt.Errorf("failed to send subscribe: %v", err)
+	}
+
+	for {
+		header, body, err = readPacket(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read suback: %v", err)
+		}
+
+		// the messages kept by the broker may be sent before the suback
+		if header&0xF0 == packetPublish {
+			err = t.handlePublish(header, body)
+			if err != nil {
+				return fmt.Errorf("failed to handle publish: %v", err)
+			}
+
+			continue
+		}
+
+		if header&0xF0 != packetSubAck || len(body) < 2 {
+			continue
+		}
+
+		for _, code := range body[2:] {
+			if code == 0x80 {
+				return errors.New("subscription refused")
+			}
+		}
+
+		return nil
+	}
+}
+
+// listen handles the packets of the broker until the connection fails. It
+// sends a ping when the connection is idle, to keep it alive.
+func (t *MQTTTrigger) listen(reader *bufio.Reader) error {
+	pinged := false
+
+	for {
+		t.conn.SetReadDeadline(time.Now().Add(keepAlive / 2))
+
+		_, err := reader.Peek(1)
+		if isTimeout(err) {
+			if pinged {
+				return errors.New("broker didn't respond to ping")
+			}
+
+			err = writePacket(t.conn, packetPingReq, nil)
+			if err != nil {
+				return fmt.Errorf("failed to ping: %v", err)
+			}
+
+			pinged = true
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read: %v", err)
+		}
+
+		pinged = false
+
+		t.conn.SetReadDeadline(time.Now().Add(keepAlive))
+
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read packet: %v", err)
+		}
+
+		if header&0xF0 != packetPublish {
+			continue
+		}
+
+		err = t.handlePublish(header, body)
+		if err != nil {
+			return fmt.Errorf("failed to handle publish: %v", err)
+		}
+	}
+}
+
+// handlePublish deploys the release of a PUBLISH packet and acknowledges it.
+// Wrong messages are logged and acknowledged, so that they are not sent again.
+func (t *MQTTTrigger) handlePublish(header byte, body []byte) error {
+	topic, body, err := readString(body)
+	if err != nil {
+		return fmt.Errorf("failed to read topic: %v", err)
+	}
+
+	qos := (header >> 1) & 0x03
+
+	var packetID []byte
+
+	if qos > 0 {
+		if len(body) < 2 {
+			return errors.New("missing packet identifier")
+		}
+
+		packetID, body = body[:2], body[2:]
+	}
+
+	retained := header&0x01 != 0
+
+	if retained {
+		t.logger.Warn().Msgf("ignoring retained message on %q", topic)
+	} else {
+		err = t.deploy(topic, body)
+		if err != nil {
+			t.logger.Err(err).Msgf("failed to deploy from %q", topic)
+		}
+	}
+
+	if qos > 0 {
+		// QoS 2 is not supported and downgraded by acknowledging it as QoS 1
+		err = writePacket(t.conn, packetPubAck, packetID)
+		if err != nil {
+			return fmt.Errorf("failed to send puback: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// deploy deploys the release of the topic from the payload
+func (t *MQTTTrigger) deploy(topic string, payload []byte) error {
+	releaseID, found := t.topics[topic]
+	if !found {
+		return fmt.Errorf("unknown topic")
+	}
+
+	var msg message
+
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return fmt.Errorf("failed to decode message: %v", err)
+	}
+
+	var releaseURL *url.URL
+
+	if msg.BrowserDownloadURL == "" && len(msg.Assets) != 0 {
+		releaseURL, err = t.deployer.SelectAsset(releaseID, msg.Assets)
+		if err != nil {
+			return fmt.Errorf("wrong assets: %v", err)
+		}
+	} else {
+		releaseURL, err = url.ParseRequestURI(msg.BrowserDownloadURL)
+		if err != nil {
+			return fmt.Errorf("wrong url: %v", err)
+		}
+	}
+
+	jobID, err := t.deployer.Deploy(deployer.Request{
+		ReleaseID:  releaseID,
+		Tag:        msg.Tag,
+		ReleaseURL: releaseURL,
+		Assets:     msg.Assets,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to deploy: %v", err)
+	}
+
+	t.logger.Info().Msgf("deploying %q from %q with job %s", releaseID, topic, jobID)
+
+	return nil
+}
+
+// isTimeout returns true if the error is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// appendString appends an MQTT string, prefixed by its length
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// appendUint16 appends n in big endian
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+// readString reads an MQTT string and returns the rest of the buffer
+func readString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, errors.New("missing length")
+	}
+
+	length := int(binary.BigEndian.Uint16(buf))
+
+	if len(buf) < 2+length {
+		return "", nil, errors.New("string too short")
+	}
+
+	return string(buf[2 : 2+length]), buf[2+length:], nil
+}
+
+// writePacket writes a packet with its remaining length
+func writePacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+
+	length := len(body)
+
+	for {
+		b := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(packet, body...))
+
+	return err
+}
+
+// readPacket reads a packet and returns its first byte and its body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length |= int(b&0x7F) << (7 * i)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too big", length)
+	}
+
+	body := make([]byte, length)
+
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
@@ -0,0 +1,164 @@
+package trigger
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/nkcr/hodor/deployer"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTTrigger_Scenario(t *testing.T) {
+	client, broker := net.Pipe()
+	d := &fakeDeployer{}
+
+	trigger, err := NewMQTTTrigger(config.MQTTConfig{
+		Broker:   "tcp://broker",
+		ClientID: "hodor",
+		Username: "user",
+		Password: "pass",
+	}, []string{"XX"}, d, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	trigger.(*MQTTTrigger).dial = func() (net.Conn, error) {
+		return client, nil
+	}
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		trigger.Start()
+	}()
+
+	reader := bufio.NewReader(broker)
+
+	header, body, err := readPacket(reader)
+	require.NoError(t, err)
+	require.Equal(t, byte(packetConnect), header)
+	require.Equal(t, "\x00\x04MQTT\x04\xc0\x00\x3c\x00\x05hodor\x00\x04user\x00\x04pass",
+		string(body))
+
+	require.NoError(t, writePacket(broker, packetConnAck, []byte{0, 0}))
+
+	header, body, err = readPacket(reader)
+	require.NoError(t, err)
+	require.Equal(t, byte(packetSubscribe), header)
+	require.Equal(t, "\x00\x01\x00\x0fhodor/deploy/XX\x01", string(body))
+
+	// a message kept by the broker, sent before the suback
+	publish := appendString(nil, "hodor/deploy/XX")
+	publish = append(publish, 0, 7)
+	publish = append(publish, `{"browser_download_url":"http://xx","tag":"v1"}`...)
+
+	require.NoError(t, writePacket(broker, packetPublish|0x02, publish))
+
+	header, body, err = readPacket(reader)
+	require.NoError(t, err)
+	require.Equal(t, byte(packetPubAck), header)
+	require.Equal(t, []byte{0, 7}, body)
+
+	require.NoError(t, writePacket(broker, packetSubAck, []byte{0, 1, 1}))
+
+	// retained messages are ignored
+	retained := appendString(nil, "hodor/deploy/XX")
+	retained = append(retained, `{"browser_download_url":"http://yy"}`...)
+
+	require.NoError(t, writePacket(broker, packetPublish|0x01, retained))
+
+	// a wrong message is still acknowledged
+	wrong := appendString(nil, "hodor/deploy/XX")
+	wrong = append(wrong, 0, 8)
+	wrong = append(wrong, `{"browser_download_url":"xx"}`...)
+
+	require.NoError(t, writePacket(broker, packetPublish|0x02, wrong))
+
+	header, body, err = readPacket(reader)
+	require.NoError(t, err)
+	require.Equal(t, byte(packetPubAck), header)
+	require.Equal(t, []byte{0, 8}, body)
+
+	go func() {
+		readPacket(reader)
+		broker.Close()
+	}()
+
+	trigger.Stop()
+	wait.Wait()
+
+	require.Len(t, d.requests, 1)
+	require.Equal(t, "XX", d.requests[0].ReleaseID)
+	require.Equal(t, "v1", d.requests[0].Tag)
+	require.Equal(t, "http://xx", d.requests[0].ReleaseURL.String())
+}
+
+func TestMQTTTrigger_Refused(t *testing.T) {
+	client, broker := net.Pipe()
+
+	trigger := &MQTTTrigger{
+		dial: func() (net.Conn, error) {
+			return client, nil
+		},
+		quit: make(chan struct{}),
+	}
+
+	go func() {
+		readPacket(bufio.NewReader(broker))
+		writePacket(broker, packetConnAck, []byte{0, 5})
+	}()
+
+	_, err := trigger.connect()
+	require.EqualError(t, err, "connection refused with code 5")
+}
+
+func TestNewMQTTTrigger_Fail(t *testing.T) {
+	_, err := NewMQTTTrigger(config.MQTTConfig{Broker: "http://xx"}, []string{"XX"},
+		nil, zerolog.Nop())
+	require.EqualError(t, err, "unsupported broker scheme \"http\"")
+
+	_, err = NewMQTTTrigger(config.MQTTConfig{Broker: "tcp://xx"}, nil, nil, zerolog.Nop())
+	require.EqualError(t, err, "no release to subscribe to")
+}
+
+func TestPacket(t *testing.T) {
+	buf := new(bytes.Buffer)
+	body := make([]byte, 200)
+
+	require.NoError(t, writePacket(buf, packetPublish, body))
+	require.Equal(t, []byte{packetPublish, 0xC8, 0x01}, buf.Bytes()[:3])
+
+	header, read, err := readPacket(bufio.NewReader(buf))
+	require.NoError(t, err)
+	require.Equal(t, byte(packetPublish), header)
+	require.Equal(t, body, read)
+
+	_, _, err = readPacket(bufio.NewReader(bytes.NewReader([]byte{packetPublish,
+		0xFF, 0xFF, 0xFF, 0xFF})))
+	require.EqualError(t, err, "malformed remaining length")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+type fakeDeployer struct {
+	deployer.Deployer
+
+	requests []deployer.Request
+}
+
+func (d *fakeDeployer) Deploy(req deployer.Request) (string, error) {
+	if req.ReleaseURL == nil {
+		return "", errors.New("fake")
+	}
+
+	d.requests = append(d.requests, req)
+
+	return "AA", nil
+}
@@ -0,0 +1,38 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// notifyUpgrade does nothing: upgrades are not supported on this platform
+func notifyUpgrade(c chan<- os.Signal) {}
+
+// inheritListener returns nil: upgrades are not supported on this platform
+func inheritListener() (net.Listener, error) {
+	return nil, nil
+}
+
+// inheritReadyPipe returns nil: upgrades are not supported on this platform
+func inheritReadyPipe() (*os.File, error) {
+	return nil, nil
+}
+
+// upgradeProcess is never started: upgrades are not supported on this platform
+type upgradeProcess struct {
+	pid int
+}
+
+// waitReady is not supported on this platform
+func (p *upgradeProcess) waitReady(timeout time.Duration) error {
+	return errors.New("upgrades are not supported on this platform")
+}
+
+// upgrade is not supported on this platform
+func upgrade(ln net.Listener, timeout time.Duration) (*upgradeProcess, error) {
+	return nil, errors.New("upgrades are not supported on this platform")
+}
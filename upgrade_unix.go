@@ -0,0 +1,170 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The environment variables that give the new process of an upgrade the file
+// descriptors of the inherited listener and of the pipe where it tells that it
+// started and then that it is ready
+const (
+	listenFDEnv = "HODOR_LISTEN_FD"
+	readyFDEnv  = "HODOR_READY_FD"
+)
+
+// notifyUpgrade relays the signal that starts an upgrade, SIGUSR2, to c
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// inheritListener returns the listener inherited from the previous process of
+// an upgrade, or nil if Hodor was not started by an upgrade
+func inheritListener() (net.Listener, error) {
+	f, err := inheritedFile(listenFDEnv)
+	if f == nil || err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit listener: %v", err)
+	}
+
+	return ln, nil
+}
+
+// inheritReadyPipe returns the pipe where the new process of an upgrade tells
+// the previous one that it started and then that it is ready, see notifyPrevious.
+// It returns nil if Hodor was not started by an upgrade.
+func inheritReadyPipe() (*os.File, error) {
+	return inheritedFile(readyFDEnv)
+}
+
+// inheritedFile returns the file whose descriptor is in the environment
+// variable, or nil if it is not set. The variable is then removed, and the
+// descriptor closed on exec, so that neither is given to the processes started
+// by Hodor.
+func inheritedFile(env string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("wrong %s: %v", env, err)
+	}
+
+	syscall.CloseOnExec(fd)
+
+	return os.NewFile(uintptr(fd), env), nil
+}
+
+// upgradeProcess is the new process of an upgrade, once it started
+type upgradeProcess struct {
+	pid   int
+	pipe  *os.File
+	lines *bufio.Reader
+}
+
+// waitReady waits for the process to tell that it opened the database and
+// serves, up to the timeout, and then closes the pipe.
+func (p *upgradeProcess) waitReady(timeout time.Duration) error {
+	defer p.pipe.Close()
+
+	p.pipe.SetReadDeadline(time.Now().Add(timeout))
+
+	return expectLine(p.lines, "ready")
+}
+
+// expectLine reads the next line and returns an error if it is not expected
+func expectLine(lines *bufio.Reader, expected string) error {
+	line, err := lines.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if line != expected+"\n" {
+		return fmt.Errorf("unexpected %q", line)
+	}
+
+	return nil
+}
+
+// upgrade starts a new process from the current executable, with the same
+// arguments, that inherits the listener. It returns the new process once it
+// started, so that this one stops and releases the database, or an error if it
+// exited or didn't start within the timeout, in which case it is killed.
+func upgrade(ln net.Listener, timeout time.Duration) (*upgradeProcess, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't pass a %T listener", ln)
+	}
+
+	lnFile, err := filer.File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listener file: %v", err)
+	}
+
+	defer lnFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyR.Close()
+		readyW.Close()
+		return nil, fmt.Errorf("failed to get executable: %v", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// the extra files are given from the descriptor 3
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+
+	err = cmd.Start()
+
+	// only the new process keeps the write end, so that the read fails once it
+	// exits
+	readyW.Close()
+
+	if err != nil {
+		readyR.Close()
+		return nil, fmt.Errorf("failed to start %s: %v", exe, err)
+	}
+
+	// reaps the process if it exits while this one still runs
+	go cmd.Wait()
+
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+
+	lines := bufio.NewReader(readyR)
+
+	err = expectLine(lines, "started")
+	if err != nil {
+		readyR.Close()
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("process %d didn't start: %v", cmd.Process.Pid, err)
+	}
+
+	return &upgradeProcess{pid: cmd.Process.Pid, pipe: readyR, lines: lines}, nil
+}
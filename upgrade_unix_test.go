@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeProcess_WaitReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	defer w.Close()
+
+	next := &upgradeProcess{pipe: r, lines: bufio.NewReader(r)}
+
+	require.NoError(t, notifyPrevious(w, "started"))
+	require.NoError(t, expectLine(next.lines, "started"))
+
+	// the new process is ready once it serves
+	require.NoError(t, notifyPrevious(w, "ready"))
+	require.NoError(t, next.waitReady(time.Second))
+}
+
+func TestUpgradeProcess_WaitReady_Exited(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	next := &upgradeProcess{pipe: r, lines: bufio.NewReader(r)}
+
+	require.NoError(t, notifyPrevious(w, "started"))
+	require.NoError(t, expectLine(next.lines, "started"))
+
+	// the new process exited before it was ready
+	w.Close()
+
+	require.Error(t, next.waitReady(time.Second))
+}
@@ -0,0 +1,145 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/rs/zerolog"
+)
+
+// Watcher defines the primitives needed to reload the configuration while
+// Hodor runs
+type Watcher interface {
+	// Start must be called only once to start watching
+	Start()
+	// Stop must be called only once and when start has been called
+	Stop()
+}
+
+// Reload applies a new configuration. It returns an error if the
+// configuration can't be applied, in which case the current one is kept.
+type Reload func(conf config.Config) error
+
+// NewConfigWatcher returns a new initialized watcher that loads the
+// configuration file and gives it to reload each time its content changes,
+// checked at each interval, and each time a signal is received. A zero interval
+// only reloads on signals.
+func NewConfigWatcher(path string, interval time.Duration, signals <-chan os.Signal,
+	reload Reload, logger zerolog.Logger) Watcher {
+
+	logger = logger.With().Str("role", "watcher").Logger()
+
+	return &ConfigWatcher{
+		path:     path,
+		interval: interval,
+		signals:  signals,
+		reload:   reload,
+		logger:   logger,
+		quit:     make(chan struct{}),
+	}
+}
+
+// ConfigWatcher implements a watcher that polls the configuration file, so
+// that it works on any file system.
+//
+// - implements watcher.Watcher
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+	signals  <-chan os.Signal
+	reload   Reload
+	logger   zerolog.Logger
+	quit     chan struct{}
+	// sum is the checksum of the content last loaded
+	sum [sha256.Size]byte
+}
+
+// Start implements watcher.Watcher. This is a blocking function that returns
+// once Stop has been called.
+func (cw *ConfigWatcher) Start() {
+	sum, err := checksum(cw.path)
+	if err != nil {
+		cw.logger.Warn().Msgf("failed to read the configuration: %v", err)
+	}
+
+	cw.sum = sum
+
+	var tick <-chan time.Time
+
+	if cw.interval > 0 {
+		ticker := time.NewTicker(cw.interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+
+		cw.logger.Info().Msgf("checking the configuration every %s", cw.interval)
+	}
+
+	for {
+		select {
+		case <-cw.quit:
+			return
+		case sig := <-cw.signals:
+			cw.logger.Info().Msgf("reloading the configuration on %s", sig)
+			cw.load()
+		case <-tick:
+			sum, err := checksum(cw.path)
+			if err != nil {
+				cw.logger.Warn().Msgf("failed to read the configuration: %v", err)
+				continue
+			}
+
+			if sum != cw.sum {
+				cw.logger.Info().Msg("the configuration changed, reloading it")
+				cw.load()
+			}
+		}
+	}
+}
+
+// Stop implements watcher.Watcher
+func (cw *ConfigWatcher) Stop() {
+	close(cw.quit)
+}
+
+// load loads the configuration and reloads it. A configuration that can't be
+// loaded or applied is only logged, and is not loaded again until the file
+// changes.
+func (cw *ConfigWatcher) load() {
+	sum, err := checksum(cw.path)
+	if err != nil {
+		cw.logger.Err(err).Msg("failed to read the configuration, the current one is kept")
+		return
+	}
+
+	cw.sum = sum
+
+	var conf config.Config
+
+	err = conf.LoadFromJSON(cw.path)
+	if err != nil {
+		cw.logger.Err(err).Msg("failed to load the configuration, the current one is kept")
+		return
+	}
+
+	err = cw.reload(conf)
+	if err != nil {
+		cw.logger.Err(err).Msg("failed to reload the configuration, the current one is kept")
+		return
+	}
+
+	cw.logger.Info().Msgf("configuration reloaded with %d entries", len(conf.Entries))
+}
+
+// checksum returns the SHA-256 of the file's content
+func checksum(path string) ([sha256.Size]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	return sha256.Sum256(buf), nil
+}
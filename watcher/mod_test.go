@@ -0,0 +1,141 @@
+package watcher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nkcr/hodor/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher_Scenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{"entries": {"XX": "/var/xx"}}`)
+
+	reloader := &fakeReloader{}
+	signals := make(chan os.Signal, 1)
+
+	watcher := NewConfigWatcher(path, time.Millisecond*10, signals, reloader.reload,
+		zerolog.New(io.Discard))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		watcher.Start()
+	}()
+
+	// not reloaded while unchanged
+	time.Sleep(time.Millisecond * 50)
+	require.Len(t, reloader.getConfigs(), 0)
+
+	writeFile(t, path, `{"entries": {"XX": "/var/xx", "YY": "/var/yy"}}`)
+
+	require.Eventually(t, func() bool {
+		return len(reloader.getConfigs()) == 1
+	}, time.Second, time.Millisecond*10)
+
+	signals <- syscall.SIGHUP
+
+	require.Eventually(t, func() bool {
+		return len(reloader.getConfigs()) == 2
+	}, time.Second, time.Millisecond*10)
+
+	watcher.Stop()
+	wait.Wait()
+
+	for _, conf := range reloader.getConfigs() {
+		require.Equal(t, map[string]config.Entry{
+			"XX": {Target: "/var/xx"},
+			"YY": {Target: "/var/yy"},
+		}, conf.Entries)
+	}
+}
+
+func TestLoad_Wrong_Config(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{"entries": `)
+
+	log := new(bytes.Buffer)
+	reloader := &fakeReloader{}
+
+	cw := ConfigWatcher{
+		path:   path,
+		reload: reloader.reload,
+		logger: zerolog.New(log),
+	}
+
+	cw.load()
+
+	require.Len(t, reloader.getConfigs(), 0)
+	require.Contains(t, log.String(), "failed to load the configuration, the current one is kept")
+
+	// the content is not loaded again until it changes
+	sum, err := checksum(path)
+	require.NoError(t, err)
+	require.Equal(t, sum, cw.sum)
+}
+
+func TestLoad_Reload_Fail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{"entries": {"XX": "/var/xx"}}`)
+
+	log := new(bytes.Buffer)
+	reloader := &fakeReloader{err: errors.New("fake")}
+
+	cw := ConfigWatcher{
+		path:   path,
+		reload: reloader.reload,
+		logger: zerolog.New(log),
+	}
+
+	cw.load()
+
+	require.Len(t, reloader.getConfigs(), 1)
+	require.Contains(t, log.String(), "failed to reload the configuration, the current one is kept")
+	require.Contains(t, log.String(), "fake")
+}
+
+func TestChecksum_No_File(t *testing.T) {
+	_, err := checksum(filepath.Join(t.TempDir(), "config.json"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read file: ")
+}
+
+// ----------------------------------------------------------------------------
+// Utility functions
+
+func writeFile(t *testing.T, path, content string) {
+	err := os.WriteFile(path, []byte(content), 0644)
+	require.NoError(t, err)
+}
+
+type fakeReloader struct {
+	sync.Mutex
+	configs []config.Config
+	err     error
+}
+
+func (r *fakeReloader) reload(conf config.Config) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.configs = append(r.configs, conf)
+
+	return r.err
+}
+
+func (r *fakeReloader) getConfigs() []config.Config {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]config.Config{}, r.configs...)
+}